@@ -243,44 +243,76 @@ function logout_init(): StateLogout | null {
 
 type StateSessionTimer = {
     display: HTMLElement;
-    timeout_seconds: number;
-    last_activity: number;
+    warning: HTMLElement | null;
+    status_url: string;
+    keepalive_url: string;
+    warning_seconds: number;
+    expires_at: number;
     interval: number | null;
 };
 
+function session_timer_logout(): void {
+    // The form action carries the base path the app is mounted under.
+    const logout_form = element_get_or_null('logout-form') as HTMLFormElement | null;
+    window.location.href = logout_form?.action ?? '/logout';
+}
+
+function session_timer_apply(state: StateSessionTimer, status: { active: boolean; remaining_seconds: number; warning_seconds: number }): void {
+    if (!status.active) {
+        session_timer_logout();
+        return;
+    }
+    state.warning_seconds = status.warning_seconds;
+    state.expires_at = Date.now() + status.remaining_seconds * 1000;
+    session_timer_update(state);
+}
+
+// Only the server knows when the session expires: saves and other background
+// requests extend it without any click or keypress.
+async function session_timer_sync(state: StateSessionTimer, method: 'GET' | 'POST'): Promise<void> {
+    try {
+        const response = await fetch(method === 'GET' ? state.status_url : state.keepalive_url, { method });
+        if (response.ok) session_timer_apply(state, await response.json());
+    } catch {
+        // Keep counting down from the last known value.
+    }
+}
+
 function session_timer_update(state: StateSessionTimer): void {
-    const elapsed = Math.floor((Date.now() - state.last_activity) / 1000);
-    const remaining = Math.max(0, state.timeout_seconds - elapsed);
+    const remaining = Math.max(0, Math.floor((state.expires_at - Date.now()) / 1000));
     
     const minutes = Math.floor(remaining / 60);
     const seconds = remaining % 60;
     state.display.textContent = `${minutes}:${seconds.toString().padStart(2, '0')}`;
+    state.warning?.classList.toggle('hidden', remaining > state.warning_seconds);
     
     if (remaining <= 0) {
-        window.location.href = '/logout';
+        // Another tab may have extended the session in the meantime.
+        session_timer_sync(state, 'GET');
     }
 }
 
-function session_timer_reset(state: StateSessionTimer): void {
-    state.last_activity = Date.now();
-}
-
-function session_timer_init(timeout_minutes: number): StateSessionTimer | null {
+function session_timer_init(): StateSessionTimer | null {
     const display = element_get_or_null('session-timer');
     if (!display) return null;
     
     const state: StateSessionTimer = {
         display,
-        timeout_seconds: timeout_minutes * 60,
-        last_activity: Date.now(),
+        warning: element_get_or_null('session-warning'),
+        status_url: display.dataset.statusUrl ?? '',
+        keepalive_url: display.dataset.keepaliveUrl ?? '',
+        warning_seconds: 0,
+        expires_at: Date.now() + 30 * 60 * 1000,
         interval: null,
     };
     
-    document.addEventListener('keypress', () => session_timer_reset(state), true);
-    document.addEventListener('click', () => session_timer_reset(state), true);
+    document.querySelectorAll<HTMLElement>('[data-session-extend]').forEach(button => {
+        button.addEventListener('click', () => session_timer_sync(state, 'POST'));
+    });
     
     state.interval = window.setInterval(() => session_timer_update(state), 1000);
-    session_timer_update(state);
+    window.setInterval(() => session_timer_sync(state, 'GET'), 60 * 1000);
+    session_timer_sync(state, 'GET');
     
     return state;
 }
@@ -535,7 +567,7 @@ function row_cells_validate(cells: HTMLElement[]): boolean {
     
     cells.forEach(cell => {
         cell.querySelectorAll<HTMLInputElement>('.number-input:not([readonly])').forEach(input => {
-            const required = input.dataset.required === 'true';
+            const required = input_required(input);
             const error = validate_number_required(input);
             if (error) {
                 input_show_error(input, error, required ? 'error' : 'warning');
@@ -546,7 +578,7 @@ function row_cells_validate(cells: HTMLElement[]): boolean {
         });
         
         cell.querySelectorAll<HTMLInputElement>('.string-input:not([readonly])').forEach(input => {
-            const required = input.dataset.required === 'true';
+            const required = input_required(input);
             const error = validate_string_required(input);
             if (error) {
                 input_show_error(input, error, required ? 'error' : 'warning');
@@ -560,7 +592,7 @@ function row_cells_validate(cells: HTMLElement[]): boolean {
             const input = container.querySelector('[data-enum-input]') as HTMLInputElement;
             if (input?.hasAttribute('readonly')) return;
             
-            const required = input?.dataset.required === 'true';
+            const required = input_required(input);
             const error = validate_enum_required(container);
             if (error && input) {
                 input_show_error(input, error, required ? 'error' : 'warning');
@@ -572,7 +604,7 @@ function row_cells_validate(cells: HTMLElement[]): boolean {
         
         cell.querySelectorAll<HTMLElement>('[data-multi-exclusive-container]').forEach(container => {
             const hiddenInput = container.querySelector<HTMLInputElement>('[data-multi-exclusive-value]');
-            const required = hiddenInput?.dataset.required === 'true';
+            const required = input_required(hiddenInput);
             const error = validate_multi_exclusive_required(container);
             if (error && hiddenInput) {
                 input_show_error(hiddenInput, error, required ? 'error' : 'warning');
@@ -613,18 +645,27 @@ function row_cells_show_success(cells: HTMLElement[]): void {
 
 type TableType = 
     | 'HORIZONTAL_STATIC_UNIQUE'
+    | 'PKD_STATIC_UNIQUE'
+    | 'SIMC_STATIC_UNIQUE'
     | 'HORIZONTAL_DYNAMIC_UNIQUE'
     | 'HORIZONTAL_DYNAMIC_DUPLICABLE'
     | 'VERTICAL_STATIC_UNIQUE'
+    | 'MATRIX_DYNAMIC_UNIQUE'
     | 'SYSTEM_DEFINITION';
 
 type StateTable = {
     element: HTMLElement;
     type: TableType;
     endpoint: string;
+    // Lp limit of a compact view, sent back so hidden columns keep their data.
+    compact: string;
     enum_selected_index: Map<HTMLElement, number>;
     pending_save: boolean;
     last_save_time: number;
+    // Idempotency-Key of the last save that got no response, reused while the
+    // body it was sent with stays the same.
+    save_key: string;
+    save_body: string;
     // Dynamic table fields (only used for HORIZONTAL_DYNAMIC_*)
     is_dynamic: boolean;
     is_unique: boolean;
@@ -637,87 +678,29 @@ const SAVE_COOLDOWN_MS = 3000;
 // Table: Input Validation (single input, ignores required)
 // ============================================================================
 
-async function dynamic_table_load_existing(state: StateTable): Promise<void> {
-    const jsonData = state.element.dataset.initial;
-    if (!jsonData) return;
-
-    let dataArray: Record<string, unknown>[];
-    try {
-        dataArray = JSON.parse(jsonData);
-    } catch {
-        console.error('Failed to parse initial data');
-        return;
-    }
-
-    if (!Array.isArray(dataArray) || dataArray.length === 0) return;
-
-    const firstRow = dataArray[0];
-    if (!firstRow) return;
-
-    const kodKey = Object.keys(firstRow).find(k => k.endsWith('_Kod'));
-    if (!kodKey) return;
-
-    for (const rowData of dataArray) {
-        const code = rowData[kodKey] as string;
-        if (!code) continue;
-
-        const success = await dynamic_table_add_row(state, code);
-        if (!success) continue;
-
-        const rowIndex = state.row_counter - 1;
-        const cells = row_cells_get(state.element, rowIndex);
-
-        populate_cells_from_data(cells, rowData);
-    }
-}
-
-function populate_cells_from_data(cells: HTMLElement[], rowData: Record<string, unknown>): void {
-    cells.forEach(cell => {
-        cell.querySelectorAll<HTMLInputElement>('.number-input').forEach(input => {
-            const value = rowData[input.name];
-            if (value !== undefined && value !== null) {
-                const fmt = number_format_parse(input.dataset.format || '###0');
-                input.value = number_format_value(Number(value), fmt);
-            }
-        });
-
-        cell.querySelectorAll<HTMLInputElement>('.string-input').forEach(input => {
-            const value = rowData[input.name];
-            if (value !== undefined && value !== null) {
-                input.value = String(value);
-            }
-        });
-
-        cell.querySelectorAll<HTMLInputElement>('[data-enum-value]').forEach(hidden => {
-            const value = rowData[hidden.name];
-            if (value !== undefined && value !== null) {
-                hidden.value = String(value);
-                const container = hidden.closest('[data-enum-container]');
-                const visibleInput = container?.querySelector('[data-enum-input]') as HTMLInputElement;
-                const option = container?.querySelector(`[data-enum-option][data-value="${value}"]`) as HTMLElement;
-                if (visibleInput && option) {
-                    visibleInput.value = `${option.dataset.value} - ${option.dataset.label}`;
-                }
-            }
-        });
-
-        cell.querySelectorAll<HTMLInputElement>('[data-multi-exclusive-value]').forEach(hidden => {
-            const value = rowData[hidden.name];
-            if (value !== undefined && value !== null) {
-                hidden.value = String(value);
-                const container = hidden.closest('[data-multi-exclusive-container]') as HTMLElement;
-                if (container) multi_exclusive_load_value(container);
-            }
-        });
+// Stored rows arrive rendered by the server. New rows continue after the highest
+// index so none is reused, and unique tables hide the codes already present.
+function dynamic_table_init(state: StateTable): void {
+    state.element.querySelectorAll<HTMLElement>('[data-cell][data-row-code]').forEach(cell => {
+        const index = Number(cell.dataset.rowIndex);
+        if (index >= state.row_counter) state.row_counter = index + 1;
+        if (state.is_unique) {
+            state.element.querySelector(
+                `[data-row-selector] [data-enum-option][data-row-code="${cell.dataset.rowCode}"]`
+            )?.classList.add('hidden');
+        }
     });
 }
 
 async function dynamic_table_add_row(state: StateTable, code: string): Promise<boolean> {
+    if (!state.endpoint) return false;
     const index = state.row_counter++;
-    const url = `${state.endpoint.replace(/\/$/, '')}/${code}/${index}`;
+    let url = `${state.endpoint.replace(/\/$/, '')}/${code}/${index}`;
+    if (state.compact) url += `?compact=${state.compact}`;
     
     try {
         const response = await fetch(url);
+        if (response.status === 422) throw new Error(await response.text());
         if (!response.ok) throw new Error(`${response.status}`);
         
         const html = await response.text();
@@ -850,7 +833,7 @@ function validate_number_value(input: HTMLInputElement): string | null {
 
 function validate_number_required(input: HTMLInputElement): string | null {
     const raw = input.value.trim();
-    const required = input.dataset.required === 'true';
+    const required = input_required(input);
     const custom_msg = input.dataset.errorMessage;
     
     if (required && string_is_blank(raw)) {
@@ -861,7 +844,7 @@ function validate_number_required(input: HTMLInputElement): string | null {
 }
 
 function validate_string_required(input: HTMLInputElement): string | null {
-    const required = input.dataset.required === 'true';
+    const required = input_required(input);
     const value = input.value.trim();
     
     if (required && !value) {
@@ -874,7 +857,7 @@ function validate_string_required(input: HTMLInputElement): string | null {
 function validate_enum_required(container: HTMLElement): string | null {
     const input = container.querySelector('[data-enum-input]') as HTMLInputElement;
     const hidden = container.querySelector('[data-enum-value]') as HTMLInputElement;
-    const required = input?.dataset.required === 'true';
+    const required = input_required(input);
     
     if (required && !hidden?.value) {
         return 'Wybierz wartość z listy';
@@ -883,6 +866,215 @@ function validate_enum_required(container: HTMLElement): string | null {
     return null;
 }
 
+// ============================================================================
+// Conditional Required (b_kolumny.wymagana_gdy)
+// ============================================================================
+
+// wymagana_gdy overrides data-required. As in columnRequired on the server, a
+// condition that doesn't evaluate leaves the field optional.
+function input_required(input: HTMLInputElement | null | undefined): boolean {
+    if (!input) return false;
+    const condition = input.dataset.requiredWhen;
+    if (!condition) return input.dataset.required === 'true';
+    return condition_eval(condition, input_record_get(input)) ?? false;
+}
+
+// The record a condition sees: the input's row, or the whole vertical table.
+function input_record_get(input: HTMLInputElement): Record<string, unknown> {
+    const table = input.closest<HTMLElement>('[data-table-type]');
+    if (!table) return {};
+    if (table.dataset.tableType === 'VERTICAL_STATIC_UNIQUE') return cells_values_get([table]);
+    
+    const cell = input.closest<HTMLElement>('[data-cell]');
+    const index = cell ? row_index_get(cell) : null;
+    return index === null ? {} : cells_values_get(row_cells_get(table, index));
+}
+
+// number_strict_parse follows ParseLocalizedNumber: one decimal comma or dot,
+// spaces ignored, nothing but digits and signs.
+function number_strict_parse(value: string): number | null {
+    const raw = value.replace(/[\s\u00a0\u202f]/g, '');
+    if (raw.includes(',') && raw.includes('.') || raw.split(',').length > 2) return null;
+    const normalized = raw.replace(',', '.');
+    if (!/^[0-9.+-]+$/.test(normalized)) return null;
+    const number = Number(normalized);
+    return isNaN(number) ? null : number;
+}
+
+function condition_tokenize(condition: string): string[] | null {
+    const tokens: string[] = [];
+    let i = 0;
+    while (i < condition.length) {
+        const c = condition[i]!;
+        const next = condition[i + 1];
+        if (' \t\n\r'.includes(c)) {
+            i++;
+        } else if ('+-*/(),='.includes(c)) {
+            tokens.push(c);
+            i++;
+        } else if (c === '<' || c === '>' || c === '!') {
+            if (next === '=' || c === '<' && next === '>') {
+                tokens.push(c + next);
+                i += 2;
+            } else if (c === '!') {
+                return null;
+            } else {
+                tokens.push(c);
+                i++;
+            }
+        } else if (c === "'") {
+            const end = condition.indexOf("'", i + 1);
+            if (end < 0) return null;
+            // Kept with the opening quote so text can be told from identifiers.
+            tokens.push(condition.slice(i, end));
+            i = end + 1;
+        } else {
+            const match = /^(?:[0-9.]+|[A-Za-z_][A-Za-z0-9_]*)/.exec(condition.slice(i));
+            if (!match) return null;
+            tokens.push(match[0]);
+            i += match[0].length;
+        }
+    }
+    return tokens;
+}
+
+// condition_eval is EvalCondition of main.go, so the form asks for the fields the
+// server will; change the two together. null is a condition that doesn't parse.
+function condition_eval(condition: string, values: Record<string, unknown>): boolean | null {
+    const tokens = condition_tokenize(condition);
+    if (!tokens) return null;
+    
+    let pos = 0;
+    const fail = (): never => { throw new Error(`condition ${condition}`); };
+    const peek = (): string => tokens[pos] ?? '';
+    const keyword = (word: string): boolean => {
+        if (peek().toUpperCase() !== word) return false;
+        pos++;
+        return true;
+    };
+    const expect = (token: string): void => {
+        if (peek() !== token) fail();
+        pos++;
+    };
+    const is_identifier = (token: string): boolean => /^[A-Za-z_]/.test(token);
+    const text_get = (column: string): string => {
+        const value = values[column];
+        return value === undefined || value === null ? '' : String(value).trim();
+    };
+    
+    const primary = (): number => {
+        const token = peek();
+        if (token === '') return fail();
+        if (token === '(') {
+            pos++;
+            const value = or();
+            expect(')');
+            return value;
+        }
+        if (/^[0-9.]/.test(token)) {
+            pos++;
+            const value = Number(token);
+            return isNaN(value) ? fail() : value;
+        }
+        if (token.toUpperCase() === 'SUM' && tokens[pos + 1] === '(') {
+            pos += 2;
+            let sum = 0;
+            for (;;) {
+                sum += expr();
+                if (peek() !== ',') break;
+                pos++;
+            }
+            expect(')');
+            return sum;
+        }
+        if (is_identifier(token)) {
+            pos++;
+            const value = values[token];
+            if (typeof value === 'number') return value;
+            const raw = text_get(token);
+            if (raw === '') return 0;
+            return number_strict_parse(raw) ?? fail();
+        }
+        return fail();
+    };
+    const unary = (): number => {
+        if (peek() !== '-') return primary();
+        pos++;
+        return -unary();
+    };
+    const term = (): number => {
+        let left = unary();
+        while (peek() === '*' || peek() === '/') {
+            const op = tokens[pos++];
+            const right = unary();
+            if (op === '*') left *= right;
+            else if (right === 0) fail();
+            else left /= right;
+        }
+        return left;
+    };
+    const expr = (): number => {
+        let left = term();
+        while (peek() === '+' || peek() === '-') {
+            const op = tokens[pos++];
+            const right = term();
+            left = op === '+' ? left + right : left - right;
+        }
+        return left;
+    };
+    const comparison = (): number => {
+        // column = 'text' compares the raw answer, which may be a non-numeric code.
+        const text = tokens[pos + 2];
+        if (text?.startsWith("'") && is_identifier(peek())) {
+            const column = peek();
+            const op = tokens[pos + 1];
+            if (op !== '=' && op !== '<>' && op !== '!=') fail();
+            pos += 3;
+            const equal = text_get(column) === text.slice(1);
+            return Number(equal === (op === '='));
+        }
+        
+        const left = expr();
+        const op = peek();
+        if (!['=', '<>', '!=', '<', '<=', '>', '>='].includes(op)) return left;
+        pos++;
+        const right = expr();
+        switch (op) {
+            case '=': return Number(left === right);
+            case '<>':
+            case '!=': return Number(left !== right);
+            case '<': return Number(left < right);
+            case '<=': return Number(left <= right);
+            case '>': return Number(left > right);
+            default: return Number(left >= right);
+        }
+    };
+    const not = (): number => keyword('NOT') ? Number(not() === 0) : comparison();
+    const and = (): number => {
+        let left = not();
+        while (keyword('AND')) {
+            const right = not();
+            left = Number(left !== 0 && right !== 0);
+        }
+        return left;
+    };
+    const or = (): number => {
+        let left = and();
+        while (keyword('OR')) {
+            const right = and();
+            left = Number(left !== 0 || right !== 0);
+        }
+        return left;
+    };
+    
+    try {
+        const result = or();
+        return pos < tokens.length ? null : result !== 0;
+    } catch {
+        return null;
+    }
+}
+
 // ============================================================================
 // String Input Validation
 // ============================================================================
@@ -947,68 +1139,66 @@ function table_validate_all(state: StateTable): boolean {
     return valid;
 }
 
+// cells_values_get reads the answers under roots the way they are saved: numbers
+// parsed, text trimmed, blanks left out.
+function cells_values_get(roots: ParentNode[]): Record<string, unknown> {
+    const data: Record<string, unknown> = {};
+    
+    roots.forEach(root => {
+        root.querySelectorAll<HTMLInputElement>('.number-input').forEach(input => {
+            const value = number_value_parse(input.value);
+            if (value !== null) data[input.name] = value;
+        });
+        root.querySelectorAll<HTMLInputElement>('.string-input').forEach(input => {
+            const value = input.value.trim();
+            if (value) data[input.name] = value;
+        });
+        root.querySelectorAll<HTMLInputElement>('[data-enum-value]').forEach(input => {
+            if (input.value) data[input.name] = input.value;
+        });
+        root.querySelectorAll<HTMLInputElement>('[data-multi-exclusive-value]').forEach(input => {
+            if (input.value) data[input.name] = input.value;
+        });
+    });
+    
+    return data;
+}
+
 function table_serialize(state: StateTable): Record<string, unknown>[] {
     const rows: Record<string, unknown>[] = [];
     
     for (const rowIndex of all_row_indices_get(state)) {
         const cells = row_cells_get(state.element, rowIndex);
         if (!row_cells_has_data(cells)) continue;
-        
-        const data: Record<string, unknown> = {};
-        
-        cells.forEach(c => {
-            c.querySelectorAll<HTMLInputElement>('.number-input').forEach(input => {
-                const value = number_value_parse(input.value);
-                if (value !== null) data[input.name] = value;
-            });
-            c.querySelectorAll<HTMLInputElement>('.string-input').forEach(input => {
-                const value = input.value.trim();
-                if (value) data[input.name] = value;
-            });
-            c.querySelectorAll<HTMLInputElement>('[data-enum-value]').forEach(input => {
-                if (input.value) data[input.name] = input.value;
-            });
-            c.querySelectorAll<HTMLInputElement>('[data-multi-exclusive-value]').forEach(input => {
-                if (input.value) data[input.name] = input.value;
-            });
-        });
-        
-        rows.push(data);
+        rows.push(cells_values_get(cells));
     }
     
     return rows;
 }
 
 function table_serialize_vertical(state: StateTable): Record<string, unknown> {
-    const data: Record<string, unknown> = {};
-    
-    state.element.querySelectorAll<HTMLInputElement>('.number-input').forEach(input => {
-        const value = number_value_parse(input.value);
-        if (value !== null) data[input.name] = value;
-    });
-    
-    state.element.querySelectorAll<HTMLInputElement>('.string-input').forEach(input => {
-        const value = input.value.trim();
-        if (value) data[input.name] = value;
-    });
-    
-    state.element.querySelectorAll<HTMLInputElement>('[data-enum-value]').forEach(input => {
-        if (input.value) data[input.name] = input.value;
-    });
-    
-    state.element.querySelectorAll<HTMLInputElement>('[data-multi-exclusive-value]').forEach(input => {
-        if (input.value) data[input.name] = input.value;
-    });
-    
-    return data;
+    return cells_values_get([state.element]);
 }
 
 // ============================================================================
 // Table: Save
 // ============================================================================
 
+// crypto.randomUUID needs a secure context; plain HTTP on an intranet falls back.
+function idempotency_key_new(): string {
+    if (typeof crypto.randomUUID === 'function') return crypto.randomUUID();
+    return `${Date.now().toString(36)}-${Math.random().toString(36).slice(2)}`;
+}
+
+// Notes travel in the same envelope the server stores, so they never mix with cell data.
+function table_payload_build(data: unknown): unknown {
+    const notes = document.querySelector<HTMLTextAreaElement>('[data-subtable-notes]');
+    if (!notes) return data;
+    return { _v: 1, data, notes: notes.value.trim() };
+}
+
 async function table_save(state: StateTable): Promise<boolean> {
-    if (state.pending_save) return false;
+    if (state.pending_save || !state.endpoint) return false;
     
     const now = Date.now();
     const time_since_last = now - state.last_save_time;
@@ -1027,11 +1217,13 @@ async function table_save(state: StateTable): Promise<boolean> {
     
     if (state.type === 'VERTICAL_STATIC_UNIQUE') {
         data = table_serialize_vertical(state);
+    } else if (state.type === 'MATRIX_DYNAMIC_UNIQUE') {
+        data = table_serialize_matrix(state);
     } else {
         data = table_serialize(state);
     }
     
-    if (state.type === 'VERTICAL_STATIC_UNIQUE') {
+    if (state.type === 'VERTICAL_STATIC_UNIQUE' || state.type === 'MATRIX_DYNAMIC_UNIQUE') {
         if (Object.keys(data).length === 0) {
             toast_show('Brak danych do zapisania', 'warning');
             return false;
@@ -1045,15 +1237,26 @@ async function table_save(state: StateTable): Promise<boolean> {
     
     state.pending_save = true;
     
+    // A save lost in transit may still have landed; retrying it under the same
+    // key lets the server answer it once instead of writing it twice.
+    const body = JSON.stringify(table_payload_build(data));
+    if (body !== state.save_body) {
+        state.save_key = idempotency_key_new();
+        state.save_body = body;
+    }
+    
     try {
-        const response = await fetch(state.endpoint, {
+        const url = state.compact ? `${state.endpoint}?compact=${state.compact}` : state.endpoint;
+        const response = await fetch(url, {
             method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify(data),
+            headers: { 'Content-Type': 'application/json', 'Idempotency-Key': state.save_key },
+            body,
         });
+        state.save_body = '';
         
         if (!response.ok) {
-            throw new Error(`Błąd serwera: ${response.status}`);
+            const body = await response.json().catch(() => ({}));
+            throw new Error(body.message ?? `Błąd serwera: ${response.status}`);
         }
         
         state.last_save_time = Date.now();
@@ -1115,7 +1318,7 @@ function table_handle_input_number(target: HTMLInputElement): void {
     
     const error = validate_number_value(target);
     if (error) {
-        const required = target.dataset.required === 'true';
+        const required = input_required(target);
         input_show_error(target, error, required ? 'error' : 'warning');
         input_show_error_popup(target);
     } else {
@@ -1135,7 +1338,7 @@ function table_handle_input_string(target: HTMLInputElement): void {
     
     const error = input_format_error_get(target);
     if (error) {
-        const required = target.dataset.required === 'true';
+        const required = input_required(target);
         input_show_error(target, error, required ? 'error' : 'warning');
         input_show_error_popup(target);
     } else {
@@ -1195,6 +1398,7 @@ function input_event_route(state: StateTable, e: Event): void {
     }
 
     if (target.classList.contains('string-input')) {
+        if (target.dataset.lookupUrl) lookup_schedule(target);
         table_handle_input_string(target);
         return;
     }
@@ -1456,6 +1660,156 @@ function enum_select_init(state: StateTable): void {
     })
 }
 
+// ============================================================================
+// Lookup (PKD / SIMC autocomplete)
+// ============================================================================
+
+type LookupOption = { value: string; label: string };
+
+const LOOKUP_DELAY_MS = 250;
+const lookup_timers = new WeakMap<HTMLInputElement, number>();
+let lookup_counter = 0;
+
+async function lookup_suggest(input: HTMLInputElement): Promise<void> {
+    const url = input.dataset.lookupUrl;
+    const query = input.value.trim();
+    if (!url || query === '') return;
+
+    let list = input.list;
+    if (!list) {
+        list = document.createElement('datalist');
+        list.id = `lookup-${lookup_counter++}`;
+        input.after(list);
+        input.setAttribute('list', list.id);
+    }
+
+    try {
+        const response = await fetch(`${url}?q=${encodeURIComponent(query)}`);
+        if (!response.ok) return;
+        const options: LookupOption[] = await response.json();
+        list.replaceChildren(...options.map(o => new Option(o.label, o.value)));
+    } catch {
+        // Suggestions are a convenience; the code can still be typed in full.
+    }
+}
+
+function lookup_schedule(input: HTMLInputElement): void {
+    window.clearTimeout(lookup_timers.get(input));
+    lookup_timers.set(input, window.setTimeout(() => lookup_suggest(input), LOOKUP_DELAY_MS));
+}
+
+// ============================================================================
+// Matrix Table
+// ============================================================================
+
+// Both axes pick from one code list; a code already on an axis can't be added twice.
+function matrix_option_take(select: HTMLSelectElement, code: string): string {
+    const option = Array.from(select.options).find(o => o.value === code);
+    if (option) option.disabled = true;
+    select.value = '';
+    return option?.dataset.label ?? code;
+}
+
+function matrix_cell_create(state: StateTable, rowIndex: number, column: string): HTMLTableCellElement {
+    const cell = document.createElement('td');
+    cell.dataset.cell = '';
+    cell.dataset.rowIndex = String(rowIndex);
+    cell.dataset.matrixColumn = column;
+    cell.className = 'px-2 py-2 border-b border-l border-slate-200';
+
+    const template = state.element.querySelector<HTMLTemplateElement>('template[data-matrix-cell]');
+    if (template) cell.append(template.content.cloneNode(true));
+    cell.querySelectorAll<HTMLElement>('[data-multi-exclusive-container]').forEach(container => {
+        multi_exclusive_container_init(state, container);
+    });
+    return cell;
+}
+
+function matrix_table_add_row(state: StateTable, select: HTMLSelectElement, code: string): void {
+    const tbody = state.element.querySelector('tbody');
+    if (!tbody) return;
+    const label = matrix_option_take(select, code);
+    const rowIndex = tbody.rows.length;
+
+    const row = document.createElement('tr');
+    row.dataset.matrixRow = code;
+    const title = document.createElement('th');
+    title.dataset.cell = '';
+    title.dataset.rowIndex = String(rowIndex);
+    title.className = 'px-5 py-3 font-medium text-left text-slate-600 whitespace-nowrap border-b border-slate-200';
+    title.textContent = `${code} - ${label}`;
+    row.append(title);
+
+    state.element.querySelectorAll<HTMLElement>('[data-matrix-header] [data-matrix-column]').forEach(header => {
+        row.append(matrix_cell_create(state, rowIndex, header.dataset.matrixColumn ?? ''));
+    });
+    tbody.append(row);
+    zebra_striping_apply(state.element);
+}
+
+function matrix_table_add_column(state: StateTable, select: HTMLSelectElement, code: string): void {
+    const header = state.element.querySelector<HTMLElement>('[data-matrix-header]');
+    if (!header) return;
+    const label = matrix_option_take(select, code);
+
+    const title = document.createElement('th');
+    title.dataset.matrixColumn = code;
+    title.dataset.tooltip = label;
+    title.className = 'px-3 py-3 font-semibold text-slate-700 text-center bg-slate-50 border-b border-l border-slate-200 cursor-default';
+    title.textContent = code;
+    header.append(title);
+
+    state.element.querySelectorAll<HTMLElement>('tr[data-matrix-row]').forEach((row, rowIndex) => {
+        row.append(matrix_cell_create(state, rowIndex, code));
+    });
+    zebra_striping_apply(state.element);
+}
+
+function matrix_cell_value(cell: HTMLElement): unknown {
+    const number = cell.querySelector<HTMLInputElement>('.number-input');
+    if (number) return number_value_parse(number.value);
+    const text = cell.querySelector<HTMLInputElement>('.string-input');
+    if (text) return text.value.trim() || null;
+    const hidden = cell.querySelector<HTMLInputElement>('[data-enum-value], [data-multi-exclusive-value]');
+    return hidden?.value || null;
+}
+
+// Serializes to {row code: {column code: value}}, leaving out empty cells.
+function table_serialize_matrix(state: StateTable): Record<string, Record<string, unknown>> {
+    const data: Record<string, Record<string, unknown>> = {};
+
+    state.element.querySelectorAll<HTMLElement>('tr[data-matrix-row]').forEach(row => {
+        const code = row.dataset.matrixRow ?? '';
+        row.querySelectorAll<HTMLElement>('td[data-matrix-column]').forEach(cell => {
+            const value = matrix_cell_value(cell);
+            if (value === null) return;
+            (data[code] ??= {})[cell.dataset.matrixColumn ?? ''] = value;
+        });
+    });
+
+    return data;
+}
+
+function matrix_table_init(state: StateTable): void {
+    const add_row = state.element.querySelector<HTMLSelectElement>('[data-matrix-add-row]');
+    const add_column = state.element.querySelector<HTMLSelectElement>('[data-matrix-add-column]');
+    if (!add_row || !add_column) return;
+
+    state.element.querySelectorAll<HTMLElement>('tr[data-matrix-row]').forEach(row => {
+        matrix_option_take(add_row, row.dataset.matrixRow ?? '');
+    });
+    state.element.querySelectorAll<HTMLElement>('[data-matrix-header] [data-matrix-column]').forEach(header => {
+        matrix_option_take(add_column, header.dataset.matrixColumn ?? '');
+    });
+
+    add_row.addEventListener('change', () => {
+        if (add_row.value) matrix_table_add_row(state, add_row, add_row.value);
+    });
+    add_column.addEventListener('change', () => {
+        if (add_column.value) matrix_table_add_column(state, add_column, add_column.value);
+    });
+}
+
 // ============================================================================
 // Zebra Striping
 // ============================================================================
@@ -1479,10 +1833,14 @@ function table_init(element: HTMLElement): StateTable {
     const state: StateTable = {
         element,
         type: tableType,
-        endpoint: element.dataset.endpoint!,
+        // Previews have no farm: no endpoint, nothing is saved or fetched.
+        endpoint: element.dataset.endpoint ?? '',
+        compact: element.dataset.compact ?? '',
         enum_selected_index: new Map(),
         pending_save: false,
         last_save_time: 0,
+        save_key: '',
+        save_body: '',
         is_dynamic,
         is_unique: tableType === 'HORIZONTAL_DYNAMIC_UNIQUE',
         row_counter: 0,
@@ -1493,7 +1851,10 @@ function table_init(element: HTMLElement): StateTable {
     enum_select_init(state)
      
     if (state.is_dynamic) {
-        dynamic_table_load_existing(state);
+        dynamic_table_init(state);
+    }
+    if (tableType === 'MATRIX_DYNAMIC_UNIQUE') {
+        matrix_table_init(state);
     }
     
     element.addEventListener('input', (e) => input_event_route(state, e));
@@ -1621,7 +1982,7 @@ function multi_exclusive_handle_change(container: HTMLElement, target: HTMLInput
 
 function validate_multi_exclusive_required(container: HTMLElement): string | null {
     const hiddenInput = container.querySelector<HTMLInputElement>('[data-multi-exclusive-value]');
-    const required = hiddenInput?.dataset.required === 'true';
+    const required = input_required(hiddenInput);
     
     if (required && !hiddenInput?.value) {
         return 'Wybierz co najmniej jedną opcję';
@@ -1630,17 +1991,160 @@ function validate_multi_exclusive_required(container: HTMLElement): string | nul
     return null;
 }
 
+function multi_exclusive_container_init(state: StateTable, container: HTMLElement): void {
+    multi_exclusive_load_value(container);
+
+    container.addEventListener('change', (e) => {
+        const target = e.target as HTMLInputElement;
+        if (target.hasAttribute('data-multi-option')) {
+            multi_exclusive_handle_change(container, target, state);
+        }
+    });
+}
+
 function multi_exclusive_init(state: StateTable): void {
     state.element.querySelectorAll<HTMLElement>('[data-multi-exclusive-container]').forEach(container => {
-        multi_exclusive_load_value(container);
+        multi_exclusive_container_init(state, container);
+    });
+}
 
-        container.addEventListener('change', (e) => {
-            const target = e.target as HTMLInputElement;
-            if (target.hasAttribute('data-multi-option')) {
-                multi_exclusive_handle_change(container, target, state);
-            }
+// ============================================================================
+// Edit Lock
+// ============================================================================
+
+type StateEditLock = {
+    element: HTMLElement;
+    login: HTMLElement;
+    url: string;
+    refresh_ms: number;
+    last_activity: number;
+    interval: number | null;
+};
+
+async function edit_lock_acquire(state: StateEditLock): Promise<void> {
+    try {
+        const response = await fetch(state.url, { method: 'POST' });
+        if (response.status === 409) {
+            const body = await response.json();
+            state.login.textContent = body.login ?? '';
+            state.element.classList.remove('hidden');
+        } else if (response.ok) {
+            state.element.classList.add('hidden');
+        }
+    } catch {
+        // The lock is only advisory, a failed refresh must not disturb editing.
+    }
+}
+
+function edit_lock_tick(state: StateEditLock): void {
+    // An idle editor stops refreshing, so the lock expires on the server.
+    if (Date.now() - state.last_activity < state.refresh_ms * 2) {
+        edit_lock_acquire(state);
+    }
+}
+
+function edit_lock_init(element: HTMLElement): StateEditLock | null {
+    const url = element.dataset.editLockUrl;
+    const refresh_seconds = parseInt(element.dataset.editLockRefresh ?? '0', 10);
+    const login = element.querySelector<HTMLElement>('[data-edit-lock-login]');
+    if (!url || !login || refresh_seconds <= 0) return null;
+
+    const state: StateEditLock = {
+        element,
+        login,
+        url,
+        refresh_ms: refresh_seconds * 1000,
+        last_activity: Date.now(),
+        interval: null,
+    };
+
+    document.addEventListener('keypress', () => (state.last_activity = Date.now()), true);
+    document.addEventListener('click', () => (state.last_activity = Date.now()), true);
+    window.addEventListener('pagehide', () => navigator.sendBeacon(`${url}/zwolnij`));
+
+    state.interval = window.setInterval(() => edit_lock_tick(state), state.refresh_ms);
+    edit_lock_acquire(state);
+
+    return state;
+}
+
+// ============================================================================
+// Not Applicable
+// ============================================================================
+
+type StateNotApplicable = {
+    url: string;
+    check: HTMLInputElement;
+    reason: HTMLInputElement;
+};
+
+async function not_applicable_save(state: StateNotApplicable): Promise<void> {
+    const marked = state.check.checked;
+    if (marked && string_is_blank(state.reason.value)) {
+        state.check.checked = false;
+        toast_show('Podaj powód, dla którego podtabela nie dotyczy gospodarstwa', 'warning');
+        state.reason.focus();
+        return;
+    }
+
+    try {
+        const response = await fetch(state.url, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ nie_dotyczy: marked, powod: state.reason.value }),
         });
+        if (!response.ok) {
+            const body = await response.json().catch(() => ({}));
+            throw new Error(body.message ?? `Błąd serwera: ${response.status}`);
+        }
+        toast_show(marked ? 'Oznaczono jako nie dotyczy' : 'Usunięto oznaczenie nie dotyczy', 'success');
+    } catch (err) {
+        state.check.checked = !marked;
+        toast_show(`Błąd zapisu: ${err}`, 'error');
+    }
+}
+
+function not_applicable_init(element: HTMLElement): StateNotApplicable | null {
+    const url = element.dataset.notApplicableUrl;
+    const check = element.querySelector<HTMLInputElement>('[data-not-applicable-check]');
+    const reason = element.querySelector<HTMLInputElement>('[data-not-applicable-reason]');
+    if (!url || !check || !reason) return null;
+
+    const state: StateNotApplicable = { url, check, reason };
+
+    check.addEventListener('change', () => not_applicable_save(state));
+    // A changed reason only needs saving while the mark is on.
+    reason.addEventListener('change', () => {
+        if (state.check.checked) not_applicable_save(state);
+    });
+
+    return state;
+}
+
+// ============================================================================
+// Farm Events
+// ============================================================================
+
+function farm_events_init(element: HTMLElement): EventSource | null {
+    const url = element.dataset.farmEventsUrl;
+    if (!url || typeof EventSource === 'undefined') return null;
+    const own_login = element.dataset.farmEventsLogin ?? '';
+    const who = element.querySelector<HTMLElement>('[data-farm-events-who]');
+    const subtable = element.querySelector<HTMLElement>('[data-farm-events-subtable]');
+
+    // EventSource reconnects by itself after a dropped connection.
+    const source = new EventSource(url);
+    source.addEventListener('save', (event) => {
+        const data = JSON.parse((event as MessageEvent).data);
+        // Our own saves are broadcast too.
+        if (data.login === own_login) return;
+        if (who) who.textContent = data.login ?? '';
+        if (subtable) subtable.textContent = data.podtabela ?? '';
+        element.classList.remove('hidden');
     });
+    window.addEventListener('pagehide', () => source.close());
+
+    return source;
 }
 
 // ============================================================================
@@ -1690,10 +2194,13 @@ document.addEventListener('DOMContentLoaded', () => {
     year_select_init();
     user_menu_init();
     logout_init();
-    session_timer_init(30);
+    session_timer_init();
     nav_toggle_init();    
     tooltips_init();
 
     document.querySelectorAll<HTMLElement>('[data-table-type]').forEach(table_init);
     document.querySelectorAll<HTMLElement>('[data-table-statusy]').forEach(table_statusy_init);
+    document.querySelectorAll<HTMLElement>('[data-edit-lock]').forEach(edit_lock_init);
+    document.querySelectorAll<HTMLElement>('[data-not-applicable]').forEach(not_applicable_init);
+    document.querySelectorAll<HTMLElement>('[data-farm-events]').forEach(farm_events_init);
 });
\ No newline at end of file
@@ -3,16 +3,21 @@ module app
 go 1.24.5
 
 require (
+	github.com/go-ldap/ldap/v3 v3.4.8
 	github.com/go-playground/form v3.1.4+incompatible
 	github.com/mattn/go-sqlite3 v1.14.32
+	golang.org/x/text v0.34.0
 )
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.5 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/ncruces/go-strftime v1.0.0 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/exp v0.0.0-20251023183803-a4bb9ffd2546 // indirect
 	golang.org/x/sys v0.37.0 // indirect
 	modernc.org/libc v1.67.6 // indirect
@@ -22,8 +27,8 @@ require (
 
 require (
 	github.com/alexedwards/scs/v2 v2.9.0
-	github.com/jmoiron/sqlx v1.4.0 // indirect
-	github.com/lmittmann/tint v1.1.2 // indirect
+	github.com/jmoiron/sqlx v1.4.0
+	github.com/lmittmann/tint v1.1.2
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 	modernc.org/sqlite v1.45.0
 )
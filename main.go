@@ -1,38 +1,66 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"database/sql"
 	"embed"
+	"encoding/csv"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	html "html/template"
 	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"path"
 	"path/filepath"
+	"regexp"
 	"runtime/debug"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/go-ldap/ldap/v3"
 	"github.com/go-playground/form"
 	"github.com/jmoiron/sqlx"
 	"github.com/lmittmann/tint"
 	
 	// _ "modernc.org/sqlite"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
 )
 
 func init() {
 	gob.Register(User{})
+	sql.Register(SQLITE_DRIVER, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("login_fold", LoginFold, true)
+		},
+	})
 }
 
 //go:embed frontend/*
@@ -47,6 +75,12 @@ var FS_SQL_MASTER embed.FS
 //go:embed sql_year/*.sql
 var FS_SQL_YEAR embed.FS
 
+//go:embed sql_schema/*.sql
+var FS_SQL_SCHEMA embed.FS
+
+//go:embed sql_migrations/*/*.sql
+var FS_SQL_MIGRATIONS embed.FS
+
 func SqlPraseQueriesBoth(fsys embed.FS, name string) string {
 	file, err := fsys.ReadFile("sql_both/" + name + ".sql")
 	if err != nil {
@@ -59,14 +93,70 @@ func SqlPraseQueriesBoth(fsys embed.FS, name string) string {
 type SqlCache struct {
 	DB      *sqlx.DB
 	Queries map[string]*sqlx.Stmt
+
+	Timing *SqlTiming
+
+	// requests counts the requests holding the cache through YearAcquire;
+	// RemoveYear sets closing, under DBManager.mu, and waits for it before
+	// closing DB.
+	requests sync.WaitGroup
+	closing  bool
+}
+
+// SqlTiming logs cached queries slower than Threshold at debug level, by query
+// name, to find which of the many queries behind a page is the slow one. One
+// SqlTiming is shared by all caches of a DBManager, so setting the threshold
+// after Connect reaches every year. A zero Threshold turns it off.
+type SqlTiming struct {
+	Logger    *slog.Logger
+	Threshold time.Duration
+}
+
+// since is deferred with the start time. For Queryx it measures until the first
+// row is ready, not the caller's iteration over the rest.
+func (t *SqlTiming) since(name string, start time.Time) {
+	if t == nil || t.Threshold <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed >= t.Threshold {
+		t.Logger.Debug("slow query", slog.String("query", name), slog.Duration("elapsed", elapsed))
+	}
 }
 
 func CacheSqlQueriesFS(fsys embed.FS, dir string, db *sqlx.DB) *SqlCache {
+	c, err := SqlCacheNew(fsys, dir, db)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// SqlCacheNew is CacheSqlQueriesFS for use after startup, where a bad database
+// must not take the server down.
+func SqlCacheNew(fsys embed.FS, dir string, db *sqlx.DB) (*SqlCache, error) {
 	c := &SqlCache{DB: db, Queries: make(map[string]*sqlx.Stmt)}
 
+	err := sqlFilesEach(fsys, dir, func(key, query string) error {
+		stmt, err := db.Preparex(query)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		c.Queries[key] = stmt
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// sqlFilesEach calls fn with the name (without .sql) and text of every query
+// in dir, stopping at the first error fn returns.
+func sqlFilesEach(fsys embed.FS, dir string, fn func(key, query string) error) error {
 	files, err := fsys.ReadDir(dir)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	for _, file := range files {
@@ -74,22 +164,76 @@ func CacheSqlQueriesFS(fsys embed.FS, dir string, db *sqlx.DB) *SqlCache {
 			continue
 		}
 
-		path := dir + "/" + file.Name()
-		content, err := fsys.ReadFile(path)
+		content, err := fsys.ReadFile(dir + "/" + file.Name())
 		if err != nil {
-			panic(err)
+			return err
+		}
+
+		if err := fn(strings.TrimSuffix(file.Name(), ".sql"), string(content)); err != nil {
+			return err
 		}
+	}
 
-		key := strings.TrimSuffix(file.Name(), ".sql")
-		stmt, err := db.Preparex(string(content))
+	return nil
+}
+
+// SqlCheck prepares every query in dir against db like SqlCacheNew, but keeps
+// going past failures and returns one error per broken file, so -check-sql can
+// list every mismatch between the queries and the schema in one run.
+func SqlCheck(fsys embed.FS, dir string, db *sqlx.DB) ([]error, error) {
+	var failures []error
+	err := sqlFilesEach(fsys, dir, func(key, query string) error {
+		stmt, err := db.Preparex(query)
 		if err != nil {
-			panic(err)
+			failures = append(failures, fmt.Errorf("%s/%s.sql: %w", dir, key, err))
+			return nil
 		}
+		return stmt.Close()
+	})
+	return failures, err
+}
 
-		c.Queries[key] = stmt
+// SqlCheckDir runs SqlCheck on every database in dbDirPath, the master queries
+// against master.db and the year queries against each {year}.db, and writes
+// one line per failure to out. It returns how many queries failed; err is for
+// databases it could not check at all.
+func SqlCheckDir(dbDirPath string, out io.Writer) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(dbDirPath, "*.db"))
+	if err != nil {
+		return 0, err
+	}
+	if len(paths) == 0 {
+		return 0, fmt.Errorf("no databases in %s", dbDirPath)
 	}
 
-	return c
+	failed := 0
+	for _, path := range paths {
+		dbName := strings.TrimSuffix(filepath.Base(path), ".db")
+
+		fsys, dir := FS_SQL_YEAR, "sql_year"
+		if dbName == "master" {
+			fsys, dir = FS_SQL_MASTER, "sql_master"
+		} else if _, err := strconv.Atoi(dbName); err != nil {
+			return failed, fmt.Errorf("%s: database name is neither master nor a year", path)
+		}
+
+		db, err := sqlx.Open(SQLITE_DRIVER, path+SQLITE_DSN_OPTIONS)
+		if err != nil {
+			return failed, fmt.Errorf("%s: %w", path, err)
+		}
+		failures, err := SqlCheck(fsys, dir, db)
+		db.Close()
+		if err != nil {
+			return failed, fmt.Errorf("%s: %w", path, err)
+		}
+
+		for _, failure := range failures {
+			fmt.Fprintf(out, "%s: %v\n", path, failure)
+		}
+		failed += len(failures)
+	}
+
+	return failed, nil
 }
 
 func (c *SqlCache) stmt(name string) *sqlx.Stmt {
@@ -101,14 +245,17 @@ func (c *SqlCache) stmt(name string) *sqlx.Stmt {
 }
 
 func (c *SqlCache) Queryx(name string, args ...any) (*sqlx.Rows, error) {
+	defer c.Timing.since(name, time.Now())
 	return c.stmt(name).Queryx(args...)
 }
 
 func (c *SqlCache) QueryRowx(name string, args ...any) *sqlx.Row {
+	defer c.Timing.since(name, time.Now())
 	return c.stmt(name).QueryRowx(args...)
 }
 
 func (c *SqlCache) Exec(name string, args ...any) (sql.Result, error) {
+	defer c.Timing.since(name, time.Now())
 	return c.stmt(name).Exec(args...)
 }
 
@@ -116,47 +263,471 @@ func (c *SqlCache) ExecFromString(query string, args ...any) (sql.Result, error)
 	return c.DB.Exec(query, args...)
 }
 
+// SqlTx runs cached queries inside one transaction, so a multi-row write lands
+// whole or not at all.
+type SqlTx struct {
+	Tx    *sqlx.Tx
+	cache *SqlCache
+}
+
+func (t *SqlTx) Exec(name string, args ...any) (sql.Result, error) {
+	defer t.cache.Timing.since(name, time.Now())
+	return t.Tx.Stmtx(t.cache.stmt(name)).Exec(args...)
+}
+
+func (t *SqlTx) QueryRowx(name string, args ...any) *sqlx.Row {
+	defer t.cache.Timing.since(name, time.Now())
+	return t.Tx.Stmtx(t.cache.stmt(name)).QueryRowx(args...)
+}
+
+func (t *SqlTx) Queryx(name string, args ...any) (*sqlx.Rows, error) {
+	defer t.cache.Timing.since(name, time.Now())
+	return t.Tx.Stmtx(t.cache.stmt(name)).Queryx(args...)
+}
+
 var (
-	sql_enable_fk = SqlPraseQueriesBoth(FS_SQL_BOTH, "enable_foreign_keys")
+	sql_enable_fk   = SqlPraseQueriesBoth(FS_SQL_BOTH, "enable_foreign_keys")
+	sql_year_schema = SqlPraseSchema(FS_SQL_SCHEMA, "year")
+
+	sql_migracje_create        = SqlPraseQueriesBoth(FS_SQL_BOTH, "migracje_create")
+	sql_migracje_select_wersja = SqlPraseQueriesBoth(FS_SQL_BOTH, "migracje_select_wersja")
+	sql_migracje_insert        = SqlPraseQueriesBoth(FS_SQL_BOTH, "migracje_insert")
 )
 
+func SqlPraseSchema(fsys embed.FS, name string) string {
+	file, err := fsys.ReadFile("sql_schema/" + name + ".sql")
+	if err != nil {
+		panic(err)
+	}
+
+	return string(file)
+}
+
 type YearDB int64
 
 type DBManager struct {
-	Logger       *slog.Logger
-	MasterCache  *SqlCache
+	Logger      *slog.Logger
+	MasterCache *SqlCache
+	DirPath     string
+	// Years can be added while serving (YearCreate), so every access to the map
+	// goes through mu.
+	mu           sync.RWMutex
 	yearCacheMap map[YearDB]*SqlCache
+
+	// Timing is handed to every cache Connect and AddYear create.
+	Timing *SqlTiming
+	// Retry is applied by YTx and by saves that call it directly.
+	Retry SqlRetry
+	// DrainTimeout bounds how long RemoveYear waits for requests still using
+	// the year, zero waits for as long as they take.
+	DrainTimeout time.Duration
+	// Migrate makes Connect apply pending sql_migrations before preparing
+	// the queries, which may depend on them.
+	Migrate bool
+}
+
+var ErrYearExists = errors.New("year already exists")
+
+// WAL lets readers (and backups) run alongside a writer; busy_timeout makes a
+// connection wait for a lock instead of failing with SQLITE_BUSY straight away.
+const SQLITE_DSN_OPTIONS = "?_busy_timeout=5000&_journal_mode=WAL"
+
+// SQLITE_DRIVER is go-sqlite3 with login_fold registered on every connection.
+// SQLite's own lower() only folds ASCII, so it can't match Ł against ł.
+const SQLITE_DRIVER = "sqlite3_ankiety"
+
+// ErrMasterNotLoaded and ErrYearNotLoaded come back from the DBManager query
+// methods instead of a nil pointer panic, so a handler reports a 500 that says
+// which database is missing.
+var (
+	ErrMasterNotLoaded = errors.New("master database not loaded")
+	ErrYearNotLoaded   = errors.New("year database not loaded")
+)
+
+// SqlRow is a *sqlx.Row that can also carry the error that kept the query from
+// running at all; Scan and StructScan return it like any query error.
+type SqlRow struct {
+	row *sqlx.Row
+	err error
+}
+
+func (r *SqlRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.row.Scan(dest...)
+}
+
+func (r *SqlRow) StructScan(dest any) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.row.StructScan(dest)
+}
+
+func (r *SqlRow) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.row.Err()
+}
+
+func (m *DBManager) master() (*SqlCache, error) {
+	if m.MasterCache == nil {
+		return nil, ErrMasterNotLoaded
+	}
+	return m.MasterCache, nil
 }
 
 func (m *DBManager) MQueryx(queryName string, args ...any) (*sqlx.Rows, error) {
-	return m.MasterCache.Queryx(queryName, args...)
+	cache, err := m.master()
+	if err != nil {
+		return nil, err
+	}
+	return cache.Queryx(queryName, args...)
+}
+
+func (m *DBManager) MQueryRowx(queryName string, args ...any) *SqlRow {
+	cache, err := m.master()
+	if err != nil {
+		return &SqlRow{err: err}
+	}
+	return &SqlRow{row: cache.QueryRowx(queryName, args...)}
+}
+
+func (m *DBManager) MExec(queryName string, args ...any) (sql.Result, error) {
+	cache, err := m.master()
+	if err != nil {
+		return nil, err
+	}
+	return cache.Exec(queryName, args...)
+}
+
+func (m *DBManager) yearCache(year YearDB) *SqlCache {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.yearCacheMap[year]
 }
 
-func (m *DBManager) MQueryRowx(queryName string, args ...any) *sqlx.Row {
-	return m.MasterCache.QueryRowx(queryName, args...)
+// year is yearCache for the query methods, with an error for a missing year.
+func (m *DBManager) year(year YearDB) (*SqlCache, error) {
+	cache := m.yearCache(year)
+	if cache == nil {
+		return nil, fmt.Errorf("%w: %d", ErrYearNotLoaded, year)
+	}
+	return cache, nil
 }
 
 func (m *DBManager) YQueryx(year YearDB, queryName string, args ...any) (*sqlx.Rows, error) {
-	return m.yearCacheMap[year].Queryx(queryName, args...)
+	cache, err := m.year(year)
+	if err != nil {
+		return nil, err
+	}
+	return cache.Queryx(queryName, args...)
 }
 
-func (m *DBManager) YQueryRowx(year YearDB, queryName string, args ...any) *sqlx.Row {
-	return m.yearCacheMap[year].QueryRowx(queryName, args...)
+func (m *DBManager) YQueryRowx(year YearDB, queryName string, args ...any) *SqlRow {
+	cache, err := m.year(year)
+	if err != nil {
+		return &SqlRow{err: err}
+	}
+	return &SqlRow{row: cache.QueryRowx(queryName, args...)}
 }
 
 func (m *DBManager) YExec(year YearDB, queryName string, args ...any) (sql.Result, error) {
-	return m.yearCacheMap[year].Exec(queryName, args...)
+	cache, err := m.year(year)
+	if err != nil {
+		return nil, err
+	}
+	return cache.Exec(queryName, args...)
 }
 
 func (m *DBManager) YExecFromString(year YearDB, query string, args ...any) (sql.Result, error) {
-	return m.yearCacheMap[year].DB.Exec(query, args...)
+	cache, err := m.year(year)
+	if err != nil {
+		return nil, err
+	}
+	return cache.DB.Exec(query, args...)
+}
+
+// SqlRetry retries writes that fail because another connection holds the lock.
+// busy_timeout already waits inside SQLite, but a deferred transaction whose
+// snapshot went stale gets SQLITE_BUSY straight away, and only starting over helps.
+type SqlRetry struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// SqlBusy reports SQLITE_BUSY or SQLITE_LOCKED, extended codes included.
+func SqlBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
 }
 
+// Do runs fn until it returns anything but a busy error or Attempts are used up,
+// doubling the wait after each try. Zero Attempts runs fn once.
+func (s SqlRetry) Do(fn func() error) error {
+	wait := s.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !SqlBusy(err) || attempt >= s.Attempts {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// YTx runs fn in a transaction on the year database; an error from fn rolls it back.
+// A busy database restarts the whole transaction under m.Retry, so fn must not
+// carry state over from an earlier run.
+func (m *DBManager) YTx(year YearDB, fn func(tx *SqlTx) error) error {
+	cache, err := m.year(year)
+	if err != nil {
+		return err
+	}
+	return m.Retry.Do(func() error {
+		tx, err := cache.DB.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := fn(&SqlTx{Tx: tx, cache: cache}); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// HasYear reports a loaded year that isn't being removed.
+func (m *DBManager) HasYear(year YearDB) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cache, ok := m.yearCacheMap[year]
+	return ok && !cache.closing
+}
+
+// Years returns the loaded years in ascending order, leaving out those being removed.
+func (m *DBManager) Years() []YearDB {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	years := make([]YearDB, 0, len(m.yearCacheMap))
+	for year, cache := range m.yearCacheMap {
+		if cache.closing {
+			continue
+		}
+		years = append(years, year)
+	}
+	slices.Sort(years)
+	return years
+}
+
+// AddYear prepares the year queries on db and makes the year visible to handlers.
+func (m *DBManager) AddYear(year YearDB, db *sqlx.DB) error {
+	if _, err := db.Exec(sql_enable_fk); err != nil {
+		return err
+	}
+	cache, err := SqlCacheNew(FS_SQL_YEAR, "sql_year", db)
+	if err != nil {
+		return err
+	}
+	cache.Timing = m.Timing
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.yearCacheMap[year]; ok {
+		return ErrYearExists
+	}
+	m.yearCacheMap[year] = cache
+	return nil
+}
+
+// YearAcquire holds the year database for a request, so RemoveYear doesn't close
+// it under a running query. release must be called once the request is done
+// with it; ok is false, with nothing to release, when the year isn't loaded or
+// is being removed.
+func (m *DBManager) YearAcquire(year YearDB) (release func(), ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cache, ok := m.yearCacheMap[year]
+	if !ok || cache.closing {
+		return nil, false
+	}
+	// Under the read lock, so no Add can follow RemoveYear setting closing and
+	// starting to Wait.
+	cache.requests.Add(1)
+	return cache.requests.Done, true
+}
+
+// RemoveYear unloads the year. New requests stop finding it at once, while the
+// ones holding it through YearAcquire keep querying it until they finish, or
+// until DrainTimeout runs out, with a warning; then its database is closed.
+func (m *DBManager) RemoveYear(year YearDB) error {
+	m.mu.Lock()
+	cache, ok := m.yearCacheMap[year]
+	if !ok || cache.closing {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %d", ErrYearNotLoaded, year)
+	}
+	cache.closing = true
+	m.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		cache.requests.Wait()
+		close(drained)
+	}()
+
+	var timeout <-chan time.Time
+	if m.DrainTimeout > 0 {
+		timer := time.NewTimer(m.DrainTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-drained:
+	case <-timeout:
+		m.Logger.Warn("closing year with requests still running", slog.Int64("year", int64(year)), slog.Duration("waited", m.DrainTimeout))
+	}
+
+	m.mu.Lock()
+	delete(m.yearCacheMap, year)
+	m.mu.Unlock()
+	return cache.DB.Close()
+}
+
+// YearCreate creates {year}.db from sql_schema/year.sql and registers it. The
+// schema already has every year migration, they are recorded as applied.
+// A half created file is removed so the next attempt starts clean.
+func (m *DBManager) YearCreate(year YearDB) error {
+	path := filepath.Join(m.DirPath, fmt.Sprintf("%d.db", year))
+	if m.HasYear(year) {
+		return ErrYearExists
+	}
+	if _, err := os.Stat(path); err == nil {
+		return ErrYearExists
+	}
+
+	db, err := sqlx.Open(SQLITE_DRIVER, path+SQLITE_DSN_OPTIONS)
+	if err != nil {
+		return err
+	}
+
+	err = YearSchemaCreate(db)
+	if err == nil {
+		err = m.AddYear(year, db)
+	}
+	if err != nil {
+		db.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return nil
+}
+
+// YearDiscard unloads a year YearCreate just made and deletes its file, with the
+// WAL files SQLite leaves next to it, so creating the year can be tried again.
+func (m *DBManager) YearDiscard(year YearDB) error {
+	if err := m.RemoveYear(year); err != nil {
+		return err
+	}
+	path := filepath.Join(m.DirPath, fmt.Sprintf("%d.db", year))
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// YearBackup copies the year database into dir with SQLite's online backup API,
+// so the copy is consistent even while handlers keep writing. Returns the file name.
+func (m *DBManager) YearBackup(year YearDB, dir string) (string, error) {
+	cache, err := m.year(year)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%d_%s.db", year, time.Now().Format("20060102-150405"))
+	path := filepath.Join(dir, name)
+
+	// O_EXCL so two backups in the same second never write into one file.
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+
+	if err := sqliteBackup(cache.DB.DB, path); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return name, nil
+}
+
+func sqliteBackup(src *sql.DB, destPath string) error {
+	dest, err := sql.Open("sqlite3", destPath)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriver any) error {
+		return srcConn.Raw(func(srcDriver any) error {
+			backup, err := destDriver.(*sqlite3.SQLiteConn).Backup("main", srcDriver.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			defer backup.Finish()
+
+			// Step returns not done without an error while the source is locked;
+			// busy_timeout already waited, so just retry a few times.
+			for range BACKUP_STEP_RETRIES {
+				done, err := backup.Step(-1)
+				if err != nil {
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			return errors.New("backup: source database stayed locked")
+		})
+	})
+}
+
+const BACKUP_STEP_RETRIES = 50
+
 func (m *DBManager) Disconnect() {
-	if err := m.MasterCache.DB.Close(); err != nil {
-		m.Logger.Error(err.Error())
+	if m.MasterCache != nil {
+		if err := m.MasterCache.DB.Close(); err != nil {
+			m.Logger.Error(err.Error())
+		}
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for _, sqlCache := range m.yearCacheMap {
 		if err := sqlCache.DB.Close(); err != nil {
 			m.Logger.Error(err.Error())
@@ -164,26 +735,51 @@ func (m *DBManager) Disconnect() {
 	}
 }
 
-func (m *DBManager) Connect(dbDirPath string) {
+// Connect opens master.db and every {year}.db in dbDirPath. Without master.db
+// nobody can log in, so it is an error rather than something found on first login.
+func (m *DBManager) Connect(dbDirPath string) error {
+	m.DirPath = dbDirPath
+
+	masterPath := filepath.Join(dbDirPath, "master.db")
+	if _, err := os.Stat(masterPath); err != nil {
+		return fmt.Errorf("master database %s: %w", masterPath, err)
+	}
 
 	paths, err := filepath.Glob(dbDirPath + "*.db")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	for _, path := range paths {
-		db, err := sqlx.Open("sqlite3", path)
+		db, err := sqlx.Open(SQLITE_DRIVER, path+SQLITE_DSN_OPTIONS)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("%s: %w", path, err)
 		}
 
 		dbName := strings.TrimSuffix(filepath.Base(path), ".db")
 
+		if m.Migrate {
+			migrations := MIGRATIONS_YEAR
+			if dbName == "master" {
+				migrations = MIGRATIONS_MASTER
+			}
+			applied, err := MigrationsApply(db, migrations)
+			for _, migration := range applied {
+				m.Logger.Info("migration applied", slog.String("db", dbName), slog.Int("version", migration.Version), slog.String("name", migration.Name))
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+
 		if dbName == "master" {
-			m.MasterCache = CacheSqlQueriesFS(FS_SQL_MASTER, "sql_master", db)
-			_, err := m.MasterCache.ExecFromString(sql_enable_fk)
+			m.MasterCache, err = SqlCacheNew(FS_SQL_MASTER, "sql_master", db)
 			if err != nil {
-				panic(err)
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			m.MasterCache.Timing = m.Timing
+			if _, err := m.MasterCache.ExecFromString(sql_enable_fk); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
 			}
 
 			continue
@@ -191,62 +787,410 @@ func (m *DBManager) Connect(dbDirPath string) {
 
 		value, err := strconv.Atoi(dbName)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("%s: database name is neither master nor a year", path)
 		}
 
-		yearString := YearDB(value)
-
-		m.yearCacheMap[yearString] = CacheSqlQueriesFS(FS_SQL_YEAR, "sql_year", db)
-		_, err = m.YExecFromString(yearString, sql_enable_fk)
-		if err != nil {
-			panic(err)
+		if err := m.AddYear(YearDB(value), db); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
 		}
 	}
+
+	return nil
 }
 
-var tmpl_funcs = html.FuncMap{
-	"UserTypeName": func(ut UserType) string {
-		switch ut {
-		case UserAdmin:
-			return "Administrator"
-		case UserMethodolgist:
-			return "Metodyk"
-		case UserManager:
-			return "Kierownik"
-		case UserNormal:
-			return "Pracownik"
-		default:
-			return "Nieznany"
-		}
-	},
-	"HasAccess": func(userType, allowedTypes UserType) bool {
-		return userType&allowedTypes != 0
-	},
+// Migration is one sql_migrations file, NNNN_name.sql. Versions only grow: a
+// released migration is never edited, a fix is the next version.
+type Migration struct {
+	Version int
+	Name    string
+	Query   string
+}
+
+var (
+	MIGRATIONS_MASTER = MigrationsMust(MigrationsLoad(FS_SQL_MIGRATIONS, "sql_migrations/master"))
+	MIGRATIONS_YEAR   = MigrationsMust(MigrationsLoad(FS_SQL_MIGRATIONS, "sql_migrations/year"))
+)
+
+func MigrationsMust(migrations []Migration, err error) []Migration {
+	if err != nil {
+		panic(err)
+	}
+	return migrations
+}
+
+// MigrationsLoad reads the migrations in dir ordered by version. A file not
+// named NNNN_name.sql or a version used twice is an error.
+func MigrationsLoad(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		base, ok := strings.CutSuffix(entry.Name(), ".sql")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		number, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if err != nil || version < 1 || name == "" {
+			return nil, fmt.Errorf("migration %s/%s: expected NNNN_name.sql", dir, entry.Name())
+		}
+		query, err := fs.ReadFile(fsys, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, Query: string(query)})
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int { return cmp.Compare(a.Version, b.Version) })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("migration %s: version %d used twice", dir, migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+func migrationsApplied(db *sqlx.DB) (map[int]bool, error) {
+	if _, err := db.Exec(sql_migracje_create); err != nil {
+		return nil, err
+	}
+	var versions []int
+	if err := db.Select(&versions, sql_migracje_select_wersja); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool, len(versions))
+	for _, version := range versions {
+		applied[version] = true
+	}
+	return applied, nil
+}
+
+// MigrationsApply runs the migrations db has no record of, oldest first. Each
+// one commits together with its record, so a failure leaves that migration
+// and the later ones pending for the next run; the ones before it stay applied
+// and are returned along with the error.
+func MigrationsApply(db *sqlx.DB, migrations []Migration) ([]Migration, error) {
+	done, err := migrationsApplied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, migration := range migrations {
+		if done[migration.Version] {
+			continue
+		}
+		err := func() error {
+			tx, err := db.Beginx()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+
+			if _, err := tx.Exec(migration.Query); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(sql_migracje_insert, migration.Version, migration.Name); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}()
+		if err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		applied = append(applied, migration)
+	}
+	return applied, nil
+}
+
+// MigrationsMark records migrations as applied without running them, for a
+// database just made from a schema that already has their changes.
+func MigrationsMark(db *sqlx.DB, migrations []Migration) error {
+	done, err := migrationsApplied(db)
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if done[migration.Version] {
+			continue
+		}
+		if _, err := db.Exec(sql_migracje_insert, migration.Version, migration.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// YearSchemaCreate lays sql_schema/year.sql onto an empty year database. The
+// schema already holds every year migration, so they are recorded, not run.
+func YearSchemaCreate(db *sqlx.DB) error {
+	if _, err := db.Exec(sql_year_schema); err != nil {
+		return err
+	}
+	return MigrationsMark(db, MIGRATIONS_YEAR)
+}
+
+// BASE_PATH is the prefix the app is mounted under behind a reverse proxy, empty
+// at the root. It is package level because template funcs are bound at init and
+// never see Application; main sets it once, before Routes.
+var BASE_PATH = ""
+
+// BasePathClean turns -base-path into "" or "/prefix" without a trailing slash.
+func BasePathClean(value string) string {
+	value = strings.Trim(strings.TrimSpace(value), "/")
+	if value == "" {
+		return ""
+	}
+	return "/" + value
+}
+
+// AppURL builds a page URL under BASE_PATH from path segments, escaping each
+// one. A trailing "" segment gives a trailing slash: AppURL("app", 2030, "")
+// is "/app/2030/". Redirects use plain app paths instead, MountBasePath adds
+// the prefix to their Location.
+func AppURL(segments ...any) string {
+	var b strings.Builder
+	b.WriteString(BASE_PATH)
+	for _, segment := range segments {
+		b.WriteByte('/')
+		b.WriteString(url.PathEscape(fmt.Sprint(segment)))
+	}
+	return b.String()
+}
+
+var tmpl_funcs = html.FuncMap{
+	"HasAccess": func(userType, allowedTypes UserType) bool {
+		return userType&allowedTypes != 0
+	},
+	"AppURL":             AppURL,
 	"AdminOnly":          func() UserType { return AccessAdminOnly },
+	"ManagerOnly":        func() UserType { return UserManager },
 	"AdminMethodologist": func() UserType { return AccessAdminMethodologist },
 	"AllUsers":           func() UserType { return AccessAllUsers },
 }
 
-func TmplCompse(template_names ...string) *html.Template {
+//go:embed locales/*.json
+var FS_LOCALES embed.FS
+
+const LOCALE_DEFAULT = "pl"
+
+// I18N_CATALOG maps locale -> message key -> text, one locales/{locale}.json each.
+var I18N_CATALOG = I18nCatalogLoad(FS_LOCALES)
+
+func I18nCatalogLoad(fsys fs.FS) map[string]map[string]string {
+	paths, err := fs.Glob(fsys, "locales/*.json")
+	if err != nil {
+		panic(err)
+	}
+
+	catalog := make(map[string]map[string]string)
+	for _, path := range paths {
+		file, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			panic(err)
+		}
+		messages := make(map[string]string)
+		if err := json.Unmarshal(file, &messages); err != nil {
+			panic(fmt.Errorf("%s: %w", path, err))
+		}
+		catalog[strings.TrimSuffix(filepath.Base(path), ".json")] = messages
+	}
+
+	if _, ok := catalog[LOCALE_DEFAULT]; !ok {
+		panic("missing catalog for default locale " + LOCALE_DEFAULT)
+	}
+	return catalog
+}
+
+// I18nTranslate falls back to the default locale and then to the key itself, so a
+// missing translation shows up on the page instead of breaking the render.
+func I18nTranslate(locale, key string) string {
+	if message, ok := I18N_CATALOG[locale][key]; ok {
+		return message
+	}
+	if message, ok := I18N_CATALOG[LOCALE_DEFAULT][key]; ok {
+		return message
+	}
+	return key
+}
+
+// LocaleFromAcceptLanguage picks the supported locale with the highest q value,
+// matching on the primary subtag only ("en-GB" -> "en").
+func LocaleFromAcceptLanguage(header string) string {
+	locale, best := LOCALE_DEFAULT, 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+
+		if _, ok := I18N_CATALOG[tag]; ok && q > best {
+			locale, best = tag, q
+		}
+	}
+	return locale
+}
+
+// LocaleFormat is how a locale writes numbers and dates for people. Stored
+// answers, formulas and JSON keep the canonical form with a dot; only rendered
+// cells, dates on pages and CSV exports go through this.
+type LocaleFormat struct {
+	Decimal  string
+	Date     string
+	DateTime string
+	// CSVComma separates CSV fields, so it must differ from Decimal.
+	CSVComma rune
+}
+
+// LOCALE_FORMATS needs an entry for every catalog locale, LocaleFormatGet falls
+// back to the default one.
+var LOCALE_FORMATS = map[string]LocaleFormat{
+	"pl": {Decimal: ",", Date: "02.01.2006", DateTime: "02.01.2006 15:04", CSVComma: ';'},
+	"en": {Decimal: ".", Date: "2006-01-02", DateTime: "2006-01-02 15:04", CSVComma: ','},
+}
+
+func LocaleFormatGet(locale string) LocaleFormat {
+	if format, ok := LOCALE_FORMATS[locale]; ok {
+		return format
+	}
+	return LOCALE_FORMATS[LOCALE_DEFAULT]
+}
+
+// Number rewrites a number written with a dot, as formatValue and json.Number
+// do, with the locale's decimal separator.
+func (f LocaleFormat) Number(number string) string {
+	return strings.Replace(number, ".", f.Decimal, 1)
+}
+
+// Value is formatValue for display.
+func (f LocaleFormat) Value(v any) string {
+	if _, ok := v.(float64); ok {
+		return f.Number(formatValue(v))
+	}
+	return formatValue(v)
+}
+
+// FormatDate shows a date SQLite stored, by date() or CURRENT_TIMESTAMP, in the
+// locale's layout. Anything else is returned as stored.
+func (f LocaleFormat) FormatDate(value string) string {
+	if t, err := time.Parse(DATA_MODYFIKACJI_LAYOUT, value); err == nil {
+		return t.Format(f.DateTime)
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t.Format(f.Date)
+	}
+	return value
+}
+
+// tmplFuncsLocale holds the functions whose output depends on the locale. They are
+// bound at parse time, so TmplCompse parses every template once per locale.
+func tmplFuncsLocale(locale string) html.FuncMap {
+	return html.FuncMap{
+		"T":    func(key string) string { return I18nTranslate(locale, key) },
+		"Date": LocaleFormatGet(locale).FormatDate,
+		"UserTypeName": func(ut UserType) string {
+			switch ut {
+			case UserAdmin:
+				return I18nTranslate(locale, "role.admin")
+			case UserMethodolgist:
+				return I18nTranslate(locale, "role.methodologist")
+			case UserManager:
+				return I18nTranslate(locale, "role.manager")
+			case UserNormal:
+				return I18nTranslate(locale, "role.normal")
+			default:
+				return I18nTranslate(locale, "role.unknown")
+			}
+		},
+	}
+}
+
+// TMPL_LOCALIZED maps the default-locale template returned by TmplCompse to its
+// variants for every locale. Written by TmplsLoad, read only after it.
+var TMPL_LOCALIZED = map[*html.Template]map[string]*html.Template{}
+
+// TmplCompse parses the named frontend files once per locale. The error names
+// the set and the locale; html/template adds the file and line.
+func TmplCompse(template_names ...string) (*html.Template, error) {
 	paths := []string{}
 	for _, name := range template_names {
 		paths = append(paths, "frontend/"+name+".html")
 	}
 
-	t := html.New("base").Funcs(tmpl_funcs)
-	return html.Must(t.ParseFS(FS_FRONTEND, paths...))
+	localized := make(map[string]*html.Template)
+	for locale := range I18N_CATALOG {
+		t, err := html.New("base").Funcs(tmpl_funcs).Funcs(tmplFuncsLocale(locale)).ParseFS(FS_FRONTEND, paths...)
+		if err != nil {
+			return nil, fmt.Errorf("template set %s (locale %s): %w", strings.Join(template_names, ", "), locale, err)
+		}
+		localized[locale] = t
+	}
+
+	t := localized[LOCALE_DEFAULT]
+	TMPL_LOCALIZED[t] = localized
+	return t, nil
+}
+
+func TmplLocalize(t *html.Template, locale string) *html.Template {
+	if localized, ok := TMPL_LOCALIZED[t][locale]; ok {
+		return localized
+	}
+	return t
 }
 
+// The page templates, nil until TmplsLoad has run.
 var (
-	TMPL_LOGIN       = TmplCompse("user_login")
-	TMPL_APP         = TmplCompse("base", "main_choose_year", "nav_top")
-	TMPL_APP_YEAR    = TmplCompse("base_year", "nav_top", "nav_left", "main_choose_module")
-	TMPL_MOCK        = TmplCompse("base", "mock", "nav_top")
-	TMPL_LIST_GR     = TmplCompse("base_year", "nav_top", "nav_left", "main_statusy")
-	TMPL_GRID        = TmplCompse("base_year", "nav_top", "nav_left", "main_grid", "tables", "table_inputs")
-	TMPL_DYNAMIC_ROW = TmplCompse("table_dynamic_row", "table_inputs")
+	TMPL_LOGIN       *html.Template
+	TMPL_APP         *html.Template
+	TMPL_APP_YEAR    *html.Template
+	TMPL_MOCK        *html.Template
+	TMPL_PROFILE     *html.Template
+	TMPL_LIST_GR     *html.Template
+	TMPL_GRID        *html.Template
+	TMPL_DYNAMIC_ROW *html.Template
 )
 
+// TMPL_SETS lists the files each page template is parsed from.
+var TMPL_SETS = []struct {
+	Tmpl  **html.Template
+	Names []string
+}{
+	{&TMPL_LOGIN, []string{"user_login"}},
+	{&TMPL_APP, []string{"base", "main_choose_year", "nav_top"}},
+	{&TMPL_APP_YEAR, []string{"base_year", "nav_top", "nav_left", "main_choose_module"}},
+	{&TMPL_MOCK, []string{"base", "mock", "nav_top"}},
+	{&TMPL_PROFILE, []string{"base", "main_profile", "nav_top"}},
+	{&TMPL_LIST_GR, []string{"base_year", "nav_top", "nav_left", "main_statusy"}},
+	{&TMPL_GRID, []string{"base_year", "nav_top", "nav_left", "main_grid", "tables", "table_inputs"}},
+	{&TMPL_DYNAMIC_ROW, []string{"table_dynamic_row", "table_inputs"}},
+}
+
+// TmplsLoad parses every TMPL_SETS entry. It runs from setupApplication rather
+// than package init, so a broken template is a startup error naming the file
+// instead of a panic before the logger exists. All sets are tried and their
+// errors joined, one fix-and-restart shows every broken file.
+func TmplsLoad() error {
+	TMPL_LOCALIZED = map[*html.Template]map[string]*html.Template{}
+	var errs []error
+	for _, set := range TMPL_SETS {
+		t, err := TmplCompse(set.Names...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		*set.Tmpl = t
+	}
+	return errors.Join(errs...)
+}
+
 type UserType uint8
 
 func (u UserType) HasAccess(allowedTypes UserType) bool {
@@ -267,21 +1211,324 @@ const (
 	AccessAllUsers           UserType = UserAdmin | UserMethodolgist | UserManager | UserNormal
 )
 
+// User scope by role:
+//   - Adm sees every farm.
+//   - ZBR (manager) sees farms of their accounting office, gospodarstwa.idbr = IdBR.
+//   - PBR (normal) sees farms assigned to them, gospodarstwa.idpbr = IdPBR. These are
+//     loaded into IdGR per year at login, so reassignments apply on next login.
+//   - Met works on definitions and has no farm access.
 type User struct {
 	Login              string `db:"login"`
 	Rola               string `db:"rola"`
 	IdBR               string `db:"idbr"`
 	IdPBR              string `db:"idpbr"`
-	IdGR               string
-	LastLogin          string
+	IdGR               map[YearDB][]string
+	LastLogin          string `db:"ostatnie_logowanie"`
 	LastPasswordChange string
 	Role               UserType
 }
 
+// USER_ROLES maps uzytkownicy.rola to the UserType used for access checks.
+var USER_ROLES = map[string]UserType{
+	"Adm": UserAdmin,
+	"Met": UserMethodolgist,
+	"ZBR": UserManager,
+	"PBR": UserNormal,
+}
+
+// UserProfile is what a user may see about themselves; credentials stay out of it.
+type UserProfile struct {
+	Login    string `db:"login"`
+	Imie     string `db:"imie"`
+	Nazwisko string `db:"nazwisko"`
+	Email    string `db:"email"`
+}
+
+func (u User) HasIdGR(year YearDB, idGR string) bool {
+	return slices.Contains(u.IdGR[year], idGR)
+}
+
+// UserCredentials is the login-time view of uzytkownicy. Password is either a
+// PasswordHash string or, for accounts created before hashing, the plain text.
+type UserCredentials struct {
+	Login       string `db:"login"`
+	Password    string `db:"password"`
+	Salt        string `db:"salt"`
+	Aktywny     int64  `db:"aktywny"`
+	Zablokowany int64  `db:"zablokowany"`
+}
+
+// Hashes are stored as "pbkdf2-sha256${iterations}${hex key}" with the random salt
+// in uzytkownicy.salt, so the cost can be raised later without breaking old hashes.
+const (
+	PASSWORD_HASH_PREFIX     = "pbkdf2-sha256$"
+	PASSWORD_HASH_ITERATIONS = 600_000
+	PASSWORD_MIN_LENGTH      = 8
+)
+
+func PasswordHash(password, salt string, iterations int) (string, error) {
+	key, err := pbkdf2.Key(sha256.New, password, []byte(salt), iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d$%s", PASSWORD_HASH_PREFIX, iterations, hex.EncodeToString(key)), nil
+}
+
+func PasswordSaltNew() (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// PasswordVerify accepts hashed passwords and, until every account has been reset,
+// the legacy plain-text ones.
+func PasswordVerify(stored, salt, password string) bool {
+	rest, hashed := strings.CutPrefix(stored, PASSWORD_HASH_PREFIX)
+	if !hashed {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+
+	iterationsText, _, ok := strings.Cut(rest, "$")
+	iterations, err := strconv.Atoi(iterationsText)
+	if !ok || err != nil || iterations <= 0 {
+		return false
+	}
+
+	computed, err := PasswordHash(password, salt, iterations)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(computed)) == 1
+}
+
+// LoginFold is the form two logins are compared in: NFC first, so a decomposed
+// "ó" typed on some keyboards equals the precomposed one, then Polish lower case.
+// A Caser keeps state, hence a new one per call.
+func LoginFold(login string) string {
+	return cases.Lower(language.Polish).String(norm.NFC.String(login))
+}
+
+// LoginEqual compares two logins after LoginFold in constant time, like the
+// password check next to it.
+func LoginEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(LoginFold(a)), []byte(LoginFold(b))) == 1
+}
+
+// PASSWORD_DIRECTORY is stored for users created from the directory. Zero
+// iterations never verify, so if the directory is switched off they need a
+// password set by an admin rather than logging in with any.
+const PASSWORD_DIRECTORY = PASSWORD_HASH_PREFIX + "0$directory"
+
+// DirectoryUser is what the directory says about a user it authenticated. Rola
+// is already a uzytkownicy.rola.
+type DirectoryUser struct {
+	Login    string
+	Imie     string
+	Nazwisko string
+	Email    string
+	IdBR     string
+	Rola     string
+}
+
+// DirectoryAuth checks a login and password against an external directory.
+type DirectoryAuth interface {
+	Authenticate(login, password string) (DirectoryUser, error)
+}
+
+// ErrDirectoryCredentials is the directory refusing the login: a wrong
+// password, or a user in none of the mapped groups.
+var ErrDirectoryCredentials = errors.New("directory refused the credentials")
+
+// LDAPDirectory binds as the user, which is the password check, then reads the
+// user's own entry for groups and names. No service account is needed.
+type LDAPDirectory struct {
+	URL string
+	// BindDN is the user's DN with %s for the login, e.g. uid=%s,ou=people,dc=example,dc=pl.
+	BindDN string
+	// Groups maps the cn of a memberOf group to a uzytkownicy.rola.
+	Groups map[string]string
+	// IdBRAttr names the attribute holding the accounting office, read for
+	// users created at their first login.
+	IdBRAttr string
+	Timeout  time.Duration
+}
+
+// LDAP_ROLE_ORDER settles users in several mapped groups: the widest role wins.
+var LDAP_ROLE_ORDER = []string{"Adm", "Met", "ZBR", "PBR"}
+
+func (d *LDAPDirectory) Authenticate(login, password string) (DirectoryUser, error) {
+	// A bind with an empty password is an unauthenticated bind, which succeeds.
+	if password == "" {
+		return DirectoryUser{}, ErrDirectoryCredentials
+	}
+
+	conn, err := ldap.DialURL(d.URL, ldap.DialWithDialer(&net.Dialer{Timeout: d.Timeout}))
+	if err != nil {
+		return DirectoryUser{}, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(d.Timeout)
+
+	dn := fmt.Sprintf(d.BindDN, ldap.EscapeDN(login))
+	if err := conn.Bind(dn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return DirectoryUser{}, ErrDirectoryCredentials
+		}
+		return DirectoryUser{}, err
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)", []string{"memberOf", "givenName", "sn", "mail", d.IdBRAttr}, nil))
+	if err != nil {
+		return DirectoryUser{}, err
+	}
+	if len(result.Entries) != 1 {
+		return DirectoryUser{}, ErrDirectoryCredentials
+	}
+	entry := result.Entries[0]
+
+	user := DirectoryUser{
+		Login:    login,
+		Imie:     entry.GetAttributeValue("givenName"),
+		Nazwisko: entry.GetAttributeValue("sn"),
+		Email:    entry.GetAttributeValue("mail"),
+		IdBR:     entry.GetAttributeValue(d.IdBRAttr),
+		Rola:     LDAPRoleMap(entry.GetAttributeValues("memberOf"), d.Groups),
+	}
+	if user.Rola == "" {
+		return DirectoryUser{}, ErrDirectoryCredentials
+	}
+	return user, nil
+}
+
+// LDAPRoleMap picks the widest role of the groups, matched by their cn.
+func LDAPRoleMap(memberOf []string, groups map[string]string) string {
+	roles := make(map[string]bool)
+	for _, group := range memberOf {
+		dn, err := ldap.ParseDN(group)
+		if err != nil || len(dn.RDNs) == 0 {
+			continue
+		}
+		for _, attr := range dn.RDNs[0].Attributes {
+			if rola, ok := groups[attr.Value]; ok && strings.EqualFold(attr.Type, "cn") {
+				roles[rola] = true
+			}
+		}
+	}
+	for _, rola := range LDAP_ROLE_ORDER {
+		if roles[rola] {
+			return rola
+		}
+	}
+	return ""
+}
+
+// LDAPGroupsParse reads -ldap-groups, comma separated cn=rola pairs.
+func LDAPGroupsParse(value string) (map[string]string, error) {
+	groups := make(map[string]string)
+	for _, item := range FlagList(value) {
+		cn, rola, ok := strings.Cut(item, "=")
+		cn, rola = strings.TrimSpace(cn), strings.TrimSpace(rola)
+		if !ok || cn == "" {
+			return nil, fmt.Errorf("ldap group %q: want cn=rola", item)
+		}
+		if _, known := USER_ROLES[rola]; !known {
+			return nil, fmt.Errorf("ldap group %s: unknown role %q", cn, rola)
+		}
+		groups[cn] = rola
+	}
+	return groups, nil
+}
+
+// DirectoryLogin authenticates against app.Directory and brings the local
+// uzytkownicy record in line with it: created at the first login, with the
+// login as idpbr, and afterwards given the directory's role and names. Farm
+// scope and the aktywny/zablokowany flags stay local, set by admins. Returns the
+// login as stored.
+func (app *Application) DirectoryLogin(r *http.Request, login, password string) (string, error) {
+	user, err := app.Directory.Authenticate(login, password)
+	if err != nil {
+		return "", err
+	}
+
+	var stored string
+	err = app.DBManager.MQueryRowx("uzytkownicy_select_login_where_login", user.Login).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		// email is unique and required; the login stands in until the directory has one.
+		email := cmp.Or(user.Email, user.Login)
+		if _, err := app.DBManager.MExec("uzytkownicy_insert", user.Login, user.Login, PASSWORD_DIRECTORY, "", user.Imie, user.Nazwisko, email, user.Rola, user.IdBR); err != nil {
+			return "", err
+		}
+		app.logger(r).Info("user created from directory", slog.String("login", user.Login), slog.String("rola", user.Rola))
+		return user.Login, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := app.DBManager.MExec("uzytkownicy_update_directory_where_login", user.Rola, user.Imie, user.Nazwisko, user.Email, stored); err != nil {
+		return "", err
+	}
+	return stored, nil
+}
+
 type LoginForm struct {
 	Login           string `form:"login" db:"login"`
 	Password        string `form:"password" db:"password"`
 	ValidationError bool   `form:"-"`
+
+	// Message is the locale key shown above the submit button, picked from
+	// LOGIN_MESSAGES by the code in the redirect query.
+	Message string `form:"-"`
+}
+
+// Message codes passed back to the login page in ?login_error= or ?login_info=.
+const (
+	LOGIN_ERROR_CREDENTIALS = "1"
+	LOGIN_ERROR_LOCKED      = "zablokowane"
+	LOGIN_ERROR_INACTIVE    = "nieaktywne"
+	LOGIN_INFO_LOGGED_OUT   = "wylogowano"
+)
+
+// LOGIN_MESSAGES maps a message code to its locale key. Locked and inactive
+// accounts only get their code once the password has matched, so the codes
+// never tell a stranger which logins exist.
+var LOGIN_MESSAGES = map[string]string{
+	LOGIN_ERROR_CREDENTIALS: "login.invalid",
+	LOGIN_ERROR_LOCKED:      "login.locked",
+	LOGIN_ERROR_INACTIVE:    "login.inactive",
+	LOGIN_INFO_LOGGED_OUT:   "login.logged_out",
+}
+
+// LoginFormMessage builds the form for a login page request. Unknown error codes
+// fall back to the generic credentials message, unknown info codes are ignored.
+func LoginFormMessage(query url.Values) LoginForm {
+	if code := query.Get("login_error"); code != "" {
+		key, ok := LOGIN_MESSAGES[code]
+		if !ok || code == LOGIN_INFO_LOGGED_OUT {
+			key = LOGIN_MESSAGES[LOGIN_ERROR_CREDENTIALS]
+		}
+		return LoginForm{ValidationError: true, Message: key}
+	}
+	if code := query.Get("login_info"); code == LOGIN_INFO_LOGGED_OUT {
+		return LoginForm{Message: LOGIN_MESSAGES[code]}
+	}
+	return LoginForm{}
+}
+
+// NullCount is a b_statusy number as templates show it: String gives "" for
+// NULL and the number otherwise, so 0 stays distinguishable from unset.
+type NullCount struct {
+	sql.NullInt64
+}
+
+func (n NullCount) String() string {
+	if !n.Valid {
+		return ""
+	}
+	return strconv.FormatInt(n.Int64, 10)
 }
 
 type Statusy struct {
@@ -289,19 +1536,19 @@ type Statusy struct {
 	IDBR                string `db:"idbr"`
 	IDPBR               string `db:"idpbr"`
 	Etap                string `db:"etap"`
-	O                   sql.NullInt64  `db:"o"`
-	OW                  sql.NullInt64  `db:"ow"`
-	OO                  sql.NullInt64  `db:"oo"`
-	B                   sql.NullInt64  `db:"b"`
-	BW                  sql.NullInt64  `db:"bw"`
-	BNW                 sql.NullInt64  `db:"bnw"`
-	BO                  sql.NullInt64  `db:"bo"`
-	K                   sql.NullInt64  `db:"k"`
-	Z                   sql.NullInt64  `db:"z"`
+	O                   NullCount      `db:"o"`
+	OW                  NullCount      `db:"ow"`
+	OO                  NullCount      `db:"oo"`
+	B                   NullCount      `db:"b"`
+	BW                  NullCount      `db:"bw"`
+	BNW                 NullCount      `db:"bnw"`
+	BO                  NullCount      `db:"bo"`
+	K                   NullCount      `db:"k"`
+	Z                   NullCount      `db:"z"`
 	KomentarzZBR        sql.NullString `db:"komentarz_zbr"`
 	KomentarzInst       sql.NullString `db:"komentarz_inst"`
 	DataPrzepisaniaNaSP string `db:"data_przepisania_na_sp"`
-	RokAuweitr          sql.NullInt64  `db:"rok_auweitr"`
+	RokAuweitr          NullCount      `db:"rok_auweitr"`
 	DataTestowania      sql.NullString `db:"data_testowania"`
 	DataPrzekazaniaZBR  sql.NullString `db:"data_przekazania_zbr"`
 	DataZwrotuPBR       sql.NullString `db:"data_zwrotu_pbr"`
@@ -312,6 +1559,62 @@ type Statusy struct {
 	DataAkceptacji      sql.NullString `db:"data_akceptacji"`
 	DataZamkniecia      sql.NullString `db:"data_zamkniecia"`
 	DataPrzepisaniaZSK  sql.NullString `db:"data_przepisania_z_sk"`
+	// Zarchiwizowane comes from the master gospodarstwa, not from b_statusy.
+	Zarchiwizowane bool `db:"-"`
+}
+
+// StatusEvent is one dated step of a farm's way through the survey. Etap is the
+// b_statusy date column without its data_ prefix.
+type StatusEvent struct {
+	Etap string    `json:"etap"`
+	Data time.Time `json:"data"`
+}
+
+// StatusDateParse reads the dates b_statusy holds: CURRENT_TIMESTAMP from the
+// transitions, and plain dates or RFC 3339 from imports.
+func StatusDateParse(value string) (time.Time, bool) {
+	for _, layout := range []string{DATA_MODYFIKACJI_LAYOUT, time.DateOnly, time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Timeline returns the set dates oldest first. A column that is NULL, empty or
+// not a date has nothing to place on the line and is left out; steps on the
+// same date keep the order of the columns.
+func (s Statusy) Timeline() []StatusEvent {
+	columns := []struct {
+		etap  string
+		value sql.NullString
+	}{
+		{"przepisania_na_sp", sql.NullString{String: s.DataPrzepisaniaNaSP, Valid: true}},
+		{"testowania", s.DataTestowania},
+		{"przekazania_zbr", s.DataPrzekazaniaZBR},
+		{"zwrotu_pbr", s.DataZwrotuPBR},
+		{"przekazania_inst", s.DataPrzekazaniaInst},
+		{"zwrotu_zbr", s.DataZwrotuZBR},
+		{"eksportu", s.DataEksportu},
+		{"importu", s.DataImportu},
+		{"akceptacji", s.DataAkceptacji},
+		{"zamkniecia", s.DataZamkniecia},
+		{"przepisania_z_sk", s.DataPrzepisaniaZSK},
+	}
+
+	events := []StatusEvent{}
+	for _, column := range columns {
+		if !column.value.Valid {
+			continue
+		}
+		if t, ok := StatusDateParse(column.value.String); ok {
+			events = append(events, StatusEvent{Etap: column.etap, Data: t})
+		}
+	}
+	slices.SortStableFunc(events, func(a, b StatusEvent) int {
+		return a.Data.Compare(b.Data)
+	})
+	return events
 }
 
 type BTabele struct {
@@ -350,6 +1653,9 @@ type BKolumny struct {
 	Width           int64          `db:"szerokosc"`
 	Formula         sql.NullString `db:"formula"`
 	Regex           sql.NullString `db:"walidacja"`
+	RequiredWhen    sql.NullString `db:"wymagana_gdy"`
+	KeepWhitespace  int64          `db:"zachowaj_biale_znaki"`
+	EditRoles       sql.NullString `db:"role_edycji"`
 	Min             sql.NullInt64  `db:"min"`
 	Max             sql.NullInt64  `db:"max"`
 	Lp              int64          `db:"lp"`
@@ -386,7 +1692,34 @@ type BDGROBMSP struct {
 	DataModyfikacji string `db:"data_modyfikacji"`
 }
 
-// ============================================================================
+type BZalaczniki struct {
+	Id          int64  `db:"id" json:"id"`
+	IDGR        string `db:"idgr" json:"idgr"`
+	Podtabela   string `db:"podtabela" json:"podtabela"`
+	NazwaPliku  string `db:"nazwa_pliku" json:"nazwa_pliku"`
+	Rozmiar     int64  `db:"rozmiar" json:"rozmiar"`
+	Typ         string `db:"typ" json:"typ"`
+	Zawartosc   []byte `db:"zawartosc" json:"-"`
+	Login       string `db:"login" json:"login"`
+	DataDodania string `db:"data_dodania" json:"data_dodania"`
+}
+
+type BEdycje struct {
+	IDGR            string `db:"idgr" json:"idgr"`
+	Podtabela       string `db:"podtabela" json:"podtabela"`
+	Login           string `db:"login" json:"login"`
+	DataOdswiezenia string `db:"data_odswiezenia" json:"data_odswiezenia"`
+}
+
+type BNieDotyczy struct {
+	IDGR           string `db:"idgr" json:"idgr"`
+	Podtabela      string `db:"podtabela" json:"podtabela"`
+	Powod          string `db:"powod" json:"powod"`
+	Login          string `db:"login" json:"login"`
+	DataOznaczenia string `db:"data_oznaczenia" json:"data_oznaczenia"`
+}
+
+// ============================================================================
 // Administracja Tables
 // ============================================================================
 
@@ -418,8 +1751,45 @@ type Gospodarstwa struct {
 }
 
 type TmplYears struct {
-	Year   string
-	Locked bool
+	Year   string `json:"year"`
+	Locked bool   `json:"locked"`
+}
+
+// TmplModule is one entry of the module chooser, Group is the nav_left section.
+type TmplModule struct {
+	Group string `json:"group"`
+	Code  string `json:"code"`
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+}
+
+// YEAR_MODULES are the modules of a year in menu order, each shown to the roles
+// in Access.
+var YEAR_MODULES = []struct {
+	Group  string
+	Code   string
+	Name   string
+	Access UserType
+}{
+	{TmplModuleBDGR, "lista-ankiet", "Lista ankiet", AccessAllUsers},
+	{TmplModuleBDGR, "metodyka", "Metodyka", AccessAdminMethodologist},
+}
+
+// YearModules lists the YEAR_MODULES user may open in year.
+func YearModules(year string, user User) []TmplModule {
+	modules := []TmplModule{}
+	for _, module := range YEAR_MODULES {
+		if !user.Role.HasAccess(module.Access) {
+			continue
+		}
+		modules = append(modules, TmplModule{
+			Group: module.Group,
+			Code:  module.Code,
+			Name:  module.Name,
+			URL:   AppURL("app", year, "bdgr", module.Code, ""),
+		})
+	}
+	return modules
 }
 
 type TableName string
@@ -434,7 +1804,8 @@ type TmplTabItem struct {
 	URLSegment string
 	Tooltip    string
 	Lp         uint8
-	Selected   bool	
+	Selected   bool
+	Completed  bool
 }
 
 type TmplBaseData struct {
@@ -447,7 +1818,18 @@ type TmplBaseData struct {
 	TabRows     []TmplTabsRow
 	Table       TableSchema
 	Statusy     []Statusy
+	Status      *Statusy
+	Profile     *UserProfile
 	BaseUrl     string
+	FormError   string
+	// EditLock is set when someone else is editing the subtable.
+	EditLock        *BEdycje
+	EditLockRefresh int
+
+	// Modules is the chooser of a year, set whenever the path has one.
+	Modules []TmplModule
+	// NotApplicable is set when the subtable is marked as not applicable to the farm.
+	NotApplicable *BNieDotyczy
 }
 
 const (
@@ -482,6 +1864,8 @@ type TableCell struct {
 	Required int64
 	Editable int64
 	Blocked  bool
+	// Lookup is the autocomplete endpoint of PKD and SIMC code cells.
+	Lookup string
 }
 
 type TableRow struct {
@@ -505,22 +1889,75 @@ type TableColumn struct {
 	Width         int64
 	Formula       string
 	Regex         string
+	RequiredWhen  string // Overrides Required when set, see EvalCondition
 	Min           *int64
 	Max           *int64
 	Lp            int64
 	IsPK          bool
+
+	// KeepWhitespace skips TextNormalize for answers where spacing is data.
+	KeepWhitespace bool
+
+	// EditRoles are the roles that may fill the column in, from b_kolumny.role_edycji;
+	// 0 leaves it to everyone who can edit the survey. See RoleEditable.
+	EditRoles UserType
+}
+
+// RoleEditable reports whether role may fill the column in. Admins always may,
+// as they may on a locked year.
+func (c *TableColumn) RoleEditable(role UserType) bool {
+	return c.EditRoles == 0 || role&UserAdmin != 0 || role.HasAccess(c.EditRoles)
+}
+
+// ColumnsRoleRestricted names the columns role may not fill in.
+func ColumnsRoleRestricted(columns []TableColumn, role UserType) []string {
+	var restricted []string
+	for i := range columns {
+		if !columns[i].RoleEditable(role) {
+			restricted = append(restricted, columns[i].Name)
+		}
+	}
+	return restricted
+}
+
+// RolesMaskParse reads b_kolumny.role_edycji, comma separated uzytkownicy.rola
+// values. Names it doesn't know are skipped; if none is left the column is for
+// admins only, rather than open to everyone by a typo.
+func RolesMaskParse(value string) UserType {
+	if strings.TrimSpace(value) == "" {
+		return 0
+	}
+	var mask UserType
+	for _, name := range FlagList(value) {
+		mask |= USER_ROLES[name]
+	}
+	if mask == 0 {
+		return UserAdmin
+	}
+	return mask
 }
 
 const (
 	HORIZONTAL_DYNAMIC_DUPLICABLE = "HORIZONTAL_DYNAMIC_DUPLICABLE"
 	HORIZONTAL_DYNAMIC_UNIQUE     = "HORIZONTAL_DYNAMIC_UNIQUE"
 	HORIZONTAL_STATIC_UNIQUE      = "HORIZONTAL_STATIC_UNIQUE"
-	PKD_STATIC_UNIQUE             = "PKD_STATIC_UNIQUE"
-	SIMC_STATIC_UNIQUE            = "SIMC_STATIC_UNIQUE"
 	VERTICAL_STATIC_UNIQUE        = "VERTICAL_STATIC_UNIQUE"
 	SYSTEM_DEFINITON              = "SYSTEM_DEFINITION"
+	// PKD_STATIC_UNIQUE and SIMC_STATIC_UNIQUE are HORIZONTAL_STATIC_UNIQUE tables
+	// whose ColumnFirstValue holds a PKD activity or a SIMC locality code, typed with
+	// autocomplete from pkd_pkd or teryt_simc.
+	PKD_STATIC_UNIQUE  = "PKD_STATIC_UNIQUE"
+	SIMC_STATIC_UNIQUE = "SIMC_STATIC_UNIQUE"
+	// MATRIX_DYNAMIC_UNIQUE crosses codes with codes: the user adds both rows and
+	// columns from the subtable's code list, and every cell holds one value typed by
+	// ColumnFirstValue. HORIZONTAL_DYNAMIC rows are codes too, but its columns are
+	// the fixed b_kolumny definitions. The blob is {"row code": {"column code": value}}.
+	MATRIX_DYNAMIC_UNIQUE = "MATRIX_DYNAMIC_UNIQUE"
 )
 
+// TableSchema is what the grid templates render. Rows always holds rows of the
+// farm's answers with populated Cells, dynamic tables included, never the list
+// of codes to pick from; that is Codes.
 type TableSchema struct {
 	Columns   []TableColumn
 	Rows      []TableRow
@@ -530,7 +1967,50 @@ type TableSchema struct {
 	Table     string
 	Subtable  string
 	IdGR      string
-	Data      string
+	Notes     string
+
+	// Codes are the codes rows can be added with, for the row selector of
+	// dynamic tables and both axes of matrix tables. Matrix tables also get
+	// the column codes in use and an empty cell the frontend copies into
+	// added rows and columns.
+	Codes         []TableRow
+	MatrixColumns []TableRow
+	MatrixCell    *TableCell
+
+	// Width is the rendered width of Columns in px, Wide is set past
+	// -wide-table-width. Compact is the ?compact Lp limit Columns were cut to,
+	// CompactSuggested the one the wide table notice links to.
+	Width            int64
+	Wide             bool
+	Compact          int64
+	CompactSuggested int64
+}
+
+// MSG_REQUIRED is also matched by IntegrityCheck to pick out missing required fields.
+const MSG_REQUIRED = "Pole wymagane"
+
+type ValidationError struct {
+	Code    string `json:"code,omitempty"`
+	Index   int    `json:"index"`
+	Column  string `json:"column"`
+	Message string `json:"message"`
+}
+
+// ValidationErrorsOptional drops the MSG_REQUIRED errors, for subtables marked
+// as not applicable where nothing has to be filled in.
+func ValidationErrorsOptional(errs []ValidationError) []ValidationError {
+	return slices.DeleteFunc(errs, func(e ValidationError) bool {
+		return e.Message == MSG_REQUIRED
+	})
+}
+
+type SubtableProgress struct {
+	Table    string `json:"table"`
+	Subtable string `json:"subtable"`
+	HasData  bool   `json:"has_data"`
+	Complete bool   `json:"complete"`
+
+	NotApplicable bool `json:"not_applicable"`
 }
 
 type Constructor func(http.Handler) http.Handler
@@ -621,15 +2101,345 @@ type Application struct {
 	FormDecoder *form.Decoder
 	Session     *scs.SessionManager
 	Debug       bool
+	// StackStdout also prints ServerError stack traces to stdout, readable
+	// where the structured log isn't. The log has the trace either way.
+	StackStdout bool
+	CORS        CORSConfig
+	Idempotency *IdempotencyStore
+	HSTSMaxAge  time.Duration
+	// MaxRows caps the number of rows per subtable. Subtables not listed are unlimited.
+	MaxRows map[string]int
+	// BackupDir receives YearBackup copies. Keep it outside the -db directory,
+	// Connect would try to open the copies as years.
+	BackupDir string
+	// LongWriteTimeout replaces the server WriteTimeout on MiddleLongWrite routes.
+	LongWriteTimeout time.Duration
+	// LogRequestBodies allows the debug log of survey payloads, off by default.
+	LogRequestBodies bool
+	// EditLockTimeout is how long an idle editor keeps a subtable; 0 disables the locks.
+	EditLockTimeout time.Duration
+	// StaticDir overrides embedded frontend files that exist in it.
+	StaticDir string
+	Events    *EventHub
+	// SessionWarning is how long before expiry the frontend starts offering to extend.
+	SessionWarning time.Duration
+	// BodyCharset is assumed for survey saves whose Content-Type names no charset.
+	BodyCharset string
+	// AllowedHosts are the Host headers served, see MiddleAllowedHosts. nil
+	// skips the check.
+	AllowedHosts []string
+	// WideTableWidth is the rendered width in px past which a table is logged
+	// and offered in compact form, 0 disables. CompactColumns is the Lp limit
+	// of that offer.
+	WideTableWidth int64
+	CompactColumns int64
+	// InFlight holds a slot for every request MiddleInFlight let through; its
+	// capacity is -max-in-flight. nil disables the cap.
+	InFlight chan struct{}
+	// Directory checks logins instead of the stored passwords when set, see
+	// DirectoryLogin. nil keeps local authentication.
+	Directory DirectoryAuth
+	// Features switches the optional parts of the app off by name, see
+	// FeaturesParse. A feature missing from the map is on.
+	Features map[string]bool
+}
+
+// CORSConfig only applies to the /api/ group. HTML routes never get CORS
+// headers, so a misconfigured origin list can't expose the session-backed app.
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+}
+
+// MaxRowsParse reads -max-rows, a comma separated list of podtabela=limit pairs.
+func MaxRowsParse(value string) (map[string]int, error) {
+	maxRows := make(map[string]int)
+	for _, item := range FlagList(value) {
+		subtable, limitString, ok := strings.Cut(item, "=")
+		limit, err := strconv.Atoi(strings.TrimSpace(limitString))
+		if !ok || err != nil || limit < 1 {
+			return nil, fmt.Errorf("max rows %q: expected podtabela=limit with limit >= 1", item)
+		}
+		maxRows[strings.TrimSpace(subtable)] = limit
+	}
+	return maxRows, nil
+}
+
+// Features an operator can switch off with -features. Each gates its routes in
+// Routes through FeatureGate.
+const (
+	FEATURE_API     = "api"
+	FEATURE_EXPORTS = "exports"
+	FEATURE_LDAP    = "ldap"
+)
+
+var FEATURES = []string{FEATURE_API, FEATURE_EXPORTS, FEATURE_LDAP}
+
+// FeaturesParse reads -features, a comma separated list of feature=bool pairs.
+// Features not listed stay on, so a deployment only names what it turns off.
+func FeaturesParse(value string) (map[string]bool, error) {
+	features := make(map[string]bool, len(FEATURES))
+	for _, name := range FEATURES {
+		features[name] = true
+	}
+	for _, item := range FlagList(value) {
+		name, enabledString, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		enabled, err := strconv.ParseBool(strings.TrimSpace(enabledString))
+		if !ok || err != nil {
+			return nil, fmt.Errorf("feature %q: expected name=true or name=false", item)
+		}
+		if !slices.Contains(FEATURES, name) {
+			return nil, fmt.Errorf("feature %q: unknown, expected one of %s", name, strings.Join(FEATURES, ", "))
+		}
+		features[name] = enabled
+	}
+	return features, nil
+}
+
+func (app *Application) FeatureEnabled(name string) bool {
+	enabled, ok := app.Features[name]
+	return !ok || enabled
+}
+
+// FeatureGate is decided once, when Routes registers h: a disabled feature's
+// route answers 404 instead of falling through to a broader pattern such as
+// the /app/{year}/ subtree.
+func (app *Application) FeatureGate(name string, h http.Handler) http.Handler {
+	if app.FeatureEnabled(name) {
+		return h
+	}
+	return http.NotFoundHandler()
+}
+
+// MaxRowsExceeded reports whether count rows break the subtable's limit.
+func (app *Application) MaxRowsExceeded(subtable string, count int) (int, bool) {
+	limit, ok := app.MaxRows[subtable]
+	return limit, ok && count > limit
+}
+
+// IdempotencyStore remembers responses to recently seen Idempotency-Key headers, so an
+// autosave retried over a flaky network replays the first result instead of writing twice.
+// In memory only: a restart forgets the keys, which is fine for a window of minutes.
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*IdempotencyEntry
+}
+
+// IdempotencyEntry is a key's response once Done. BodyHash is the SHA-256 of the
+// request body the key was first used with; Header holds the headers the
+// handler set, replayed along with the body.
+type IdempotencyEntry struct {
+	Done     bool
+	BodyHash string
+	Status   int
+	Header   http.Header
+	Body     []byte
+	Expires  time.Time
+}
+
+func IdempotencyStoreNew(window time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		window:  window,
+		entries: make(map[string]*IdempotencyEntry),
+	}
+}
+
+// Begin returns the stored entry for a key, or nil after reserving the key for the
+// request whose body hashes to bodyHash. The map is small (one key per save in the
+// window), so expired keys are swept here instead of running a background goroutine.
+func (s *IdempotencyStore) Begin(key, bodyHash string) *IdempotencyEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range s.entries {
+		if now.After(entry.Expires) {
+			delete(s.entries, k)
+		}
+	}
+
+	if entry, ok := s.entries[key]; ok {
+		copied := *entry
+		return &copied
+	}
+	s.entries[key] = &IdempotencyEntry{BodyHash: bodyHash, Expires: now.Add(s.window)}
+	return nil
+}
+
+// Finish stores the response. Server errors release the key so a retry runs again.
+func (s *IdempotencyStore) Finish(key, bodyHash string, status int, header http.Header, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status >= http.StatusInternalServerError {
+		delete(s.entries, key)
+		return
+	}
+	s.entries[key] = &IdempotencyEntry{
+		Done:     true,
+		BodyHash: bodyHash,
+		Status:   status,
+		Header:   header,
+		Body:     body,
+		Expires:  time.Now().Add(s.window),
+	}
+}
+
+// ResponseRecorder keeps a copy of what the handler wrote.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	Status int
+	Body   bytes.Buffer
+}
+
+func (rec *ResponseRecorder) WriteHeader(status int) {
+	rec.Status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *ResponseRecorder) Write(b []byte) (int, error) {
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+	rec.Body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// SaveEvent tells the other people on a farm page that a subtable was saved.
+type SaveEvent struct {
+	Podtabela string    `json:"podtabela"`
+	Login     string    `json:"login"`
+	Time      time.Time `json:"time"`
+}
+
+type EventKey struct {
+	Year YearDB
+	IdGR string
+}
+
+// EventHub fans SaveEvents out to the /events streams of a farm. Sends never
+// block: a subscriber that isn't reading loses events rather than stalling a
+// save. A nil hub drops everything, so handlers work without one in tests.
+type EventHub struct {
+	mu   sync.Mutex
+	subs map[EventKey]map[chan SaveEvent]struct{}
+}
+
+// EVENT_BUFFER is how many events a slow stream may fall behind before drops.
+const EVENT_BUFFER = 16
+
+func EventHubNew() *EventHub {
+	return &EventHub{subs: make(map[EventKey]map[chan SaveEvent]struct{})}
+}
+
+// Subscribe returns the event channel and the func that must be called once the
+// stream ends; it closes the channel.
+func (h *EventHub) Subscribe(key EventKey) (<-chan SaveEvent, func()) {
+	ch := make(chan SaveEvent, EVENT_BUFFER)
+
+	h.mu.Lock()
+	if h.subs[key] == nil {
+		h.subs[key] = make(map[chan SaveEvent]struct{})
+	}
+	h.subs[key][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[key], ch)
+		if len(h.subs[key]) == 0 {
+			delete(h.subs, key)
+		}
+		close(ch)
+	}
+}
+
+func (h *EventHub) Publish(key EventKey, event SaveEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[key] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribers counts the open streams for key.
+func (h *EventHub) Subscribers(key EventKey) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs[key])
+}
+
+// FlagList splits a comma separated flag value, dropping empty entries.
+func FlagList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// FlagStrings is a flag that may be repeated, each use adding its comma
+// separated values.
+type FlagStrings []string
+
+func (f *FlagStrings) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *FlagStrings) Set(value string) error {
+	*f = append(*f, FlagList(value)...)
+	return nil
+}
+
+// ALLOWED_HOSTS_DEV is the -allowed-host default, enough for a browser on the
+// same machine. Deployments list their public names.
+var ALLOWED_HOSTS_DEV = []string{"localhost", "127.0.0.1", "::1"}
+
+// HostAllowed matches a Host header, port ignored, against the allowlist; "*"
+// allows any host.
+func HostAllowed(host string, allowed []string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	for _, item := range allowed {
+		if item == "*" || strings.EqualFold(host, item) {
+			return true
+		}
+	}
+	return false
 }
 
+// Sanity bounds for the {year} path segment, checked before any year DB lookup.
+const (
+	YEAR_MIN = 2000
+	YEAR_MAX = 2100
+)
+
 // PathValueYearParse extracts and validates year from request path.
 func (app *Application) PathValueYearParse(r *http.Request) (YearDB, error) {
 	yearString := r.PathValue("year")
 	year, err := strconv.Atoi(yearString)
 	if err != nil {
 		return 0, fmt.Errorf("invalid year parameter: %w", err)
-}
+	}
+	if year < YEAR_MIN || year > YEAR_MAX {
+		return 0, fmt.Errorf("year %d outside %d-%d", year, YEAR_MIN, YEAR_MAX)
+	}
 	return YearDB(year), nil
 }
 
@@ -658,8 +2468,21 @@ func (app *Application) TabRowsTableBuild(yearDB YearDB, selectedTable string) (
 	return items, rows.Err()
 }
 
-// TabRowsSubtableBuild builds tab row with subtables for given table.
-func (app *Application) TabRowsSubtableBuild(yearDB YearDB, table, selectedSubtable string) ([]TmplTabItem, error) {
+// TabRowsSubtableBuild builds tab row with subtables for given table, marking
+// the ones the farm already has stored data for as completed.
+func (app *Application) TabRowsSubtableBuild(yearDB YearDB, idGR, table, selectedSubtable string) ([]TmplTabItem, error) {
+	completed, err := app.PodtabeleWithDataSelect(yearDB, idGR)
+	if err != nil {
+		return nil, err
+	}
+	notApplicable, err := app.NotApplicableSelect(yearDB, idGR)
+	if err != nil {
+		return nil, err
+	}
+	for subtable := range notApplicable {
+		completed[subtable] = true
+	}
+
 	rows, err := app.DBManager.YQueryx(yearDB, "b_tabele_select_podtabela_tytul_where_tabela", table)
 	if err != nil {
 		return nil, err
@@ -677,12 +2500,239 @@ func (app *Application) TabRowsSubtableBuild(yearDB YearDB, table, selectedSubta
 			URLSegment: table + "/" + subtableLabel,
 			Tooltip: tytul,
 			Selected:   subtableLabel == selectedSubtable,
+			Completed:  completed[subtableLabel],
 		})
 	}
 
 	return items, rows.Err()
 }
 
+// PodtabeleWithDataSelect returns the set of subtables that have stored data
+// for idGR. A blob saved empty, with no rows and no notes, doesn't count.
+func (app *Application) PodtabeleWithDataSelect(yearDB YearDB, idGR string) (map[string]bool, error) {
+	dane, err := app.DaneSelectByIdGR(yearDB, idGR)
+	if err != nil {
+		return nil, err
+	}
+
+	subtables := make(map[string]bool)
+	for _, row := range dane {
+		subtables[row.Podtabela] = !BlobEmpty(row.Dane)
+	}
+	return subtables, nil
+}
+
+// NotApplicableSelect returns the not applicable marks of idGR by subtable.
+func (app *Application) NotApplicableSelect(yearDB YearDB, idGR string) (map[string]BNieDotyczy, error) {
+	rows, err := app.DBManager.YQueryx(yearDB, "b_nie_dotyczy_select_where_idgr", idGR)
+	if err != nil {
+		return nil, err
+	}
+	var marks []BNieDotyczy
+	err = sqlx.StructScan(rows, &marks)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	subtables := make(map[string]BNieDotyczy, len(marks))
+	for _, mark := range marks {
+		subtables[mark.Podtabela] = mark
+	}
+	return subtables, nil
+}
+
+// Column names are {subtable}_{name}; the name alone marks the row key and the
+// row title. Matching on the suffix keeps names like Rok_Koduwagi out.
+const (
+	COLUMN_KEY_SUFFIX         = "_Kod"
+	COLUMN_DESCRIPTION_SUFFIX = "_Wyszczegolnienie"
+)
+
+func ColumnIsKey(name string) bool {
+	return strings.HasSuffix(name, COLUMN_KEY_SUFFIX)
+}
+
+func ColumnIsDescription(name string) bool {
+	return strings.HasSuffix(name, COLUMN_DESCRIPTION_SUFFIX)
+}
+
+// COLUMN_WIDTH_DEFAULT is what the horizontal table templates give a column
+// without szerokosc.
+const COLUMN_WIDTH_DEFAULT = 140
+
+// ColumnsWidth is the rendered width of columns in px.
+func ColumnsWidth(columns []TableColumn) int64 {
+	var width int64
+	for _, column := range columns {
+		if column.Width > 0 {
+			width += column.Width
+		} else {
+			width += COLUMN_WIDTH_DEFAULT
+		}
+	}
+	return width
+}
+
+// TableCompactable tells the table types laid out column by column, the only
+// ones a compact view narrows.
+func TableCompactable(tableType string) bool {
+	switch tableType {
+	case HORIZONTAL_DYNAMIC_DUPLICABLE, HORIZONTAL_DYNAMIC_UNIQUE, HORIZONTAL_STATIC_UNIQUE, PKD_STATIC_UNIQUE, SIMC_STATIC_UNIQUE:
+		return true
+	}
+	return false
+}
+
+// ColumnsCompact keeps the columns with Lp up to limit, plus the row key and
+// title wherever they sit, and returns the names of the columns left out.
+func ColumnsCompact(columns []TableColumn, limit int64) ([]TableColumn, []string) {
+	kept := make([]TableColumn, 0, len(columns))
+	var hidden []string
+	for _, column := range columns {
+		if column.Lp <= limit || ColumnIsKey(column.Name) || ColumnIsDescription(column.Name) {
+			kept = append(kept, column)
+		} else {
+			hidden = append(hidden, column.Name)
+		}
+	}
+	return kept, hidden
+}
+
+// CompactParse reads ?compact, the highest column Lp a compact view shows, 0
+// when the view is full.
+func CompactParse(r *http.Request) (int64, error) {
+	value := r.URL.Query().Get("compact")
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("compact %q: expected a column number >= 1", value)
+	}
+	return limit, nil
+}
+
+// HiddenColumnsRestore copies the stored values of the hidden columns into a
+// save made from a compact view, which never had them to send back. Rows are
+// matched by row key and, for duplicated codes, by their order.
+func HiddenColumnsRestore(stored, payload string, hidden []string) (string, error) {
+	if len(hidden) == 0 || strings.TrimSpace(stored) == "" {
+		return payload, nil
+	}
+	var storedRows, rows []map[string]any
+	if err := json.Unmarshal([]byte(stored), &storedRows); err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal([]byte(payload), &rows); err != nil {
+		return "", err
+	}
+
+	for i, storedRow := range RowsMatch(storedRows, rows) {
+		if storedRow == nil {
+			continue
+		}
+		for _, name := range hidden {
+			if value, ok := storedRow[name]; ok {
+				rows[i][name] = value
+			}
+		}
+	}
+
+	merged, err := json.Marshal(rows)
+	return string(merged), err
+}
+
+// RowsMatch pairs each of rows with its stored row, matched by row key and, for
+// duplicated codes, by their order; nil for rows that weren't stored.
+func RowsMatch(storedRows, rows []map[string]any) []map[string]any {
+	byKey := make(map[string][]map[string]any)
+	for _, row := range storedRows {
+		key := rowKey(row)
+		byKey[key] = append(byKey[key], row)
+	}
+	matched := make([]map[string]any, len(rows))
+	seen := make(map[string]int)
+	for i, row := range rows {
+		key := rowKey(row)
+		if n := seen[key]; n < len(byKey[key]) {
+			matched[i] = byKey[key][n]
+		}
+		seen[key]++
+	}
+	return matched
+}
+
+// RestrictedColumnsKeep puts the stored values of the restricted columns back
+// into a save, whatever it sent for them, and drops values it gave them in rows
+// that weren't stored. The grid shows these cells read-only, so an honest save
+// sends them unchanged or not at all. A matrix has a single value column, so a
+// restricted one keeps the whole stored matrix.
+func RestrictedColumnsKeep(tableType, stored, payload string, restricted []string) (string, error) {
+	if len(restricted) == 0 {
+		return payload, nil
+	}
+	keep := func(row, storedRow map[string]any) {
+		for _, name := range restricted {
+			if value, ok := storedRow[name]; ok {
+				row[name] = value
+			} else {
+				delete(row, name)
+			}
+		}
+	}
+
+	switch tableType {
+	case MATRIX_DYNAMIC_UNIQUE:
+		if strings.TrimSpace(stored) == "" {
+			return "{}", nil
+		}
+		return stored, nil
+
+	case VERTICAL_STATIC_UNIQUE:
+		var storedRow, row map[string]any
+		if strings.TrimSpace(stored) != "" {
+			if err := json.Unmarshal([]byte(stored), &storedRow); err != nil {
+				return "", err
+			}
+		}
+		if err := json.Unmarshal([]byte(payload), &row); err != nil {
+			return "", err
+		}
+		if row == nil {
+			row = make(map[string]any)
+		}
+		keep(row, storedRow)
+		kept, err := json.Marshal(row)
+		return string(kept), err
+	}
+
+	var storedRows, rows []map[string]any
+	if strings.TrimSpace(stored) != "" {
+		if err := json.Unmarshal([]byte(stored), &storedRows); err != nil {
+			return "", err
+		}
+	}
+	if err := json.Unmarshal([]byte(payload), &rows); err != nil {
+		return "", err
+	}
+	for i, storedRow := range RowsMatch(storedRows, rows) {
+		keep(rows[i], storedRow)
+	}
+	kept, err := json.Marshal(rows)
+	return string(kept), err
+}
+
+// rowKey is the value of the row key column, "" for rows without one.
+func rowKey(row map[string]any) string {
+	for name, value := range row {
+		if ColumnIsKey(name) {
+			return fmt.Sprint(value)
+		}
+	}
+	return ""
+}
+
 // ColumnsBuildFromKolumny converts database column definitions to TableColumn slice.
 func ColumnsBuildFromKolumny(kolumny []BKolumny) []TableColumn {
 	columns := make([]TableColumn, 0, len(kolumny))
@@ -699,6 +2749,17 @@ func ColumnsBuildFromKolumny(kolumny []BKolumny) []TableColumn {
 			Visiable:      k.Visible,
 			Width:         k.Width,
 			Lp:            k.Lp,
+
+			KeepWhitespace: k.KeepWhitespace != 0,
+			EditRoles:      RolesMaskParse(k.EditRoles.String),
+		}
+
+		// opis is the help text written for respondents, uwagi the methodologists' notes;
+		// the latter is still better than no hint at all.
+		if k.Opis.Valid && strings.TrimSpace(k.Opis.String) != "" {
+			column.Tooltip = k.Opis.String
+		} else if k.Uwagi.Valid {
+			column.Tooltip = k.Uwagi.String
 		}
 
 		if k.Formula.Valid {
@@ -709,6 +2770,10 @@ func ColumnsBuildFromKolumny(kolumny []BKolumny) []TableColumn {
 			column.Regex = k.Regex.String
 		}
 
+		if k.RequiredWhen.Valid {
+			column.RequiredWhen = strings.TrimSpace(k.RequiredWhen.String)
+		}
+
 		if k.Min.Valid {
 			column.Min = &k.Min.Int64
 		}
@@ -732,9 +2797,55 @@ func ColumnsBuildFromKolumny(kolumny []BKolumny) []TableColumn {
 		columns = append(columns, column)
 	}
 
+	// Order comes from the lp metadata, not from whatever the query sorts by.
+	// The name breaks ties so equal lp values still render the same way.
+	slices.SortStableFunc(columns, func(a, b TableColumn) int {
+		return cmp.Or(cmp.Compare(a.Lp, b.Lp), strings.Compare(a.Name, b.Name))
+	})
+
 	return columns
 }
 
+// KodyPodtabeleSort orders the rows of a subtable by lp, then code. Codes
+// without lp go last.
+func KodyPodtabeleSort(kody []BKodyPodtabele) {
+	slices.SortStableFunc(kody, func(a, b BKodyPodtabele) int {
+		if a.Lp.Valid != b.Lp.Valid {
+			if a.Lp.Valid {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Or(cmp.Compare(a.Lp.Int64, b.Lp.Int64), strings.Compare(a.Code, b.Code))
+	})
+}
+
+// KodySelectBySubtable fetches the codes of subtable in KodyPodtabeleSort order.
+func (app *Application) KodySelectBySubtable(yearDB YearDB, subtable string) ([]BKodyPodtabele, error) {
+	rows, err := app.DBManager.YQueryx(yearDB, "b_kody__podtabele_select_kod_tytul_join_kod_where_podtabela", subtable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var kody []BKodyPodtabele
+	if err := sqlx.StructScan(rows, &kody); err != nil {
+		return nil, err
+	}
+	KodyPodtabeleSort(kody)
+	return kody, nil
+}
+
+// KodyRows turns the codes of a subtable into the cell-less rows of
+// TableSchema.Codes.
+func KodyRows(kody []BKodyPodtabele) []TableRow {
+	rows := make([]TableRow, 0, len(kody))
+	for _, kod := range kody {
+		rows = append(rows, TableRow{Title: kod.Title, Code: kod.Code})
+	}
+	return rows
+}
+
 // KolumnySelectBySubtable fetches column definitions for a subtable.
 func (app *Application) KolumnySelectBySubtable(yearDB YearDB, subtable string) ([]BKolumny, error) {
 	rows, err := app.DBManager.YQueryx(yearDB, "b_kolumny_select_where_podtabela", subtable)
@@ -751,24 +2862,369 @@ func (app *Application) KolumnySelectBySubtable(yearDB YearDB, subtable string)
 	return kolumny, nil
 }
 
-// Add this method to fetch existing data
-func (app *Application) DaneSelectByIdGRAndSubtable(yearDB YearDB, idGR, subtable string) (string, error) {
-	row := app.DBManager.YQueryRowx(yearDB, "b_bdgrobmsp_dane_select_where_idgr_podtabela", idGR, subtable)
-
+// SubtableDefinition is what the grid, validation and the integrity check read
+// about a subtable before looking at any answers.
+type SubtableDefinition struct {
+	Podtabela BPodtabele
+	Columns   []TableColumn
+	Blocks    []BBlokady
+}
+
+// SubtableDefinitionSelect loads the definition of subtable, sql.ErrNoRows when
+// b_podtabele doesn't have it.
+func (app *Application) SubtableDefinitionSelect(yearDB YearDB, subtable string) (SubtableDefinition, error) {
+	var definition SubtableDefinition
+	if err := app.DBManager.YQueryRowx(yearDB, "b_podtabeal_select_where_podtabela", subtable).StructScan(&definition.Podtabela); err != nil {
+		return definition, fmt.Errorf("subtable %s: %w", subtable, err)
+	}
+
+	kolumny, err := app.KolumnySelectBySubtable(yearDB, subtable)
+	if err != nil {
+		return definition, err
+	}
+	definition.Columns = ColumnsBuildFromKolumny(kolumny)
+
+	definition.Blocks, err = app.BlokadySelectBySubtable(yearDB, subtable)
+	return definition, err
+}
+
+// Add this method to fetch existing data
+func (app *Application) DaneSelectByIdGRAndSubtable(yearDB YearDB, idGR, subtable string) (string, error) {
+	data, _, err := app.DaneNotesSelectByIdGRAndSubtable(yearDB, idGR, subtable)
+	return data, err
+}
+
+func (app *Application) DaneNotesSelectByIdGRAndSubtable(yearDB YearDB, idGR, subtable string) (string, string, error) {
+	row := app.DBManager.YQueryRowx(yearDB, "b_bdgrobmsp_dane_select_where_idgr_podtabela", idGR, subtable)
+
 	var dane BDGROBMSP
 	if err := row.StructScan(&dane); err != nil {
 		if err == sql.ErrNoRows {
-			return "", nil // No data yet, that's fine
+			return "", "", nil // No data yet, that's fine
+		}
+		return "", "", err
+	}
+	return BlobUnwrapNotes(dane.Dane)
+}
+
+// DaneRawSelectByIdGRAndSubtable returns the row exactly as stored, envelope included.
+func (app *Application) DaneRawSelectByIdGRAndSubtable(yearDB YearDB, idGR, subtable string) (BDGROBMSP, error) {
+	var dane BDGROBMSP
+	row := app.DBManager.YQueryRowx(yearDB, "b_bdgrobmsp_dane_select_where_idgr_podtabela", idGR, subtable)
+	err := row.StructScan(&dane)
+	return dane, err
+}
+
+func (app *Application) DaneSelectByIdGR(yearDB YearDB, idGR string) ([]BDGROBMSP, error) {
+	var dane []BDGROBMSP
+	rows, err := app.DBManager.YQueryx(yearDB, "b_bdgrobmsp_select_where_idgr", idGR)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row BDGROBMSP
+		if err := rows.StructScan(&row); err != nil {
+			return nil, err
 		}
+		dane = append(dane, row)
+	}
+	return dane, rows.Err()
+}
+
+// DaneLastModified is the newest data_modyfikacji across all subtables of idGR,
+// or the newest clearing of one, zero when nothing is stored. It is indexed MAXes
+// only, so a 304 never loads blobs.
+func (app *Application) DaneLastModified(yearDB YearDB, idGR string) (time.Time, error) {
+	var modified sql.NullString
+	row := app.DBManager.YQueryRowx(yearDB, "b_bdgrobmsp_max_data_modyfikacji_where_idgr", idGR, idGR, AUDIT_DELETE)
+	if err := row.Scan(&modified); err != nil {
+		return time.Time{}, err
+	}
+	if !modified.Valid {
+		return time.Time{}, nil
+	}
+	return DataModyfikacjiParse(modified.String)
+}
+
+// data_modyfikacji defaults to CURRENT_TIMESTAMP, which SQLite writes in UTC.
+const DATA_MODYFIKACJI_LAYOUT = "2006-01-02 15:04:05"
+
+func DataModyfikacjiParse(value string) (time.Time, error) {
+	return time.ParseInLocation(DATA_MODYFIKACJI_LAYOUT, value, time.UTC)
+}
+
+// Stored b_bdgrobmsp.dane is wrapped as {"_v":BLOB_VERSION,"data":...}. Bump the
+// version when the shape of data changes and teach BlobUnwrap to upgrade old ones.
+const BLOB_VERSION = 1
+
+// Notes is the respondent's free-text comment on the whole subtable. It lives in
+// the envelope so it never reaches validation, formulas or cell population.
+type BlobEnvelope struct {
+	Version *int            `json:"_v"`
+	Data    json.RawMessage `json:"data"`
+	Notes   string          `json:"notes,omitempty"`
+}
+
+func BlobWrap(data []byte, notes string) (string, error) {
+	if !json.Valid(data) {
+		return "", fmt.Errorf("blob is not valid JSON")
+	}
+	version := BLOB_VERSION
+	wrapped, err := json.Marshal(BlobEnvelope{Version: &version, Data: data, Notes: notes})
+	if err != nil {
 		return "", err
 	}
-	return dane.Dane, nil
+	return string(wrapped), nil
+}
+
+// BlobUnwrap returns the bare payload. Legacy blobs were stored without the envelope:
+// arrays for horizontal tables, objects keyed by column names for vertical ones.
+// Neither has a "_v" key, so its absence marks a legacy blob.
+func BlobUnwrap(blob string) (string, error) {
+	data, _, err := BlobUnwrapNotes(blob)
+	return data, err
+}
+
+// BlobUnwrapNotes is BlobUnwrap that also returns the subtable notes. The save
+// endpoint accepts the same envelope, so it parses request bodies too.
+func BlobUnwrapNotes(blob string) (string, string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(blob), "{") {
+		return blob, "", nil
+	}
+
+	var envelope BlobEnvelope
+	if err := json.Unmarshal([]byte(blob), &envelope); err != nil || envelope.Version == nil {
+		return blob, "", nil
+	}
+	if *envelope.Version > BLOB_VERSION {
+		return "", "", fmt.Errorf("blob version %d is newer than supported %d", *envelope.Version, BLOB_VERSION)
+	}
+	return string(envelope.Data), envelope.Notes, nil
+}
+
+// BlobEmpty reports a blob with neither rows nor notes, which copying a farm
+// may overwrite without being forced.
+func BlobEmpty(blob string) bool {
+	data, notes, err := BlobUnwrapNotes(blob)
+	if err != nil || notes != "" {
+		return false
+	}
+	switch strings.TrimSpace(data) {
+	case "", "[]", "{}", "null":
+		return true
+	}
+	return false
+}
+
+// BlobRowCount is the number of rows of a horizontal blob; a vertical one is
+// a single object and counts as one row.
+func BlobRowCount(blob string) int {
+	data, _, err := BlobUnwrapNotes(blob)
+	if err != nil {
+		return 0
+	}
+	var rows []json.RawMessage
+	if json.Unmarshal([]byte(data), &rows) == nil {
+		return len(rows)
+	}
+	var row map[string]json.RawMessage
+	if json.Unmarshal([]byte(data), &row) == nil && len(row) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func BlobIsWrapped(blob string) bool {
+	var envelope BlobEnvelope
+	if !strings.HasPrefix(strings.TrimSpace(blob), "{") {
+		return false
+	}
+	return json.Unmarshal([]byte(blob), &envelope) == nil && envelope.Version != nil && *envelope.Version == BLOB_VERSION
+}
+
+// BlobsMigrate rewrites every blob of a year database to the current envelope.
+// Safe to run repeatedly, already wrapped blobs are left alone.
+func (app *Application) BlobsMigrate(yearDB YearDB) (int, error) {
+	rows, err := app.DBManager.YQueryx(yearDB, "b_bdgrobmsp_select_all")
+	if err != nil {
+		return 0, err
+	}
+	var blobs []BDGROBMSP
+	err = sqlx.StructScan(rows, &blobs)
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, blob := range blobs {
+		if BlobIsWrapped(blob.Dane) {
+			continue
+		}
+		bare, err := BlobUnwrap(blob.Dane)
+		if err != nil {
+			return migrated, fmt.Errorf("idgr %s, podtabela %s: %w", blob.IDGR, blob.Podtabela, err)
+		}
+		wrapped, err := BlobWrap([]byte(bare), "")
+		if err != nil {
+			return migrated, fmt.Errorf("idgr %s, podtabela %s: %w", blob.IDGR, blob.Podtabela, err)
+		}
+		if _, err := app.DBManager.YExec(yearDB, "b_bdgrobmsp_update_dane_where_idgr_podtabela", wrapped, blob.IDGR, blob.Podtabela); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// IntegrityReport lists what in one stored blob no longer matches the current
+// definitions. Error is set when the blob can't be checked at all.
+type IntegrityReport struct {
+	IdGR            string            `json:"idgr"`
+	Subtable        string            `json:"podtabela"`
+	UnknownColumns  []string          `json:"unknown_columns,omitempty"`
+	MissingRequired []ValidationError `json:"missing_required,omitempty"`
+	Error           string            `json:"error,omitempty"`
+}
+
+type integritySchema struct {
+	tableType string
+	columns   []TableColumn
+	blocks    []BBlokady
+	known     map[string]bool
+}
+
+// IntegrityCheck scans every blob of the year against the current column
+// definitions. Only blobs with findings are returned.
+func (app *Application) IntegrityCheck(yearDB YearDB) ([]IntegrityReport, error) {
+	rows, err := app.DBManager.YQueryx(yearDB, "b_bdgrobmsp_select_all")
+	if err != nil {
+		return nil, err
+	}
+	var blobs []BDGROBMSP
+	err = sqlx.StructScan(rows, &blobs)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = app.DBManager.YQueryx(yearDB, "b_nie_dotyczy_select_all")
+	if err != nil {
+		return nil, err
+	}
+	var marks []BNieDotyczy
+	err = sqlx.StructScan(rows, &marks)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	notApplicable := make(map[[2]string]bool, len(marks))
+	for _, mark := range marks {
+		notApplicable[[2]string{mark.IDGR, mark.Podtabela}] = true
+	}
+
+	schemas := make(map[string]*integritySchema)
+	reports := []IntegrityReport{}
+	for _, blob := range blobs {
+		report := IntegrityReport{IdGR: blob.IDGR, Subtable: blob.Podtabela}
+
+		schema, ok := schemas[blob.Podtabela]
+		if !ok {
+			schema, err = app.integritySchemaLoad(yearDB, blob.Podtabela)
+			if err != nil {
+				return nil, err
+			}
+			schemas[blob.Podtabela] = schema
+		}
+		if schema == nil {
+			report.Error = "Nieznana podtabela"
+			reports = append(reports, report)
+			continue
+		}
+
+		data, err := BlobUnwrap(blob.Dane)
+		if err != nil {
+			report.Error = err.Error()
+			reports = append(reports, report)
+			continue
+		}
+
+		var items []map[string]any
+		switch schema.tableType {
+		case VERTICAL_STATIC_UNIQUE:
+			var item map[string]any
+			err = json.Unmarshal([]byte(data), &item)
+			items = append(items, item)
+		case MATRIX_DYNAMIC_UNIQUE:
+			// Matrix keys are codes rather than columns, validation covers the cells.
+			_, err = MatrixParse(data)
+		default:
+			err = json.Unmarshal([]byte(data), &items)
+		}
+		if err != nil {
+			report.Error = err.Error()
+			reports = append(reports, report)
+			continue
+		}
+
+		unknown := make(map[string]bool)
+		for _, item := range items {
+			for key := range item {
+				if !schema.known[key] {
+					unknown[key] = true
+				}
+			}
+		}
+		for key := range unknown {
+			report.UnknownColumns = append(report.UnknownColumns, key)
+		}
+		slices.Sort(report.UnknownColumns)
+
+		errs, _ := ValidateSubtableData(schema.tableType, schema.columns, schema.blocks, data)
+		for _, e := range errs {
+			if e.Message == MSG_REQUIRED && !notApplicable[[2]string{blob.IDGR, blob.Podtabela}] {
+				report.MissingRequired = append(report.MissingRequired, e)
+			}
+		}
+
+		if len(report.UnknownColumns) > 0 || len(report.MissingRequired) > 0 {
+			reports = append(reports, report)
+		}
+	}
+
+	return reports, nil
+}
+
+// integritySchemaLoad returns nil without an error when the subtable no longer exists.
+func (app *Application) integritySchemaLoad(yearDB YearDB, subtable string) (*integritySchema, error) {
+	definition, err := app.SubtableDefinitionSelect(yearDB, subtable)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &integritySchema{
+		tableType: definition.Podtabela.TableSchema,
+		columns:   definition.Columns,
+		blocks:    definition.Blocks,
+		known:     make(map[string]bool),
+	}
+	for _, column := range schema.columns {
+		schema.known[column.Name] = true
+	}
+	return schema, nil
 }
 
 // Populate cells for horizontal tables (static or dynamic)
-func PopulateCellsFromArray(rows []TableRow, jsonData string) error {
-	if jsonData == "" {
-		return nil
+func PopulateCellsFromArray(rows []TableRow, jsonData string, format LocaleFormat) error {
+	jsonData, err := BlobUnwrap(jsonData)
+	if err != nil || jsonData == "" {
+		return err
 	}
 
 	var dataArray []map[string]any
@@ -781,7 +3237,7 @@ func PopulateCellsFromArray(rows []TableRow, jsonData string) error {
 	for _, item := range dataArray {
 		// Find the _Kod field to use as key
 		for k, v := range item {
-			if strings.HasSuffix(k, "_Kod") {
+			if ColumnIsKey(k) {
 				if code, ok := v.(string); ok {
 					lookup[code] = item
 				}
@@ -790,18 +3246,108 @@ func PopulateCellsFromArray(rows []TableRow, jsonData string) error {
 		}
 	}
 
-	// Populate cells
 	for i := range rows {
-		row := &rows[i]
-		data, exists := lookup[row.Code]
-		if !exists {
+		if data, ok := lookup[rows[i].Code]; ok {
+			RowCellsPopulate(&rows[i], data, format)
+		}
+	}
+
+	return nil
+}
+
+// RowCellsPopulate fills the cells of row with the values of one stored entry.
+func RowCellsPopulate(row *TableRow, data map[string]any, format LocaleFormat) {
+	for j := range row.Cells {
+		cell := &row.Cells[j]
+		if val, ok := data[cell.Name]; ok {
+			cell.Value = format.Value(val)
+		}
+	}
+}
+
+// ScanRowsToTableRows reads the whole result set into one row per record, with a
+// cell for each of cols filled from the result column of the same Name.
+// Columns the query doesn't return stay empty. Index is the record's position.
+func ScanRowsToTableRows(rows *sqlx.Rows, cols []TableColumn) ([]TableRow, error) {
+	var tableRows []TableRow
+	for rows.Next() {
+		record := make(map[string]any)
+		if err := rows.MapScan(record); err != nil {
+			return nil, err
+		}
+
+		row := TableRow{Cells: make([]TableCell, len(cols)), Index: int64(len(tableRows))}
+		for i := range cols {
+			value := record[cols[i].Name]
+			// SQLite hands TEXT back as bytes.
+			if b, ok := value.([]byte); ok {
+				value = string(b)
+			}
+			row.Cells[i] = TableCell{Name: cols[i].Name, Column: &cols[i], Value: formatValue(value)}
+		}
+		tableRows = append(tableRows, row)
+	}
+	return tableRows, rows.Err()
+}
+
+// DynamicRowsBuild expands the stored array of a HORIZONTAL_DYNAMIC_* table into
+// one populated row per entry. Index is the entry's position in the array, which
+// AnkietRowPost addresses, so an entry without a code is skipped without shifting
+// the rest. build makes the empty row for a code and index.
+func DynamicRowsBuild(jsonData string, format LocaleFormat, build func(code string, index int) TableRow) ([]TableRow, error) {
+	jsonData, err := BlobUnwrap(jsonData)
+	if err != nil || strings.TrimSpace(jsonData) == "" {
+		return nil, err
+	}
+
+	var entries []map[string]any
+	if err := json.Unmarshal([]byte(jsonData), &entries); err != nil {
+		return nil, err
+	}
+
+	rows := make([]TableRow, 0, len(entries))
+	for i, entry := range entries {
+		var code string
+		for k, v := range entry {
+			if ColumnIsKey(k) {
+				code, _ = v.(string)
+				break
+			}
+		}
+		if code == "" {
 			continue
 		}
+		row := build(code, i)
+		RowCellsPopulate(&row, entry, format)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// MatrixParse reads a MATRIX_DYNAMIC_UNIQUE blob. An empty blob is an empty matrix.
+func MatrixParse(jsonData string) (map[string]map[string]any, error) {
+	jsonData, err := BlobUnwrap(jsonData)
+	if err != nil || jsonData == "" {
+		return nil, err
+	}
+	var matrix map[string]map[string]any
+	err = json.Unmarshal([]byte(jsonData), &matrix)
+	return matrix, err
+}
+
+// PopulateCellsFromMatrix fills matrix cells, whose Name is the column code.
+func PopulateCellsFromMatrix(rows []TableRow, jsonData string, format LocaleFormat) error {
+	matrix, err := MatrixParse(jsonData)
+	if err != nil {
+		return err
+	}
 
+	for i := range rows {
+		row := &rows[i]
 		for j := range row.Cells {
 			cell := &row.Cells[j]
-			if val, ok := data[cell.Name]; ok {
-				cell.Value = formatValue(val)
+			if val, ok := matrix[row.Code][cell.Name]; ok {
+				cell.Value = format.Value(val)
 			}
 		}
 	}
@@ -809,10 +3355,41 @@ func PopulateCellsFromArray(rows []TableRow, jsonData string) error {
 	return nil
 }
 
+// ColumnFirstValue is the first column that is neither the _Kod key, a description
+// nor a formula: what every matrix cell is typed by, and the autocompleted code of
+// PKD and SIMC tables. Nil when there is none.
+func ColumnFirstValue(columns []TableColumn) *TableColumn {
+	for i := range columns {
+		column := &columns[i]
+		if !ColumnIsKey(column.Name) && !ColumnIsDescription(column.Name) && column.Formula == "" {
+			return column
+		}
+	}
+	return nil
+}
+
+// MatrixCodesOrder orders the codes used in a matrix the way the code list does.
+// Codes no longer on the list go last, so their data stays visible.
+func MatrixCodesOrder(codes []TableRow, used map[string]bool) []TableRow {
+	ordered := make([]TableRow, 0, len(used))
+	for _, code := range codes {
+		if used[code.Code] {
+			ordered = append(ordered, code)
+			delete(used, code.Code)
+		}
+	}
+	rest := slices.Sorted(maps.Keys(used))
+	for _, code := range rest {
+		ordered = append(ordered, TableRow{Code: code, Title: code})
+	}
+	return ordered
+}
+
 // Populate cells for vertical tables
-func PopulateCellsFromObject(rows []TableRow, jsonData string) error {
-	if jsonData == "" {
-		return nil
+func PopulateCellsFromObject(rows []TableRow, jsonData string, format LocaleFormat) error {
+	jsonData, err := BlobUnwrap(jsonData)
+	if err != nil || jsonData == "" {
+		return err
 	}
 
 	var data map[string]any
@@ -825,7 +3402,7 @@ func PopulateCellsFromObject(rows []TableRow, jsonData string) error {
 		for j := range row.Cells {
 			cell := &row.Cells[j]
 			if val, ok := data[cell.Name]; ok {
-				cell.Value = formatValue(val)
+				cell.Value = format.Value(val)
 			}
 		}
 	}
@@ -833,386 +3410,4350 @@ func PopulateCellsFromObject(rows []TableRow, jsonData string) error {
 	return nil
 }
 
-func formatValue(v any) string {
-	switch val := v.(type) {
-	case string:
-		return val
-	case float64:
-		// Check if it's actually an integer
-		if val == float64(int64(val)) {
-			return strconv.FormatInt(int64(val), 10)
+// ParseLocalizedNumber accepts numbers the way Polish users type them: "1 234,56".
+// Spaces (including the non-breaking ones pasted from spreadsheets) group thousands
+// and either comma or dot is the decimal separator, but not both.
+func ParseLocalizedNumber(s string) (float64, error) {
+	raw := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '\u00a0' || r == '\u202f' {
+			return -1
 		}
-		return strconv.FormatFloat(val, 'f', -1, 64)
-	case nil:
-		return ""
-	default:
-		return fmt.Sprintf("%v", val)
-	}
-}
+		return r
+	}, s)
 
-// BlokadySelectBySubtable fetches blocks for a subtable.
-func (app *Application) BlokadySelectBySubtable(yearDB YearDB, subtable string) ([]BBlokady, error) {
-	rows, err := app.DBManager.YQueryx(yearDB, "b_blokady_where_podtabela", subtable)
-	if err != nil {
-		return nil, err
+	if strings.Contains(raw, ",") && strings.Contains(raw, ".") || strings.Count(raw, ",") > 1 {
+		return 0, fmt.Errorf("invalid number %q", s)
 	}
-	defer rows.Close()
+	raw = strings.Replace(raw, ",", ".", 1)
 
-	var blocks []BBlokady
-	if err := sqlx.StructScan(rows, &blocks); err != nil {
-		return nil, err
+	// ParseFloat would also take "Inf", "NaN" and hex; none of those are survey answers.
+	if raw == "" || strings.ContainsFunc(raw, func(r rune) bool { return !(r >= '0' && r <= '9' || r == '.' || r == '-' || r == '+') }) {
+		return 0, fmt.Errorf("invalid number %q", s)
 	}
 
-	return blocks, nil
+	number, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return number, nil
 }
 
-// BlokadySelectBySubtableAndCode fetches blocks for a subtable and specific code.
-func (app *Application) BlokadySelectBySubtableAndCode(yearDB YearDB, subtable, code string) ([]BBlokady, error) {
-	rows, err := app.DBManager.YQueryx(yearDB, "b_blokady_where_podtabela_and_kod", subtable, code)
+// EvalFormula evaluates b_kolumny.formula against one record of a subtable.
+// Operands are column names (kolumna) of the same record, blank or missing values
+// count as 0. Besides numbers, + - * / and parentheses there is SUM(a, b, ...), e.g.
+//
+//	SUM(D_1_Grunty, D_1_Budynki, D_1_Maszyny)
+//	D_2_Brutto - D_2_Vat
+func EvalFormula(formula string, values map[string]any) (float64, error) {
+	tokens, err := formulaTokenize(formula)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	defer rows.Close()
 
-	var blocks []BBlokady
-	if err := sqlx.StructScan(rows, &blocks); err != nil {
-		return nil, err
+	p := &formulaParser{tokens: tokens, values: values}
+	result, err := p.expr()
+	if err != nil {
+		return 0, err
 	}
-
-	return blocks, nil
+	if p.pos < len(p.tokens) {
+		return 0, fmt.Errorf("formula %q: unexpected %q", formula, p.tokens[p.pos])
+	}
+	return result, nil
 }
 
-func (app *Application) TmplBaseDataUserDate(r *http.Request) (*TmplBaseData, error) {
-	user, ok := app.Session.Get(r.Context(), "user").(User)
-	if !ok {
-		return nil, fmt.Errorf("user type mismatch")
+func formulaTokenize(formula string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(formula); {
+		c := formula[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.IndexByte("+-*/(),", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '=':
+			tokens = append(tokens, "=")
+			i++
+		case c == '<' || c == '>' || c == '!':
+			if i+1 < len(formula) && (formula[i+1] == '=' || c == '<' && formula[i+1] == '>') {
+				tokens = append(tokens, formula[i:i+2])
+				i += 2
+				continue
+			}
+			if c == '!' {
+				return nil, fmt.Errorf("formula %q: unexpected character %q", formula, c)
+			}
+			tokens = append(tokens, string(c))
+			i++
+		case c == '\'':
+			end := strings.IndexByte(formula[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("formula %q: unterminated text", formula)
+			}
+			// Kept with the opening quote so the parser can tell text from identifiers.
+			tokens = append(tokens, formula[i:i+1+end])
+			i += end + 2
+		case c >= '0' && c <= '9' || c == '.':
+			start := i
+			for i < len(formula) && (formula[i] >= '0' && formula[i] <= '9' || formula[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, formula[start:i])
+		case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+			start := i
+			for i < len(formula) && (formula[i] == '_' || formula[i] >= 'A' && formula[i] <= 'Z' ||
+				formula[i] >= 'a' && formula[i] <= 'z' || formula[i] >= '0' && formula[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, formula[start:i])
+		default:
+			return nil, fmt.Errorf("formula %q: unexpected character %q", formula, c)
+		}
 	}
+	return tokens, nil
+}
 
-	tmplBaseData := &TmplBaseData{
-		PageTitle: "Dashboard",
-		User:      user,
-	}
+type formulaParser struct {
+	tokens []string
+	pos    int
+	values map[string]any
+}
 
-	rows, err := app.DBManager.MQueryx("lata_select_year_status")
-	if err != nil {
-		return nil, err
+func (p *formulaParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
 	}
-	defer rows.Close()
+	return ""
+}
 
-	var tmplYears []TmplYears
-	for rows.Next() {
-		var year Lata
-		if err := rows.StructScan(&year); err != nil {
-			return nil, err
-		}
+func (p *formulaParser) expect(token string) error {
+	if p.peek() != token {
+		return fmt.Errorf("formula: expected %q, got %q", token, p.peek())
+	}
+	p.pos++
+	return nil
+}
 
-		if year.Detached == 1 {
-			continue
+func (p *formulaParser) expr() (float64, error) {
+	left, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.tokens[p.pos]
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return 0, err
+		}
+		if op == "+" {
+			left += right
+		} else {
+			left -= right
 		}
-
-		tmplYears = append(tmplYears, TmplYears{
-			Year:   strconv.FormatInt(year.Year, 10),
-			Locked: year.Locked == 1,
-		})
 	}
+	return left, nil
+}
 
-	tmplBaseData.Years = tmplYears
-
-	if currentYear := r.PathValue("year"); currentYear != "" {
-		tmplBaseData.CurrentYear = &TmplYears{Year: currentYear, Locked: false}
+func (p *formulaParser) term() (float64, error) {
+	left, err := p.unary()
+	if err != nil {
+		return 0, err
 	}
-	
-	if currentIdGR := r.PathValue("idgr"); currentIdGR != "" {
-		tmplBaseData.IdGR = currentIdGR
+	for p.peek() == "*" || p.peek() == "/" {
+		op := p.tokens[p.pos]
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		if op == "*" {
+			left *= right
+		} else if right == 0 {
+			return 0, fmt.Errorf("formula: division by zero")
+		} else {
+			left /= right
+		}
 	}
+	return left, nil
+}
 
-	return tmplBaseData, nil
+func (p *formulaParser) unary() (float64, error) {
+	if p.peek() == "-" {
+		p.pos++
+		value, err := p.unary()
+		return -value, err
+	}
+	return p.primary()
 }
 
-func (app *Application) Render(w http.ResponseWriter, r *http.Request, status int, tmpl *html.Template, data any) {
-	buf := new(bytes.Buffer)
+func (p *formulaParser) primary() (float64, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return 0, fmt.Errorf("formula: unexpected end")
 
-	err := tmpl.ExecuteTemplate(buf, "base", data)
-	if err != nil {
-		app.ServerError(w, r, err)
-		return
-	}
+	case token == "(":
+		p.pos++
+		value, err := p.condition()
+		if err != nil {
+			return 0, err
+		}
+		return value, p.expect(")")
 
-	w.WriteHeader(status)
-	buf.WriteTo(w)
-}
+	case token[0] >= '0' && token[0] <= '9' || token[0] == '.':
+		p.pos++
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return 0, fmt.Errorf("formula: bad number %q", token)
+		}
+		return value, nil
 
-func (app *Application) ClientError(w http.ResponseWriter, status int) {
-	http.Error(w, http.StatusText(status), status)
-}
+	case strings.EqualFold(token, "SUM") && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1] == "(":
+		p.pos += 2
+		sum := 0.0
+		for {
+			value, err := p.expr()
+			if err != nil {
+				return 0, err
+			}
+			sum += value
+			if p.peek() != "," {
+				break
+			}
+			p.pos++
+		}
+		return sum, p.expect(")")
 
-func (app *Application) ServerError(w http.ResponseWriter, r *http.Request, err error) {
-	trace := string(debug.Stack())
+	case formulaIsIdentifier(token):
+		p.pos++
+		raw := strings.TrimSpace(formatValue(p.values[token]))
+		if raw == "" {
+			return 0, nil
+		}
+		value, err := ParseLocalizedNumber(raw)
+		if err != nil {
+			return 0, fmt.Errorf("formula: %s is not a number: %q", token, raw)
+		}
+		return value, nil
+	}
 
-	app.Logger.Error("internal error",
-		slog.String("method", r.Method),
-		slog.String("uri", r.URL.RequestURI()),
-		slog.String("error", err.Error()),
-		slog.String("trace", trace),
-	)
+	return 0, fmt.Errorf("formula: unexpected %q", token)
+}
 
-	if app.Debug {
-		fmt.Println("\nSTACK TRACE:\n" + err.Error() + "\n" + trace)
+// EvalCondition evaluates b_kolumny.wymagana_gdy against one record. On top of the
+// EvalFormula syntax it has comparisons (= <> != < <= > >=), AND, OR and NOT, and a
+// column can be compared with text in single quotes (= <> != only), e.g.
+//
+//	C_1_Dzierzawa = 'T'
+//	C_2_Powierzchnia > 0 AND NOT C_2_Rodzaj = '3'
+//	(C_3_Brutto - C_3_Vat) >= 100 OR C_3_Kod <> ''
+//
+// Numeric comparisons treat a blank column as 0, text comparisons as empty text. Keywords
+// are case-insensitive; AND binds tighter than OR.
+func EvalCondition(condition string, values map[string]any) (bool, error) {
+	tokens, err := formulaTokenize(condition)
+	if err != nil {
+		return false, err
 	}
 
-	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	p := &formulaParser{tokens: tokens, values: values}
+	result, err := p.condition()
+	if err != nil {
+		return false, err
+	}
+	if p.pos < len(p.tokens) {
+		return false, fmt.Errorf("condition %q: unexpected %q", condition, p.tokens[p.pos])
+	}
+	return result != 0, nil
 }
 
-func (app *Application) Forbidden(w http.ResponseWriter, r *http.Request) {
-	app.Logger.Warn("forbidden access",
-		"method", r.Method,
-		"path", r.URL.Path,
-		"remote_addr", r.RemoteAddr,
-	)
-	http.Error(w, "403 Forbidden", http.StatusForbidden)
+func formulaIsIdentifier(token string) bool {
+	return token != "" && (token[0] == '_' || token[0] >= 'A' && token[0] <= 'Z' || token[0] >= 'a' && token[0] <= 'z')
 }
 
-func (app *Application) MiddleLogRequest(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.Logger.Info("received request",
-			slog.String("ip", r.RemoteAddr),
-			slog.String("proto", r.Proto),
-			slog.String("method", r.Method),
-			slog.String("uri", r.URL.RequestURI()),
-		)
-		next.ServeHTTP(w, r)
-	})
+// Conditions reuse the float parser with 1 and 0 for true and false.
+func formulaBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
-func (app *Application) MiddleRecoverPanic(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if pv := recover(); pv != nil {
-				w.Header().Set("Connection", "close")
-				app.ServerError(w, r, fmt.Errorf("%v", pv))
-			}
-		}()
-		next.ServeHTTP(w, r)
-	})
+func (p *formulaParser) keyword(word string) bool {
+	if strings.EqualFold(p.peek(), word) {
+		p.pos++
+		return true
+	}
+	return false
 }
 
-func (app *Application) MiddleLoged(next http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, ok := app.Session.Get(r.Context(), "user").(User)
-		if !ok {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
+func (p *formulaParser) condition() (float64, error) {
+	left, err := p.and()
+	if err != nil {
+		return 0, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return 0, err
 		}
-
-		next.ServeHTTP(w, r)
-	})
+		left = formulaBool(left != 0 || right != 0)
+	}
+	return left, nil
 }
 
-func (app *Application) MiddleAccessIdGR(next http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		yearDB, err := app.PathValueYearParse(r)
+func (p *formulaParser) and() (float64, error) {
+	left, err := p.not()
+	if err != nil {
+		return 0, err
+	}
+	for p.keyword("AND") {
+		right, err := p.not()
 		if err != nil {
-			http.Redirect(w, r, "/app/", http.StatusSeeOther)
-			return
+			return 0, err
 		}
+		left = formulaBool(left != 0 && right != 0)
+	}
+	return left, nil
+}
 
-		idGR := r.PathValue("idgr")
-		if idGR == "" {
-			http.Redirect(w, r, "/app/", http.StatusSeeOther)
-			return
-		}
+func (p *formulaParser) not() (float64, error) {
+	if p.keyword("NOT") {
+		value, err := p.not()
+		return formulaBool(value == 0), err
+	}
+	return p.comparison()
+}
 
-		user := app.Session.Get(r.Context(), "user").(User)
-		if user.Role & UserAdmin != 0 {	
-			next.ServeHTTP(w, r)
-			return 
-		}
-		
-		if user.Role & UserManager != 0 {	
-			app.Logger.Error("Noo Accesss")
-			var access int64
-			row := app.DBManager.MQueryRowx("rok_idbr_check", int(yearDB), idGR, user.IdBR)	
-			row.Scan(&access)
-			if access == 1 {	
-				next.ServeHTTP(w, r)
-				return 
-			}
-		}
-		
-		var access int64
-		row := app.DBManager.MQueryRowx("rok_idgr_idpbr_check", int(yearDB), idGR, user.IdPBR)	
-		row.Scan(&access)
-		if access == 1 {	
-			next.ServeHTTP(w, r)
-			return 
+func (p *formulaParser) comparison() (float64, error) {
+	// column = 'text' compares the raw answer, which may be a non-numeric code.
+	if p.pos+2 < len(p.tokens) && strings.HasPrefix(p.tokens[p.pos+2], "'") && formulaIsIdentifier(p.peek()) {
+		column, op, text := p.tokens[p.pos], p.tokens[p.pos+1], p.tokens[p.pos+2][1:]
+		if op != "=" && op != "<>" && op != "!=" {
+			return 0, fmt.Errorf("condition: text can only be compared with = or <>")
 		}
+		p.pos += 3
+		equal := strings.TrimSpace(formatValue(p.values[column])) == text
+		return formulaBool(equal == (op == "=")), nil
+	}
 
-		http.Redirect(w, r, "/app/", http.StatusSeeOther)
-	})
-}
+	left, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
 
-func MiddlewareStaticHeaders(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
-        w.Header().Set("X-Content-Type-Options", "nosniff")
-        next.ServeHTTP(w, r)
-    })
-}
+	op := p.peek()
+	switch op {
+	case "=", "<>", "!=", "<", "<=", ">", ">=":
+	default:
+		return left, nil
+	}
+	p.pos++
 
-func MiddlewareMainHeaders(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Referrer-Policy", "origin-when-cross-origin")
-        w.Header().Set("X-Content-Type-Options", "nosniff")
-        w.Header().Set("X-Frame-Options", "deny")
-        w.Header().Set("X-XSS-Protection", "0")
-        // TODO: Causes issue with style set as an attribute
-        // w.Header().Set("Content-Security-Policy", "default-src 'self'") 
-        w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-        w.Header().Set("Pragma", "no-cache")
-        w.Header().Set("Expires", "0")
-        next.ServeHTTP(w, r)
-    })
+	right, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+
+	switch op {
+	case "=":
+		return formulaBool(left == right), nil
+	case "<>", "!=":
+		return formulaBool(left != right), nil
+	case "<":
+		return formulaBool(left < right), nil
+	case "<=":
+		return formulaBool(left <= right), nil
+	case ">":
+		return formulaBool(left > right), nil
+	default:
+		return formulaBool(left >= right), nil
+	}
 }
 
-func (app *Application) Routes() http.Handler {
-	staticContent := http.NewServeMux()
-	staticContent.Handle("GET  /frontend/", http.FileServer(http.FS(FS_FRONTEND)))
-	staticContent.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-		data, err := FS_FRONTEND.ReadFile("frontend/favicon.ico")
+// FormulasApply stores the result of every formula column in data, in column order,
+// so a total may build on an earlier total. The client value is always overwritten:
+// computed cells are read-only and must not be trusted from the payload.
+func FormulasApply(columns []TableColumn, data map[string]any) error {
+	for _, column := range columns {
+		if column.Formula == "" {
+			continue
+		}
+		value, err := EvalFormula(column.Formula, data)
 		if err != nil {
-			http.NotFound(w, r)
-			return
+			return fmt.Errorf("%s: %w", column.Name, err)
 		}
-		w.Header().Set("Content-Type", "image/png")
-		w.Header().Set("Cache-Control", "public, max-age=86400")
-		w.Write(data)
-	})
-	
-	staticWrapped := ChainNew(MiddlewareStaticHeaders).Then(staticContent)
-	
-	Logged := ChainFuncNew(app.MiddleLoged)
-	AccessIdGR := Logged.Append(app.MiddleAccessIdGR)
-
-	main := http.NewServeMux()
-	main.HandleFunc("GET  /{$}", app.LoginGet)
-	main.HandleFunc("POST /login", app.LoginPost)
-	main.HandleFunc("GET  /logout", app.LogoutGet)
-	main.HandleFunc("GET  /app/", Logged.Then(app.AppGet))
-	main.HandleFunc("GET  /app/{year}/", Logged.Then(app.YearGet))
-	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/", Logged.Then(app.ListGRGet))
-	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}", AccessIdGR.Then(app.AnkietIdGRGet))
-	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/", AccessIdGR.Then(app.AnkietTableGet))
-	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/", AccessIdGR.Then(app.AnkietSubtableGet))
-	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/", AccessIdGR.Then(app.AnkietSubtablePost))
-	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/{code}/{index}", AccessIdGR.Then(app.AnkietRowGet))
-	// main.HandleFunc("GET  /app/{year}/bdgr/metodyka/{path...}", app.MiddleLoged(app.MetodykaGet))
-
-	mainWrapped := ChainNew(
-		app.MiddleRecoverPanic,
-		app.Session.LoadAndSave,
-		app.MiddleLogRequest,
-		MiddlewareMainHeaders,
-	).Then(main)
-	
-	root := http.NewServeMux()
-	root.Handle("/frontend/", staticWrapped)
-    root.Handle("/favicon.ico", staticWrapped)
-    root.Handle("/", mainWrapped)
-    
-    return root
+		data[column.Name] = value
+	}
+	return nil
 }
 
-func (app *Application) LoginGet(w http.ResponseWriter, r *http.Request) {	
-	_, ok := app.Session.Get(r.Context(), "user").(User)
-	if ok {
-		http.Redirect(w, r, "/app/", http.StatusSeeOther)
-		return
-	}
-	
-	if r.URL.Query().Get("login_error") == "1" {	
-		app.Render(w, r, http.StatusOK, TMPL_LOGIN, LoginForm{ValidationError: true})
-		return
+// TextNormalize cleans a text answer the way its DataType reads it: line endings
+// become \n and the ends are trimmed everywhere, codes lose all inner whitespace
+// and multi-choice lists the spaces around commas. Free text keeps its line breaks
+// but runs of spaces and tabs become one space.
+func TextNormalize(dataType, text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = strings.TrimSpace(text)
+
+	switch dataType {
+	case "P":
+		return strings.Join(strings.Fields(text), "")
+	case "W0":
+		values := strings.Split(text, ",")
+		for i, value := range values {
+			values[i] = strings.TrimSpace(value)
+		}
+		return strings.Join(values, ",")
+	case "str":
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			lines[i] = strings.Join(strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' }), " ")
+		}
+		return strings.Join(lines, "\n")
 	}
-	
-	app.Render(w, r, http.StatusOK, TMPL_LOGIN, nil)
+	return text
 }
 
-func (app *Application) LoginPost(w http.ResponseWriter, r *http.Request) {		
-	var loginForm LoginForm
-	r.ParseForm()
-	app.FormDecoder.Decode(&loginForm, r.PostForm)
-
-	var userCreds LoginForm
-	row := app.DBManager.MQueryRowx("login_password_get", loginForm.Login)
-	if err := row.StructScan(&userCreds); err != nil {
-		app.Logger.Error(err.Error())
-		http.Redirect(w, r, "/?login_error=1", http.StatusSeeOther)
+// SubtableDataNormalize rewrites numeric answers typed as text ("1 234,56") into JSON
+// numbers and cleans text answers with TextNormalize, so every stored blob uses the
+// same canonical form. Values that don't parse are left as they are for validation
+// to report. Columns flagged zachowaj_biale_znaki keep their text untouched.
+func SubtableDataNormalize(columns []TableColumn, jsonData string) (string, error) {
+	byName := make(map[string]*TableColumn, len(columns))
+	for i := range columns {
+		byName[columns[i].Name] = &columns[i]
 	}
 
-	loginFormLower := strings.ToLower(loginForm.Login)
-	userCredsLower := strings.ToLower(userCreds.Login)
-	
-	if loginFormLower != userCredsLower || loginForm.Password != userCreds.Password {
-		http.Redirect(w, r, "/?login_error=1", http.StatusSeeOther)
-		return
+	normalizeValue := func(column *TableColumn, value any) any {
+		text, ok := value.(string)
+		if !ok || column == nil {
+			return value
+		}
+		if column.DataType == "int" || column.DataType == "float" {
+			if strings.TrimSpace(text) == "" {
+				return value
+			}
+			if number, err := ParseLocalizedNumber(text); err == nil {
+				return number
+			}
+		}
+		if !column.KeepWhitespace {
+			return TextNormalize(column.DataType, text)
+		}
+		return value
 	}
 
-	var userData User
-	row = app.DBManager.MQueryRowx("user_data_get", loginForm.Login)
-	if err := row.StructScan(&userData); err != nil {
-		app.ServerError(w, r, err)
-		return
+	// Matrix blobs nest a row per code; every cell takes the value column's type.
+	matrixColumn := ColumnFirstValue(columns)
+	normalize := func(data map[string]any) {
+		for name, value := range data {
+			if cells, ok := value.(map[string]any); ok {
+				for code, cell := range cells {
+					cells[code] = normalizeValue(matrixColumn, cell)
+				}
+				continue
+			}
+			data[name] = normalizeValue(byName[name], value)
+		}
 	}
 
-	switch userData.Rola {
-	case "Adm":
-		userData.Role = UserAdmin
-	case "Met":
-		userData.Role = UserMethodolgist
-	case "ZBR":
-		userData.Role = UserManager
-	case "PBR":
-		userData.Role = UserNormal
-	default:
-		app.ServerError(w, r, fmt.Errorf("unknown role: %s", userData.Rola))
-		return
+	if strings.HasPrefix(strings.TrimSpace(jsonData), "{") {
+		var data map[string]any
+		if err := json.Unmarshal([]byte(jsonData), &data); err != nil {
+			return "", err
+		}
+		normalize(data)
+		normalized, err := json.Marshal(data)
+		return string(normalized), err
 	}
 
-	app.Session.Put(r.Context(), "user", userData)
-
-	http.Redirect(w, r, "/app/", http.StatusSeeOther)
+	var dataArray []map[string]any
+	if err := json.Unmarshal([]byte(jsonData), &dataArray); err != nil {
+		return "", err
+	}
+	for _, data := range dataArray {
+		normalize(data)
+	}
+	normalized, err := json.Marshal(dataArray)
+	return string(normalized), err
 }
 
-func (app *Application) LogoutGet(w http.ResponseWriter, r *http.Request) {
-	if err := app.Session.Destroy(r.Context()); err != nil {
-		app.ServerError(w, r, err)
+// VerticalFormulasApply runs FormulasApply on a vertical table payload.
+func VerticalFormulasApply(columns []TableColumn, jsonData string) (string, error) {
+	if jsonData == "" || !slices.ContainsFunc(columns, func(c TableColumn) bool { return c.Formula != "" }) {
+		return jsonData, nil
+	}
+
+	var data map[string]any
+	if err := json.Unmarshal([]byte(jsonData), &data); err != nil {
+		return "", err
+	}
+	if err := FormulasApply(columns, data); err != nil {
+		return "", err
+	}
+
+	computed, err := json.Marshal(data)
+	return string(computed), err
+}
+
+func formatValue(v any) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64:
+		// Check if it's actually an integer
+		if val == float64(int64(val)) {
+			return strconv.FormatInt(int64(val), 10)
+		}
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+// BlokadySelectBySubtable fetches blocks for a subtable.
+func (app *Application) BlokadySelectBySubtable(yearDB YearDB, subtable string) ([]BBlokady, error) {
+	rows, err := app.DBManager.YQueryx(yearDB, "b_blokady_where_podtabela", subtable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocks []BBlokady
+	if err := sqlx.StructScan(rows, &blocks); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// PodtabeleSelectAll fetches every subtable with its parent table and schema type,
+// ordered the same way the tabs are.
+func (app *Application) PodtabeleSelectAll(yearDB YearDB) ([]BPodtabele, error) {
+	rows, err := app.DBManager.YQueryx(yearDB, "b_podtabele_select_tabela_podtabela_schemat_tabeli")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var podtabele []BPodtabele
+	if err := sqlx.StructScan(rows, &podtabele); err != nil {
+		return nil, err
+	}
+
+	return podtabele, nil
+}
+
+// ValidateSubtableData checks subtable JSON against its column definitions.
+// Horizontal tables carry an array of rows keyed by the _Kod column, vertical
+// tables a single object. Blocked cells must stay empty; codes must be unique
+// unless the table is HORIZONTAL_DYNAMIC_DUPLICABLE.
+func ValidateSubtableData(tableType string, columns []TableColumn, blocks []BBlokady, jsonData string) ([]ValidationError, error) {
+	if jsonData == "" {
+		return nil, nil
+	}
+
+	// walidacja comes from the definitions; one that doesn't compile is a definition
+	// bug and shouldn't block every save, so the column just isn't pattern checked.
+	patterns := make(map[string]*regexp.Regexp)
+	for _, column := range columns {
+		if column.Regex == "" {
+			continue
+		}
+		if re, err := regexp.Compile("^(?:" + column.Regex + ")$"); err == nil {
+			patterns[column.Name] = re
+		}
+	}
+
+	if tableType == VERTICAL_STATIC_UNIQUE {
+		var data map[string]any
+		if err := json.Unmarshal([]byte(jsonData), &data); err != nil {
+			return nil, err
+		}
+		return validateRow(columns, patterns, nil, "", 0, data), nil
+	}
+
+	if tableType == MATRIX_DYNAMIC_UNIQUE {
+		matrix, err := MatrixParse(jsonData)
+		if err != nil {
+			return nil, err
+		}
+		return validateMatrix(columns, patterns, blocks, matrix), nil
+	}
+
+	var dataArray []map[string]any
+	if err := json.Unmarshal([]byte(jsonData), &dataArray); err != nil {
+		return nil, err
+	}
+
+	var errs []ValidationError
+	seen := make(map[string]bool)
+	for i, item := range dataArray {
+		code, codeColumn := "", ""
+		for k, v := range item {
+			if ColumnIsKey(k) {
+				code, _ = v.(string)
+				codeColumn = k
+				break
+			}
+		}
+
+		if code != "" && tableType != HORIZONTAL_DYNAMIC_DUPLICABLE {
+			if seen[code] {
+				errs = append(errs, ValidationError{Code: code, Index: i, Column: codeColumn, Message: "Zduplikowany kod"})
+			}
+			seen[code] = true
+		}
+
+		errs = append(errs, validateRow(columns, patterns, blocks, code, i, item)...)
+	}
+
+	return errs, nil
+}
+
+// MSG_CODE_UNKNOWN marks a row whose code isn't on the subtable's code list.
+const MSG_CODE_UNKNOWN = "Nieznany kod"
+
+// CodesAllowedSelect loads the codes the rows of a subtable may carry, from the
+// same query the grid builds its code list with.
+func (app *Application) CodesAllowedSelect(yearDB YearDB, subtable string) (map[string]bool, error) {
+	kody, err := app.KodySelectBySubtable(yearDB, subtable)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool, len(kody))
+	for _, kod := range kody {
+		allowed[kod.Code] = true
+	}
+	return allowed, nil
+}
+
+// ValidateRowCodes rejects the rows of a horizontal table whose _Kod isn't in
+// allowed. A subtable without a code list has nothing to check against, and the
+// other table types don't key rows by _Kod.
+func ValidateRowCodes(tableType string, allowed map[string]bool, jsonData string) ([]ValidationError, error) {
+	switch tableType {
+	case HORIZONTAL_DYNAMIC_DUPLICABLE, HORIZONTAL_DYNAMIC_UNIQUE, HORIZONTAL_STATIC_UNIQUE, PKD_STATIC_UNIQUE, SIMC_STATIC_UNIQUE:
+	default:
+		return nil, nil
+	}
+	if len(allowed) == 0 || jsonData == "" {
+		return nil, nil
+	}
+
+	var dataArray []map[string]any
+	if err := json.Unmarshal([]byte(jsonData), &dataArray); err != nil {
+		return nil, err
+	}
+
+	var errs []ValidationError
+	for i, item := range dataArray {
+		code, codeColumn := "", ""
+		for k, v := range item {
+			if ColumnIsKey(k) {
+				code, _ = v.(string)
+				codeColumn = k
+				break
+			}
+		}
+		if !allowed[code] {
+			errs = append(errs, ValidationError{Code: code, Index: i, Column: codeColumn, Message: MSG_CODE_UNKNOWN})
+		}
+	}
+	return errs, nil
+}
+
+// validateMatrix checks every cell against ColumnFirstValue. A matrix is sparse, so
+// an absent cell is never missing; required only rejects cells sent empty. A block on
+// the value column and a row code closes that whole row. Errors carry the column code.
+func validateMatrix(columns []TableColumn, patterns map[string]*regexp.Regexp, blocks []BBlokady, matrix map[string]map[string]any) []ValidationError {
+	value := ColumnFirstValue(columns)
+	if value == nil {
+		return nil
+	}
+
+	var errs []ValidationError
+	for i, rowCode := range slices.Sorted(maps.Keys(matrix)) {
+		row := matrix[rowCode]
+		blocked := slices.ContainsFunc(blocks, func(b BBlokady) bool { return b.Column == value.Name && b.Code == rowCode })
+		for _, columnCode := range slices.Sorted(maps.Keys(row)) {
+			cell := *value
+			cell.Name = columnCode
+			cell.RequiredWhen = ""
+			cellPatterns := map[string]*regexp.Regexp{columnCode: patterns[value.Name]}
+			if cellPatterns[columnCode] == nil {
+				cellPatterns = nil
+			}
+			var cellBlocks []BBlokady
+			if blocked {
+				cellBlocks = []BBlokady{{Column: columnCode, Code: rowCode}}
+			}
+			errs = append(errs, validateRow([]TableColumn{cell}, cellPatterns, cellBlocks, rowCode, i, row)...)
+		}
+	}
+	return errs
+}
+
+// columnRequired resolves wymagana_gdy against the submitted row. Like walidacja,
+// a condition that doesn't parse is a definition bug and leaves the field optional
+// rather than blocking every save.
+func columnRequired(column *TableColumn, data map[string]any) bool {
+	if column.RequiredWhen == "" {
+		return column.Required == 1
+	}
+	required, err := EvalCondition(column.RequiredWhen, data)
+	return err == nil && required
+}
+
+func validateRow(columns []TableColumn, patterns map[string]*regexp.Regexp, blocks []BBlokady, code string, index int, data map[string]any) []ValidationError {
+	var errs []ValidationError
+	fail := func(column, message string) {
+		errs = append(errs, ValidationError{Code: code, Index: index, Column: column, Message: message})
+	}
+
+	for i := range columns {
+		column := &columns[i]
+		if ColumnIsKey(column.Name) {
+			continue
+		}
+
+		value := strings.TrimSpace(formatValue(data[column.Name]))
+
+		blocked := false
+		for _, block := range blocks {
+			if block.Column == column.Name && block.Code == code {
+				blocked = true
+				break
+			}
+		}
+		if blocked {
+			if value != "" {
+				fail(column.Name, "Pole zablokowane")
+			}
+			continue
+		}
+
+		if value == "" {
+			if columnRequired(column, data) {
+				fail(column.Name, MSG_REQUIRED)
+			}
+			continue
+		}
+
+		switch column.DataType {
+		case "int", "float":
+			number, err := ParseLocalizedNumber(value)
+			if err != nil {
+				fail(column.Name, "Nieprawidłowy format liczby")
+				continue
+			}
+			if column.Min != nil && number < float64(*column.Min) {
+				fail(column.Name, fmt.Sprintf("Wartość musi być co najmniej %d", *column.Min))
+			}
+			if column.Max != nil && number > float64(*column.Max) {
+				fail(column.Name, fmt.Sprintf("Wartość musi być co najwyżej %d", *column.Max))
+			}
+
+		case "P", "W0":
+			// W0 stores the checked options joined with commas.
+			values := []string{value}
+			if column.DataType == "W0" {
+				values = strings.Split(value, ",")
+			}
+			for _, v := range values {
+				if !slices.ContainsFunc(column.Enum, func(e TableEnum) bool { return e.Value == v }) {
+					fail(column.Name, "Wartość spoza listy")
+					break
+				}
+			}
+		}
+
+		if re, ok := patterns[column.Name]; ok && !re.MatchString(value) {
+			fail(column.Name, "Nieprawidłowy format")
+		}
+	}
+
+	return errs
+}
+
+// BlokadySelectBySubtableAndCode fetches blocks for a subtable and specific code.
+func (app *Application) BlokadySelectBySubtableAndCode(yearDB YearDB, subtable, code string) ([]BBlokady, error) {
+	rows, err := app.DBManager.YQueryx(yearDB, "b_blokady_where_podtabela_and_kod", subtable, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocks []BBlokady
+	if err := sqlx.StructScan(rows, &blocks); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// YearLocked reports lata.zablokowany for year. A year missing from lata is
+// treated as open; any other error as locked, so a broken master DB can't
+// reopen a closed year.
+func (app *Application) YearLocked(year YearDB) bool {
+	var locked int64
+	err := app.DBManager.MQueryRowx("lata_select_zablokowany_where_rok", int(year)).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		app.Logger.Error("year lock lookup failed", slog.Int("year", int(year)), slog.String("error", err.Error()))
+		return true
+	}
+	return locked == 1
+}
+
+// CellEditable is the single place deciding whether a cell accepts input:
+//   - _Kod columns hold the row key and formula columns are computed,
+//   - blocked cells (b_blokady) must stay empty,
+//   - a locked year is read-only for everyone but Adm, who locks it.
+func (app *Application) CellEditable(col *TableColumn, code string, blocks []BBlokady, year YearDB, user User) bool {
+	if ColumnIsKey(col.Name) || col.Formula != "" || !col.RoleEditable(user.Role) {
+		return false
+	}
+	for _, block := range blocks {
+		if block.Column == col.Name && block.Code == code {
+			return false
+		}
+	}
+	if user.Role&UserAdmin == 0 && app.YearLocked(year) {
+		return false
+	}
+	return true
+}
+
+func (app *Application) TmplBaseDataUserDate(r *http.Request) (*TmplBaseData, error) {
+	user, ok := app.SessionUser(r)
+	if !ok {
+		return nil, fmt.Errorf("user type mismatch")
+	}
+
+	tmplBaseData := &TmplBaseData{
+		PageTitle: "Dashboard",
+		User:      user,
+	}
+
+	rows, err := app.DBManager.MQueryx("lata_select_year_status")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tmplYears []TmplYears
+	for rows.Next() {
+		var year Lata
+		if err := rows.StructScan(&year); err != nil {
+			return nil, err
+		}
+
+		if year.Detached == 1 {
+			continue
+		}
+
+		tmplYears = append(tmplYears, TmplYears{
+			Year:   strconv.FormatInt(year.Year, 10),
+			Locked: year.Locked == 1,
+		})
+	}
+
+	tmplBaseData.Years = tmplYears
+
+	if currentYear := r.PathValue("year"); currentYear != "" {
+		tmplBaseData.CurrentYear = &TmplYears{Year: currentYear, Locked: false}
+		tmplBaseData.Modules = YearModules(currentYear, user)
+	}
+	
+	if currentIdGR := r.PathValue("idgr"); currentIdGR != "" {
+		tmplBaseData.IdGR = currentIdGR
+	}
+
+	return tmplBaseData, nil
+}
+
+// SESSION_LOCALE_KEY holds the locale picked on the profile page, by LocalePost.
+const SESSION_LOCALE_KEY = "locale"
+
+// Locale prefers the choice stored in the session, then the browser's Accept-Language.
+func (app *Application) Locale(r *http.Request) string {
+	if locale := app.Session.GetString(r.Context(), SESSION_LOCALE_KEY); locale != "" {
+		if _, ok := I18N_CATALOG[locale]; ok {
+			return locale
+		}
+	}
+	return LocaleFromAcceptLanguage(r.Header.Get("Accept-Language"))
+}
+
+// Buffers bigger than this (a full grid export) are dropped instead of pooled,
+// so one large page does not pin its memory for the life of the process.
+const RENDER_BUFFER_MAX = 1 << 20
+
+var RENDER_BUFFERS = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+var RENDER_ERROR_HEADERS = []string{
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Length",
+	"ETag",
+	"Last-Modified",
+}
+
+func renderBufferGet() *bytes.Buffer {
+	buf := RENDER_BUFFERS.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func renderBufferPut(buf *bytes.Buffer) {
+	if buf.Cap() > RENDER_BUFFER_MAX {
+		return
+	}
+	RENDER_BUFFERS.Put(buf)
+}
+
+func (app *Application) Render(w http.ResponseWriter, r *http.Request, status int, tmpl *html.Template, data any) {
+	buf := renderBufferGet()
+	defer renderBufferPut(buf)
+
+	err := TmplLocalize(tmpl, app.Locale(r)).ExecuteTemplate(buf, "base", data)
+	if err != nil {
+		// The half-executed page stays in the buffer and is never sent.
+		// Headers a handler set for the page it meant to send would
+		// describe the error body instead, so they go first.
+		for _, header := range RENDER_ERROR_HEADERS {
+			w.Header().Del(header)
+		}
+		app.ServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// Encoding to a buffer first lets an unencodable value become a clean 500
+// instead of a half-written body behind a success status.
+func (app *Application) RenderJSON(w http.ResponseWriter, status int, v any) {
+	buf := renderBufferGet()
+	defer renderBufferPut(buf)
+
+	err := json.NewEncoder(buf).Encode(v)
+	if err != nil {
+		app.Logger.Error("failed to encode json", slog.String("error", err.Error()))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+func (app *Application) ClientError(w http.ResponseWriter, status int) {
+	http.Error(w, http.StatusText(status), status)
+}
+
+func (app *Application) ServerError(w http.ResponseWriter, r *http.Request, err error) {
+	trace := string(debug.Stack())
+
+	app.logger(r).Error("internal error",
+		slog.String("method", r.Method),
+		slog.String("uri", r.URL.RequestURI()),
+		slog.String("error", err.Error()),
+		slog.String("trace", trace),
+	)
+
+	if app.StackStdout {
+		fmt.Fprintln(os.Stdout, "\nSTACK TRACE:\n"+err.Error()+"\n"+trace)
+	}
+
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+func (app *Application) Forbidden(w http.ResponseWriter, r *http.Request) {
+	app.logger(r).Warn("forbidden access",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"remote_addr", r.RemoteAddr,
+	)
+	http.Error(w, "403 Forbidden", http.StatusForbidden)
+}
+
+// ForbiddenJSON is Forbidden for endpoints called with fetch, which expect a
+// JSON body even when they refuse.
+func (app *Application) ForbiddenJSON(w http.ResponseWriter, r *http.Request, message string) {
+	app.logger(r).Warn("forbidden access",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"remote_addr", r.RemoteAddr,
+	)
+	app.jsonError(w, message, http.StatusForbidden)
+}
+
+// contextKey keeps the values this package puts on request contexts apart from
+// other packages' keys.
+type contextKey int
+
+const (
+	CONTEXT_LOGGER contextKey = iota
+	// CONTEXT_IN_FLIGHT carries the release of the request's InFlight slot.
+	CONTEXT_IN_FLIGHT
+	// CONTEXT_YEAR carries the release of the year MiddleYear acquired.
+	CONTEXT_YEAR
+)
+
+// RE_REQUEST_ID is what a proxy's X-Request-Id must look like to be reused;
+// anything else is replaced so the header can't inject into the logs.
+var RE_REQUEST_ID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// MiddleRequestID gives every request an ID, the proxy's X-Request-Id when it
+// sent a usable one, echoes it back and puts a logger carrying it on the context.
+func (app *Application) MiddleRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !RE_REQUEST_ID.MatchString(id) {
+			id = rand.Text()
+		}
+		w.Header().Set("X-Request-Id", id)
+
+		logger := app.Logger.With(slog.String("request_id", id))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CONTEXT_LOGGER, logger)))
+	})
+}
+
+// MiddleLogUser adds the session user to the request logger. It must run after
+// LoadAndSave, app.logger can't look the user up itself because the session
+// status endpoint has no session loaded and scs panics on that.
+func (app *Application) MiddleLogUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := app.SessionUser(r); ok {
+			logger := app.logger(r).With(slog.String("user", user.Login))
+			r = r.WithContext(context.WithValue(r.Context(), CONTEXT_LOGGER, logger))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logger is app.Logger with the request ID and the session user, when the
+// middleware put them there, so every line of a request can be found together.
+func (app *Application) logger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(CONTEXT_LOGGER).(*slog.Logger); ok {
+		return logger
+	}
+	return app.Logger
+}
+
+func (app *Application) MiddleLogRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.logger(r).Info("received request",
+			slog.String("ip", r.RemoteAddr),
+			slog.String("proto", r.Proto),
+			slog.String("method", r.Method),
+			slog.String("uri", r.URL.RequestURI()),
+		)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *Application) MiddleRecoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if pv := recover(); pv != nil {
+				w.Header().Set("Connection", "close")
+				app.ServerError(w, r, fmt.Errorf("%v", pv))
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SESSION_USER_KEY is the session key LoginPost stores the User under.
+const SESSION_USER_KEY = "user"
+
+// SessionUser is the logged in user of the request. ok is false for no user, a
+// value of another type, or a request that never went through LoadAndSave,
+// where scs would panic instead.
+func (app *Application) SessionUser(r *http.Request) (user User, ok bool) {
+	defer func() {
+		if recover() != nil {
+			user, ok = User{}, false
+		}
+	}()
+	user, ok = app.Session.Get(r.Context(), SESSION_USER_KEY).(User)
+	return user, ok
+}
+
+func (app *Application) MiddleLoged(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := app.SessionUser(r)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MiddleRequireRole lets through only users whose role is in allowed (see Access* consts).
+func (app *Application) MiddleRequireRole(allowed UserType) ConstructorFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := app.SessionUser(r)
+			if !ok || !user.Role.HasAccess(allowed) {
+				app.Forbidden(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// MiddleYear rejects years that are out of range or have no loaded database, so
+// handlers never index yearCacheMap with a year that isn't there. The year is
+// held with YearAcquire until the handler returns, or until YearRelease.
+func (app *Application) MiddleYear(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		yearDB, err := app.PathValueYearParse(r)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		acquired, ok := app.DBManager.YearAcquire(yearDB)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		release := sync.OnceFunc(acquired)
+		defer release()
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CONTEXT_YEAR, release)))
+	})
+}
+
+// YearRelease lets go of the year MiddleYear holds before the handler returns.
+// The events stream calls it once it no longer queries the year, so RemoveYear
+// doesn't wait out DrainTimeout on every open farm page.
+func YearRelease(r *http.Request) {
+	if release, ok := r.Context().Value(CONTEXT_YEAR).(func()); ok {
+		release()
+	}
+}
+
+// MiddleYearHold is MiddleYear for the JSON routes: it holds a loaded year the
+// same way but leaves a missing one to the handler's own JSON error.
+func (app *Application) MiddleYearHold(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if yearDB, err := app.PathValueYearParse(r); err == nil {
+			if release, ok := app.DBManager.YearAcquire(yearDB); ok {
+				defer release()
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *Application) MiddleAccessIdGR(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		yearDB, err := app.PathValueYearParse(r)
+		if err != nil {
+			http.Redirect(w, r, "/app/", http.StatusSeeOther)
+			return
+		}
+
+		idGR := r.PathValue("idgr")
+		if idGR == "" {
+			http.Redirect(w, r, "/app/", http.StatusSeeOther)
+			return
+		}
+
+		user, ok := app.SessionUser(r)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if app.IdGRAllowed(r, yearDB, user, idGR) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		http.Redirect(w, r, "/app/", http.StatusSeeOther)
+	})
+}
+
+// MiddleAccessIdGRJSON does the checks of MiddleLoged, MiddleYear and
+// MiddleAccessIdGR for JSON endpoints. fetch follows their redirects silently,
+// so a refused save got the /app/ page with 200 and looked successful.
+func (app *Application) MiddleAccessIdGRJSON(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.SessionUser(r)
+		if !ok {
+			app.jsonError(w, "Sesja wygasła, zaloguj się ponownie", http.StatusUnauthorized)
+			return
+		}
+
+		yearDB, err := app.PathValueYearParse(r)
+		if err != nil || !app.DBManager.HasYear(yearDB) {
+			app.jsonError(w, "Unknown year", http.StatusNotFound)
+			return
+		}
+
+		idGR := r.PathValue("idgr")
+		if idGR == "" || !app.IdGRAllowed(r, yearDB, user, idGR) {
+			app.ForbiddenJSON(w, r, "Brak dostępu do tego gospodarstwa")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IdGRAllowed tells whether user may work on the farm idGR, see User for the
+// scope of each role.
+func (app *Application) IdGRAllowed(r *http.Request, yearDB YearDB, user User, idGR string) bool {
+	switch {
+	case user.Role&UserAdmin != 0:
+		return true
+
+	case app.FarmArchived(r, idGR):
+		return false
+
+	case user.Role&UserManager != 0:
+		var access int64
+		row := app.DBManager.MQueryRowx("rok_idbr_check", int(yearDB), idGR, user.IdBR)
+		if err := row.Scan(&access); err != nil {
+			app.logger(r).Error(err.Error())
+		}
+		return access == 1
+
+	case user.Role&UserNormal != 0:
+		return user.HasIdGR(yearDB, idGR)
+	}
+
+	return false
+}
+
+// FarmArchived tells whether an admin archived idGR. A failed check counts as
+// archived, so an error never opens a farm.
+func (app *Application) FarmArchived(r *http.Request, idGR string) bool {
+	var archived bool
+	if err := app.DBManager.MQueryRowx("gospodarstwa_zarchiwizowane_check", idGR).Scan(&archived); err != nil {
+		app.logger(r).Error(err.Error())
+		return true
+	}
+	return archived
+}
+
+// FarmsArchivedSelect returns the archived farms of every year; archiving is a
+// master flag, the year databases keep the farm's data as it was.
+func (app *Application) FarmsArchivedSelect() (map[string]bool, error) {
+	rows, err := app.DBManager.MQueryx("gospodarstwa_select_idgr_where_zarchiwizowane")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	archived := make(map[string]bool)
+	for rows.Next() {
+		var idGR string
+		if err := rows.Scan(&idGR); err != nil {
+			return nil, err
+		}
+		archived[idGR] = true
+	}
+	return archived, rows.Err()
+}
+
+func (app *Application) CORSOriginAllowed(origin string) bool {
+	for _, allowed := range app.CORS.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// corsAllowOrigin sets Access-Control-Allow-Origin for an allowed origin: the
+// origin itself when it is listed, a literal "*" when only the wildcard lets it
+// in. Credentials are only ever allowed to listed origins; browsers refuse them
+// with "*", so a wildcard never exposes a logged-in user's data.
+func (app *Application) corsAllowOrigin(w http.ResponseWriter, origin string) {
+	if !slices.Contains(app.CORS.AllowedOrigins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if app.CORS.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Preflight is answered here, before the mux, because routes only register GET/POST.
+func (app *Application) MiddleCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && app.CORSOriginAllowed(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if preflight {
+			if !allowed {
+				app.ClientError(w, http.StatusForbidden)
+				return
+			}
+			app.corsAllowOrigin(w, origin)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(app.CORS.AllowedMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(app.CORS.AllowedHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed {
+			app.corsAllowOrigin(w, origin)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Keys are scoped by user, year, farm and subtable, so two users (or two subtables)
+// reusing the same client generated key never see each other's responses. A key
+// reused with another body is refused rather than answered with the old save's result.
+func (app *Application) MiddleIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get("Idempotency-Key")
+		if idempotencyKey == "" || app.Idempotency == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, _ := app.SessionUser(r)
+		key := strings.Join([]string{
+			user.Login, r.PathValue("year"), r.PathValue("idgr"), r.PathValue("subtable"), idempotencyKey,
+		}, "|")
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			app.jsonError(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		bodyHash := hex.EncodeToString(sum[:])
+
+		entry := app.Idempotency.Begin(key, bodyHash)
+		if entry != nil {
+			if entry.BodyHash != bodyHash {
+				app.jsonError(w, "Idempotency-Key was already used with a different request body", http.StatusUnprocessableEntity)
+				return
+			}
+			if !entry.Done {
+				app.jsonError(w, "Request with this Idempotency-Key is still in progress", http.StatusConflict)
+				return
+			}
+			for name, values := range entry.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.Status)
+			w.Write(entry.Body)
+			return
+		}
+
+		// Only the headers the handler sets are replayed; the ones set before it,
+		// like X-Request-Id, belong to each request.
+		before := w.Header().Clone()
+		rec := &ResponseRecorder{ResponseWriter: w}
+		defer func() {
+			// A panic leaves Status at 0; release the key so the retry is not stuck on 409.
+			if rec.Status == 0 {
+				rec.Status = http.StatusInternalServerError
+			}
+			header := make(http.Header)
+			for name, values := range w.Header() {
+				if !slices.Equal(before[name], values) {
+					header[name] = slices.Clone(values)
+				}
+			}
+			app.Idempotency.Finish(key, bodyHash, rec.Status, header, rec.Body.Bytes())
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// MiddleAllowedHosts rejects requests for hosts not in AllowedHosts, so a forged
+// Host header never reaches redirects or absolute URLs built from the request.
+func (app *Application) MiddleAllowedHosts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.AllowedHosts != nil && !HostAllowed(r.Host, app.AllowedHosts) {
+			app.logger(r).Warn("host not allowed",
+				slog.String("host", r.Host),
+				slog.String("remote_addr", r.RemoteAddr),
+			)
+			app.ClientError(w, http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HSTS is only sent when this server terminates TLS, so local development over plain
+// HTTP never pins localhost to HTTPS.
+func (app *Application) MiddleHSTS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && app.HSTSMaxAge > 0 {
+			w.Header().Set("Strict-Transport-Security",
+				fmt.Sprintf("max-age=%d; includeSubDomains", int64(app.HSTSMaxAge.Seconds())))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MiddleInFlight answers 503 once InFlight is full instead of queueing more
+// requests on SQLite, e.g. when everyone submits right before a deadline. Only
+// the app and API chains use it, static files and the session status poll
+// don't touch the databases and stay reachable. Streams give the slot back with
+// InFlightRelease once they are set up.
+func (app *Application) MiddleInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.InFlight == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case app.InFlight <- struct{}{}:
+			release := sync.OnceFunc(func() { <-app.InFlight })
+			defer release()
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CONTEXT_IN_FLIGHT, release)))
+		default:
+			app.logger(r).Warn("too many requests in flight",
+				slog.Int("limit", cap(app.InFlight)),
+				slog.String("uri", r.URL.RequestURI()),
+			)
+			w.Header().Set("Retry-After", "1")
+			app.ClientError(w, http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// InFlightRelease frees the request's InFlight slot before the handler returns,
+// for the events stream, which stays open for as long as the page does and
+// would otherwise use a slot per open tab.
+func InFlightRelease(r *http.Request) {
+	if release, ok := r.Context().Value(CONTEXT_IN_FLIGHT).(func()); ok {
+		release()
+	}
+}
+
+// MiddleLongWrite moves the write deadline for routes that legitimately run past
+// -write-timeout (exports, backups). There is no per-request timeout middleware:
+// the server deadlines are the only bound, so this one is the whole budget.
+func (app *Application) MiddleLongWrite(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.LongWriteTimeout > 0 {
+			err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(app.LongWriteTimeout))
+			if err != nil && !errors.Is(err, http.ErrNotSupported) {
+				app.logger(r).Warn("failed to extend write deadline", slog.String("error", err.Error()))
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func MiddlewareStaticHeaders(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+        w.Header().Set("X-Content-Type-Options", "nosniff")
+        next.ServeHTTP(w, r)
+    })
+}
+
+func MiddlewareMainHeaders(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Referrer-Policy", "origin-when-cross-origin")
+        w.Header().Set("X-Content-Type-Options", "nosniff")
+        w.Header().Set("X-Frame-Options", "deny")
+        w.Header().Set("X-XSS-Protection", "0")
+        // TODO: Causes issue with style set as an attribute
+        // w.Header().Set("Content-Security-Policy", "default-src 'self'") 
+        w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+        w.Header().Set("Pragma", "no-cache")
+        w.Header().Set("Expires", "0")
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Routes maps every URL to exactly one handler. The HTML pages nest the way a user
+// drills down, one handler per level:
+//
+//	/app/                                  AppGet             year chooser
+//	/app/{year}/                           YearGet            module chooser
+//	/app/{year}/bdgr/lista-ankiet/         ListGRGet          farm list (TMPL_LIST_GR)
+//	/app/{year}/bdgr/lista-ankiet/{idgr}   AnkietIdGRGet      farm page: table tabs, comments (TMPL_GRID)
+//	.../{idgr}/{table}/                    AnkietTableGet     subtable tabs (TMPL_GRID)
+//	.../{idgr}/{table}/{subtable}/         AnkietSubtableGet  the survey grid (TMPL_GRID)
+//
+// Everything else under a level is an action or JSON for that level's page.
+// All of these sit under BASE_PATH when -base-path is set.
+func (app *Application) Routes() http.Handler {
+	staticContent := http.NewServeMux()
+	embedded := http.FileServer(http.FS(FS_FRONTEND))
+	staticContent.HandleFunc("GET  /frontend/", func(w http.ResponseWriter, r *http.Request) {
+		if app.StaticDirServe(w, r, strings.TrimPrefix(r.URL.Path, "/frontend/")) {
+			return
+		}
+		embedded.ServeHTTP(w, r)
+	})
+	staticContent.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		if app.StaticDirServe(w, r, "favicon.ico") {
+			return
+		}
+		data, err := FS_FRONTEND.ReadFile("frontend/favicon.ico")
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Write(data)
+	})
+	
+	staticWrapped := ChainNew(MiddlewareStaticHeaders, app.MiddleHSTS).Then(staticContent)
+	
+	Logged := ChainFuncNew(app.MiddleLoged)
+	Year := Logged.Append(app.MiddleYear)
+	AccessIdGR := Year.Append(app.MiddleAccessIdGR)
+	AccessIdGRJSON := ChainFuncNew(app.MiddleYearHold, app.MiddleAccessIdGRJSON)
+
+	main := http.NewServeMux()
+	main.HandleFunc("GET  /{$}", app.LoginGet)
+	main.HandleFunc("POST /login", app.LoginPost)
+	main.HandleFunc("GET  /logout", app.LogoutGet)
+	if app.Debug {
+		main.HandleFunc("GET  /mock", app.MockGet)
+	}
+	main.HandleFunc("GET  /app/", Logged.Then(app.AppGet))
+	main.HandleFunc("GET  /app/years.json", Logged.Then(app.ChooserJSONGet))
+	main.HandleFunc("GET  /app/config.json", Logged.Then(app.ConfigJSONGet))
+	main.HandleFunc("GET  /app/profile", Logged.Then(app.ProfileGet))
+	main.HandleFunc("POST /app/profile/locale", Logged.Then(app.LocalePost))
+	main.HandleFunc("POST /app/session/keepalive", Logged.Then(app.SessionKeepalivePost))
+	main.HandleFunc("GET  /app/users.json", Logged.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.UsersGet))
+	main.HandleFunc("POST /app/users", Logged.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.UsersPost))
+	main.HandleFunc("POST /app/users/{idpbr}/aktywny", Logged.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.UserAktywnyPost))
+	main.HandleFunc("POST /app/users/{idpbr}/zablokowany", Logged.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.UserZablokowanyPost))
+	main.HandleFunc("POST /app/farms/{idgr}/archiwizuj", Logged.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.FarmArchivePost))
+	main.HandleFunc("POST /app/farms/{idgr}/przywroc", Logged.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.FarmUnarchivePost))
+	main.HandleFunc("POST /app/years", Logged.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.YearsPost))
+	// /app/{year}/ is a subtree on purpose: module pages without a handler yet
+	// land on the module chooser. See TrailingSlashCanonical for the slash policy.
+	main.HandleFunc("GET  /app/{year}/", Year.Then(app.YearGet))
+	main.HandleFunc("GET  /app/{year}/modules.json", Year.Then(app.ChooserJSONGet))
+	main.HandleFunc("GET  /app/{year}/integrity.json", Year.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.IntegrityGet))
+	main.HandleFunc("POST /app/{year}/backup", Year.Append(app.MiddleRequireRole(AccessAdminOnly), app.MiddleLongWrite).Then(app.YearBackupPost))
+	main.Handle("GET  /app/{year}/audyt", app.FeatureGate(FEATURE_EXPORTS, Year.Append(app.MiddleRequireRole(AccessAdminOnly), app.MiddleLongWrite).Then(app.AuditExportGet)))
+	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/", Year.Then(app.ListGRGet))
+	main.HandleFunc("GET  /app/{year}/bdgr/stats.json", Year.Then(app.StatsGet))
+	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}", AccessIdGR.Then(app.AnkietIdGRGet))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/komentarz-zbr", AccessIdGR.Append(app.MiddleRequireRole(UserManager)).Then(app.KomentarzZBRPost))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/komentarz-inst", Year.Append(app.MiddleRequireRole(AccessAdminMethodologist)).Then(app.KomentarzInstPost))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/etap/{akcja}", Year.Then(app.EtapTransitionPost))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/batch-transition", Year.Append(app.MiddleRequireRole(AcesssAdminManager)).Then(app.BatchTransitionPost))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/kopiuj", Year.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.FarmCopyPost))
+	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/progress.json", AccessIdGR.Then(app.AnkietProgressGet))
+	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/timeline.json", AccessIdGR.Then(app.AnkietTimelineGet))
+	main.Handle("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/export", app.FeatureGate(FEATURE_EXPORTS, AccessIdGR.Append(app.MiddleLongWrite).Then(app.AnkietExportGet)))
+	main.Handle("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/export.json", app.FeatureGate(FEATURE_EXPORTS, AccessIdGR.Append(app.MiddleLongWrite).Then(app.AnkietExportGet)))
+	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/events", AccessIdGR.Then(app.AnkietEventsGet))
+	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/", AccessIdGR.Then(app.AnkietTableGet))
+	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/", AccessIdGR.Then(app.AnkietSubtableGet))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/", AccessIdGRJSON.Append(app.MiddleIdempotency).Then(app.AnkietSubtablePost))
+	main.HandleFunc("DELETE /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}", AccessIdGRJSON.Then(app.AnkietSubtableDelete))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/validate", AccessIdGR.Then(app.AnkietSubtableValidatePost))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/blokada", AccessIdGR.Then(app.EditLockPost))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/blokada/zwolnij", AccessIdGR.Then(app.EditLockReleasePost))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/zalaczniki", AccessIdGR.Then(app.ZalacznikiPost))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/nie-dotyczy", AccessIdGR.Then(app.NotApplicablePost))
+	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/zalaczniki.json", AccessIdGR.Then(app.ZalacznikiGet))
+	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/zalaczniki/{id}", AccessIdGR.Then(app.ZalacznikGet))
+	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/raw.json", AccessIdGR.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.AnkietSubtableRawGet))
+	main.HandleFunc("GET  /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/{code}/{index}", AccessIdGR.Then(app.AnkietRowGet))
+	main.HandleFunc("POST /app/{year}/bdgr/lista-ankiet/{idgr}/{table}/{subtable}/{code}/{index}", AccessIdGRJSON.Append(app.MiddleIdempotency).Then(app.AnkietRowPost))
+	main.HandleFunc("GET  /app/{year}/bdgr/metodyka/{path...}", Year.Then(app.MetodykaGet))
+	main.HandleFunc("GET  /app/{year}/bdgr/metodyka/preview/{table}/{subtable}", Year.Append(app.MiddleRequireRole(AccessAdminMethodologist)).Then(app.MetodykaPreviewGet))
+	main.HandleFunc("GET  /app/{year}/slowniki/{source}", Year.Then(app.LookupGet))
+	main.HandleFunc("POST /app/{year}/bdgr/metodyka/import/{table}", Year.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.SystemImportPost))
+	main.HandleFunc("GET  /app/{year}/bdgr/metodyka/diff/{table}", Year.Append(app.MiddleRequireRole(AccessAdminMethodologist)).Then(app.SystemDiffGet))
+	main.HandleFunc("GET  /app/{year}/bdgr/metodyka/schema/{subtable}", Year.Append(app.MiddleRequireRole(AccessAdminOnly)).Then(app.MetodykaSchemaGet))
+	main.HandleFunc("POST /app/{year}/bdgr/metodyka/kopiuj", Year.Append(app.MiddleRequireRole(AccessAdminOnly), app.MiddleLongWrite).Then(app.DefinitionsCopyPost))
+
+	mainWrapped := ChainNew(
+		app.MiddleRequestID,
+		app.MiddleRecoverPanic,
+		app.MiddleInFlight,
+		app.Session.LoadAndSave,
+		app.MiddleSessionSeen,
+		app.MiddleLogUser,
+		app.MiddleLogRequest,
+		MiddlewareMainHeaders,
+		app.MiddleHSTS,
+	).Then(TrailingSlashCanonical(main))
+
+	sessionStatus := ChainNew(
+		app.MiddleRequestID,
+		app.MiddleRecoverPanic,
+		app.MiddleLogRequest,
+		MiddlewareMainHeaders,
+		app.MiddleHSTS,
+	).Then(http.HandlerFunc(app.SessionStatusGet))
+
+	// JSON endpoints meant for other origins. Kept on a separate mux so CORS never
+	// touches the HTML app.
+	api := http.NewServeMux()
+	api.HandleFunc("GET  /api/{year}/bdgr/lista-ankiet/{idgr}/progress.json", AccessIdGR.Then(app.AnkietProgressGet))
+	api.HandleFunc("GET  /api/{year}/bdgr/lista-ankiet/{idgr}/timeline.json", AccessIdGR.Then(app.AnkietTimelineGet))
+
+	apiWrapped := ChainNew(
+		app.MiddleRequestID,
+		app.MiddleRecoverPanic,
+		app.MiddleCORS,
+		app.MiddleInFlight,
+		app.Session.LoadAndSave,
+		app.MiddleSessionSeen,
+		app.MiddleLogUser,
+		app.MiddleLogRequest,
+		MiddlewareMainHeaders,
+		app.MiddleHSTS,
+	).Then(TrailingSlashCanonical(api))
+	
+	root := http.NewServeMux()
+	root.Handle("/frontend/", staticWrapped)
+    root.Handle("/favicon.ico", staticWrapped)
+    root.Handle("/api/", app.FeatureGate(FEATURE_API, apiWrapped))
+    root.Handle("GET /app/session/status", sessionStatus)
+    root.Handle("/", mainWrapped)
+    
+    return app.MiddleAllowedHosts(MountBasePath(root))
+}
+
+// StaticDirServe serves name from -static-dir when the file exists there, so a
+// deployment can swap CSS or the favicon without a rebuild. Unlike the embedded
+// files those can change under a running binary, so browsers must revalidate
+// them instead of caching them as immutable.
+func (app *Application) StaticDirServe(w http.ResponseWriter, r *http.Request, name string) bool {
+	if app.StaticDir == "" {
+		return false
+	}
+	// http.Dir refuses names that climb out of the directory.
+	file, err := http.Dir(app.StaticDir).Open("/" + name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	return true
+}
+
+// Trailing slash policy: a page whose URL has children below it, a list or a
+// table of subtables, ends in a slash (/app/, /app/2030/bdgr/lista-ankiet/,
+// .../{table}/{subtable}/); a single resource, a file or an action doesn't
+// (.../lista-ankiet/G1, progress.json, .../blokada). Routes are registered in
+// their canonical form and TrailingSlashCanonical fixes requests for the other.
+
+// TrailingSlashCanonical sends a request to the form of its path, with the
+// trailing slash or without, that a route of mux matches more specifically:
+// matching all segments, with more of them literal. So progress.json/ is no
+// {table}/ and years.json/ no {year}/. GET and HEAD are redirected, with the
+// 307 ServeMux itself answers a bare subtree path with, so the address bar shows
+// the canonical URL; other methods are served in place rather than make every
+// client replay its body. A path only a subtree route catches, like /app/{year}/
+// catching pages without a handler yet, is left to it.
+func TrailingSlashCanonical(mux *http.ServeMux) http.Handler {
+	// specificity counts the literal segments of the route matching path, -1
+	// when none matches all of its segments.
+	specificity := func(r *http.Request, path string) int {
+		probe := r.Clone(r.Context())
+		probe.URL.Path, probe.URL.RawPath = path, ""
+		_, pattern := mux.Handler(probe)
+		if pattern == "" {
+			return -1
+		}
+		fields := strings.Fields(pattern)
+		patternPath := fields[len(fields)-1]
+		if !strings.Contains(patternPath, "...}") && strings.Count(patternPath, "/") != strings.Count(path, "/") {
+			return -1
+		}
+		literal := 0
+		for _, segment := range strings.Split(patternPath, "/") {
+			if segment != "" && !strings.HasPrefix(segment, "{") {
+				literal++
+			}
+		}
+		return literal
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		other := path + "/"
+		if strings.HasSuffix(path, "/") {
+			other = strings.TrimSuffix(path, "/")
+		}
+		if path == "/" || specificity(r, other) <= specificity(r, path) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			target := url.URL{Path: other, RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.URL.Path, r.URL.RawPath = other, ""
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// MountBasePath serves root under BASE_PATH. Handlers and the mux's own
+// trailing-slash redirects only know app paths, so root-relative Location
+// headers get the prefix on the way out.
+func MountBasePath(root http.Handler) http.Handler {
+	if BASE_PATH == "" {
+		return root
+	}
+
+	mounted := http.NewServeMux()
+	mounted.Handle(BASE_PATH+"/", http.StripPrefix(BASE_PATH, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		root.ServeHTTP(&basePathWriter{ResponseWriter: w}, r)
+	})))
+	return mounted
+}
+
+type basePathWriter struct {
+	http.ResponseWriter
+}
+
+func (bw *basePathWriter) WriteHeader(status int) {
+	location := bw.Header().Get("Location")
+	if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+		bw.Header().Set("Location", BASE_PATH+location)
+	}
+	bw.ResponseWriter.WriteHeader(status)
+}
+
+func (bw *basePathWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+func (app *Application) LoginGet(w http.ResponseWriter, r *http.Request) {	
+	_, ok := app.SessionUser(r)
+	if ok {
+		http.Redirect(w, r, "/app/", http.StatusSeeOther)
+		return
+	}
+	
+	app.Render(w, r, http.StatusOK, TMPL_LOGIN, LoginFormMessage(r.URL.Query()))
+}
+
+// UserIdGRSelect loads the farms assigned to a PBR user, grouped by year.
+func (app *Application) UserIdGRSelect(idPBR string) (map[YearDB][]string, error) {
+	rows, err := app.DBManager.MQueryx("gospodarstwa__lata_select_rok_idgr_where_idpbr", idPBR)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scope := make(map[YearDB][]string)
+	for rows.Next() {
+		var year YearDB
+		var idGR string
+		if err := rows.Scan(&year, &idGR); err != nil {
+			return nil, err
+		}
+		scope[year] = append(scope[year], idGR)
+	}
+
+	return scope, rows.Err()
+}
+
+func (app *Application) LoginPost(w http.ResponseWriter, r *http.Request) {		
+	var loginForm LoginForm
+	r.ParseForm()
+	app.FormDecoder.Decode(&loginForm, r.PostForm)
+
+	var userCreds UserCredentials
+	if app.Directory != nil {
+		login, err := app.DirectoryLogin(r, loginForm.Login, loginForm.Password)
+		if err != nil {
+			if !errors.Is(err, ErrDirectoryCredentials) {
+				app.logger(r).Error("directory login failed", slog.String("error", err.Error()))
+			}
+			http.Redirect(w, r, "/?login_error="+LOGIN_ERROR_CREDENTIALS, http.StatusSeeOther)
+			return
+		}
+		if err := app.DBManager.MQueryRowx("login_password_get", login).StructScan(&userCreds); err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+	} else {
+		row := app.DBManager.MQueryRowx("login_password_get", loginForm.Login)
+		if err := row.StructScan(&userCreds); err != nil {
+			app.logger(r).Error(err.Error())
+			http.Redirect(w, r, "/?login_error="+LOGIN_ERROR_CREDENTIALS, http.StatusSeeOther)
+			return
+		}
+
+		if !LoginEqual(loginForm.Login, userCreds.Login) || !PasswordVerify(userCreds.Password, userCreds.Salt, loginForm.Password) {
+			http.Redirect(w, r, "/?login_error="+LOGIN_ERROR_CREDENTIALS, http.StatusSeeOther)
+			return
+		}
+	}
+
+	// Only reached with the right password, so naming the reason doesn't reveal
+	// which accounts exist.
+	if userCreds.Zablokowany != 0 {
+		http.Redirect(w, r, "/?login_error="+LOGIN_ERROR_LOCKED, http.StatusSeeOther)
+		return
+	}
+	if userCreds.Aktywny != 1 {
+		http.Redirect(w, r, "/?login_error="+LOGIN_ERROR_INACTIVE, http.StatusSeeOther)
+		return
+	}
+
+	var userData User
+	// The stored spelling from here on, whatever case the user typed.
+	row := app.DBManager.MQueryRowx("user_data_get", userCreds.Login)
+	if err := row.StructScan(&userData); err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	role, ok := USER_ROLES[userData.Rola]
+	if !ok {
+		app.ServerError(w, r, fmt.Errorf("unknown role: %s", userData.Rola))
+		return
+	}
+	userData.Role = role
+
+	// The session keeps the previous login, the one worth showing to the user.
+	if _, err := app.DBManager.MExec("uzytkownicy_update_ostatnie_logowanie_where_login", userData.Login); err != nil {
+		app.logger(r).Error("failed to record login time", slog.String("login", userData.Login), slog.String("error", err.Error()))
+	}
+
+	if userData.Role == UserNormal {
+		scope, err := app.UserIdGRSelect(userData.IdPBR)
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		userData.IdGR = scope
+	}
+
+	app.Session.Put(r.Context(), SESSION_USER_KEY, userData)
+
+	http.Redirect(w, r, "/app/", http.StatusSeeOther)
+}
+
+func (app *Application) LogoutGet(w http.ResponseWriter, r *http.Request) {
+	if err := app.Session.Destroy(r.Context()); err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/?login_info="+LOGIN_INFO_LOGGED_OUT, http.StatusSeeOther)
+}
+
+// SESSION_SEEN_KEY holds the unix time of the last request that extended the
+// session. scs keeps the idle expiry in the store only, so the app tracks its own.
+const SESSION_SEEN_KEY = "seen"
+
+// MiddleSessionSeen runs inside LoadAndSave, where every request of a logged in user
+// pushes the idle expiry out by Session.IdleTimeout.
+func (app *Application) MiddleSessionSeen(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.Session.Exists(r.Context(), SESSION_USER_KEY) {
+			app.Session.Put(r.Context(), SESSION_SEEN_KEY, time.Now().Unix())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SessionRemaining is the time left before the session loaded in ctx expires, by
+// whichever comes first: the idle timeout or the absolute lifetime.
+func (app *Application) SessionRemaining(ctx context.Context) time.Duration {
+	if !app.Session.Exists(ctx, SESSION_USER_KEY) {
+		return 0
+	}
+	expires := app.Session.Deadline(ctx)
+	if seen := app.Session.GetInt64(ctx, SESSION_SEEN_KEY); seen > 0 && app.Session.IdleTimeout > 0 {
+		if idle := time.Unix(seen, 0).Add(app.Session.IdleTimeout); idle.Before(expires) {
+			expires = idle
+		}
+	}
+	return max(time.Until(expires), 0)
+}
+
+func (app *Application) sessionStatusRender(w http.ResponseWriter, remaining time.Duration) {
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"active":               remaining > 0,
+		"remaining_seconds":    int(remaining.Seconds()),
+		"idle_timeout_seconds": int(app.Session.IdleTimeout.Seconds()),
+		"warning_seconds":      int(app.SessionWarning.Seconds()),
+	})
+}
+
+// SessionStatusGet is mounted outside LoadAndSave: asking how long the session has
+// left must not extend it, or a page polling this would never time out.
+func (app *Application) SessionStatusGet(w http.ResponseWriter, r *http.Request) {
+	var token string
+	if cookie, err := r.Cookie(app.Session.Cookie.Name); err == nil {
+		token = cookie.Value
+	}
+	ctx, err := app.Session.Load(r.Context(), token)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	app.sessionStatusRender(w, app.SessionRemaining(ctx))
+}
+
+// SessionKeepalivePost extends the session; passing through LoadAndSave and
+// MiddleSessionSeen is all it takes.
+func (app *Application) SessionKeepalivePost(w http.ResponseWriter, r *http.Request) {
+	remaining := min(app.Session.IdleTimeout, time.Until(app.Session.Deadline(r.Context())))
+	app.sessionStatusRender(w, remaining)
+}
+
+// CONFIG_MAX_AGE is how long browsers may reuse /app/config.json. The values
+// only change with a restart, a minute keeps a reload cheap without serving a
+// stale timeout for long after one.
+const CONFIG_MAX_AGE = time.Minute
+
+// ConfigJSONGet tells the frontend the server settings it has to follow, so
+// warnings and limits match the configuration instead of hardcoded guesses.
+// Only what a logged in user's browser needs goes here, never paths on disk,
+// directory or database settings.
+func (app *Application) ConfigJSONGet(w http.ResponseWriter, r *http.Request) {
+	maxRows := app.MaxRows
+	if maxRows == nil {
+		maxRows = map[string]int{}
+	}
+	// The -features switches, then what other settings turn on.
+	features := map[string]bool{
+		"edit_locks":      app.EditLockTimeout > 0,
+		"compact_tables":  app.WideTableWidth > 0,
+		"directory_login": app.Directory != nil,
+	}
+	for _, name := range FEATURES {
+		features[name] = app.FeatureEnabled(name)
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(CONFIG_MAX_AGE.Seconds())))
+	w.Header().Add("Vary", "Accept-Language, Cookie")
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"base_path":                BASE_PATH,
+		"locale":                   app.Locale(r),
+		"idle_timeout_seconds":     int(app.Session.IdleTimeout.Seconds()),
+		"absolute_timeout_seconds": int(app.Session.Lifetime.Seconds()),
+		"warning_seconds":          int(app.SessionWarning.Seconds()),
+		"edit_lock_seconds":        int(app.EditLockTimeout.Seconds()),
+		"max_rows":                 maxRows,
+		"features":                 features,
+	})
+}
+
+func (app *Application) AppGet(w http.ResponseWriter, r *http.Request) {
+	data, err := app.TmplBaseDataUserDate(r)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.Render(w, r, http.StatusOK, TMPL_APP, data)
+}
+
+// ProfileGet shows the session user together with the personal data kept in master,
+// read fresh so changes made by an admin show up without logging in again.
+func (app *Application) ProfileGet(w http.ResponseWriter, r *http.Request) {
+	data, err := app.TmplBaseDataUserDate(r)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	data.PageTitle = I18nTranslate(app.Locale(r), "profile.title")
+
+	var profile UserProfile
+	row := app.DBManager.MQueryRowx("user_profile_get", data.User.Login)
+	if err := row.StructScan(&profile); err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	data.Profile = &profile
+
+	app.Render(w, r, http.StatusOK, TMPL_PROFILE, data)
+}
+
+// LocalePost stores the user's language for the rest of the session; it is
+// gone again after logging out.
+func (app *Application) LocalePost(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	locale := r.PostForm.Get("locale")
+	if _, ok := I18N_CATALOG[locale]; !ok {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	app.Session.Put(r.Context(), SESSION_LOCALE_KEY, locale)
+	http.Redirect(w, r, "/app/profile", http.StatusSeeOther)
+}
+
+const USERS_PAGE_SIZE = 50
+
+// UserListItem is one row of the admin user list; credentials never leave master.
+type UserListItem struct {
+	IdPBR       string `db:"idpbr" json:"idpbr"`
+	Login       string `db:"login" json:"login"`
+	Imie        string `db:"imie" json:"imie"`
+	Nazwisko    string `db:"nazwisko" json:"nazwisko"`
+	Email       string `db:"email" json:"email"`
+	Rola        string `db:"rola" json:"rola"`
+	Aktywny     int64  `db:"aktywny" json:"aktywny"`
+	Zablokowany int64  `db:"zablokowany" json:"zablokowany"`
+	IdBR        string `db:"idbr" json:"idbr"`
+}
+
+// UsersGet lists users page by page (?page=1 is the first), ordered by login.
+func (app *Application) UsersGet(w http.ResponseWriter, r *http.Request) {
+	page := 1
+	if value := r.URL.Query().Get("page"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			app.jsonError(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		page = parsed
+	}
+
+	var total int
+	if err := app.DBManager.MQueryRowx("uzytkownicy_count_all").Scan(&total); err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	rows, err := app.DBManager.MQueryx("uzytkownicy_select_page", USERS_PAGE_SIZE, (page-1)*USERS_PAGE_SIZE)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	users := []UserListItem{}
+	err = sqlx.StructScan(rows, &users)
+	rows.Close()
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"users":     users,
+		"page":      page,
+		"page_size": USERS_PAGE_SIZE,
+		"total":     total,
+	})
+}
+
+// UsersPost creates an active, unblocked user with a hashed password.
+func (app *Application) UsersPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.jsonError(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	field := func(name string) string { return strings.TrimSpace(r.PostForm.Get(name)) }
+	idPBR, login, email, rola, idBR := field("idpbr"), field("login"), field("email"), field("rola"), field("idbr")
+	imie, nazwisko := field("imie"), field("nazwisko")
+	password := r.PostForm.Get("password")
+
+	switch {
+	case idPBR == "" || login == "" || imie == "" || nazwisko == "" || idBR == "":
+		app.jsonError(w, "Wypełnij wszystkie pola", http.StatusBadRequest)
+		return
+	case !ReEmail.MatchString(email):
+		app.jsonError(w, "Nieprawidłowy adres e-mail", http.StatusBadRequest)
+		return
+	case utf8.RuneCountInString(password) < PASSWORD_MIN_LENGTH:
+		app.jsonError(w, fmt.Sprintf("Hasło musi mieć co najmniej %d znaków", PASSWORD_MIN_LENGTH), http.StatusBadRequest)
+		return
+	}
+	if _, ok := USER_ROLES[rola]; !ok {
+		app.jsonError(w, "Nieznana rola", http.StatusBadRequest)
+		return
+	}
+
+	// LoginPost compares logins case-insensitively, so "Nowak" next to "nowak" would be ambiguous.
+	var taken bool
+	if err := app.DBManager.MQueryRowx("uzytkownicy_check_login", login).Scan(&taken); err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	if taken {
+		app.jsonError(w, fmt.Sprintf("Login %s jest już zajęty", login), http.StatusConflict)
+		return
+	}
+
+	salt, err := PasswordSaltNew()
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	hash, err := PasswordHash(password, salt, PASSWORD_HASH_ITERATIONS)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	if _, err := app.DBManager.MExec("uzytkownicy_insert", idPBR, login, hash, salt, imie, nazwisko, email, rola, idBR); err != nil {
+		// Unique idpbr/email and the idbr reference are enforced by master itself.
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+			app.jsonError(w, "Użytkownik narusza ograniczenia bazy (duplikat lub nieznane biuro)", http.StatusConflict)
+			return
+		}
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.logger(r).Info("user created", slog.String("login", login), slog.String("rola", rola))
+	app.RenderJSON(w, http.StatusCreated, map[string]any{
+		"success": true,
+		"idpbr":   idPBR,
+	})
+}
+
+func (app *Application) UserAktywnyPost(w http.ResponseWriter, r *http.Request) {
+	app.userFlagToggle(w, r, "uzytkownicy_update_aktywny_where_idpbr", "aktywny")
+}
+
+func (app *Application) UserZablokowanyPost(w http.ResponseWriter, r *http.Request) {
+	app.userFlagToggle(w, r, "uzytkownicy_update_zablokowany_where_idpbr", "zablokowany")
+}
+
+// userFlagToggle flips a 0/1 column and answers with its new value. Sessions that
+// are already open keep working until they expire; the flags are checked at login.
+func (app *Application) userFlagToggle(w http.ResponseWriter, r *http.Request, queryName, flag string) {
+	idPBR := r.PathValue("idpbr")
+
+	var value int64
+	if err := app.DBManager.MQueryRowx(queryName, idPBR).Scan(&value); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.jsonError(w, "Nieznany użytkownik", http.StatusNotFound)
+			return
+		}
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.logger(r).Info("user flag toggled", slog.String("idpbr", idPBR), slog.String(flag, strconv.FormatInt(value, 10)))
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		flag:      value,
+	})
+}
+
+func (app *Application) FarmArchivePost(w http.ResponseWriter, r *http.Request) {
+	app.farmArchivedSet(w, r, true)
+}
+
+func (app *Application) FarmUnarchivePost(w http.ResponseWriter, r *http.Request) {
+	app.farmArchivedSet(w, r, false)
+}
+
+// farmArchivedSet hides a farm from everyone but admins, or brings it back. Its
+// survey data stays in the year databases either way.
+func (app *Application) farmArchivedSet(w http.ResponseWriter, r *http.Request, archived bool) {
+	idGR := r.PathValue("idgr")
+
+	var value bool
+	if err := app.DBManager.MQueryRowx("gospodarstwa_update_zarchiwizowane_where_idgr", archived, idGR).Scan(&value); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.jsonError(w, "Nieznane gospodarstwo", http.StatusNotFound)
+			return
+		}
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.logger(r).Info("farm archive flag set", slog.String("idgr", idGR), slog.Bool("zarchiwizowane", value))
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"success":        true,
+		"zarchiwizowane": value,
+	})
+}
+
+// MOCK_DATA is what MockGet renders TMPL_MOCK with: an admin "mock" of office
+// BR1 in 2030 (unlocked, the current year) with 2029 locked next to it, and
+// the BDGR module open. Nothing in it is read from a database.
+var MOCK_DATA = TmplBaseData{
+	PageTitle: "Mock",
+	Module:    TmplModuleBDGR,
+	User: User{
+		Login:              "mock",
+		Rola:               "Adm",
+		Role:               UserAdmin,
+		IdBR:               "BR1",
+		IdPBR:              "P1",
+		LastLogin:          "2030-01-15 08:00:00",
+		LastPasswordChange: "2029-12-01 12:00:00",
+	},
+	Years:       []TmplYears{{Year: "2030"}, {Year: "2029", Locked: true}},
+	CurrentYear: &TmplYears{Year: "2030"},
+}
+
+// MockGet lets frontend work on layout without a database or a login. Routes
+// only registers it with -debug.
+func (app *Application) MockGet(w http.ResponseWriter, r *http.Request) {
+	data := MOCK_DATA
+	data.Modules = YearModules(data.CurrentYear.Year, data.User)
+	app.Render(w, r, http.StatusOK, TMPL_MOCK, &data)
+}
+
+func (app *Application) YearGet(w http.ResponseWriter, r *http.Request) {
+	data, err := app.TmplBaseDataUserDate(r)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.Render(w, r, http.StatusOK, TMPL_APP_YEAR, data)
+}
+
+// ChooserJSON is the data of the year and module choosers, for navigation over
+// XHR. Year and Modules are only set under a year.
+type ChooserJSON struct {
+	Years   []TmplYears  `json:"years"`
+	Year    string       `json:"year,omitempty"`
+	Modules []TmplModule `json:"modules,omitempty"`
+}
+
+// ChooserJSONGet serves AppGet's and YearGet's data as JSON, built by the same
+// TmplBaseDataUserDate so the two never disagree.
+func (app *Application) ChooserJSONGet(w http.ResponseWriter, r *http.Request) {
+	data, err := app.TmplBaseDataUserDate(r)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	chooser := ChooserJSON{Years: data.Years, Modules: data.Modules}
+	if chooser.Years == nil {
+		chooser.Years = []TmplYears{}
+	}
+	if data.CurrentYear != nil {
+		chooser.Year = data.CurrentYear.Year
+	}
+
+	app.RenderJSON(w, http.StatusOK, chooser)
+}
+
+// StatsGet returns the number of farms per etap, scoped like ListGRGet.
+func (app *Application) StatsGet(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.SessionUser(r)
+	if !ok {
+		app.Forbidden(w, r)
+		return
+	}
+	counts := make(map[string]int64)
+
+	var rows *sqlx.Rows
+	switch {
+	case user.Role&UserAdmin != 0:
+		rows, err = app.DBManager.YQueryx(yearDB, "b_statusy_count_etap")
+	case user.Role&UserManager != 0:
+		rows, err = app.DBManager.YQueryx(yearDB, "b_statusy_count_etap_where_idbr", user.IdBR)
+	case user.Role&UserNormal != 0:
+		scope, _ := json.Marshal(user.IdGR[yearDB])
+		rows, err = app.DBManager.YQueryx(yearDB, "b_statusy_count_etap_where_idgr_in", string(scope))
+	default:
+		// Methodologists have no farms.
+		app.RenderJSON(w, http.StatusOK, counts)
+		return
+	}
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var etap string
+		var count int64
+		if err := rows.Scan(&etap, &count); err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		counts[etap] = count
+	}
+	if err := rows.Err(); err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.RenderJSON(w, http.StatusOK, counts)
+}
+
+// YearsPost creates a new survey year: an empty {year}.db from the schema template
+// and its row in master lata. Definitions (tables, columns, codes) are filled in afterwards.
+// A year master refuses to register is discarded again.
+func (app *Application) YearsPost(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		app.jsonError(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	year, err := strconv.Atoi(r.PostForm.Get("rok"))
+	if err != nil || year < YEAR_MIN || year > YEAR_MAX {
+		app.jsonError(w, fmt.Sprintf("Rok musi być liczbą z zakresu %d-%d", YEAR_MIN, YEAR_MAX), http.StatusBadRequest)
+		return
+	}
+
+	err = app.DBManager.YearCreate(YearDB(year))
+	if errors.Is(err, ErrYearExists) {
+		app.jsonError(w, fmt.Sprintf("Rok %d już istnieje", year), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.logger(r).Error("failed to create year", slog.Int("year", year), slog.String("error", err.Error()))
+		app.jsonError(w, "Failed to create year", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := app.DBManager.MExec("lata_insert_rok", year); err != nil {
+		app.logger(r).Error("year created but lata insert failed", slog.Int("year", year), slog.String("error", err.Error()))
+		if err := app.DBManager.YearDiscard(YearDB(year)); err != nil {
+			app.logger(r).Error("failed to discard unregistered year", slog.Int("year", year), slog.String("error", err.Error()))
+		}
+		app.jsonError(w, "Failed to register year", http.StatusInternalServerError)
+		return
+	}
+
+	app.logger(r).Info("year created", slog.Int("year", year))
+	app.RenderJSON(w, http.StatusCreated, map[string]any{
+		"success": true,
+		"year":    year,
+	})
+}
+
+func (app *Application) YearBackupPost(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	if app.BackupDir == "" {
+		app.jsonError(w, "Backups are not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	name, err := app.DBManager.YearBackup(yearDB, app.BackupDir)
+	if err != nil {
+		app.logger(r).Error("backup failed", slog.Int64("year", int64(yearDB)), slog.String("error", err.Error()))
+		app.jsonError(w, "Backup failed", http.StatusInternalServerError)
+		return
+	}
+
+	app.logger(r).Info("backup created", slog.Int64("year", int64(yearDB)), slog.String("file", name))
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"file":    name,
+	})
+}
+
+func (app *Application) IntegrityGet(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	reports, err := app.IntegrityCheck(yearDB)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.RenderJSON(w, http.StatusOK, reports)
+}
+
+// BackupsSchedule backs up every loaded year each interval. A failing year is
+// logged and skipped so one broken database doesn't stop the others.
+func (app *Application) BackupsSchedule(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, yearDB := range app.DBManager.Years() {
+			name, err := app.DBManager.YearBackup(yearDB, app.BackupDir)
+			if err != nil {
+				app.Logger.Error("scheduled backup failed", slog.Int64("year", int64(yearDB)), slog.String("error", err.Error()))
+				continue
+			}
+			app.Logger.Info("scheduled backup created", slog.Int64("year", int64(yearDB)), slog.String("file", name))
+		}
+	}
+}
+
+const KOMENTARZ_MAX_LENGTH = 1000
+
+// KomentarzZBRPost and KomentarzInstPost are plain form posts from the farm page;
+// both redirect back to it. An empty comment clears the column to NULL.
+func (app *Application) KomentarzZBRPost(w http.ResponseWriter, r *http.Request) {
+	app.komentarzUpdate(w, r, "b_statusy_update_komentarz_zbr_where_idgr")
+}
+
+// Etapy a farm's survey moves through, b_etapy describes them for people. A
+// new farm has etap "", which counts as ETAP_PBR.
+const (
+	ETAP_PBR     = "PBR"     // filled in by the worker
+	ETAP_ZBR     = "ZBR"     // handed to the manager for review
+	ETAP_INST    = "INST"    // handed over to the institute
+	ETAP_EKSPORT = "EKSPORT" // exported to the institute's system
+	ETAP_IMPORT  = "IMPORT"  // imported back from the institute's system
+)
+
+// EtapTransition moves a farm from one of From to To. Query sets the etap and
+// stamps the date of the move, Access is who may trigger it.
+type EtapTransition struct {
+	From   []string
+	To     string
+	Query  string
+	Access UserType
+}
+
+// ETAP_TRANSITIONS is the status workflow by the action name used in URLs.
+var ETAP_TRANSITIONS = map[string]EtapTransition{
+	"przekazanie-zbr":  {From: []string{"", ETAP_PBR}, To: ETAP_ZBR, Query: "b_statusy_update_przekazanie_zbr_where_idgr_etap", Access: UserAdmin | UserNormal},
+	"zwrot-pbr":        {From: []string{ETAP_ZBR}, To: ETAP_PBR, Query: "b_statusy_update_zwrot_pbr_where_idgr_etap", Access: AcesssAdminManager},
+	"przekazanie-inst": {From: []string{ETAP_ZBR}, To: ETAP_INST, Query: "b_statusy_update_przekazanie_inst_where_idgr_etap", Access: AcesssAdminManager},
+	"zwrot-zbr":        {From: []string{ETAP_INST}, To: ETAP_ZBR, Query: "b_statusy_update_zwrot_zbr_where_idgr_etap", Access: AccessAdminMethodologist},
+	"eksport": {From: []string{ETAP_INST}, To: ETAP_EKSPORT, Query: "b_statusy_update_eksport_where_idgr_etap", Access: AccessAdminMethodologist},
+	"import":  {From: []string{ETAP_EKSPORT}, To: ETAP_IMPORT, Query: "b_statusy_update_import_where_idgr_etap", Access: AccessAdminMethodologist},
+}
+
+var ErrEtapTransition = errors.New("etap does not allow this transition")
+
+// Apply runs the transition on idGR inside tx. The UPDATE matches the etap it
+// was read with, so a farm moved in the meantime fails instead of moving twice.
+func (t EtapTransition) Apply(tx *SqlTx, idGR string) error {
+	var etap string
+	if err := tx.QueryRowx("b_statusy_select_etap_where_idgr", idGR).Scan(&etap); err != nil {
+		return err
+	}
+	if !slices.Contains(t.From, etap) {
+		return fmt.Errorf("%w: %q", ErrEtapTransition, etap)
+	}
+
+	result, err := tx.Exec(t.Query, t.To, idGR, etap)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return fmt.Errorf("%w: %q", ErrEtapTransition, etap)
+	}
+	return nil
+}
+
+// EtapTransitionPost applies the {akcja} transition of ETAP_TRANSITIONS to one
+// farm. Institute staff have no farm scope, anyone else needs it.
+func (app *Application) EtapTransitionPost(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	idGR := r.PathValue("idgr")
+	action := r.PathValue("akcja")
+
+	transition, ok := ETAP_TRANSITIONS[action]
+	if !ok {
+		app.jsonError(w, "Unknown action", http.StatusNotFound)
+		return
+	}
+	user, ok := app.SessionUser(r)
+	if !ok || !user.Role.HasAccess(transition.Access) ||
+		(!user.Role.HasAccess(AccessAdminMethodologist) && !app.IdGRAllowed(r, yearDB, user, idGR)) {
+		app.Forbidden(w, r)
+		return
+	}
+
+	err = app.DBManager.YTx(yearDB, func(tx *SqlTx) error {
+		return transition.Apply(tx, idGR)
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.jsonError(w, "Unknown farm", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrEtapTransition):
+		app.jsonError(w, "Etap ankiety nie pozwala na tę zmianę ("+err.Error()+")", http.StatusConflict)
+		return
+	case err != nil:
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.logger(r).Info("etap changed", slog.String("idgr", idGR), slog.String("action", action), slog.String("etap", transition.To))
+	app.RenderJSON(w, http.StatusOK, map[string]any{"success": true, "etap": transition.To})
+}
+
+// BatchTransitionResult is the outcome for one farm of BatchTransitionPost. Etap
+// is the new etap after a move, the unchanged one otherwise.
+type BatchTransitionResult struct {
+	IdGR    string `json:"idgr"`
+	Success bool   `json:"success"`
+	Etap    string `json:"etap"`
+	Message string `json:"message,omitempty"`
+}
+
+// BatchTransitionPost applies one ETAP_TRANSITIONS action to every farm of the
+// manager's idbr (every farm for an admin) whose etap allows it, in a single
+// transaction. Farms that aren't eligible are reported and left alone; any
+// other error rolls the whole batch back.
+func (app *Application) BatchTransitionPost(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	var form struct {
+		Akcja string `json:"akcja"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	transition, ok := ETAP_TRANSITIONS[form.Akcja]
+	if !ok {
+		app.jsonError(w, "Unknown action", http.StatusNotFound)
+		return
+	}
+	user, ok := app.SessionUser(r)
+	if !ok || !user.Role.HasAccess(transition.Access) {
+		app.Forbidden(w, r)
+		return
+	}
+
+	var rows *sqlx.Rows
+	if user.Role&UserAdmin != 0 {
+		rows, err = app.DBManager.YQueryx(yearDB, "b_statusy_list_all")
+	} else {
+		rows, err = app.DBManager.YQueryx(yearDB, "b_statusy_list_where_idbr", user.IdBR)
+	}
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	var statusy []Statusy
+	err = sqlx.StructScan(rows, &statusy)
+	rows.Close()
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	// Archived farms are out of the list for everyone but Adm, so out of reach here too.
+	if user.Role&UserAdmin == 0 {
+		archived, err := app.FarmsArchivedSelect()
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		statusy = slices.DeleteFunc(statusy, func(s Statusy) bool { return archived[s.IDGR] })
+	}
+
+	results := make([]BatchTransitionResult, 0, len(statusy))
+	err = app.DBManager.YTx(yearDB, func(tx *SqlTx) error {
+		results = results[:0]
+		for _, status := range statusy {
+			result := BatchTransitionResult{IdGR: status.IDGR, Etap: status.Etap}
+			err := transition.Apply(tx, status.IDGR)
+			switch {
+			case errors.Is(err, ErrEtapTransition):
+				result.Message = "Etap ankiety nie pozwala na tę zmianę"
+			case err != nil:
+				return fmt.Errorf("%s: %w", status.IDGR, err)
+			default:
+				result.Success = true
+				result.Etap = transition.To
+			}
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	moved := 0
+	for _, result := range results {
+		if result.Success {
+			moved++
+		}
+	}
+	app.logger(r).Info("batch etap change", slog.String("action", form.Akcja), slog.Int("farms", len(results)), slog.Int("moved", moved))
+
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"akcja":   form.Akcja,
+		"wyniki":  results,
+	})
+}
+
+// FarmCopyResult is one copied subtable of FarmCopyPost. Nadpisano is set when
+// the target already had data there.
+type FarmCopyResult struct {
+	Podtabela string `json:"podtabela"`
+	Wiersze   int    `json:"wiersze"`
+	Nadpisano bool   `json:"nadpisano"`
+}
+
+// ErrFarmCopyTargetNotEmpty stops FarmCopyPost from replacing answers the target
+// farm already has, unless the request is forced.
+var ErrFarmCopyTargetNotEmpty = errors.New("target farm has data")
+
+// FarmCopyPost copies every b_bdgrobmsp blob of {idgr} to the farm in "cel" within
+// the year, envelope and notes included, in one transaction. Subtables the source
+// doesn't have are left alone on the target.
+func (app *Application) FarmCopyPost(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	source := r.PathValue("idgr")
+
+	var form struct {
+		Cel   string `json:"cel"`
+		Wymus bool   `json:"wymus"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if form.Cel == "" || form.Cel == source {
+		app.jsonError(w, "Target farm must differ from the source", http.StatusBadRequest)
+		return
+	}
+
+	user, _ := app.SessionUser(r)
+	var results []FarmCopyResult
+	var notEmpty []string
+	err = app.DBManager.YTx(yearDB, func(tx *SqlTx) error {
+		var etap string
+		for _, idGR := range []string{source, form.Cel} {
+			if err := tx.QueryRowx("b_statusy_select_etap_where_idgr", idGR).Scan(&etap); err != nil {
+				return err
+			}
+		}
+
+		results, notEmpty = nil, nil
+		target := make(map[string]bool)
+		rows, err := tx.Queryx("b_bdgrobmsp_select_where_idgr", form.Cel)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var dane BDGROBMSP
+			if err := rows.StructScan(&dane); err != nil {
+				rows.Close()
+				return err
+			}
+			target[dane.Podtabela] = !BlobEmpty(dane.Dane)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = tx.Queryx("b_bdgrobmsp_select_where_idgr", source)
+		if err != nil {
+			return err
+		}
+		var dane []BDGROBMSP
+		err = sqlx.StructScan(rows, &dane)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, d := range dane {
+			if target[d.Podtabela] {
+				notEmpty = append(notEmpty, d.Podtabela)
+			}
+			results = append(results, FarmCopyResult{Podtabela: d.Podtabela, Wiersze: BlobRowCount(d.Dane), Nadpisano: target[d.Podtabela]})
+		}
+		if len(notEmpty) > 0 && !form.Wymus {
+			return ErrFarmCopyTargetNotEmpty
+		}
+
+		for _, d := range dane {
+			if _, err := tx.Exec("b_bdgrobmsp_dane_replace", form.Cel, d.Podtabela, d.Dane); err != nil {
+				return err
+			}
+			if err := AuditRecord(tx, form.Cel, d.Podtabela, user.Login, AUDIT_COPY, d.Dane); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		app.jsonError(w, "Unknown farm", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrFarmCopyTargetNotEmpty):
+		app.RenderJSON(w, http.StatusConflict, map[string]any{
+			"success":  false,
+			"error":    "Ankieta docelowa zawiera dane, potwierdź nadpisanie",
+			"niepuste": notEmpty,
+		})
+		return
+	case err != nil:
+		app.ServerError(w, r, err)
+		return
+	}
+
+	for _, result := range results {
+		app.Events.Publish(EventKey{Year: yearDB, IdGR: form.Cel}, SaveEvent{Podtabela: result.Podtabela, Login: user.Login, Time: time.Now()})
+	}
+	app.logger(r).Info("farm answers copied", slog.String("idgr", source), slog.String("target", form.Cel), slog.Int("subtables", len(results)), slog.Int("overwritten", len(notEmpty)))
+
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"success":   true,
+		"zrodlo":    source,
+		"cel":       form.Cel,
+		"podtabele": results,
+	})
+}
+
+func (app *Application) KomentarzInstPost(w http.ResponseWriter, r *http.Request) {
+	app.komentarzUpdate(w, r, "b_statusy_update_komentarz_inst_where_idgr")
+}
+
+func (app *Application) komentarzUpdate(w http.ResponseWriter, r *http.Request, queryName string) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	idGR := r.PathValue("idgr")
+	farmUrl := fmt.Sprintf("/app/%d/bdgr/lista-ankiet/%s", yearDB, idGR)
+
+	if err := r.ParseForm(); err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	komentarz := strings.TrimSpace(r.PostForm.Get("komentarz"))
+	if utf8.RuneCountInString(komentarz) > KOMENTARZ_MAX_LENGTH {
+		http.Redirect(w, r, farmUrl+"?komentarz_error=1", http.StatusSeeOther)
+		return
+	}
+
+	value := sql.NullString{String: komentarz, Valid: komentarz != ""}
+	result, err := app.DBManager.YExec(yearDB, queryName, value, idGR)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.Redirect(w, r, farmUrl, http.StatusSeeOther)
+}
+
+func (app *Application) ListGRGet(w http.ResponseWriter, r *http.Request) {
+	data, err := app.TmplBaseDataUserDate(r)
+	if err != nil {
+		app.logger(r).Error(err.Error())
+		http.Redirect(w, r, "/app/", http.StatusSeeOther)
+		return
+	}
+	data.Module = TmplModuleBDGR
+	data.BaseUrl = AppURL("app", r.PathValue("year"), "bdgr", "lista-ankiet", "")
+
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.logger(r).Error(err.Error())
+		http.Redirect(w, r, "/app/", http.StatusSeeOther)
+		return
+	}
+
+
+	// Methodologists work on definitions, not on farms: they get the page with an empty list.
+	if data.User.Role&UserMethodolgist != 0 {	
+		app.Render(w, r, http.StatusOK, TMPL_LIST_GR, data)
+		return
+	}
+	
+	var statusy []Statusy
+	var rows *sqlx.Rows 
+	if data.User.Role&UserAdmin != 0 {	 
+		rows, err = app.DBManager.YQueryx(yearDB, "b_statusy_list_all")
+	} else if data.User.Role&UserManager != 0 {		
+		rows, err = app.DBManager.YQueryx(yearDB, "b_statusy_list_where_idbr", data.User.IdBR)
+	} else {
+		// Same scope MiddleAccessIdGR checks, so the list never shows a farm that can't be opened.
+		scope, _ := json.Marshal(data.User.IdGR[yearDB])
+		rows, err = app.DBManager.YQueryx(yearDB, "b_statusy_list_where_idgr_in", string(scope))
+	}
+		
+	if err != nil {
+		app.logger(r).Error(err.Error())
+		http.Redirect(w, r, "/app/", http.StatusSeeOther)
+		return
+	}
+	defer rows.Close()
+
+	if err = sqlx.StructScan(rows, &statusy); err != nil {
+		app.logger(r).Error(err.Error())
+		http.Redirect(w, r, "/app/", http.StatusSeeOther)
+		return
+	}
+
+	// Admins still see archived farms, marked, so they can restore them.
+	archived, err := app.FarmsArchivedSelect()
+	if err != nil {
+		app.logger(r).Error(err.Error())
+		http.Redirect(w, r, "/app/", http.StatusSeeOther)
+		return
+	}
+	statusy = slices.DeleteFunc(statusy, func(s Statusy) bool {
+		return archived[s.IDGR] && data.User.Role&UserAdmin == 0
+	})
+	for i := range statusy {
+		statusy[i].Zarchiwizowane = archived[statusy[i].IDGR]
+	}
+
+	data.Statusy = statusy
+
+	app.Render(w, r, http.StatusOK, TMPL_LIST_GR, data)
+}
+
+func (app *Application) AnkietIdGRGet(w http.ResponseWriter, r *http.Request) {
+	data, err := app.TmplBaseDataUserDate(r)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	data.Module = TmplModuleBDGR
+
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.logger(r).Error(err.Error())
+		app.Forbidden(w, r)
+		return
+	}
+
+	tabItems, err := app.TabRowsTableBuild(yearDB, "")
+	if err != nil {
+		app.logger(r).Error(err.Error())
+		app.Forbidden(w, r)
+		return
+	}
+
+	farmUrl := AppURL("app", yearDB, "bdgr", "lista-ankiet", r.PathValue("idgr"))
+	data.TabRows = []TmplTabsRow{{Items: tabItems, BaseUrl: farmUrl}}
+	data.BaseUrl = farmUrl
+
+	var status Statusy
+	row := app.DBManager.YQueryRowx(yearDB, "b_statusy_list_where_idgr", r.PathValue("idgr"))
+	if err := row.StructScan(&status); err == nil {
+		data.Status = &status
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	if r.URL.Query().Get("komentarz_error") == "1" {
+		data.FormError = fmt.Sprintf("Komentarz może mieć najwyżej %d znaków", KOMENTARZ_MAX_LENGTH)
+	}
+
+	app.Render(w, r, http.StatusOK, TMPL_GRID, data)
+}
+
+func (app *Application) AnkietTableGet(w http.ResponseWriter, r *http.Request) {
+	data, err := app.TmplBaseDataUserDate(r)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	data.Module = TmplModuleBDGR
+
+	selectedTable := r.PathValue("table")
+
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.logger(r).Error(err.Error())
+		app.Forbidden(w, r)
+		return
+	}
+
+	tabItems, err := app.TabRowsTableBuild(yearDB, selectedTable)
+	if err != nil {
+		app.logger(r).Error(err.Error())
+		app.Forbidden(w, r)
+		return
+	}
+
+	subtabItems, err := app.TabRowsSubtableBuild(yearDB, r.PathValue("idgr"), selectedTable, "")
+	if err != nil {
+		app.logger(r).Error(err.Error())
+		app.Forbidden(w, r)
+		return
+	}
+
+	baseUrl := AppURL("app", yearDB, "bdgr", "lista-ankiet", r.PathValue("idgr"))
+	data.TabRows = []TmplTabsRow{
+		{Items: tabItems, BaseUrl: baseUrl},
+		{Items: subtabItems, BaseUrl: baseUrl},
+	}
+
+	app.Render(w, r, http.StatusOK, TMPL_GRID, data)
+}
+
+// AnkietProgressGet reports, per subtable, whether the farm has stored data and
+// whether every required field in it is filled.
+// AnkietTimelineGet serves Statusy.Timeline of the farm; a farm without a
+// b_statusy row has an empty one.
+func (app *Application) AnkietTimelineGet(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	var status Statusy
+	row := app.DBManager.YQueryRowx(yearDB, "b_statusy_list_where_idgr", r.PathValue("idgr"))
+	if err := row.StructScan(&status); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.RenderJSON(w, http.StatusOK, status.Timeline())
+}
+
+func (app *Application) AnkietProgressGet(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	idGR := r.PathValue("idgr")
+
+	podtabele, err := app.PodtabeleSelectAll(yearDB)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	notApplicable, err := app.NotApplicableSelect(yearDB, idGR)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	progress := make([]SubtableProgress, 0, len(podtabele))
+	for _, podtabela := range podtabele {
+		item := SubtableProgress{Table: podtabela.Table, Subtable: podtabela.Subtable}
+		_, item.NotApplicable = notApplicable[podtabela.Subtable]
+
+		jsonData, err := app.DaneSelectByIdGRAndSubtable(yearDB, idGR, podtabela.Subtable)
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+
+		if jsonData != "" {
+			item.HasData = true
+
+			kolumny, err := app.KolumnySelectBySubtable(yearDB, podtabela.Subtable)
+			if err != nil {
+				app.ServerError(w, r, err)
+				return
+			}
+
+			blocks, err := app.BlokadySelectBySubtable(yearDB, podtabela.Subtable)
+			if err != nil {
+				app.ServerError(w, r, err)
+				return
+			}
+
+			errs, err := ValidateSubtableData(podtabela.TableSchema, ColumnsBuildFromKolumny(kolumny), blocks, jsonData)
+			if err != nil {
+				app.logger(r).Warn("stored data is not valid JSON",
+					slog.String("idgr", idGR),
+					slog.String("subtable", podtabela.Subtable),
+					slog.String("error", err.Error()),
+				)
+			}
+			item.Complete = err == nil && len(errs) == 0
+		}
+		// Marked by hand, with or without data: nothing more will be filled in.
+		if item.NotApplicable {
+			item.Complete = true
+		}
+
+		progress = append(progress, item)
+	}
+
+	app.RenderJSON(w, http.StatusOK, progress)
+}
+
+// NotModified sets Last-Modified and answers 304 when the client's copy is
+// still current. HTTP dates have second precision, hence the truncation.
+func NotModified(w http.ResponseWriter, r *http.Request, modified time.Time) bool {
+	if modified.IsZero() {
+		return false
+	}
+	modified = modified.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+type ExportSubtable struct {
+	Podtabela       string          `json:"podtabela"`
+	DataModyfikacji string          `json:"data_modyfikacji"`
+	Dane            json.RawMessage `json:"dane"`
+	Uwagi           string          `json:"uwagi,omitempty"`
+
+	// Columns and Rows are Dane flattened by ExportRowsBuild for the CSV and
+	// XLSX encoders; JSON keeps sending Dane as stored.
+	Columns []string `json:"-"`
+	Rows    [][]any  `json:"-"`
+}
+
+// Formats of AnkietExportGet, as named in ?format=.
+const (
+	EXPORT_CSV  = "csv"
+	EXPORT_JSON = "json"
+	EXPORT_XLSX = "xlsx"
+)
+
+var EXPORT_MEDIA_TYPES = map[string]string{
+	"text/csv":         EXPORT_CSV,
+	"application/json": EXPORT_JSON,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": EXPORT_XLSX,
+}
+
+var EXPORT_CONTENT_TYPES = map[string]string{
+	EXPORT_CSV:  "text/csv; charset=utf-8",
+	EXPORT_JSON: "application/json",
+	EXPORT_XLSX: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+var ErrExportFormat = errors.New("unsupported export format")
+
+// ExportFormatNegotiate picks the export format: ?format= first, then the old
+// export.json route, then the supported type with the highest q in Accept.
+// No Accept, */* or text/* mean CSV.
+func ExportFormatNegotiate(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := EXPORT_CONTENT_TYPES[format]; !ok {
+			return "", fmt.Errorf("%w: %q", ErrExportFormat, format)
+		}
+		return format, nil
+	}
+	if strings.HasSuffix(r.URL.Path, ".json") {
+		return EXPORT_JSON, nil
+	}
+
+	accept := strings.TrimSpace(r.Header.Get("Accept"))
+	if accept == "" {
+		return EXPORT_CSV, nil
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		format, ok := EXPORT_MEDIA_TYPES[mediaType]
+		if !ok && (mediaType == "*/*" || mediaType == "text/*") {
+			format, ok = EXPORT_CSV, true
+		}
+		if ok && q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("%w: %q", ErrExportFormat, accept)
+	}
+	return best, nil
+}
+
+// ExportRowsBuild flattens a subtable blob into rows of cells under columns
+// ordered like the grid. Keys the metadata doesn't know about follow, sorted,
+// so nothing stored is dropped. A vertical subtable is a single row. Cells are
+// decoded JSON with numbers kept as json.Number.
+func ExportRowsBuild(columns []TableColumn, data string) ([]string, [][]any, error) {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, nil, err
+	}
+
+	var records []map[string]any
+	switch value := value.(type) {
+	case []any:
+		for _, item := range value {
+			if record, ok := item.(map[string]any); ok {
+				records = append(records, record)
+			}
+		}
+	case map[string]any:
+		records = append(records, value)
+	}
+
+	names := make([]string, 0, len(columns))
+	known := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		names = append(names, column.Name)
+		known[column.Name] = true
+	}
+	var extra []string
+	for _, record := range records {
+		for key := range record {
+			if !known[key] {
+				known[key] = true
+				extra = append(extra, key)
+			}
+		}
+	}
+	slices.Sort(extra)
+	names = append(names, extra...)
+
+	rows := make([][]any, 0, len(records))
+	for _, record := range records {
+		row := make([]any, len(names))
+		for i, name := range names {
+			row[i] = record[name]
+		}
+		rows = append(rows, row)
+	}
+	return names, rows, nil
+}
+
+func exportCellString(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+}
+
+// ExportCSVWrite writes the subtables in long form, one cell per line, since
+// every subtable has its own columns. The BOM and format's separators are what
+// Excel with the matching regional settings opens without an import dialog,
+// semicolons and decimal commas for Polish.
+func ExportCSVWrite(w io.Writer, subtables []ExportSubtable, format LocaleFormat) error {
+	io.WriteString(w, "\uFEFF")
+	writer := csv.NewWriter(w)
+	writer.Comma = format.CSVComma
+	writer.Write([]string{"podtabela", "wiersz", "kolumna", "wartosc"})
+	for _, subtable := range subtables {
+		for i, row := range subtable.Rows {
+			for j, cell := range row {
+				value := exportCellString(cell)
+				if _, ok := cell.(json.Number); ok {
+					value = format.Number(value)
+				}
+				writer.Write([]string{subtable.Podtabela, strconv.Itoa(i + 1), subtable.Columns[j], value})
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ExportXLSXWrite writes a workbook with one sheet per subtable, column names
+// in the first row. It is the minimal SpreadsheetML package with inline
+// strings, which is all Excel and LibreOffice need.
+func ExportXLSXWrite(w io.Writer, subtables []ExportSubtable) error {
+	if len(subtables) == 0 {
+		subtables = []ExportSubtable{{Podtabela: "Ankieta"}}
+	}
+
+	var types, sheets, rels strings.Builder
+	used := make(map[string]bool)
+	archive := zip.NewWriter(w)
+	for i, subtable := range subtables {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		sheets.WriteString(`<sheet name="`)
+		xml.EscapeText(&sheets, []byte(xlsxSheetName(subtable.Podtabela, used)))
+		fmt.Fprintf(&sheets, `" sheetId="%d" r:id="rId%d"/>`, n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+
+		file, err := archive.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", n))
+		if err != nil {
+			return err
+		}
+		if err := xlsxSheetWrite(file, subtable); err != nil {
+			return err
+		}
+	}
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` + types.String() + `</Types>`},
+		{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>` + sheets.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` + rels.String() + `</Relationships>`},
+	}
+	for _, part := range parts {
+		file, err := archive.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(file, xml.Header+part.content); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func xlsxSheetWrite(w io.Writer, subtable ExportSubtable) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	header := make([]any, len(subtable.Columns))
+	for i, name := range subtable.Columns {
+		header[i] = name
+	}
+	for i, row := range append([][]any{header}, subtable.Rows...) {
+		fmt.Fprintf(&buf, `<row r="%d">`, i+1)
+		for j, cell := range row {
+			ref := xlsxColumn(j) + strconv.Itoa(i+1)
+			switch cell := cell.(type) {
+			case nil:
+			case json.Number:
+				fmt.Fprintf(&buf, `<c r="%s"><v>%s</v></c>`, ref, cell)
+			case bool:
+				value := 0
+				if cell {
+					value = 1
+				}
+				fmt.Fprintf(&buf, `<c r="%s" t="b"><v>%d</v></c>`, ref, value)
+			default:
+				fmt.Fprintf(&buf, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+				xml.EscapeText(&buf, []byte(exportCellString(cell)))
+				buf.WriteString(`</t></is></c>`)
+			}
+		}
+		buf.WriteString(`</row>`)
+	}
+
+	buf.WriteString(`</sheetData></worksheet>`)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// xlsxColumn turns a zero based index into a column letter: 0 is A, 26 is AA.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// xlsxSheetName makes name a valid, unique sheet name: Excel rejects []:*?/\
+// and more than 31 characters.
+func xlsxSheetName(name string, used map[string]bool) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = "_"
+	}
+	base := []rune(name)
+	if len(base) > 31 {
+		base = base[:31]
+	}
+	candidate := string(base)
+	for n := 2; used[strings.ToLower(candidate)]; n++ {
+		suffix := fmt.Sprintf("~%d", n)
+		candidate = string(base[:min(len(base), 31-len(suffix))]) + suffix
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// AnkietExportGet returns every stored subtable of a farm, unwrapped, as CSV,
+// JSON or XLSX picked by ExportFormatNegotiate. The old export.json route is
+// the same handler fixed to JSON.
+func (app *Application) AnkietExportGet(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	idGR := r.PathValue("idgr")
+
+	format, err := ExportFormatNegotiate(r)
+	if err != nil {
+		if r.URL.Query().Has("format") {
+			app.jsonError(w, err.Error(), http.StatusBadRequest)
+		} else {
+			app.jsonError(w, err.Error(), http.StatusNotAcceptable)
+		}
+		return
+	}
+	w.Header().Add("Vary", "Accept, Accept-Language")
+
+	modified, err := app.DaneLastModified(yearDB, idGR)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	if NotModified(w, r, modified) {
+		return
+	}
+
+	stored, err := app.DaneSelectByIdGR(yearDB, idGR)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	subtables := make([]ExportSubtable, 0, len(stored))
+	for _, dane := range stored {
+		data, notes, err := BlobUnwrapNotes(dane.Dane)
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		if !json.Valid([]byte(data)) {
+			app.logger(r).Warn("stored data is not valid JSON",
+				slog.String("idgr", idGR),
+				slog.String("subtable", dane.Podtabela),
+			)
+			continue
+		}
+		subtable := ExportSubtable{
+			Podtabela:       dane.Podtabela,
+			DataModyfikacji: dane.DataModyfikacji,
+			Dane:            json.RawMessage(data),
+			Uwagi:           notes,
+		}
+		if format != EXPORT_JSON {
+			kolumny, err := app.KolumnySelectBySubtable(yearDB, dane.Podtabela)
+			if err != nil {
+				app.ServerError(w, r, err)
+				return
+			}
+			subtable.Columns, subtable.Rows, err = ExportRowsBuild(ColumnsBuildFromKolumny(kolumny), data)
+			if err != nil {
+				app.ServerError(w, r, err)
+				return
+			}
+		}
+		subtables = append(subtables, subtable)
+	}
+
+	if format == EXPORT_JSON {
+		app.RenderJSON(w, http.StatusOK, map[string]any{
+			"idgr":      idGR,
+			"podtabele": subtables,
+		})
+		return
+	}
+
+	buf := renderBufferGet()
+	defer renderBufferPut(buf)
+	if format == EXPORT_XLSX {
+		err = ExportXLSXWrite(buf, subtables)
+	} else {
+		err = ExportCSVWrite(buf, subtables, LocaleFormatGet(app.Locale(r)))
+	}
+	if err != nil {
+		for _, header := range RENDER_ERROR_HEADERS {
+			w.Header().Del(header)
+		}
+		app.ServerError(w, r, err)
+		return
+	}
+
+	filename := fmt.Sprintf("ankieta_%s_%d.%s", idGR, yearDB, format)
+	w.Header().Set("Content-Type", EXPORT_CONTENT_TYPES[format])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.WriteHeader(http.StatusOK)
+	buf.WriteTo(w)
+}
+
+// Actions recorded in b_audyt.akcja.
+const (
+	AUDIT_SAVE     = "zapis"
+	AUDIT_ROW_SAVE = "zapis_wiersza"
+	AUDIT_DELETE   = "usuniecie"
+	AUDIT_COPY     = "kopia"
+)
+
+type BAudyt struct {
+	Id        int64  `db:"id" json:"id"`
+	IdGR      string `db:"idgr" json:"idgr"`
+	Podtabela string `db:"podtabela" json:"podtabela"`
+	Login     string `db:"login" json:"login"`
+	Akcja     string `db:"akcja" json:"akcja"`
+	Skrot     string `db:"skrot" json:"skrot"`
+	Dane      string `db:"dane" json:"dane,omitempty"`
+	Czas      string `db:"czas" json:"czas"`
+}
+
+// AuditHash is the SHA-256 hex of a stored blob, what the export shows when the
+// payload itself is left out.
+func AuditHash(dane string) string {
+	sum := sha256.Sum256([]byte(dane))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditRecord adds an entry to the audit trail in the same transaction as the
+// change, so one is never committed without the other. dane is the blob as
+// stored afterwards, empty for a cleared subtable.
+func AuditRecord(tx *SqlTx, idGR, subtable, login, akcja, dane string) error {
+	_, err := tx.Exec("b_audyt_insert", idGR, subtable, login, akcja, AuditHash(dane), dane)
+	return err
+}
+
+// AuditExportGet returns the year's audit trail as CSV, JSON or XLSX picked by
+// ExportFormatNegotiate, optionally narrowed by ?idgr=, ?podtabela=, ?login=
+// and the ?od= and ?do= dates, both inclusive. Payloads are only included with
+// ?dane=1; the hash is enough to tell whether two entries stored the same.
+func (app *Application) AuditExportGet(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	format, err := ExportFormatNegotiate(r)
+	if err != nil {
+		if r.URL.Query().Has("format") {
+			app.jsonError(w, err.Error(), http.StatusBadRequest)
+		} else {
+			app.jsonError(w, err.Error(), http.StatusNotAcceptable)
+		}
+		return
+	}
+	w.Header().Add("Vary", "Accept, Accept-Language")
+
+	query := r.URL.Query()
+	from, to := query.Get("od"), query.Get("do")
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse(time.DateOnly, date); date != "" && err != nil {
+			app.jsonError(w, fmt.Sprintf("Nieprawidłowa data %q, oczekiwano RRRR-MM-DD", date), http.StatusBadRequest)
+			return
+		}
+	}
+	withData := query.Get("dane") == "1"
+	idGR, subtable, login := query.Get("idgr"), query.Get("podtabela"), query.Get("login")
+
+	rows, err := app.DBManager.YQueryx(yearDB, "b_audyt_select_where_filters",
+		withData, idGR, idGR, subtable, subtable, login, login, from, from, to, to)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	entries := []BAudyt{}
+	if err := sqlx.StructScan(rows, &entries); err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	if format == EXPORT_JSON {
+		app.RenderJSON(w, http.StatusOK, map[string]any{
+			"rok":   yearDB,
+			"wpisy": entries,
+		})
+		return
+	}
+
+	columns := []string{"id", "czas", "idgr", "podtabela", "login", "akcja", "skrot"}
+	if withData {
+		columns = append(columns, "dane")
+	}
+	table := make([][]any, 0, len(entries))
+	for _, entry := range entries {
+		row := []any{json.Number(strconv.FormatInt(entry.Id, 10)), entry.Czas, entry.IdGR, entry.Podtabela, entry.Login, entry.Akcja, entry.Skrot}
+		if withData {
+			row = append(row, entry.Dane)
+		}
+		table = append(table, row)
+	}
+
+	buf := renderBufferGet()
+	defer renderBufferPut(buf)
+	if format == EXPORT_XLSX {
+		err = ExportXLSXWrite(buf, []ExportSubtable{{Podtabela: "Audyt", Columns: columns, Rows: table}})
+	} else {
+		err = auditCSVWrite(buf, columns, table, LocaleFormatGet(app.Locale(r)))
+	}
+	if err != nil {
+		for _, header := range RENDER_ERROR_HEADERS {
+			w.Header().Del(header)
+		}
+		app.ServerError(w, r, err)
+		return
+	}
+
+	filename := fmt.Sprintf("audyt_%d.%s", yearDB, format)
+	w.Header().Set("Content-Type", EXPORT_CONTENT_TYPES[format])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.WriteHeader(http.StatusOK)
+	buf.WriteTo(w)
+}
+
+// auditCSVWrite writes the audit trail one entry per line; unlike the farm
+// export every row has the same columns.
+func auditCSVWrite(w io.Writer, columns []string, rows [][]any, format LocaleFormat) error {
+	io.WriteString(w, "\uFEFF")
+	writer := csv.NewWriter(w)
+	writer.Comma = format.CSVComma
+	writer.Write(columns)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, cell := range row {
+			record[i] = exportCellString(cell)
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// NotApplicableForm is the body of NotApplicablePost. Powod is required to
+// mark, clearing the mark ignores it.
+type NotApplicableForm struct {
+	NieDotyczy bool   `json:"nie_dotyczy"`
+	Powod      string `json:"powod"`
+}
+
+// NotApplicablePost marks a subtable as not applicable to the farm, or clears
+// the mark. The stored data is kept either way, unmarking brings it back into
+// validation.
+func (app *Application) NotApplicablePost(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	idGR := r.PathValue("idgr")
+	subtable := r.PathValue("subtable")
+
+	user, ok := app.SessionUser(r)
+	if !ok {
+		app.Forbidden(w, r)
+		return
+	}
+	if user.Role&UserAdmin == 0 && app.YearLocked(yearDB) {
+		app.ForbiddenJSON(w, r, "Rok jest zablokowany do edycji")
+		return
+	}
+
+	var form NotApplicableForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if !form.NieDotyczy {
+		if _, err := app.DBManager.YExec(yearDB, "b_nie_dotyczy_delete_where_idgr_podtabela", idGR, subtable); err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		app.RenderJSON(w, http.StatusOK, map[string]any{"success": true})
+		return
+	}
+
+	form.Powod = TextNormalize("str", form.Powod)
+	if form.Powod == "" {
+		app.jsonError(w, "Podaj powód, dla którego podtabela nie dotyczy gospodarstwa", http.StatusUnprocessableEntity)
+		return
+	}
+
+	var podtabela BPodtabele
+	if err := app.DBManager.YQueryRowx(yearDB, "b_podtabeal_select_where_podtabela", subtable).StructScan(&podtabela); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.jsonError(w, "Unknown subtable", http.StatusNotFound)
+			return
+		}
+		app.ServerError(w, r, err)
+		return
+	}
+
+	if _, err := app.DBManager.YExec(yearDB, "b_nie_dotyczy_replace", idGR, subtable, form.Powod, user.Login); err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	app.logger(r).Info("subtable marked not applicable", slog.String("idgr", idGR), slog.String("subtable", subtable))
+
+	app.RenderJSON(w, http.StatusOK, map[string]any{"success": true})
+}
+
+// EditLockHolder returns the live lock on a subtable held by anyone but login,
+// nil when the subtable is free, expired or locked by login itself.
+func (app *Application) EditLockHolder(yearDB YearDB, idGR, subtable, login string) (*BEdycje, error) {
+	var lock BEdycje
+	row := app.DBManager.YQueryRowx(yearDB, "b_edycje_select_where_idgr_podtabela", idGR, subtable)
+	if err := row.StructScan(&lock); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if lock.Login == login || lock.DataOdswiezenia < app.editLockCutoff() {
+		return nil, nil
+	}
+	return &lock, nil
+}
+
+// data_odswiezenia is stored as UTC text, so the cutoff compares as a string.
+func (app *Application) editLockCutoff() string {
+	return time.Now().UTC().Add(-app.EditLockTimeout).Format(DATA_MODYFIKACJI_LAYOUT)
+}
+
+// EditLockPost acquires or refreshes the caller's lock. It is advisory: saves
+// are never refused because of it, the editor is only told who else is there.
+func (app *Application) EditLockPost(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	if app.EditLockTimeout <= 0 {
+		app.RenderJSON(w, http.StatusOK, map[string]any{"success": true})
+		return
+	}
+	idGR := r.PathValue("idgr")
+	subtable := r.PathValue("subtable")
+	user, ok := app.SessionUser(r)
+	if !ok {
+		app.Forbidden(w, r)
+		return
+	}
+
+	result, err := app.DBManager.YExec(yearDB, "b_edycje_upsert", idGR, subtable, user.Login, app.editLockCutoff())
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	if affected == 0 {
+		lock, err := app.EditLockHolder(yearDB, idGR, subtable, user.Login)
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		if lock != nil {
+			app.RenderJSON(w, http.StatusConflict, map[string]any{
+				"success": false,
+				"message": "Subtable is being edited by another user",
+				"login":   lock.Login,
+			})
+			return
+		}
+	}
+
+	app.RenderJSON(w, http.StatusOK, map[string]any{"success": true})
+}
+
+// EditLockReleasePost is sent as a beacon when the page is left. Only the
+// caller's own lock is removed.
+func (app *Application) EditLockReleasePost(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	user, ok := app.SessionUser(r)
+	if !ok {
+		app.Forbidden(w, r)
+		return
+	}
+
+	_, err = app.DBManager.YExec(yearDB, "b_edycje_delete_where_idgr_podtabela_login", r.PathValue("idgr"), r.PathValue("subtable"), user.Login)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	app.RenderJSON(w, http.StatusOK, map[string]any{"success": true})
+}
+
+const ATTACHMENT_MAX_SIZE = 10 << 20
+
+// ATTACHMENT_CONTENT_TYPES maps each allowed declared type to what
+// http.DetectContentType must see in the file, so a renamed executable
+// can't pass as a PDF. Office files are zip containers.
+var ATTACHMENT_CONTENT_TYPES = map[string]string{
+	"application/pdf": "application/pdf",
+	"image/jpeg":      "image/jpeg",
+	"image/png":       "image/png",
+	"text/csv":        "text/plain",
+	"text/plain":      "text/plain",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":       "application/zip",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": "application/zip",
+}
+
+func AttachmentTypeAllowed(declared string, content []byte) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return "", false
+	}
+	sniffed, ok := ATTACHMENT_CONTENT_TYPES[mediaType]
+	if !ok || !strings.HasPrefix(http.DetectContentType(content), sniffed) {
+		return "", false
+	}
+	return mediaType, true
+}
+
+func (app *Application) ZalacznikiPost(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	idGR := r.PathValue("idgr")
+	subtable := r.PathValue("subtable")
+
+	// Refused before the upload is read, not after buffering up to the size limit.
+	user, ok := app.SessionUser(r)
+	if !ok {
+		app.Forbidden(w, r)
+		return
+	}
+	if user.Role&UserAdmin == 0 && app.YearLocked(yearDB) {
+		app.ForbiddenJSON(w, r, "Rok jest zablokowany do edycji")
+		return
+	}
+
+	var podtabela BPodtabele
+	row := app.DBManager.YQueryRowx(yearDB, "b_podtabeal_select_where_podtabela", subtable)
+	if err := row.StructScan(&podtabela); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.jsonError(w, "Unknown subtable", http.StatusNotFound)
+			return
+		}
+		app.ServerError(w, r, err)
+		return
+	}
+
+	// The limit is on the file; leave room for the multipart framing around it.
+	r.Body = http.MaxBytesReader(w, r.Body, ATTACHMENT_MAX_SIZE+64<<10)
+	if err := r.ParseMultipartForm(ATTACHMENT_MAX_SIZE); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			app.jsonError(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		app.jsonError(w, "Invalid upload", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("plik")
+	if err != nil {
+		app.jsonError(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > ATTACHMENT_MAX_SIZE {
+		app.jsonError(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Browsers on Windows may send the full client path.
+	name := strings.TrimSpace(filepath.Base(strings.ReplaceAll(header.Filename, `\`, "/")))
+	if name == "" || name == "." || name == "/" {
+		app.jsonError(w, "Missing file name", http.StatusBadRequest)
+		return
+	}
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	contentType, ok := AttachmentTypeAllowed(header.Header.Get("Content-Type"), content)
+	if !ok {
+		app.jsonError(w, "File type not allowed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	result, err := app.DBManager.YExec(yearDB, "b_zalaczniki_insert",
+		idGR, subtable, name, len(content), contentType, content, user.Login)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		app.ServerError(w, r, err)
 		return
 	}
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	app.RenderJSON(w, http.StatusCreated, map[string]any{
+		"success": true,
+		"id":      id,
+	})
 }
 
-func (app *Application) AppGet(w http.ResponseWriter, r *http.Request) {
-	data, err := app.TmplBaseDataUserDate(r)
+func (app *Application) ZalacznikiGet(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := app.DBManager.YQueryx(yearDB, "b_zalaczniki_select_where_idgr_podtabela", r.PathValue("idgr"), r.PathValue("subtable"))
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	zalaczniki := []BZalaczniki{}
+	for rows.Next() {
+		var zalacznik BZalaczniki
+		if err := rows.StructScan(&zalacznik); err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		zalaczniki = append(zalaczniki, zalacznik)
+	}
+	if err := rows.Err(); err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.RenderJSON(w, http.StatusOK, map[string]any{"zalaczniki": zalaczniki})
+}
+
+// ZalacznikGet matches on idgr and podtabela as well as id, so access to one
+// farm never reaches another farm's files by guessing ids.
+func (app *Application) ZalacznikGet(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		app.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	var zalacznik BZalaczniki
+	row := app.DBManager.YQueryRowx(yearDB, "b_zalaczniki_select_where_id_idgr_podtabela", id, r.PathValue("idgr"), r.PathValue("subtable"))
+	if err := row.StructScan(&zalacznik); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.ClientError(w, http.StatusNotFound)
+			return
+		}
+		app.ServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", zalacznik.Typ)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": zalacznik.NazwaPliku}))
+	modified, _ := DataModyfikacjiParse(zalacznik.DataDodania)
+	http.ServeContent(w, r, zalacznik.NazwaPliku, modified, bytes.NewReader(zalacznik.Zawartosc))
+}
+
+// AnkietSubtableRawGet dumps the stored blob untouched (no unwrapping, formulas or
+// normalisation) so support can see exactly what is in the database.
+func (app *Application) AnkietSubtableRawGet(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	dane, err := app.DaneRawSelectByIdGRAndSubtable(yearDB, r.PathValue("idgr"), r.PathValue("subtable"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.jsonError(w, "No stored data", http.StatusNotFound)
+			return
+		}
+		app.ServerError(w, r, err)
+		return
+	}
+
+	// An unparsable stamp only costs the client its cache, not the dump.
+	modified, _ := DataModyfikacjiParse(dane.DataModyfikacji)
+	if NotModified(w, r, modified) {
+		return
+	}
+
+	// A corrupt blob is exactly what someone debugging wants to see, so fall back
+	// to a JSON string instead of failing the encode.
+	var blob any = json.RawMessage(dane.Dane)
+	if !json.Valid([]byte(dane.Dane)) {
+		blob = dane.Dane
+	}
+
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"idgr":             dane.IDGR,
+		"podtabela":        dane.Podtabela,
+		"data_modyfikacji": dane.DataModyfikacji,
+		"dane":             blob,
+	})
+}
+
+// AnkietSubtableValidatePost runs the save validation on a payload without storing it.
+func (app *Application) AnkietSubtableValidatePost(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	subtable := r.PathValue("subtable")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		app.jsonError(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	definition, err := app.SubtableDefinitionSelect(yearDB, subtable)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.jsonError(w, "Unknown subtable", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	payload, _, err := BlobUnwrapNotes(string(body))
+	if err != nil {
+		app.jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tableType := definition.Podtabela.TableSchema
+	if tableType == VERTICAL_STATIC_UNIQUE {
+		if payload, err = VerticalFormulasApply(definition.Columns, payload); err != nil {
+			app.jsonError(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	errs, err := ValidateSubtableData(tableType, definition.Columns, definition.Blocks, payload)
+	if err != nil {
+		app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	notApplicable, err := app.NotApplicableSelect(yearDB, r.PathValue("idgr"))
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	if _, ok := notApplicable[subtable]; ok {
+		errs = ValidationErrorsOptional(errs)
+	}
+
+	status := http.StatusOK
+	if len(errs) > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	if errs == nil {
+		errs = []ValidationError{}
+	}
+
+	app.RenderJSON(w, status, map[string]any{
+		"success": status == http.StatusOK,
+		"errors":  errs,
+	})
+}
+
+// CP1250 maps the upper half of Windows-1250, the code page Polish Windows tools
+// still export in. 0 marks the five bytes the code page leaves undefined.
+var CP1250 = [128]rune{
+	0x20AC, 0, 0x201A, 0, 0x201E, 0x2026, 0x2020, 0x2021,
+	0, 0x2030, 0x0160, 0x2039, 0x015A, 0x0164, 0x017D, 0x0179,
+	0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0, 0x2122, 0x0161, 0x203A, 0x015B, 0x0165, 0x017E, 0x017A,
+	0x00A0, 0x02C7, 0x02D8, 0x0141, 0x00A4, 0x0104, 0x00A6, 0x00A7,
+	0x00A8, 0x00A9, 0x015E, 0x00AB, 0x00AC, 0x00AD, 0x00AE, 0x017B,
+	0x00B0, 0x00B1, 0x02DB, 0x0142, 0x00B4, 0x00B5, 0x00B6, 0x00B7,
+	0x00B8, 0x0105, 0x015F, 0x00BB, 0x013D, 0x02DD, 0x013E, 0x017C,
+	0x0154, 0x00C1, 0x00C2, 0x0102, 0x00C4, 0x0139, 0x0106, 0x00C7,
+	0x010C, 0x00C9, 0x0118, 0x00CB, 0x011A, 0x00CD, 0x00CE, 0x010E,
+	0x0110, 0x0143, 0x0147, 0x00D3, 0x00D4, 0x0150, 0x00D6, 0x00D7,
+	0x0158, 0x016E, 0x00DA, 0x0170, 0x00DC, 0x00DD, 0x0162, 0x00DF,
+	0x0155, 0x00E1, 0x00E2, 0x0103, 0x00E4, 0x013A, 0x0107, 0x00E7,
+	0x010D, 0x00E9, 0x0119, 0x00EB, 0x011B, 0x00ED, 0x00EE, 0x010F,
+	0x0111, 0x0144, 0x0148, 0x00F3, 0x00F4, 0x0151, 0x00F6, 0x00F7,
+	0x0159, 0x016F, 0x00FA, 0x0171, 0x00FC, 0x00FD, 0x0163, 0x02D9,
+}
+
+var (
+	ErrCharsetUnsupported = errors.New("unsupported charset")
+	ErrInvalidUTF8        = errors.New("invalid UTF-8")
+)
+
+// CharsetName folds the aliases browsers and tools use into "utf-8" or "windows-1250".
+func CharsetName(charset string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8":
+		return "utf-8", nil
+	case "windows-1250", "cp1250", "x-cp1250":
+		return "windows-1250", nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrCharsetUnsupported, charset)
+}
+
+// BodyDecode returns body as UTF-8. The charset comes from the Content-Type header,
+// fallback is used when the header names none. encoding/json silently replaces
+// invalid bytes with U+FFFD, so the check has to happen before any Unmarshal.
+func BodyDecode(body []byte, contentType, fallback string) ([]byte, error) {
+	charset := fallback
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		charset = params["charset"]
+	}
+	charset, err := CharsetName(charset)
+	if err != nil {
+		return nil, err
+	}
+
+	if charset == "windows-1250" {
+		decoded := make([]rune, 0, len(body))
+		for i, b := range body {
+			if b < 0x80 {
+				decoded = append(decoded, rune(b))
+			} else if r := CP1250[b-0x80]; r != 0 {
+				decoded = append(decoded, r)
+			} else {
+				return nil, fmt.Errorf("%w: byte 0x%02X at offset %d is undefined in windows-1250", ErrInvalidUTF8, b, i)
+			}
+		}
+		return []byte(string(decoded)), nil
+	}
+
+	for i := 0; i < len(body); {
+		r, size := utf8.DecodeRune(body[i:])
+		if r == utf8.RuneError && size <= 1 {
+			return nil, fmt.Errorf("%w: byte 0x%02X at offset %d", ErrInvalidUTF8, body[i], i)
+		}
+		i += size
+	}
+	return body, nil
+}
+
+// formulaError aborts the subtable transaction on a formula the answers can't be
+// computed with, which the user has to fix rather than a server error.
+type formulaError struct{ error }
+
+func (app *Application) AnkietSubtablePost(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	idGR := r.PathValue("idgr")
+	subtable := r.PathValue("subtable")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		app.jsonError(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	body, err = BodyDecode(body, r.Header.Get("Content-Type"), app.BodyCharset)
+	if errors.Is(err, ErrCharsetUnsupported) {
+		app.jsonError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		app.jsonError(w, "Nieprawidłowe kodowanie znaków, oczekiwano UTF-8 ("+err.Error()+")", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Survey payloads are farm data; redaction only knows about credentials.
+	if app.Debug && app.LogRequestBodies {
+		app.logger(r).Debug("received JSON", slog.String("body", string(body)))
+	}
+
+	payload, notes, err := BlobUnwrapNotes(string(body))
+	if err != nil {
+		app.jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body = []byte(payload)
+
+	// Vertical tables send a single object and have nothing to count.
+	var rows []json.RawMessage
+	if json.Unmarshal(body, &rows) == nil {
+		if limit, exceeded := app.MaxRowsExceeded(subtable, len(rows)); exceeded {
+			app.jsonError(w, fmt.Sprintf("Przekroczono maksymalną liczbę wierszy (%d)", limit), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	// The form is read-only on a locked year (CellEditable); a page opened
+	// before the lock must not save anyway.
+	user, _ := app.SessionUser(r)
+	if user.Role&UserAdmin == 0 && app.YearLocked(yearDB) {
+		app.ForbiddenJSON(w, r, "Rok jest zablokowany do edycji")
+		return
+	}
+
+	var podtabela BPodtabele
+	row := app.DBManager.YQueryRowx(yearDB, "b_podtabeal_select_where_podtabela", subtable)
+	if err := row.StructScan(&podtabela); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.jsonError(w, "Unknown subtable", http.StatusNotFound)
+			return
+		}
+		app.ServerError(w, r, err)
+		return
+	}
+
+	kolumny, err := app.KolumnySelectBySubtable(yearDB, subtable)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	columns := ColumnsBuildFromKolumny(kolumny)
+
+	payload, err = SubtableDataNormalize(columns, payload)
+	if err != nil {
+		app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	allowed, err := app.CodesAllowedSelect(yearDB, subtable)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	codeErrs, err := ValidateRowCodes(podtabela.TableSchema, allowed, payload)
+	if err != nil {
+		app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(codeErrs) > 0 {
+		app.RenderJSON(w, http.StatusUnprocessableEntity, map[string]any{
+			"success": false,
+			"message": fmt.Sprintf("%s %q", MSG_CODE_UNKNOWN, codeErrs[0].Code),
+			"errors":  codeErrs,
+		})
+		return
+	}
+
+	compact, err := CompactParse(r)
+	if err != nil {
+		app.jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if compact > 0 && TableCompactable(podtabela.TableSchema) {
+		_, hidden := ColumnsCompact(columns, compact)
+		stored, err := app.DaneSelectByIdGRAndSubtable(yearDB, idGR, subtable)
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		payload, err = HiddenColumnsRestore(stored, payload, hidden)
+		if err != nil {
+			app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The stored values of the columns the user may not edit are read in the
+	// transaction that writes the blob, so a concurrent save of them isn't undone.
+	restricted := ColumnsRoleRestricted(columns, user.Role)
+	err = app.DBManager.YTx(yearDB, func(tx *SqlTx) error {
+		merged := payload
+		if len(restricted) > 0 {
+			var dane BDGROBMSP
+			if err := tx.QueryRowx("b_bdgrobmsp_dane_select_where_idgr_podtabela", idGR, subtable).StructScan(&dane); err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			stored, _, err := BlobUnwrapNotes(dane.Dane)
+			if err != nil {
+				return err
+			}
+			if merged, err = RestrictedColumnsKeep(podtabela.TableSchema, stored, merged, restricted); err != nil {
+				return err
+			}
+		}
+
+		if podtabela.TableSchema == VERTICAL_STATIC_UNIQUE {
+			var err error
+			if merged, err = VerticalFormulasApply(columns, merged); err != nil {
+				return formulaError{err}
+			}
+		}
+		blob, err := BlobWrap([]byte(merged), strings.TrimSpace(notes))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("b_bdgrobmsp_dane_replace", idGR, subtable, blob); err != nil {
+			return err
+		}
+		return AuditRecord(tx, idGR, subtable, user.Login, AUDIT_SAVE, blob)
+	})
+	var formulaErr formulaError
+	if errors.As(err, &formulaErr) {
+		app.jsonError(w, formulaErr.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		app.logger(r).Error("failed to save data", slog.String("error", err.Error()))
+		app.jsonError(w, "Failed to save data", http.StatusInternalServerError)
+		return
+	}
+
+	app.Events.Publish(EventKey{Year: yearDB, IdGR: idGR}, SaveEvent{Podtabela: subtable, Login: user.Login, Time: time.Now()})
+
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+	})
+}
+
+// AnkietSubtableDelete removes the answers idGR stored for the subtable so the
+// user can start over. Notes are stored in the same row and go with them; a not
+// applicable mark lives in b_nie_dotyczy and stays.
+// Clearing a subtable that had data is recorded in the audit trail.
+func (app *Application) AnkietSubtableDelete(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	idGR := r.PathValue("idgr")
+	subtable := r.PathValue("subtable")
+
+	user, _ := app.SessionUser(r)
+	if user.Role&UserAdmin == 0 && app.YearLocked(yearDB) {
+		app.ForbiddenJSON(w, r, "Rok jest zablokowany do edycji")
+		return
+	}
+
+	// Clearing the subtable would wipe the columns the user may not edit too.
+	kolumny, err := app.KolumnySelectBySubtable(yearDB, subtable)
 	if err != nil {
 		app.ServerError(w, r, err)
 		return
 	}
+	if len(ColumnsRoleRestricted(ColumnsBuildFromKolumny(kolumny), user.Role)) > 0 {
+		app.ForbiddenJSON(w, r, "Podtabela zawiera kolumny, których nie możesz edytować")
+		return
+	}
 
-	app.Render(w, r, http.StatusOK, TMPL_APP, data)
-}
-
-func (app *Application) YearGet(w http.ResponseWriter, r *http.Request) {
-	data, err := app.TmplBaseDataUserDate(r)
+	var deleted int64
+	err = app.DBManager.YTx(yearDB, func(tx *SqlTx) error {
+		result, err := tx.Exec("b_bdgrobmsp_dane_delete", idGR, subtable)
+		if err != nil {
+			return err
+		}
+		if deleted, err = result.RowsAffected(); err != nil || deleted == 0 {
+			return err
+		}
+		return AuditRecord(tx, idGR, subtable, user.Login, AUDIT_DELETE, "")
+	})
 	if err != nil {
-		http.Redirect(w, r, "/app/", http.StatusSeeOther)
-		app.ServerError(w, r, err)
+		app.logger(r).Error("failed to clear data", slog.String("error", err.Error()))
+		app.jsonError(w, "Failed to clear data", http.StatusInternalServerError)
 		return
 	}
 
-	app.Render(w, r, http.StatusOK, TMPL_APP_YEAR, data)
+	app.logger(r).Info("subtable cleared",
+		slog.Int("year", int(yearDB)),
+		slog.String("idgr", idGR),
+		slog.String("subtable", subtable),
+		slog.Bool("had_data", deleted > 0),
+	)
+	if deleted > 0 {
+		app.Events.Publish(EventKey{Year: yearDB, IdGR: idGR}, SaveEvent{Podtabela: subtable, Login: user.Login, Time: time.Now()})
+	}
+
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"success":  true,
+		"usunieto": deleted > 0,
+	})
+}
+
+func (app *Application) jsonError(w http.ResponseWriter, message string, status int) {
+	app.RenderJSON(w, status, map[string]any{
+		"success": false,
+		"message": message,
+	})
 }
 
-func (app *Application) AnkietListGet(w http.ResponseWriter, r *http.Request) {
+func (app *Application) AnkietSubtableGet(w http.ResponseWriter, r *http.Request) {
 	data, err := app.TmplBaseDataUserDate(r)
 	if err != nil {
 		app.ServerError(w, r, err)
@@ -1220,449 +7761,1171 @@ func (app *Application) AnkietListGet(w http.ResponseWriter, r *http.Request) {
 	}
 	data.Module = TmplModuleBDGR
 
+	selectedTable := r.PathValue("table")
+	selectedSubtable := r.PathValue("subtable")
+	idGR := r.PathValue("idgr")
+
 	yearDB, err := app.PathValueYearParse(r)
 	if err != nil {
-		app.Logger.Error(err.Error())
+		app.logger(r).Error(err.Error())
 		app.Forbidden(w, r)
 		return
 	}
 
-	tabItems, err := app.TabRowsTableBuild(yearDB, "")
+	tabItems, err := app.TabRowsTableBuild(yearDB, selectedTable)
 	if err != nil {
-		app.Logger.Error(err.Error())
+		app.logger(r).Error(err.Error())
 		app.Forbidden(w, r)
 		return
 	}
 
-	data.TabRows = []TmplTabsRow{{Items: tabItems, BaseUrl: r.URL.Path}}
+	subtabItems, err := app.TabRowsSubtableBuild(yearDB, idGR, selectedTable, selectedSubtable)
+	if err != nil {
+		app.logger(r).Error(err.Error())
+		app.Forbidden(w, r)
+		return
+	}
 
-	app.Render(w, r, http.StatusOK, TMPL_GRID, data)
-}
+	baseUrl := AppURL("app", yearDB, "bdgr", "lista-ankiet", idGR)
+	data.TabRows = []TmplTabsRow{
+		{Items: tabItems, BaseUrl: baseUrl},
+		{Items: subtabItems, BaseUrl: baseUrl},
+	}
 
-func (app *Application) ListGRGet(w http.ResponseWriter, r *http.Request) {
-	data, err := app.TmplBaseDataUserDate(r)
+	compact, err := CompactParse(r)
 	if err != nil {
-		app.Logger.Error(err.Error())
-		http.Redirect(w, r, "/app/", http.StatusSeeOther)
+		app.ClientError(w, http.StatusBadRequest)
 		return
 	}
-	data.Module = TmplModuleBDGR
-	data.BaseUrl = r.URL.Path
 
-	yearDB, err := app.PathValueYearParse(r)
+	status := http.StatusOK
+	data.Table, err = app.SubtableSchemaBuild(r, yearDB, idGR, selectedTable, selectedSubtable, compact, data.User)
+	switch {
+	case errors.Is(err, ErrTableTypeUnknown):
+		// The grid still renders, with its "unknown table type" notice, so the user
+		// keeps the navigation instead of facing a blank page.
+		app.logger(r).Error(err.Error())
+		status = http.StatusNotImplemented
+	case errors.Is(err, sql.ErrNoRows):
+		app.logger(r).Error(err.Error())
+		app.Forbidden(w, r)
+		return
+	case err != nil:
+		app.ServerError(w, r, err)
+		return
+	}
+
+	notApplicable, err := app.NotApplicableSelect(yearDB, idGR)
 	if err != nil {
-		app.Logger.Error(err.Error())
-		http.Redirect(w, r, "/app/", http.StatusSeeOther)
+		app.ServerError(w, r, err)
 		return
 	}
+	if mark, ok := notApplicable[selectedSubtable]; ok {
+		data.NotApplicable = &mark
+	}
+
+	if app.EditLockTimeout > 0 {
+		data.BaseUrl = AppURL("app", yearDB, "bdgr", "lista-ankiet", idGR, selectedTable, selectedSubtable)
+		data.EditLockRefresh = int(app.EditLockTimeout.Seconds()) / 2
+		data.EditLock, err = app.EditLockHolder(yearDB, idGR, selectedSubtable, data.User.Login)
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+	}
 
+	app.Render(w, r, status, TMPL_GRID, data)
+}
 
-	if data.User.Role&UserMethodolgist != 0 {	
-		app.Render(w, r, http.StatusOK, TMPL_LIST_GR, data)
+// ErrTableTypeUnknown is returned with a schema whose rows can't be built; it
+// still has its columns, so the grid can show its notice.
+var ErrTableTypeUnknown = errors.New("not implemented table schema type")
+
+// SubtableSchemaBuild builds the grid of subtable: its columns, cut to compact
+// when the type allows, and its rows with blocks, editability for user and the
+// answers idGR stored, shown in the request's locale. An empty idGR gives the
+// grid a farm sees before answering, for previews.
+func (app *Application) SubtableSchemaBuild(r *http.Request, yearDB YearDB, idGR, table, subtable string, compact int64, user User) (TableSchema, error) {
+	schema := TableSchema{
+		Year:     strconv.Itoa(int(yearDB)),
+		Table:    table,
+		Subtable: subtable,
+		IdGR:     idGR,
 	}
-	
-	var statusy []Statusy
-	var rows *sqlx.Rows 
-	if data.User.Role&UserAdmin != 0 {	 
-		rows, err = app.DBManager.YQueryx(yearDB, "b_statusy_list_all")
-	} else if data.User.Role&UserManager != 0 {		
-		rows, err = app.DBManager.YQueryx(yearDB, "b_statusy_list_where_idbr", data.User.IdBR)
-	} else {		
-		rows, err = app.DBManager.YQueryx(yearDB, "b_statusy_list_where_idpbr", data.User.IdPBR)
+
+	definition, err := app.SubtableDefinitionSelect(yearDB, subtable)
+	if err != nil {
+		return schema, err
 	}
-		
+	schema.TableName = definition.Podtabela.Symbol + definition.Podtabela.Title
+	schema.Type = definition.Podtabela.TableSchema
+	schema.Columns = definition.Columns
+	blocks := definition.Blocks
+
+	if compact > 0 && TableCompactable(schema.Type) {
+		schema.Columns, _ = ColumnsCompact(schema.Columns, compact)
+		schema.Compact = compact
+	}
+	schema.Width = ColumnsWidth(schema.Columns)
+	if app.WideTableWidth > 0 && schema.Width > app.WideTableWidth && TableCompactable(schema.Type) {
+		schema.Wide = true
+		schema.CompactSuggested = app.CompactColumns
+		app.logger(r).Warn("wide table",
+			slog.String("subtable", subtable),
+			slog.Int64("width", schema.Width),
+			slog.Int("columns", len(schema.Columns)),
+		)
+	}
+
+	kodyPodtabele, err := app.KodySelectBySubtable(yearDB, subtable)
 	if err != nil {
-		app.Logger.Error(err.Error())
-		http.Redirect(w, r, "/app/", http.StatusSeeOther)
-		return
+		return schema, err
 	}
-	defer rows.Close()
 
-	if err = sqlx.StructScan(rows, &statusy); err != nil {
-		app.Logger.Error(err.Error())
-		http.Redirect(w, r, "/app/", http.StatusSeeOther)
-		return
+	var jsonData string
+	if idGR != "" {
+		jsonData, schema.Notes, err = app.DaneNotesSelectByIdGRAndSubtable(yearDB, idGR, subtable)
+		if err != nil {
+			app.logger(r).Warn("no existing data", slog.String("error", err.Error()))
+		}
 	}
 
-	data.Statusy = statusy
+	format := LocaleFormatGet(app.Locale(r))
+	switch schema.Type {
+	case HORIZONTAL_DYNAMIC_DUPLICABLE, HORIZONTAL_DYNAMIC_UNIQUE:
+		schema.Codes = KodyRows(kodyPodtabele)
 
-	app.Render(w, r, http.StatusOK, TMPL_LIST_GR, data)
-}
+		titles := make(map[string]string, len(kodyPodtabele))
+		for _, kod := range kodyPodtabele {
+			titles[kod.Code] = kod.Title
+		}
+		schema.Rows, err = DynamicRowsBuild(jsonData, format, func(code string, index int) TableRow {
+			return app.DynamicRowBuild(schema.Columns, code, titles[code], index, blocks, yearDB, user)
+		})
+		if err != nil {
+			app.logger(r).Warn("failed to populate horizontal dynamic data", slog.String("error", err.Error()))
+		}
 
-func (app *Application) AnkietIdGRGet(w http.ResponseWriter, r *http.Request) {
-	data, err := app.TmplBaseDataUserDate(r)
-	if err != nil {
-		app.ServerError(w, r, err)
-		return
+	case HORIZONTAL_STATIC_UNIQUE, PKD_STATIC_UNIQUE, SIMC_STATIC_UNIQUE:
+		var lookup, lookupURL string
+		if schema.Type != HORIZONTAL_STATIC_UNIQUE {
+			if column := ColumnFirstValue(schema.Columns); column != nil {
+				lookup = column.Name
+				lookupURL = AppURL("app", yearDB, "slowniki", LOOKUP_SOURCES[schema.Type])
+			}
+		}
+
+		tableRows := make([]TableRow, 0, len(kodyPodtabele))
+		for _, row := range kodyPodtabele {
+			tableRow := TableRow{Title: row.Title, Code: row.Code} // Add Code here
+			for i := range schema.Columns {
+				column := &schema.Columns[i]
+				cell := TableCell{
+					Name:     column.Name,
+					Column:   column,
+					Required: column.Required,
+				}
+				if app.CellEditable(column, row.Code, blocks, yearDB, user) {
+					cell.Editable = 1
+				}
+				for _, block := range blocks {
+					if block.Column == column.Name && block.Code == row.Code {
+						cell.Blocked = true
+						break
+					}
+				}
+				if ColumnIsKey(cell.Name) {
+					cell.Value = row.Code
+				}
+				if column.Name == lookup {
+					cell.Lookup = lookupURL
+				}
+				tableRow.Cells = append(tableRow.Cells, cell)
+			}
+			tableRows = append(tableRows, tableRow)
+		}
+		schema.Rows = tableRows
+
+		// Populate with existing data
+		if err := PopulateCellsFromArray(schema.Rows, jsonData, format); err != nil {
+			app.logger(r).Warn("failed to populate horizontal static data", slog.String("error", err.Error()))
+		}
+
+	case VERTICAL_STATIC_UNIQUE:
+		for i := range schema.Columns {
+			column := &schema.Columns[i]
+			title := column.Label + " " + column.Title
+			tableRow := TableRow{
+				Title: title,
+				Cells: []TableCell{{Column: column, Name: column.Name}}, // Add Name here
+			}
+			if app.CellEditable(column, "", nil, yearDB, user) {
+				tableRow.Cells[0].Editable = 1
+			}
+			schema.Rows = append(schema.Rows, tableRow)
+		}
+
+		// Totals are recomputed on every render, so changed formulas show up without resaving.
+		if computed, err := VerticalFormulasApply(schema.Columns, jsonData); err != nil {
+			app.logger(r).Warn("failed to compute formulas", slog.String("subtable", subtable), slog.String("error", err.Error()))
+		} else {
+			jsonData = computed
+		}
+
+		// Populate with existing data
+		if err := PopulateCellsFromObject(schema.Rows, jsonData, format); err != nil {
+			app.logger(r).Warn("failed to populate vertical static data", slog.String("error", err.Error()))
+		}
+
+	case MATRIX_DYNAMIC_UNIQUE:
+		value := ColumnFirstValue(schema.Columns)
+		if value == nil {
+			return schema, fmt.Errorf("matrix subtable %s has no value column", subtable)
+		}
+		matrix, err := MatrixParse(jsonData)
+		if err != nil {
+			app.logger(r).Warn("failed to parse matrix data", slog.String("error", err.Error()))
+		}
+
+		codes := KodyRows(kodyPodtabele)
+		usedRows, usedColumns := make(map[string]bool), make(map[string]bool)
+		for rowCode, row := range matrix {
+			usedRows[rowCode] = true
+			for columnCode := range row {
+				usedColumns[columnCode] = true
+			}
+		}
+		schema.Codes = codes
+		schema.MatrixColumns = MatrixCodesOrder(codes, usedColumns)
+
+		// validateMatrix holds matrix cells to wymagana alone, so the form must too.
+		cellColumn := *value
+		cellColumn.RequiredWhen = ""
+		cell := func(rowCode, columnCode string) TableCell {
+			cell := TableCell{Name: columnCode, Column: &cellColumn, Required: value.Required}
+			if app.CellEditable(value, rowCode, blocks, yearDB, user) {
+				cell.Editable = 1
+			}
+			cell.Blocked = slices.ContainsFunc(blocks, func(b BBlokady) bool { return b.Column == value.Name && b.Code == rowCode })
+			return cell
+		}
+		for _, row := range MatrixCodesOrder(codes, usedRows) {
+			for _, column := range schema.MatrixColumns {
+				row.Cells = append(row.Cells, cell(row.Code, column.Code))
+			}
+			schema.Rows = append(schema.Rows, row)
+		}
+		empty := cell("", "")
+		schema.MatrixCell = &empty
+
+		if err := PopulateCellsFromMatrix(schema.Rows, jsonData, format); err != nil {
+			app.logger(r).Warn("failed to populate matrix data", slog.String("error", err.Error()))
+		}
+
+	default:
+		return schema, fmt.Errorf("%w %s in subtable %s", ErrTableTypeUnknown, schema.Type, subtable)
 	}
-	data.Module = TmplModuleBDGR
 
+	return schema, nil
+}
+
+// LOOKUP_SOURCES names the LookupGet source behind each autocompleted table type.
+var LOOKUP_SOURCES = map[string]string{
+	PKD_STATIC_UNIQUE:  "pkd",
+	SIMC_STATIC_UNIQUE: "simc",
+}
+
+// LOOKUP_LIMIT caps autocomplete suggestions; typing more narrows them down.
+const LOOKUP_LIMIT = 20
+
+type LookupOption struct {
+	Value string `json:"value"`
+	Label string `json:"label"`
+}
+
+// LookupGet suggests PKD or SIMC codes matching ?q=. PKD matches the code prefix or
+// any part of the description; SIMC the code or the start of the locality name, with
+// gmina and powiat in the label since many localities share a name.
+func (app *Application) LookupGet(w http.ResponseWriter, r *http.Request) {
 	yearDB, err := app.PathValueYearParse(r)
 	if err != nil {
-		app.Logger.Error(err.Error())
-		app.Forbidden(w, r)
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
 		return
 	}
 
-	tabItems, err := app.TabRowsTableBuild(yearDB, "")
-	if err != nil {
-		app.Logger.Error(err.Error())
-		app.Forbidden(w, r)
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	options := []LookupOption{}
+
+	switch r.PathValue("source") {
+	case "pkd":
+		if query == "" {
+			break
+		}
+		rows, err := app.DBManager.YQueryx(yearDB, "pkd_pkd_select_where_kod_or_opis_like", query, query, LOOKUP_LIMIT)
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		var pkd []PKDPKD
+		err = sqlx.StructScan(rows, &pkd)
+		rows.Close()
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		for _, p := range pkd {
+			options = append(options, LookupOption{Value: p.Kod, Label: p.Opis.String})
+		}
+
+	case "simc":
+		if query == "" {
+			break
+		}
+		rows, err := app.DBManager.YQueryx(yearDB, "teryt_simc_select_join_teryt_where_simc_or_miejscowosc_like", query, query, LOOKUP_LIMIT)
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		var simc []struct {
+			TerytSIMC
+			Gmina  sql.NullString `db:"gmina"`
+			Powiat sql.NullString `db:"powiat"`
+		}
+		err = sqlx.StructScan(rows, &simc)
+		rows.Close()
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		for _, s := range simc {
+			label := s.Miejscowosc
+			if s.Gmina.Valid {
+				label += fmt.Sprintf(" (gm. %s, pow. %s)", s.Gmina.String, s.Powiat.String)
+			}
+			options = append(options, LookupOption{Value: s.SIMC, Label: label})
+		}
+
+	default:
+		app.jsonError(w, "Unknown lookup", http.StatusNotFound)
 		return
 	}
 
-	data.TabRows = []TmplTabsRow{{Items: tabItems, BaseUrl: r.URL.Path}}
-
-	app.Render(w, r, http.StatusOK, TMPL_GRID, data)
+	app.RenderJSON(w, http.StatusOK, options)
 }
 
-func (app *Application) AnkietTableGet(w http.ResponseWriter, r *http.Request) {
-	data, err := app.TmplBaseDataUserDate(r)
+func (app *Application) AnkietRowGet(w http.ResponseWriter, r *http.Request) {
+	subtable := r.PathValue("subtable")
+	code := r.PathValue("code")
+
+	index, err := strconv.Atoi(r.PathValue("index"))
 	if err != nil {
-		app.ServerError(w, r, err)
+		app.logger(r).Error(err.Error())
+		app.Forbidden(w, r)
 		return
 	}
-	data.Module = TmplModuleBDGR
-
-	selectedTable := r.PathValue("table")
 
 	yearDB, err := app.PathValueYearParse(r)
 	if err != nil {
-		app.Logger.Error(err.Error())
+		app.logger(r).Error(err.Error())
 		app.Forbidden(w, r)
 		return
 	}
 
-	tabItems, err := app.TabRowsTableBuild(yearDB, selectedTable)
+	// The limit counts the rows already stored; the new one makes one more. Rows
+	// added but not saved yet are caught by the save.
+	if _, limited := app.MaxRows[subtable]; limited {
+		stored, err := app.DaneSelectByIdGRAndSubtable(yearDB, r.PathValue("idgr"), subtable)
+		if err != nil {
+			app.ServerError(w, r, err)
+			return
+		}
+		if limit, exceeded := app.MaxRowsExceeded(subtable, BlobRowCount(stored)+1); exceeded {
+			http.Error(w, fmt.Sprintf("Osiągnięto maksymalną liczbę wierszy (%d)", limit), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	kolumny, err := app.KolumnySelectBySubtable(yearDB, subtable)
 	if err != nil {
-		app.Logger.Error(err.Error())
+		app.logger(r).Error(err.Error())
 		app.Forbidden(w, r)
 		return
 	}
 
-	subtabItems, err := app.TabRowsSubtableBuild(yearDB, selectedTable, "")
+	tableColumns := ColumnsBuildFromKolumny(kolumny)
+	compact, err := CompactParse(r)
 	if err != nil {
-		app.Logger.Error(err.Error())
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	if compact > 0 {
+		tableColumns, _ = ColumnsCompact(tableColumns, compact)
+	}
+
+	user, ok := app.SessionUser(r)
+	if !ok {
 		app.Forbidden(w, r)
 		return
 	}
 
-	baseUrl := path.Dir(path.Dir(r.URL.Path))
-	data.TabRows = []TmplTabsRow{
-		{Items: tabItems, BaseUrl: baseUrl},
-		{Items: subtabItems, BaseUrl: baseUrl},
+	blocks, err := app.BlokadySelectBySubtableAndCode(yearDB, subtable, code)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	// The query only selects the column; DynamicRowBuild matches on the code too.
+	for i := range blocks {
+		blocks[i].Code = code
+	}
+
+	var title string
+	if slices.ContainsFunc(tableColumns, func(c TableColumn) bool { return ColumnIsDescription(c.Name) }) {
+		app.DBManager.YQueryRowx(yearDB, "b_kody_tytul_where_kod", code).Scan(&title)
+	}
+	tableRow := app.DynamicRowBuild(tableColumns, code, title, index, blocks, yearDB, user)
+
+	w.Header().Set("Content-Type", "text/html")
+	TmplLocalize(TMPL_DYNAMIC_ROW, app.Locale(r)).Execute(w, tableRow)
+}
+
+// DynamicRowBuild is an empty row of a HORIZONTAL_DYNAMIC_* table at index, with
+// the code in the key column and title in the description column. The cells
+// point into columns, which must outlive the row.
+func (app *Application) DynamicRowBuild(columns []TableColumn, code, title string, index int, blocks []BBlokady, yearDB YearDB, user User) TableRow {
+	tableRow := TableRow{Code: code, Index: int64(index)}
+	for i := range columns {
+		column := &columns[i]
+		cell := TableCell{
+			Name:     column.Name,
+			Column:   column,
+			Required: column.Required,
+		}
+		if app.CellEditable(column, code, blocks, yearDB, user) {
+			cell.Editable = 1
+		}
+		cell.Blocked = slices.ContainsFunc(blocks, func(b BBlokady) bool { return b.Column == column.Name && b.Code == code })
+		if ColumnIsKey(cell.Name) {
+			cell.Value = code
+		}
+		if ColumnIsDescription(cell.Name) {
+			cell.Value = title
+		}
+		tableRow.Cells = append(tableRow.Cells, cell)
+	}
+	return tableRow
+}
+
+var (
+	ErrRowConflict = errors.New("row index holds another code")
+	ErrRowLimit    = errors.New("row limit exceeded")
+)
+
+// RowMerge puts row at index in the stored array of a dynamic table and returns the
+// new array with the index the row ended up at. An index past the end appends, so
+// a row the client just added lands last; an index holding another code means the
+// client's view is stale.
+func RowMerge(jsonData, code string, index int, row map[string]any) (string, int, error) {
+	var rows []map[string]any
+	if strings.TrimSpace(jsonData) != "" {
+		if err := json.Unmarshal([]byte(jsonData), &rows); err != nil {
+			return "", 0, err
+		}
 	}
 
-	app.Render(w, r, http.StatusOK, TMPL_GRID, data)
+	if index >= len(rows) {
+		rows = append(rows, row)
+		index = len(rows) - 1
+	} else {
+		for k, v := range rows[index] {
+			if ColumnIsKey(k) && v != code {
+				return "", 0, ErrRowConflict
+			}
+		}
+		rows[index] = row
+	}
+
+	merged, err := json.Marshal(rows)
+	return string(merged), index, err
 }
 
-func (app *Application) AnkietSubtablePost(w http.ResponseWriter, r *http.Request) {
+// rowValidationError aborts the row transaction without it being a server error.
+type rowValidationError []ValidationError
+
+func (e rowValidationError) Error() string { return "row failed validation" }
+
+// AnkietRowPost saves one row of a dynamic table without resending the whole array,
+// so rows can autosave. The read, merge and write run in one transaction; two rows
+// saved at once must not drop each other.
+func (app *Application) AnkietRowPost(w http.ResponseWriter, r *http.Request) {
 	yearDB, err := app.PathValueYearParse(r)
 	if err != nil {
 		app.jsonError(w, "Invalid year", http.StatusBadRequest)
 		return
 	}
-
 	idGR := r.PathValue("idgr")
 	subtable := r.PathValue("subtable")
+	code := r.PathValue("code")
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 {
+		app.jsonError(w, "Invalid index", http.StatusBadRequest)
+		return
+	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		app.jsonError(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
-
-	if app.Debug {
-		app.Logger.Debug("received JSON", slog.String("body", string(body)))
+	body, err = BodyDecode(body, r.Header.Get("Content-Type"), app.BodyCharset)
+	if errors.Is(err, ErrCharsetUnsupported) {
+		app.jsonError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		app.jsonError(w, "Nieprawidłowe kodowanie znaków, oczekiwano UTF-8 ("+err.Error()+")", http.StatusUnprocessableEntity)
+		return
 	}
-
-	_, err = app.DBManager.YExec(yearDB, "b_bdgrobmsp_dane_replace", idGR, subtable, string(body))
-	if err != nil {
-		app.Logger.Error("failed to save data", slog.String("error", err.Error()))
-		app.jsonError(w, "Failed to save data", http.StatusInternalServerError)
+	var row map[string]any
+	if err := json.Unmarshal(body, &row); err != nil || row == nil {
+		app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
-		"success": true,
-	})
-}
-
-func (app *Application) jsonError(w http.ResponseWriter, message string, status int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]any{
-		"success": false,
-		"message": message,
-	})
-}
+	// Locked years are read-only the same way as for AnkietSubtablePost.
+	user, _ := app.SessionUser(r)
+	if user.Role&UserAdmin == 0 && app.YearLocked(yearDB) {
+		app.ForbiddenJSON(w, r, "Rok jest zablokowany do edycji")
+		return
+	}
 
-func (app *Application) AnkietSubtableGet(w http.ResponseWriter, r *http.Request) {
-	data, err := app.TmplBaseDataUserDate(r)
+	definition, err := app.SubtableDefinitionSelect(yearDB, subtable)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.jsonError(w, "Unknown subtable", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		app.ServerError(w, r, err)
 		return
 	}
-	data.Module = TmplModuleBDGR
-
-	selectedTable := r.PathValue("table")
-	selectedSubtable := r.PathValue("subtable")
-	yearString := r.PathValue("year")
-	idGR := r.PathValue("idgr")
-
-	data.Table.Table = selectedTable
-	data.Table.Subtable = selectedSubtable
-	data.Table.Year = yearString
-	data.Table.IdGR = idGR
-
-	yearDB, err := app.PathValueYearParse(r)
-	if err != nil {
-		app.Logger.Error(err.Error())
-		app.Forbidden(w, r)
+	podtabela, columns, blocks := definition.Podtabela, definition.Columns, definition.Blocks
+	if podtabela.TableSchema != HORIZONTAL_DYNAMIC_DUPLICABLE && podtabela.TableSchema != HORIZONTAL_DYNAMIC_UNIQUE {
+		app.jsonError(w, "Not a dynamic table", http.StatusBadRequest)
 		return
 	}
 
-	tabItems, err := app.TabRowsTableBuild(yearDB, selectedTable)
+	notApplicable, err := app.NotApplicableSelect(yearDB, idGR)
 	if err != nil {
-		app.Logger.Error(err.Error())
-		app.Forbidden(w, r)
+		app.ServerError(w, r, err)
 		return
 	}
+	_, optional := notApplicable[subtable]
 
-	subtabItems, err := app.TabRowsSubtableBuild(yearDB, selectedTable, selectedSubtable)
+	allowed, err := app.CodesAllowedSelect(yearDB, subtable)
 	if err != nil {
-		app.Logger.Error(err.Error())
-		app.Forbidden(w, r)
+		app.ServerError(w, r, err)
 		return
 	}
-
-	baseUrl := path.Dir(path.Dir(path.Dir(r.URL.Path)))
-	data.TabRows = []TmplTabsRow{
-		{Items: tabItems, BaseUrl: baseUrl},
-		{Items: subtabItems, BaseUrl: baseUrl},
-	}
-
-	row := app.DBManager.YQueryRowx(yearDB, "b_podtabeal_select_where_podtabela", selectedSubtable)
-	var podtabelaGrid BPodtabele
-	if err := row.StructScan(&podtabelaGrid); err != nil {
-		app.Logger.Error(err.Error())
-		app.Forbidden(w, r)
+	if len(allowed) > 0 && !allowed[code] {
+		errs := []ValidationError{{Code: code, Index: index, Message: MSG_CODE_UNKNOWN}}
+		app.RenderJSON(w, http.StatusUnprocessableEntity, map[string]any{"success": false, "errors": errs})
 		return
 	}
 
-	data.Table.TableName = podtabelaGrid.Symbol + podtabelaGrid.Title
-	data.Table.Type = podtabelaGrid.TableSchema
-
-	kolumny, err := app.KolumnySelectBySubtable(yearDB, selectedSubtable)
+	// The path decides which row this is, whatever the body says.
+	for _, column := range columns {
+		if ColumnIsKey(column.Name) {
+			row[column.Name] = code
+		}
+	}
+	rowJSON, err := json.Marshal([]map[string]any{row})
 	if err != nil {
-		app.Logger.Error(err.Error())
-		app.Forbidden(w, r)
+		app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-
-	data.Table.Columns = ColumnsBuildFromKolumny(kolumny)
-
-	rows, err := app.DBManager.YQueryx(yearDB, "b_kody__podtabele_select_kod_tytul_join_kod_where_podtabela", selectedSubtable)
+	normalized, err := SubtableDataNormalize(columns, string(rowJSON))
 	if err != nil {
-		app.Logger.Error(err.Error())
-		app.Forbidden(w, r)
+		app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
-
-	var kodyPodtabele []BKodyPodtabele
-	if err := sqlx.StructScan(rows, &kodyPodtabele); err != nil {
-		app.Logger.Error(err.Error())
-		app.Forbidden(w, r)
+	var normalizedRows []map[string]any
+	if err := json.Unmarshal([]byte(normalized), &normalizedRows); err != nil || len(normalizedRows) != 1 {
+		app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-
-	// Fetch existing data
-	jsonData, err := app.DaneSelectByIdGRAndSubtable(yearDB, idGR, selectedSubtable)
-	if err != nil {
-		app.Logger.Warn("no existing data", slog.String("error", err.Error()))
-	}
-
-	switch data.Table.Type {
-	case HORIZONTAL_DYNAMIC_DUPLICABLE, HORIZONTAL_DYNAMIC_UNIQUE:
-		tableRows := make([]TableRow, 0, len(kodyPodtabele))
-		for _, row := range kodyPodtabele {
-			tableRows = append(tableRows, TableRow{Title: row.Title, Code: row.Code})
+	row = normalizedRows[0]
+
+	restricted := ColumnsRoleRestricted(columns, user.Role)
+
+	// YTx may run the closure again on a busy database; each run merges at the
+	// index the client asked for, not the one an earlier run appended at.
+	requested := index
+	saved := row
+	err = app.DBManager.YTx(yearDB, func(tx *SqlTx) error {
+		var dane BDGROBMSP
+		if err := tx.QueryRowx("b_bdgrobmsp_dane_select_where_idgr_podtabela", idGR, subtable).StructScan(&dane); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		data, notes, err := BlobUnwrapNotes(dane.Dane)
+		if err != nil {
+			return err
 		}
-		data.Table.Rows = tableRows
-		data.Table.Data = jsonData
 
-	case HORIZONTAL_STATIC_UNIQUE:
-		blocks, err := app.BlokadySelectBySubtable(yearDB, selectedSubtable)
+		merged, at, err := RowMerge(data, code, requested, row)
 		if err != nil {
-			app.ServerError(w, r, err)
-			return
+			return err
 		}
-		tableRows := make([]TableRow, 0, len(kodyPodtabele))
-		for _, row := range kodyPodtabele {
-			tableRow := TableRow{Title: row.Title, Code: row.Code} // Add Code here
-			for i := range data.Table.Columns {
-				column := &data.Table.Columns[i]
-				cell := TableCell{
-					Name:     column.Name,
-					Column:   column,
-					Required: column.Required,
-					Editable: 1,
-				}
-				for _, block := range blocks {
-					if block.Column == column.Name && block.Code == row.Code {
-						cell.Blocked = true
-						break
-					}
-				}
-				if strings.Contains(cell.Name, "_Kod") {
-					cell.Editable = 0
-					cell.Value = row.Code
-				}
-				tableRow.Cells = append(tableRow.Cells, cell)
-			}
-			tableRows = append(tableRows, tableRow)
+		index = at
+		if _, exceeded := app.MaxRowsExceeded(subtable, index+1); exceeded {
+			return ErrRowLimit
 		}
-		data.Table.Rows = tableRows
 
-		// Populate with existing data
-		if err := PopulateCellsFromArray(data.Table.Rows, jsonData); err != nil {
-			app.Logger.Warn("failed to populate horizontal static data", slog.String("error", err.Error()))
+		if len(restricted) > 0 {
+			merged, err = RestrictedColumnsKeep(podtabela.TableSchema, data, merged, restricted)
+			if err != nil {
+				return err
+			}
+			var mergedRows []map[string]any
+			if err := json.Unmarshal([]byte(merged), &mergedRows); err != nil {
+				return err
+			}
+			saved = mergedRows[index]
 		}
 
-	case VERTICAL_STATIC_UNIQUE:
-		for i := range data.Table.Columns {
-			column := &data.Table.Columns[i]
-			title := column.Label + " " + column.Title
-			tableRow := TableRow{
-				Title: title,
-				Cells: []TableCell{{Column: column, Editable: 1, Name: column.Name}}, // Add Name here
+		errs, err := ValidateSubtableData(podtabela.TableSchema, columns, blocks, merged)
+		if err != nil {
+			return err
+		}
+		if optional {
+			errs = ValidationErrorsOptional(errs)
+		}
+		var rowErrs rowValidationError
+		for _, e := range errs {
+			// The user can't fix what they can't edit.
+			if e.Index == index && !slices.Contains(restricted, e.Column) {
+				rowErrs = append(rowErrs, e)
 			}
-			data.Table.Rows = append(data.Table.Rows, tableRow)
+		}
+		if len(rowErrs) > 0 {
+			return rowErrs
 		}
 
-		// Populate with existing data
-		if err := PopulateCellsFromObject(data.Table.Rows, jsonData); err != nil {
-			app.Logger.Warn("failed to populate vertical static data", slog.String("error", err.Error()))
+		blob, err := BlobWrap([]byte(merged), notes)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("b_bdgrobmsp_dane_replace", idGR, subtable, blob); err != nil {
+			return err
 		}
+		return AuditRecord(tx, idGR, subtable, user.Login, AUDIT_ROW_SAVE, blob)
+	})
 
+	var rowErrs rowValidationError
+	switch {
+	case errors.As(err, &rowErrs):
+		app.RenderJSON(w, http.StatusUnprocessableEntity, map[string]any{"success": false, "errors": []ValidationError(rowErrs)})
+	case errors.Is(err, ErrRowConflict):
+		app.jsonError(w, "Wiersz został zmieniony, odśwież stronę", http.StatusConflict)
+	case errors.Is(err, ErrRowLimit):
+		app.jsonError(w, fmt.Sprintf("Przekroczono maksymalną liczbę wierszy (%d)", app.MaxRows[subtable]), http.StatusUnprocessableEntity)
+	case err != nil:
+		app.ServerError(w, r, err)
 	default:
-		app.Logger.Error("not implemented table schema type", slog.String("type", data.Table.Type))
-		return
+		app.Events.Publish(EventKey{Year: yearDB, IdGR: idGR}, SaveEvent{Podtabela: subtable, Login: user.Login, Time: time.Now()})
+		app.RenderJSON(w, http.StatusOK, map[string]any{"success": true, "index": index, "row": saved})
 	}
-
-	app.Render(w, r, http.StatusOK, TMPL_GRID, data)
 }
 
-func (app *Application) AnkietRowGet(w http.ResponseWriter, r *http.Request) {
-	subtable := r.PathValue("subtable")
-	code := r.PathValue("code")
+// EVENT_KEEPALIVE spaces the comment lines that keep idle proxies from closing an
+// events stream; a failed keepalive write is also how a vanished client is noticed.
+const EVENT_KEEPALIVE = 30 * time.Second
 
-	index, err := strconv.Atoi(r.PathValue("index"))
+// AnkietEventsGet streams SaveEvents for the farm as server-sent events until the
+// client goes away. The stream outlives any write timeout, so the deadline is
+// lifted, and it keeps neither an InFlight slot nor the year.
+func (app *Application) AnkietEventsGet(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
 	if err != nil {
-		app.Logger.Error(err.Error())
 		app.Forbidden(w, r)
 		return
 	}
 
-	yearDB, err := app.PathValueYearParse(r)
-	if err != nil {
-		app.Logger.Error(err.Error())
-		app.Forbidden(w, r)
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.ServerError(w, r, err)
 		return
 	}
 
-	kolumny, err := app.KolumnySelectBySubtable(yearDB, subtable)
-	if err != nil {
-		app.Logger.Error(err.Error())
-		app.Forbidden(w, r)
+	events, unsubscribe := app.Events.Subscribe(EventKey{Year: yearDB, IdGR: r.PathValue("idgr")})
+	defer unsubscribe()
+	InFlightRelease(r)
+	YearRelease(r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
 		return
 	}
 
-	tableColumns := ColumnsBuildFromKolumny(kolumny)
+	keepalive := time.NewTicker(EVENT_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				app.logger(r).Error(err.Error())
+				continue
+			}
+			fmt.Fprintf(w, "event: save\ndata: %s\n\n", data)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
 
-	blocks, err := app.BlokadySelectBySubtableAndCode(yearDB, subtable, code)
-	if err != nil {
-		app.ServerError(w, r, err)
-		return
+// LOG_SENSITIVE_KEYS are redacted wherever they show up in a log record: as an
+// attribute key, or inside a message or string value as key=value or "key":"value"
+// (form bodies, query strings and JSON end up in error messages that way).
+var LOG_SENSITIVE_KEYS = []string{"password", "haslo", "salt", "token"}
+
+var RE_LOG_SENSITIVE = regexp.MustCompile(`(?i)((?:` + strings.Join(LOG_SENSITIVE_KEYS, "|") + `)[\w-]*"?\s*[:=]\s*"?)([^&"\s,;}]+)`)
+
+const LOG_REDACTED = "[REDACTED]"
+
+// RedactHandler scrubs LOG_SENSITIVE_KEYS before a record reaches next, so no
+// call site has to remember to leave passwords out.
+type RedactHandler struct {
+	next slog.Handler
+}
+
+func RedactHandlerNew(next slog.Handler) *RedactHandler {
+	return &RedactHandler{next: next}
+}
+
+func (h *RedactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *RedactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, logRedactString(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(logRedactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *RedactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = logRedactAttr(attr)
+	}
+	return &RedactHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *RedactHandler) WithGroup(name string) slog.Handler {
+	return &RedactHandler{next: h.next.WithGroup(name)}
+}
+
+func logRedactAttr(attr slog.Attr) slog.Attr {
+	for _, key := range LOG_SENSITIVE_KEYS {
+		if strings.Contains(strings.ToLower(attr.Key), key) {
+			return slog.String(attr.Key, LOG_REDACTED)
+		}
 	}
 
-	tableRow := TableRow{Code: code, Index: int64(index)}
-	for i := range tableColumns {
-		column := &tableColumns[i]
-		cell := TableCell{
-			Name:     column.Name,
-			Column:   column,
-			Required: column.Required,
-			Editable: 1,
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, logRedactString(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]any, len(group))
+		for i, member := range group {
+			redacted[i] = logRedactAttr(member)
 		}
-		
-		for _, block := range blocks {
-			if block.Column == column.Name {
-				cell.Blocked = true
-				break
-			}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindAny:
+		// Errors and Stringers are flattened so their text gets scrubbed too.
+		if _, ok := value.Any().(error); ok {
+			return slog.String(attr.Key, logRedactString(value.String()))
 		}
+		if _, ok := value.Any().(fmt.Stringer); ok {
+			return slog.String(attr.Key, logRedactString(value.String()))
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
 
-		if strings.Contains(cell.Name, "_Kod") {
-			cell.Editable = 0
-			cell.Value = code
+func logRedactString(s string) string {
+	return RE_LOG_SENSITIVE.ReplaceAllString(s, "${1}"+LOG_REDACTED)
+}
+
+// Config is everything the server can be started with. ConfigDefault holds the
+// flag defaults, ConfigFlags binds a Config to a flag set and setupApplication
+// turns the result into an Application. A zero Config leaves every optional
+// feature off, which is what tests start from.
+type Config struct {
+	Addr     string
+	DBDir    string
+	LogLevel    slog.Level
+	Debug       bool
+	StackStdout bool
+
+	CheckSQL     bool
+	Migrate      bool
+	MigrateBlobs bool
+
+	TLSCert      string
+	TLSKey       string
+	HSTSMaxAge   time.Duration
+	AllowedHosts FlagStrings
+	BasePath     string
+	StaticDir    string
+
+	CORSOrigins     string
+	CORSMethods     string
+	CORSHeaders     string
+	CORSCredentials bool
+
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	IdleTimeout      time.Duration
+	LongWriteTimeout time.Duration
+	MaxInFlight      int
+
+	SessionIdleTimeout time.Duration
+	SessionWarning     time.Duration
+	EditLockTimeout    time.Duration
+
+	IdempotencyWindow time.Duration
+	BodyCharset       string
+	LogRequestBodies  bool
+	MaxRows           string
+	WideTableWidth    int64
+	CompactColumns    int64
+
+	BackupDir      string
+	BackupInterval time.Duration
+
+	BusyRetries int
+	BusyBackoff time.Duration
+	SlowQuery   time.Duration
+
+	LDAPURL      string
+	LDAPBindDN   string
+	LDAPGroups   string
+	LDAPIdBRAttr string
+	LDAPTimeout  time.Duration
+
+	Features string
+}
+
+func ConfigDefault() Config {
+	return Config{
+		Addr:               ":8082",
+		DBDir:              "db/",
+		LogLevel:           slog.LevelDebug,
+		Debug:              true,
+		Migrate:            true,
+		HSTSMaxAge:         365 * 24 * time.Hour,
+		CORSMethods:        "GET, POST",
+		CORSHeaders:        "Content-Type",
+		ReadTimeout:        5 * time.Second,
+		WriteTimeout:       10 * time.Second,
+		IdleTimeout:        time.Minute,
+		LongWriteTimeout:   5 * time.Minute,
+		SessionIdleTimeout: 30 * time.Minute,
+		SessionWarning:     2 * time.Minute,
+		EditLockTimeout:    5 * time.Minute,
+		IdempotencyWindow:  10 * time.Minute,
+		BodyCharset:        "utf-8",
+		WideTableWidth:     4000,
+		CompactColumns:     20,
+		BackupDir:          "backup/",
+		BusyRetries:        3,
+		BusyBackoff:        50 * time.Millisecond,
+		LDAPIdBRAttr:       "departmentNumber",
+		LDAPTimeout:        5 * time.Second,
+	}
+}
+
+// ConfigFlags registers the command line flags on fs, each writing into cfg and
+// defaulting to the value cfg already holds.
+func ConfigFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "HTTP network address")
+	fs.StringVar(&cfg.DBDir, "db", cfg.DBDir, "database directory")
+	fs.TextVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "lowest level logged: debug, info, warn or error")
+	fs.StringVar(&cfg.CORSOrigins, "cors-origins", cfg.CORSOrigins, "comma separated origins allowed to call /api/ (* for any)")
+	fs.StringVar(&cfg.CORSMethods, "cors-methods", cfg.CORSMethods, "comma separated methods allowed for /api/ preflight")
+	fs.StringVar(&cfg.CORSHeaders, "cors-headers", cfg.CORSHeaders, "comma separated headers allowed for /api/ preflight")
+	fs.BoolVar(&cfg.CORSCredentials, "cors-credentials", cfg.CORSCredentials, "allow cookies on cross-origin /api/ requests")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "TLS certificate file, serves HTTPS together with -tls-key")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "TLS key file")
+	fs.DurationVar(&cfg.HSTSMaxAge, "hsts-max-age", cfg.HSTSMaxAge, "Strict-Transport-Security max-age over TLS, 0 disables")
+	fs.StringVar(&cfg.MaxRows, "max-rows", cfg.MaxRows, "comma separated podtabela=limit row caps, subtables not listed are unlimited")
+	fs.BoolVar(&cfg.Migrate, "migrate", cfg.Migrate, "apply pending sql_migrations to master and every year database at startup")
+	fs.BoolVar(&cfg.MigrateBlobs, "migrate-blobs", cfg.MigrateBlobs, "wrap legacy survey blobs in the versioned envelope and exit")
+	fs.DurationVar(&cfg.IdempotencyWindow, "idempotency-window", cfg.IdempotencyWindow, "how long Idempotency-Key results are remembered, 0 disables")
+	fs.StringVar(&cfg.BackupDir, "backup-dir", cfg.BackupDir, "directory for year database backups, must not be the -db directory")
+	fs.DurationVar(&cfg.BackupInterval, "backup-interval", cfg.BackupInterval, "back up every year database this often, 0 disables")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "maximum time to read a whole request")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "maximum time from reading a request to finishing its response")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "how long keep-alive connections wait for the next request")
+	fs.StringVar(&cfg.StaticDir, "static-dir", cfg.StaticDir, "directory whose files override the embedded frontend assets (CSS, favicon)")
+	fs.StringVar(&cfg.BasePath, "base-path", cfg.BasePath, "URL prefix when served behind a proxy under a subpath, e.g. /ankiety")
+	fs.BoolVar(&cfg.Debug, "debug", cfg.Debug, "log slow queries, serve /mock and allow -log-request-bodies")
+	fs.BoolVar(&cfg.StackStdout, "stack-stdout", cfg.StackStdout, "also print server error stack traces to stdout, the log has them anyway")
+	fs.DurationVar(&cfg.EditLockTimeout, "edit-lock-timeout", cfg.EditLockTimeout, "how long an idle editor keeps a subtable marked as being edited, 0 disables")
+	fs.BoolVar(&cfg.LogRequestBodies, "log-request-bodies", cfg.LogRequestBodies, "log survey save payloads at debug level, they contain farm data")
+	fs.DurationVar(&cfg.LongWriteTimeout, "long-write-timeout", cfg.LongWriteTimeout, "write timeout for exports and backups, 0 keeps -write-timeout")
+	fs.DurationVar(&cfg.SessionIdleTimeout, "session-idle-timeout", cfg.SessionIdleTimeout, "log users out after this long without a request")
+	fs.DurationVar(&cfg.SessionWarning, "session-warning", cfg.SessionWarning, "how long before the session expires the user is offered to extend it")
+	fs.StringVar(&cfg.BodyCharset, "body-charset", cfg.BodyCharset, "charset of survey saves that don't declare one: utf-8 or windows-1250")
+	fs.Var(&cfg.AllowedHosts, "allowed-host", "host name the server answers to, repeatable or comma separated, * for any (default localhost, 127.0.0.1, ::1)")
+	fs.Int64Var(&cfg.WideTableWidth, "wide-table-width", cfg.WideTableWidth, "rendered width in px past which a table is logged and offered in compact form, 0 disables")
+	fs.Int64Var(&cfg.CompactColumns, "compact-columns", cfg.CompactColumns, "highest column Lp the compact form of a wide table shows")
+	fs.IntVar(&cfg.BusyRetries, "busy-retries", cfg.BusyRetries, "how many times a save is tried while the database is locked by another writer")
+	fs.DurationVar(&cfg.BusyBackoff, "busy-backoff", cfg.BusyBackoff, "wait before the first retry of a locked save, doubled for each next one")
+	fs.DurationVar(&cfg.SlowQuery, "slow-query", cfg.SlowQuery, "with -debug, log queries that take at least this long at debug level, 0 disables")
+	fs.IntVar(&cfg.MaxInFlight, "max-in-flight", cfg.MaxInFlight, "requests handled at once before the rest get 503, static files and the session status excluded, 0 disables")
+	fs.BoolVar(&cfg.CheckSQL, "check-sql", cfg.CheckSQL, "prepare every embedded query against the databases in -db, report the ones that fail and exit")
+	fs.StringVar(&cfg.LDAPURL, "ldap-url", cfg.LDAPURL, "LDAP server logins are checked against instead of the stored passwords, e.g. ldaps://ldap.example.pl")
+	fs.StringVar(&cfg.LDAPBindDN, "ldap-bind-dn", cfg.LDAPBindDN, "DN a user binds as, %s stands for the login, e.g. uid=%s,ou=people,dc=example,dc=pl")
+	fs.StringVar(&cfg.LDAPGroups, "ldap-groups", cfg.LDAPGroups, "comma separated cn=rola pairs giving directory groups a role (Adm, Met, ZBR, PBR), users in none can't log in")
+	fs.StringVar(&cfg.LDAPIdBRAttr, "ldap-idbr-attr", cfg.LDAPIdBRAttr, "LDAP attribute with the accounting office of users created at their first login")
+	fs.DurationVar(&cfg.LDAPTimeout, "ldap-timeout", cfg.LDAPTimeout, "how long a login waits for the LDAP server")
+	fs.StringVar(&cfg.Features, "features", cfg.Features, "comma separated feature=bool pairs switching off "+strings.Join(FEATURES, ", ")+"; all are on by default")
+}
+
+// CONFIG_ENV_PREFIX starts the environment variable standing in for each flag:
+// -log-level is ANKIETY_LOG_LEVEL, -db is ANKIETY_DB.
+const CONFIG_ENV_PREFIX = "ANKIETY_"
+
+func ConfigEnvName(flagName string) string {
+	return CONFIG_ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ConfigParse reads args over the environment over ConfigDefault. The
+// environment is applied after parsing, to the flags args left out, so a flag
+// given on the command line always wins and -allowed-host doesn't collect hosts
+// from both. Its default can only be filled in once neither gave one.
+func ConfigParse(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	cfg := ConfigDefault()
+	ConfigFlags(fs, &cfg)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookupEnv(ConfigEnvName(f.Name))
+		if !ok || given[f.Name] || envErr != nil {
+			return
 		}
-	
-		if strings.Contains(cell.Name, "_Wyszczegolnienie") {	
-			row := app.DBManager.YQueryRowx(yearDB, "b_kody_tytul_where_kod", code)
-			if err != nil {
-				app.ServerError(w, r, err)
-				return
-			}
-			
-			var wyczegolnienie string
-			row.Scan(&wyczegolnienie)			
-			cell.Value = wyczegolnienie
+		if err := f.Value.Set(value); err != nil {
+			envErr = fmt.Errorf("%s: %w", ConfigEnvName(f.Name), err)
 		}
-		
-		tableRow.Cells = append(tableRow.Cells, cell)
+	})
+	if envErr != nil {
+		return Config{}, envErr
 	}
 
-	w.Header().Set("Content-Type", "text/html")
-	TMPL_DYNAMIC_ROW.Execute(w, tableRow)
+	if len(cfg.AllowedHosts) == 0 {
+		cfg.AllowedHosts = ALLOWED_HOSTS_DEV
+	}
+	return cfg, nil
 }
 
-func setupApplication(dbPath string) *Application {
-	logger := slog.New(tint.NewHandler(os.Stdout, &tint.Options{
+// ConfigAttrs lists every flag of fs with its effective value, for the startup
+// log. Logged through RedactHandler, a flag named like a password or token
+// shows up as LOG_REDACTED.
+func ConfigAttrs(fs *flag.FlagSet) []any {
+	var attrs []any
+	fs.VisitAll(func(f *flag.Flag) {
+		attrs = append(attrs, slog.String(f.Name, f.Value.String()))
+	})
+	return attrs
+}
+
+// setupApplication checks cfg before opening anything, so a bad flag doesn't
+// leave databases open behind it.
+func setupApplication(cfg Config) (*Application, error) {
+	bodyCharset, err := CharsetName(cfg.BodyCharset)
+	if err != nil {
+		return nil, fmt.Errorf("-body-charset: %w", err)
+	}
+	maxRows, err := MaxRowsParse(cfg.MaxRows)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StaticDir != "" {
+		if info, err := os.Stat(cfg.StaticDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("-static-dir %s is not a directory", cfg.StaticDir)
+		}
+	}
+	if cfg.BackupDir != "" && filepath.Clean(cfg.BackupDir) == filepath.Clean(cfg.DBDir) {
+		return nil, errors.New("-backup-dir must differ from -db")
+	}
+	if cfg.CORSCredentials && slices.Contains(FlagList(cfg.CORSOrigins), "*") {
+		return nil, errors.New("-cors-credentials can't be combined with -cors-origins=*, list the origins")
+	}
+	// One of the pair alone would quietly fall back to plain HTTP.
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, errors.New("-tls-cert and -tls-key must be set together")
+	}
+	features, err := FeaturesParse(cfg.Features)
+	if err != nil {
+		return nil, fmt.Errorf("-features: %w", err)
+	}
+	var directory DirectoryAuth
+	if cfg.LDAPURL != "" && features[FEATURE_LDAP] {
+		groups, err := LDAPGroupsParse(cfg.LDAPGroups)
+		if err != nil {
+			return nil, fmt.Errorf("-ldap-groups: %w", err)
+		}
+		if len(groups) == 0 {
+			return nil, errors.New("-ldap-groups: no group maps to a role, nobody could log in")
+		}
+		if strings.Count(cfg.LDAPBindDN, "%s") != 1 {
+			return nil, errors.New("-ldap-bind-dn must hold %s once, for the login")
+		}
+		directory = &LDAPDirectory{
+			URL:      cfg.LDAPURL,
+			BindDN:   cfg.LDAPBindDN,
+			Groups:   groups,
+			IdBRAttr: cfg.LDAPIdBRAttr,
+			Timeout:  cfg.LDAPTimeout,
+		}
+	}
+
+	logger := slog.New(RedactHandlerNew(tint.NewHandler(os.Stdout, &tint.Options{
 		AddSource: true,
-		Level:     slog.LevelDebug,
-	}))
+		Level:     cfg.LogLevel,
+	})))
+
+	if err := TmplsLoad(); err != nil {
+		logger.Error("templates failed to parse", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("templates: %w", err)
+	}
 
 	dbManager := &DBManager{
 		Logger:       logger,
 		yearCacheMap: make(map[YearDB]*SqlCache),
+		Timing:       &SqlTiming{Logger: logger},
+		Retry:        SqlRetry{Attempts: cfg.BusyRetries, Backoff: cfg.BusyBackoff},
+		// A request is cut off at its write timeout, so waiting longer for it is pointless.
+		DrainTimeout: max(cfg.WriteTimeout, cfg.LongWriteTimeout),
+		Migrate:      cfg.Migrate,
+	}
+	if cfg.Debug {
+		dbManager.Timing.Threshold = cfg.SlowQuery
 	}
 
-	dbManager.Connect(dbPath)
+	if err := dbManager.Connect(cfg.DBDir); err != nil {
+		dbManager.Disconnect()
+		return nil, err
+	}
 
 	session := scs.New()
-	session.IdleTimeout = 30 * time.Minute
-	
+	session.IdleTimeout = cfg.SessionIdleTimeout
+	BASE_PATH = BasePathClean(cfg.BasePath)
+	if BASE_PATH != "" {
+		session.Cookie.Path = BASE_PATH + "/"
+	}
+
 	app := &Application{
 		DBManager:   dbManager,
 		Logger:      logger,
 		FormDecoder: form.NewDecoder(),
 		Session:     session,
-		Debug:       true,
+		Debug:       cfg.Debug,
+		StackStdout: cfg.StackStdout,
+		Events:      EventHubNew(),
+		CORS: CORSConfig{
+			AllowedOrigins:   FlagList(cfg.CORSOrigins),
+			AllowedMethods:   FlagList(cfg.CORSMethods),
+			AllowedHeaders:   FlagList(cfg.CORSHeaders),
+			AllowCredentials: cfg.CORSCredentials,
+		},
+		HSTSMaxAge:       cfg.HSTSMaxAge,
+		BackupDir:        cfg.BackupDir,
+		LongWriteTimeout: cfg.LongWriteTimeout,
+		LogRequestBodies: cfg.LogRequestBodies,
+		EditLockTimeout:  cfg.EditLockTimeout,
+		SessionWarning:   cfg.SessionWarning,
+		BodyCharset:      bodyCharset,
+		AllowedHosts:     cfg.AllowedHosts,
+		WideTableWidth:   cfg.WideTableWidth,
+		CompactColumns:   cfg.CompactColumns,
+		StaticDir:        cfg.StaticDir,
+		MaxRows:          maxRows,
+		Directory:        directory,
+		Features:         features,
+	}
+	if cfg.IdempotencyWindow > 0 {
+		app.Idempotency = IdempotencyStoreNew(cfg.IdempotencyWindow)
+	}
+	if cfg.MaxInFlight > 0 {
+		app.InFlight = make(chan struct{}, cfg.MaxInFlight)
 	}
 
-	return app
+	return app, nil
 }
 
 func main() {
-	addr := flag.String("addr", ":8082", "HTTP network address")
-	dbDir := flag.String("db", "db/", "database directory")
-	flag.Parse()
+	cfg, err := ConfigParse(flag.CommandLine, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "startup: %v\n", err)
+		os.Exit(2)
+	}
+
+	// Before setupApplication, which stops at the first query that doesn't
+	// prepare; this lists all of them.
+	if cfg.CheckSQL {
+		failed, err := SqlCheckDir(cfg.DBDir, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "check-sql: %v\n", err)
+			os.Exit(1)
+		}
+		if failed > 0 {
+			fmt.Fprintf(os.Stderr, "check-sql: %d queries failed\n", failed)
+			os.Exit(1)
+		}
+		fmt.Println("check-sql: all queries prepared")
+		return
+	}
 
-	app := setupApplication(*dbDir)
+	app, err := setupApplication(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "startup: %v\n", err)
+		os.Exit(1)
+	}
 	defer app.DBManager.Disconnect()
+	app.Logger.Info("config", slog.Group("flags", ConfigAttrs(flag.CommandLine)...))
+
+	if cfg.MigrateBlobs {
+		for _, yearDB := range app.DBManager.Years() {
+			migrated, err := app.BlobsMigrate(yearDB)
+			if err != nil {
+				app.Logger.Error("blob migration failed", slog.Int64("year", int64(yearDB)), slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			app.Logger.Info("blobs migrated", slog.Int64("year", int64(yearDB)), slog.Int("count", migrated))
+		}
+		return
+	}
+
+	if cfg.BackupInterval > 0 && app.BackupDir != "" {
+		go app.BackupsSchedule(cfg.BackupInterval)
+	}
 
 	tlsConfig := &tls.Config{
 		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
@@ -1677,17 +8940,22 @@ func main() {
 	}
 
 	server := &http.Server{
-		Addr:         *addr,
+		Addr:         cfg.Addr,
 		Handler:      app.Routes(),
 		ErrorLog:     slog.NewLogLogger(app.Logger.Handler(), slog.LevelError),
 		TLSConfig:    tlsConfig,
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  cfg.IdleTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
 	}
 
-	app.Logger.Info("starting server", slog.String("addr", *addr))
-	err := server.ListenAndServe()
+	if cfg.TLSCert != "" && cfg.TLSKey != "" {
+		app.Logger.Info("starting server", slog.String("addr", cfg.Addr), slog.Bool("tls", true))
+		err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	} else {
+		app.Logger.Info("starting server", slog.String("addr", cfg.Addr))
+		err = server.ListenAndServe()
+	}
 	app.Logger.Error(err.Error())
 	os.Exit(1)
 }
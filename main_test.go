@@ -1,38 +1,250 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	html "html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/go-playground/form"
+	"github.com/jmoiron/sqlx"
 )
 
-func TestYear_Bdgr_Metodyka_Get_Formularze(t *testing.T) {
-	app := setupApplication("db/")
-	defer app.DBManager.Disconnect()
+// TEST_MASTER_SCHEMA is the part of master.db the app queries. The production
+// master is maintained outside this repo, so tests carry their own copy of its
+// shape; columns the app added since come from sql_migrations/master.
+const TEST_MASTER_SCHEMA = `
+	CREATE TABLE lata (rok INTEGER PRIMARY KEY, zablokowany INTEGER NOT NULL, odlaczony INTEGER NOT NULL);
+	CREATE TABLE uzytkownicy (
+		idpbr TEXT PRIMARY KEY, login TEXT NOT NULL UNIQUE, password TEXT NOT NULL, salt TEXT NOT NULL DEFAULT '',
+		imie TEXT NOT NULL, nazwisko TEXT NOT NULL, email TEXT NOT NULL UNIQUE, rola TEXT NOT NULL,
+		aktywny INTEGER NOT NULL DEFAULT 1, zablokowany INTEGER NOT NULL DEFAULT 0,
+		data_wylosowania TEXT NOT NULL DEFAULT '', idbr TEXT NOT NULL
+	);
+	CREATE TABLE gospodarstwa (idgr TEXT PRIMARY KEY, idbr TEXT, idpbr TEXT);
+	CREATE TABLE gospodarstwa__lata (rok INTEGER, idgr TEXT, PRIMARY KEY (rok, idgr));
+`
+
+// TestMain loads the templates the way setupApplication does, for the tests that
+// render with a hand-built Application.
+func TestMain(m *testing.M) {
+	if err := TmplsLoad(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// TEST_PASSWORD is the password of every user testApplication seeds.
+const TEST_PASSWORD = "Haslo-testowe-1"
+
+// testApplication is setupApplication over a temporary db/ directory holding a
+// master and a 2030 year database with a minimal survey. The Config keeps the
+// optional features off; tests that need one set it on the Application.
+//
+//	users    admin (Adm), zbr (ZBR, BR1), jan (PBR P1, BR1), all with TEST_PASSWORD
+//	farms    G1 of jan, in 2030
+//	survey   table T with subtable A (HORIZONTAL_DYNAMIC_UNIQUE), columns A_Kod, A_Opis (required)
+func testApplication(t *testing.T) *Application {
+	t.Helper()
+	dir := t.TempDir() + "/"
+
+	// A low iteration count keeps logins fast; PasswordVerify reads it from the hash.
+	const salt = "sol-testowa"
+	hash, err := PasswordHash(TEST_PASSWORD, salt, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	master, err := sqlx.Open(SQLITE_DRIVER, dir+"master.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	master.MustExec(TEST_MASTER_SCHEMA)
+	master.MustExec(`
+		INSERT INTO lata VALUES (2030, 0, 0);
+		INSERT INTO gospodarstwa (idgr, idbr, idpbr) VALUES ('G1', 'BR1', 'P1');
+		INSERT INTO gospodarstwa__lata VALUES (2030, 'G1');
+	`)
+	for _, user := range [][]string{
+		{"A1", "admin", "Anna", "Admin", "admin@example.com", "Adm", ""},
+		{"Z1", "zbr", "Zofia", "Kierownik", "zbr@example.com", "ZBR", "BR1"},
+		{"P1", "jan", "Jan", "Kowalski", "jan@example.com", "PBR", "BR1"},
+	} {
+		master.MustExec(`INSERT INTO uzytkownicy (idpbr, login, password, salt, imie, nazwisko, email, rola, idbr) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			user[0], user[1], hash, salt, user[2], user[3], user[4], user[5], user[6])
+	}
+	master.Close()
+
+	year, err := sqlx.Open(SQLITE_DRIVER, dir+"2030.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := YearSchemaCreate(year); err != nil {
+		t.Fatal(err)
+	}
+	year.MustExec(`
+		INSERT INTO b_tabele (tabela, tytul, lp, symbol) VALUES ('T', 'T', 1, 'T');
+		INSERT INTO b_podtabele (podtabela, tabela, schemat_tabeli, tytul, lp) VALUES ('A', 'T', 'HORIZONTAL_DYNAMIC_UNIQUE', 'A', 1);
+		INSERT INTO b_jm (jm, typ_jm) VALUES ('txt', 'string');
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm, wymagana) VALUES ('A_Kod', 'A', 'Kod', 1, 'txt', 0);
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm, wymagana) VALUES ('A_Opis', 'A', 'Opis', 2, 'txt', 1);
+		INSERT INTO b_statusy (idgr) VALUES ('G1');
+	`)
+	year.Close()
+
+	app, err := setupApplication(Config{
+		DBDir:              dir,
+		Debug:              true,
+		Migrate:            true,
+		SessionIdleTimeout: 30 * time.Minute,
+		SessionWarning:     2 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.DBManager.Disconnect)
+	app.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	app.DBManager.Logger = app.Logger
+	return app
+}
+
+var TEST_MEMORY_DB_SEQ atomic.Int64
+
+// NewDBManagerForTest opens the master and one database per year in memory. A
+// year's schema runs before the embedded queries are prepared, which fails on
+// missing tables; an empty schema means sql_schema/year.sql. The master gets
+// TEST_MASTER_SCHEMA with the master migrations applied. DirPath is empty, so
+// YearCreate and backups need disk.
+func NewDBManagerForTest(schemas map[YearDB]string) *DBManager {
+	m := &DBManager{
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		yearCacheMap: make(map[YearDB]*SqlCache),
+	}
+
+	var err error
+	master := memoryDBOpen(TEST_MASTER_SCHEMA)
+	if _, err = MigrationsApply(master, MIGRATIONS_MASTER); err != nil {
+		panic(err)
+	}
+	m.MasterCache, err = SqlCacheNew(FS_SQL_MASTER, "sql_master", master)
+	if err != nil {
+		panic(err)
+	}
+	for year, schema := range schemas {
+		if schema == "" {
+			schema = sql_year_schema
+		}
+		if err := m.AddYear(year, memoryDBOpen(schema)); err != nil {
+			panic(err)
+		}
+	}
+	return m
+}
+
+// Every pool connection to a plain :memory: DSN sees its own empty database, so
+// each database gets a unique shared-cache name instead. It lives as long as
+// the pool keeps a connection, which the idle minimum guarantees.
+func memoryDBOpen(schema string) *sqlx.DB {
+	name := fmt.Sprintf("file:memdb%d?mode=memory&cache=shared", TEST_MEMORY_DB_SEQ.Add(1))
+	db := sqlx.MustOpen(SQLITE_DRIVER, name)
+	db.SetMaxIdleConns(4)
+	db.MustExec(schema)
+	return db
+}
+
+func TestScanRowsToTableRows(t *testing.T) {
+	db := memoryDBOpen(`CREATE TABLE t (kod TEXT, ilosc INTEGER, cena REAL, uwagi TEXT);
+		INSERT INTO t VALUES ('A', 3, 2.5, NULL), ('B', 10, 4.0, 'pilne');`)
+	defer db.Close()
+
+	rows, err := db.Queryx("SELECT * FROM t ORDER BY kod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
 
+	cols := []TableColumn{{Name: "kod", DataType: "TEXT"}, {Name: "cena", DataType: "REAL"}, {Name: "ilosc", DataType: "INTEGER"}, {Name: "uwagi"}, {Name: "brak"}}
+	got, err := ScanRowsToTableRows(rows, cols)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{"A", "2.5", "3", "", ""}, {"B", "4", "10", "pilne", ""}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(got), len(want))
+	}
+	for i, row := range got {
+		if row.Index != int64(i) {
+			t.Errorf("row %d: Index %d", i, row.Index)
+		}
+		for j, cell := range row.Cells {
+			if cell.Value != want[i][j] || cell.Name != cols[j].Name || cell.Column != &cols[j] {
+				t.Errorf("row %d cell %s: got %q, want %q", i, cols[j].Name, cell.Value, want[i][j])
+			}
+		}
+	}
+}
+
+func TestTableSysBTabeleGet(t *testing.T) {
+	app := testApplication(t)
+
+	schema := app.TableSysBTabeleGet("2030", "", 2030)
+	if len(schema.Rows) != 1 {
+		t.Fatalf("got %d rows, want the one table", len(schema.Rows))
+	}
+	cells := schema.Rows[0].Cells
+	if cells[0].Value != "T" || cells[2].Value != "1" || cells[4].Value != "" {
+		t.Errorf("cells: %+v", cells)
+	}
+}
+
+func TestYear_Bdgr_Metodyka_Get_Formularze(t *testing.T) {
+	app := testApplication(t)
 	router := app.Routes()
-	req := httptest.NewRequest("GET", "/app/2025/bdgr/metodyka/formularze/", nil)
+
+	req := httptest.NewRequest("GET", "/app/2030/bdgr/metodyka/formularze/", nil)
+	req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
 
-	t.Logf("response status: %d", w.Code)
-	t.Logf("response body: %s", w.Body.String())
-
 	if w.Code != http.StatusOK {
 		t.Errorf("expected 200, got %d", w.Code)
 	}
 }
 
 func TestYear_Bdgr_Metodyka_Get_NoRedirect(t *testing.T) {
-	app := setupApplication("db/")
-	defer app.DBManager.Disconnect()
-
+	app := testApplication(t)
 	router := app.Routes()
 
-	req := httptest.NewRequest("GET", "/app/2025/bdgr/metodyka/formularze", nil)
+	req := httptest.NewRequest("GET", "/app/2030/bdgr/metodyka/formularze", nil)
+	req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
@@ -49,23 +261,5326 @@ func TestYear_Bdgr_Metodyka_Get_NoRedirect(t *testing.T) {
 	}
 }
 
+// progressTestApplication serves year 2025, made from the schema template, with
+// table T: A (dynamic, one required column) filled in for farm 1, B (vertical)
+// stored with its required answer blank, and C without data.
+func progressTestApplication(t *testing.T) *Application {
+	t.Helper()
+	m := &DBManager{DirPath: t.TempDir() + "/", yearCacheMap: make(map[YearDB]*SqlCache)}
+	if err := m.YearCreate(2025); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Disconnect)
+
+	m.yearCache(2025).DB.MustExec(`
+		INSERT INTO b_tabele (tabela, tytul, lp, symbol) VALUES ('T', 'T', 1, 'T');
+		INSERT INTO b_podtabele (podtabela, tabela, schemat_tabeli, tytul, lp) VALUES
+			('A', 'T', 'HORIZONTAL_DYNAMIC_UNIQUE', 'A', 1),
+			('B', 'T', 'VERTICAL_STATIC_UNIQUE', 'B', 2),
+			('C', 'T', 'HORIZONTAL_STATIC_UNIQUE', 'C', 3);
+		INSERT INTO b_jm (jm, typ_jm) VALUES ('txt', 'string');
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm, wymagana) VALUES
+			('A_Kod', 'A', 'Kod', 1, 'txt', 0),
+			('A_Opis', 'A', 'Opis', 2, 'txt', 1),
+			('B_Opis', 'B', 'Opis', 1, 'txt', 1),
+			('C_Kod', 'C', 'Kod', 1, 'txt', 0);
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES
+			('1', 'A', '[{"A_Kod":"1","A_Opis":"x"}]'),
+			('1', 'B', '{"B_Opis":""}');
+	`)
+
+	return &Application{
+		DBManager: m,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestAnkietProgressGet(t *testing.T) {
+	app := progressTestApplication(t)
+
+	get := func(idGR string) []SubtableProgress {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetPathValue("year", "2025")
+		req.SetPathValue("idgr", idGR)
+		w := httptest.NewRecorder()
+		app.AnkietProgressGet(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("farm %s: expected 200, got %d %s", idGR, w.Code, w.Body.String())
+		}
+		var progress []SubtableProgress
+		if err := json.Unmarshal(w.Body.Bytes(), &progress); err != nil {
+			t.Fatal(err)
+		}
+		return progress
+	}
+
+	want := []SubtableProgress{
+		{Table: "T", Subtable: "A", HasData: true, Complete: true},
+		{Table: "T", Subtable: "B", HasData: true},
+		{Table: "T", Subtable: "C"},
+	}
+	if got := get("1"); !slices.Equal(got, want) {
+		t.Errorf("farm 1: got %+v, want %+v", got, want)
+	}
+
+	// A farm without answers still lists every subtable, in tab order.
+	want = []SubtableProgress{{Table: "T", Subtable: "A"}, {Table: "T", Subtable: "B"}, {Table: "T", Subtable: "C"}}
+	if got := get("2"); !slices.Equal(got, want) {
+		t.Errorf("farm 2: got %+v, want %+v", got, want)
+	}
+}
+
+func TestMetodykaGet_SystemTables(t *testing.T) {
+	app := testApplication(t)
+	app.DBManager.yearCache(2030).DB.MustExec(`
+		INSERT INTO b_typy_slownikow (typ_slownika, opis) VALUES ('lista', 'Lista wyboru');
+		INSERT INTO b_slowniki (slownik, wartosc, typ_slownika, uwagi) VALUES ('TAK_NIE', 'T;N', 'lista', 'Uwaga metodyczna');
+		INSERT INTO b_stawki_vat_zo (stawka_vat_zo, wartosc_stawki_vat_zo, tytul) VALUES ('23', 0.23, 'Podstawowa');
+		INSERT INTO b_stawki_vat_rr (stawka_vat_rr, wartosc_stawki_vat_rr, tytul) VALUES ('RR7', 0.07, 'Zryczałtowana');
+	`)
+	router := app.Routes()
+	cookie := sessionCookie(t, app, User{Login: "admin", Role: UserAdmin})
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"slowniki/slownik_fomularzy", []string{`value="lista"`, `value="Lista wyboru"`}},
+		{"slowniki/wartosci_slownikow", []string{`value="TAK_NIE"`, `value="T;N"`, `value="Uwaga metodyczna"`}},
+		{"slowniki/stawki_vat_zo", []string{`value="23"`, `value="0.23"`, `value="Podstawowa"`}},
+		{"slowniki/stawki_vat_rr", []string{`value="RR7"`, `value="0.07"`}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/app/2030/bdgr/metodyka/"+tt.path, nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", tt.path, w.Code)
+			continue
+		}
+		body := w.Body.String()
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: body lacks %s", tt.path, want)
+			}
+		}
+		if strings.Contains(body, "Column data type cannot be handled") {
+			t.Errorf("%s: column rendered with an unknown data type", tt.path)
+		}
+		if strings.Count(body, "readonly") < len(tt.want) {
+			t.Errorf("%s: expected read-only cells", tt.path)
+		}
+	}
+}
+
 func TestLogin_Post(t *testing.T) {
-	app := setupApplication("db/")
+	app := testApplication(t)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Add("login", "jan")
+		form.Add("password", password)
+
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		app.Session.LoadAndSave(http.HandlerFunc(app.LoginPost)).ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := login(TEST_PASSWORD); rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/app/" {
+		t.Errorf("valid login: got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr := login("zle-haslo"); rr.Header().Get("Location") != "/?login_error=1" {
+		t.Errorf("wrong password: got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	master := app.DBManager.MasterCache.DB
+	var lastLogin string
+	if err := master.Get(&lastLogin, "SELECT ostatnie_logowanie FROM uzytkownicy WHERE login = 'jan'"); err != nil || lastLogin == "" {
+		t.Errorf("login time not recorded: %q, %v", lastLogin, err)
+	}
+	tests := []struct {
+		name     string
+		update   string
+		password string
+		want     string
+	}{
+		{"locked", "UPDATE uzytkownicy SET zablokowany = 1 WHERE login = 'jan'", TEST_PASSWORD, "/?login_error=" + LOGIN_ERROR_LOCKED},
+		{"locked wrong password", "", "zle-haslo", "/?login_error=" + LOGIN_ERROR_CREDENTIALS},
+		{"inactive", "UPDATE uzytkownicy SET zablokowany = 0, aktywny = 0 WHERE login = 'jan'", TEST_PASSWORD, "/?login_error=" + LOGIN_ERROR_INACTIVE},
+		{"inactive wrong password", "", "zle-haslo", "/?login_error=" + LOGIN_ERROR_CREDENTIALS},
+	}
+	for _, tt := range tests {
+		if tt.update != "" {
+			if _, err := master.Exec(tt.update); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if loc := login(tt.password).Header().Get("Location"); loc != tt.want {
+			t.Errorf("%s: redirected to %q, want %q", tt.name, loc, tt.want)
+		}
+	}
+}
+
+func TestLoginFold(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"Łukasz", "łukasz", true},
+		{"ŁUKASZ.ŻÓŁĆ", "łukasz.żółć", true},
+		{"Żółć", "z\u0307o\u0301łc\u0301", true}, // decomposed input
+		{"Świętość", "ŚWIĘTOŚĆ", true},
+		{"Łukasz", "Lukasz", false},
+		{"żółć", "zolc", false},
+	}
+	for _, tt := range tests {
+		if got := LoginEqual(tt.a, tt.b); got != tt.want {
+			t.Errorf("LoginEqual(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestLogin_PostPolish(t *testing.T) {
+	app := testApplication(t)
+	master := app.DBManager.MasterCache.DB
+	master.MustExec(`INSERT INTO uzytkownicy (idpbr, login, password, salt, imie, nazwisko, email, rola, idbr)
+		SELECT 'P2', 'Łukasz.Żółć', password, salt, 'Łukasz', 'Żółć', 'lz@example.com', 'PBR', 'BR1' FROM uzytkownicy WHERE login = 'jan'`)
+
+	for _, typed := range []string{"Łukasz.Żółć", "łukasz.żółć", "ŁUKASZ.ŻÓŁĆ", "łukasz.z\u0307o\u0301łc\u0301"} {
+		form := url.Values{"login": {typed}, "password": {TEST_PASSWORD}}
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		app.Session.LoadAndSave(http.HandlerFunc(app.LoginPost)).ServeHTTP(rr, req)
+		if loc := rr.Header().Get("Location"); rr.Code != http.StatusSeeOther || loc != "/app/" {
+			t.Errorf("login %q: got %d to %q", typed, rr.Code, loc)
+		}
+	}
+
+	var taken bool
+	if err := app.DBManager.MQueryRowx("uzytkownicy_check_login", "ŁUKASZ.ŻÓŁĆ").Scan(&taken); err != nil || !taken {
+		t.Errorf("check_login: taken = %v, %v; want the upper-case spelling taken", taken, err)
+	}
+}
+
+// fakeDirectory stands in for LDAP: users maps a login to its password and entry.
+type fakeDirectory struct {
+	users map[string]struct {
+		password string
+		user     DirectoryUser
+	}
+}
+
+func (d *fakeDirectory) Authenticate(login, password string) (DirectoryUser, error) {
+	entry, ok := d.users[login]
+	if !ok || entry.password != password {
+		return DirectoryUser{}, ErrDirectoryCredentials
+	}
+	return entry.user, nil
+}
+
+func TestLogin_PostDirectory(t *testing.T) {
+	app := testApplication(t)
+	directory := &fakeDirectory{users: map[string]struct {
+		password string
+		user     DirectoryUser
+	}{
+		"ola": {"tajne", DirectoryUser{Login: "ola", Imie: "Ola", Nazwisko: "Nowak", Email: "ola@example.com", IdBR: "BR1", Rola: "ZBR"}},
+		"jan": {"z-katalogu", DirectoryUser{Login: "jan", Rola: "PBR"}},
+	}}
+	app.Directory = directory
+
+	login := func(name, password string) string {
+		t.Helper()
+		form := url.Values{"login": {name}, "password": {password}}
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		app.Session.LoadAndSave(http.HandlerFunc(app.LoginPost)).ServeHTTP(rr, req)
+		return rr.Header().Get("Location")
+	}
+	rola := func(name string) (rola, imie, password string) {
+		t.Helper()
+		err := app.DBManager.MasterCache.DB.QueryRow("SELECT rola, imie, password FROM uzytkownicy WHERE login = ?", name).Scan(&rola, &imie, &password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if loc := login("ola", "tajne"); loc != "/app/" {
+		t.Fatalf("first directory login: redirected to %q", loc)
+	}
+	if r, imie, password := rola("ola"); r != "ZBR" || imie != "Ola" || password != PASSWORD_DIRECTORY {
+		t.Errorf("created user: rola %q imie %q password %q", r, imie, password)
+	}
+
+	entry := directory.users["ola"]
+	entry.user.Rola = "Met"
+	directory.users["ola"] = entry
+	if loc := login("ola", "tajne"); loc != "/app/" {
+		t.Fatalf("second directory login: redirected to %q", loc)
+	}
+	if r, _, _ := rola("ola"); r != "Met" {
+		t.Errorf("role after the directory changed: %q, want Met", r)
+	}
+
+	if loc := login("jan", TEST_PASSWORD); !strings.Contains(loc, LOGIN_ERROR_CREDENTIALS) {
+		t.Errorf("local password with the directory on: redirected to %q", loc)
+	}
+	if loc := login("jan", "z-katalogu"); loc != "/app/" {
+		t.Errorf("existing user through the directory: redirected to %q", loc)
+	}
+	if r, imie, password := rola("jan"); r != "PBR" || imie == "" || password == PASSWORD_DIRECTORY {
+		t.Errorf("existing user: rola %q imie %q password %q, want local name and password kept", r, imie, password)
+	}
+
+	app.DBManager.MasterCache.DB.MustExec("UPDATE uzytkownicy SET zablokowany = 1 WHERE login = 'ola'")
+	if loc := login("ola", "tajne"); !strings.Contains(loc, LOGIN_ERROR_LOCKED) {
+		t.Errorf("blocked user: redirected to %q", loc)
+	}
+}
+
+func TestLDAPRoleMap(t *testing.T) {
+	groups, err := LDAPGroupsParse("ankiety-pbr=PBR, ankiety-zbr=ZBR,ankiety-adm=Adm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		memberOf []string
+		want     string
+	}{
+		{nil, ""},
+		{[]string{"cn=inna,ou=groups,dc=x"}, ""},
+		{[]string{"cn=ankiety-pbr,ou=groups,dc=x"}, "PBR"},
+		{[]string{"cn=ankiety-pbr,ou=groups,dc=x", "CN=ankiety-zbr,ou=groups,dc=x"}, "ZBR"},
+		{[]string{"ou=ankiety-adm,dc=x"}, ""},
+		{[]string{"cn=ankiety-adm,ou=groups,dc=x", "cn=ankiety-pbr,ou=groups,dc=x"}, "Adm"},
+	}
+	for _, tt := range tests {
+		if got := LDAPRoleMap(tt.memberOf, groups); got != tt.want {
+			t.Errorf("LDAPRoleMap(%v) = %q, want %q", tt.memberOf, got, tt.want)
+		}
+	}
+
+	if PasswordVerify(PASSWORD_DIRECTORY, "", "") {
+		t.Error("PASSWORD_DIRECTORY verified an empty password")
+	}
+}
+
+func TestMockGet(t *testing.T) {
+	app := testApplication(t)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		app.Routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/mock", nil))
+		return w
+	}
+
+	w := get()
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<title>Mock</title>") || !strings.Contains(w.Body.String(), "mock") {
+		t.Errorf("debug: got %d %s", w.Code, w.Body.String())
+	}
+
+	app.Debug = false
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Errorf("without debug: expected 404, got %d", w.Code)
+	}
+}
+
+func TestLoginGet_Message(t *testing.T) {
+	app := testApplication(t)
+
+	tests := []struct {
+		query string
+		want  string
+		error bool
+	}{
+		{"login_error=1", "Nieprawidłowy login lub hasło", true},
+		{"login_error=" + LOGIN_ERROR_LOCKED, "Konto jest zablokowane", true},
+		{"login_error=" + LOGIN_ERROR_INACTIVE, "Konto jest nieaktywne", true},
+		{"login_error=cokolwiek", "Nieprawidłowy login lub hasło", true},
+		{"login_info=" + LOGIN_INFO_LOGGED_OUT, "Wylogowano.", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		app.Session.LoadAndSave(http.HandlerFunc(app.LoginGet)).ServeHTTP(w, req)
+		body := w.Body.String()
+		if tt.want != "" && !strings.Contains(body, tt.want) {
+			t.Errorf("%q: page lacks %q", tt.query, tt.want)
+		}
+		if got := strings.Contains(body, "border-red-500"); got != tt.error {
+			t.Errorf("%q: error box shown = %v, want %v", tt.query, got, tt.error)
+		}
+	}
+}
+
+func corsTestApplication() *Application {
+	return &Application{
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Session: scs.New(),
+		CORS: CORSConfig{
+			AllowedOrigins:   []string{"https://panel.example.com"},
+			AllowedMethods:   []string{"GET", "POST"},
+			AllowedHeaders:   []string{"Content-Type"},
+			AllowCredentials: true,
+		},
+	}
+}
+
+func TestCORS_Preflight(t *testing.T) {
+	router := corsTestApplication().Routes()
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/2025/bdgr/lista-ankiet/123/progress.json", nil)
+	req.Header.Set("Origin", "https://panel.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://panel.example.com" {
+		t.Errorf("unexpected Access-Control-Allow-Origin %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("unexpected Access-Control-Allow-Methods %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); got != "Content-Type" {
+		t.Errorf("unexpected Access-Control-Allow-Headers %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("unexpected Access-Control-Allow-Credentials %q", got)
+	}
+}
+
+func TestCORS_PreflightUnknownOrigin(t *testing.T) {
+	router := corsTestApplication().Routes()
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/2025/bdgr/lista-ankiet/123/progress.json", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("expected no Access-Control-Allow-Origin, got %q", got)
+	}
+}
+
+func TestCORS_ActualRequest(t *testing.T) {
+	router := corsTestApplication().Routes()
+
+	// Not logged in, so the handler redirects, but the CORS headers must still be there
+	// for the browser to expose the response.
+	req := httptest.NewRequest(http.MethodGet, "/api/2025/bdgr/lista-ankiet/123/progress.json", nil)
+	req.Header.Set("Origin", "https://panel.example.com")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://panel.example.com" {
+		t.Errorf("unexpected Access-Control-Allow-Origin %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "" {
+		t.Errorf("preflight headers on actual request: %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/2025/bdgr/lista-ankiet/123/progress.json", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("expected no Access-Control-Allow-Origin, got %q", got)
+	}
+}
+
+// A wildcard lets any origin read the response, but only as "*" and without
+// credentials, so a logged-in user's farms stay out of reach.
+func TestCORS_Wildcard(t *testing.T) {
+	app := corsTestApplication()
+	app.CORS.AllowedOrigins = []string{"https://panel.example.com", "*"}
+	router := app.Routes()
+
+	for origin, want := range map[string]string{
+		"https://panel.example.com": "https://panel.example.com",
+		"https://evil.example.com":  "*",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/2025/bdgr/lista-ankiet/123/progress.json", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, want %q", origin, got, want)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); (got == "true") != (want != "*") {
+			t.Errorf("%s: Access-Control-Allow-Credentials %q", origin, got)
+		}
+	}
+}
+
+func TestCORS_NotOnAppRoutes(t *testing.T) {
+	router := corsTestApplication().Routes()
+
+	for _, method := range []string{http.MethodGet, http.MethodOptions} {
+		req := httptest.NewRequest(method, "/app/2025/bdgr/lista-ankiet/123/progress.json", nil)
+		req.Header.Set("Origin", "https://panel.example.com")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		for key := range w.Header() {
+			if strings.HasPrefix(key, "Access-Control-") {
+				t.Errorf("%s /app/: unexpected CORS header %s", method, key)
+			}
+		}
+	}
+}
+
+func TestIdempotency_Replay(t *testing.T) {
+	app := corsTestApplication()
+	app.Idempotency = IdempotencyStoreNew(time.Minute)
+
+	calls := 0
+	handler := app.Session.LoadAndSave(app.MiddleIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	first := send("a", "{}")
+	second := send("a", "{}")
+	if calls != 1 {
+		t.Fatalf("expected handler to run once, ran %d times", calls)
+	}
+	if second.Code != first.Code || second.Body.String() != "{}" || second.Body.String() != first.Body.String() {
+		t.Errorf("replay differs: %d %q vs %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replayed response not marked")
+	}
+	if ct := second.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("replayed Content-Type %q, want the handler's", ct)
+	}
+
+	if w := send("a", `{"zmiana":1}`); w.Code != http.StatusUnprocessableEntity || calls != 1 {
+		t.Errorf("reused key with another body: expected 422 without running, got %d after %d calls", w.Code, calls)
+	}
+
+	send("b", "{}")
+	if calls != 2 {
+		t.Errorf("new key should run the handler, ran %d times", calls)
+	}
+}
+
+func TestBlob_WrapUnwrap(t *testing.T) {
+	for _, bare := range []string{`[{"A_Kod":"1","A_X":2}]`, `{"B_X":"tak"}`} {
+		wrapped, err := BlobWrap([]byte(bare), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !BlobIsWrapped(wrapped) {
+			t.Errorf("%s: not recognised as wrapped", wrapped)
+		}
+		got, err := BlobUnwrap(wrapped)
+		if err != nil || got != bare {
+			t.Errorf("unwrap(%s) = %q, %v; want %q", wrapped, got, err, bare)
+		}
+
+		// Legacy blobs come back untouched.
+		got, err = BlobUnwrap(bare)
+		if err != nil || got != bare {
+			t.Errorf("legacy unwrap(%s) = %q, %v", bare, got, err)
+		}
+	}
+
+	wrapped, err := BlobWrap([]byte(`{"B_X":"tak"}`), "Gospodarstwo w likwidacji")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, notes, err := BlobUnwrapNotes(wrapped)
+	if err != nil || data != `{"B_X":"tak"}` || notes != "Gospodarstwo w likwidacji" {
+		t.Errorf("notes roundtrip: %q, %q, %v", data, notes, err)
+	}
+
+	if _, err := BlobUnwrap(`{"_v":99,"data":[]}`); err == nil {
+		t.Error("expected error for a newer blob version")
+	}
+	if _, err := BlobWrap([]byte("{"), ""); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestPathValueYearParse_Bounds(t *testing.T) {
+	app := &Application{}
+	cases := map[string]bool{
+		"2000":  true,
+		"2025":  true,
+		"2100":  true,
+		"1999":  false,
+		"2101":  false,
+		"0":     false,
+		"-2025": false,
+		"99999": false,
+		"abc":   false,
+		"":      false,
+	}
+
+	for year, valid := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetPathValue("year", year)
+		_, err := app.PathValueYearParse(req)
+		if valid && err != nil {
+			t.Errorf("year %q: unexpected error %v", year, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("year %q: expected error", year)
+		}
+	}
+}
+
+func TestMiddleAccessIdGR_NoSessionUser(t *testing.T) {
+	app := testApplication(t)
+	handler := app.MiddleAccessIdGR(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler reached without a session user")
+	})
+
+	request := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("idgr", "G1")
+		return req
+	}
+
+	// Outside LoadAndSave scs itself would panic.
+	w := httptest.NewRecorder()
+	handler(w, request())
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Errorf("no session: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	app.Session.LoadAndSave(handler).ServeHTTP(w, request())
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Errorf("session without a user: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	app.Session.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.Session.Put(r.Context(), SESSION_USER_KEY, "admin")
+		handler(w, r)
+	})).ServeHTTP(w, request())
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Errorf("session user of another type: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// TestMiddleAccessIdGR_Matrix pins down who may open which farm. Managers are
+// checked against gospodarstwa.idbr for the year (rok_idbr_check), PBR users
+// against the farms loaded for their idpbr at login (UserIdGRSelect).
+func TestMiddleAccessIdGR_Matrix(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: "", 2031: ""})
 	defer app.DBManager.Disconnect()
 
-	form := url.Values{}
-	form.Add("email", "Szymon.Piechutowski@ierigz.waw.pl")
-	form.Add("password", "Password2")
-	
-	str := strings.NewReader(form.Encode())
+	app.DBManager.MasterCache.DB.MustExec(`
+		INSERT INTO gospodarstwa (idgr, idbr, idpbr) VALUES ('G1', 'BR1', 'P1'), ('G2', 'BR1', 'P2'), ('G3', 'BR2', 'P1'), ('G4', NULL, NULL);
+		INSERT INTO gospodarstwa__lata VALUES (2030, 'G1'), (2030, 'G2'), (2030, 'G3'), (2030, 'G4'), (2031, 'G2');
+	`)
+	pbr := func(idPBR string) User {
+		scope, err := app.UserIdGRSelect(idPBR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return User{Login: idPBR, IdPBR: idPBR, Role: UserNormal, IdGR: scope}
+	}
+
+	admin := User{Login: "admin", Role: UserAdmin}
+	methodologist := User{Login: "met", Role: UserMethodolgist}
+	zbr1 := User{Login: "zbr1", IdBR: "BR1", Role: UserManager}
+	zbr2 := User{Login: "zbr2", IdBR: "BR2", Role: UserManager}
+	zbrNone := User{Login: "zbr0", Role: UserManager}
+	p1, p2, p3 := pbr("P1"), pbr("P2"), pbr("P3")
+
+	tests := []struct {
+		name    string
+		user    User
+		year    string
+		idGR    string
+		allowed bool
+	}{
+		{"admin, any farm", admin, "2030", "G1", true},
+		{"admin, farm without office", admin, "2030", "G4", true},
+		{"admin, farm not in the year", admin, "2031", "G1", true},
+		{"methodologist", methodologist, "2030", "G1", false},
+		{"manager, own office", zbr1, "2030", "G1", true},
+		{"manager, own office, other worker", zbr1, "2030", "G2", true},
+		{"manager, other office", zbr1, "2030", "G3", false},
+		{"manager, own office, next year", zbr1, "2031", "G2", true},
+		{"manager, farm not in the year", zbr1, "2031", "G1", false},
+		{"manager, second office", zbr2, "2030", "G3", true},
+		{"manager, second office, first office farm", zbr2, "2030", "G1", false},
+		{"manager without office", zbrNone, "2030", "G4", false},
+		{"manager, unknown farm", zbr1, "2030", "G9", false},
+		{"worker, own farm", p1, "2030", "G1", true},
+		{"worker, own farm of other office", p1, "2030", "G3", true},
+		{"worker, colleague's farm", p1, "2030", "G2", false},
+		{"worker, own farm not in the year", p1, "2031", "G1", false},
+		{"worker, own farm next year", p2, "2031", "G2", true},
+		{"worker without farms", p3, "2030", "G1", false},
+	}
+
+	reached := false
+	next := func(w http.ResponseWriter, r *http.Request) { reached = true }
+	handlers := map[string]http.HandlerFunc{
+		"html": app.MiddleAccessIdGR(next),
+		"json": app.MiddleAccessIdGRJSON(next),
+	}
+	for _, tt := range tests {
+		for kind, handler := range handlers {
+			reached = false
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.SetPathValue("year", tt.year)
+			req.SetPathValue("idgr", tt.idGR)
+			w := httptest.NewRecorder()
+			sessionAs(app, tt.user, handler).ServeHTTP(w, req)
+
+			if reached != tt.allowed {
+				t.Errorf("%s (%s): reached handler %v, want %v", tt.name, kind, reached, tt.allowed)
+			}
+			if tt.allowed {
+				continue
+			}
+			if kind == "html" && (w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/app/") {
+				t.Errorf("%s (html): got %d to %q, want a redirect to /app/", tt.name, w.Code, w.Header().Get("Location"))
+			}
+			if kind == "json" && w.Code != http.StatusForbidden {
+				t.Errorf("%s (json): got %d, want 403", tt.name, w.Code)
+			}
+		}
+	}
+}
+
+func TestFarmArchive(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+	app.DBManager.yearCache(2030).DB.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '[{"A_Kod":"1","A_Opis":"x"}]')`)
+
+	admin := User{Login: "admin", Role: UserAdmin}
+	zbr := User{Login: "zbr", IdBR: "BR1", Role: UserManager}
+	jan := User{Login: "jan", IdPBR: "P1", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}}
+
+	do := func(method, path string, user User) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(sessionCookie(t, app, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	opens := func(user User) bool {
+		w := do(http.MethodGet, "/app/2030/bdgr/lista-ankiet/G1", user)
+		return w.Code == http.StatusOK
+	}
+	listed := func(user User) bool {
+		return strings.Contains(do(http.MethodGet, "/app/2030/bdgr/lista-ankiet/", user).Body.String(), `data-row-url="/app/2030/bdgr/lista-ankiet/G1"`)
+	}
+
+	if w := do(http.MethodPost, "/app/farms/G1/archiwizuj", jan); w.Code != http.StatusForbidden {
+		t.Errorf("archive as worker: expected 403, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/app/farms/G9/archiwizuj", admin); w.Code != http.StatusNotFound {
+		t.Errorf("archive unknown farm: expected 404, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/app/farms/G1/archiwizuj", admin); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"zarchiwizowane":true`) {
+		t.Fatalf("archive: got %d %s", w.Code, w.Body.String())
+	}
+
+	if opens(jan) || opens(zbr) {
+		t.Error("archived farm opened by a worker or manager")
+	}
+	if !opens(admin) {
+		t.Error("archived farm should stay open to admins")
+	}
+	if listed(jan) {
+		t.Error("archived farm listed for its worker")
+	}
+	if body := do(http.MethodGet, "/app/2030/bdgr/lista-ankiet/", admin).Body.String(); !strings.Contains(body, "data-archived") {
+		t.Error("archived farm not marked for admins")
+	}
+	if dane, err := app.DaneSelectByIdGRAndSubtable(2030, "G1", "A"); err != nil || !strings.Contains(dane, `"A_Opis":"x"`) {
+		t.Errorf("archiving touched the data: %q, %v", dane, err)
+	}
+
+	if w := do(http.MethodPost, "/app/farms/G1/przywroc", admin); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"zarchiwizowane":false`) {
+		t.Fatalf("unarchive: got %d %s", w.Code, w.Body.String())
+	}
+	if !opens(jan) || !opens(zbr) || !listed(jan) {
+		t.Error("restored farm should be back for its worker and manager")
+	}
+}
+
+func TestMiddleYear_NotLoaded(t *testing.T) {
+	app := &Application{DBManager: &DBManager{yearCacheMap: map[YearDB]*SqlCache{2025: {}}}}
+	handler := app.MiddleYear(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
 
-	req := httptest.NewRequest(http.MethodPost, "/login", str)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	cases := map[string]int{
+		"2025":  http.StatusOK,
+		"2024":  http.StatusNotFound,
+		"0":     http.StatusNotFound,
+		"99999": http.StatusNotFound,
+	}
+	for year, status := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetPathValue("year", year)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != status {
+			t.Errorf("year %q: expected %d, got %d", year, status, w.Code)
+		}
+	}
+}
 
-	rr := httptest.NewRecorder()
+// sessionAs serves next with user in the session, the way a logged in request
+// reaches it.
+func sessionAs(app *Application, user User, next http.HandlerFunc) http.Handler {
+	return app.Session.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.Session.Put(r.Context(), "user", user)
+		next.ServeHTTP(w, r)
+	}))
+}
 
-	app.LoginPost(rr, req)
+// A PBR user opens exactly the farms UserIdGRSelect loads for them at login,
+// per year, from gospodarstwa.idpbr.
+func TestMiddleAccessIdGR_PBRScope(t *testing.T) {
+	master := sqlx.MustOpen("sqlite3", ":memory:")
+	master.SetMaxOpenConns(1)
+	defer master.Close()
+	master.MustExec(`
+		CREATE TABLE gospodarstwa (idgr TEXT PRIMARY KEY, idbr TEXT, idpbr TEXT, zarchiwizowane INTEGER NOT NULL DEFAULT 0);
+		CREATE TABLE gospodarstwa__lata (rok INTEGER, idgr TEXT, PRIMARY KEY (rok, idgr));
+		INSERT INTO gospodarstwa (idgr, idbr, idpbr) VALUES ('G1', 'BR1', 'P1'), ('G2', 'BR1', 'P2'), ('G3', 'BR1', 'P1');
+		INSERT INTO gospodarstwa__lata VALUES (2025, 'G1'), (2025, 'G2'), (2024, 'G3');
+	`)
+	queries := make(map[string]*sqlx.Stmt)
+	for _, name := range []string{"gospodarstwa__lata_select_rok_idgr_where_idpbr", "gospodarstwa_zarchiwizowane_check"} {
+		query, err := FS_SQL_MASTER.ReadFile("sql_master/" + name + ".sql")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queries[name], err = master.Preparex(string(query)); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	t.Logf("Status: %d", rr.Code)
-	t.Logf("Body: %s", rr.Body.String())
-}
\ No newline at end of file
+	app := corsTestApplication()
+	app.DBManager = &DBManager{
+		MasterCache:  &SqlCache{DB: master, Queries: queries},
+		yearCacheMap: map[YearDB]*SqlCache{2024: nil, 2025: nil},
+	}
+
+	scope, err := app.UserIdGRSelect("P1")
+	want := map[YearDB][]string{2024: {"G3"}, 2025: {"G1"}}
+	if err != nil || !maps.EqualFunc(scope, want, slices.Equal[[]string]) {
+		t.Fatalf("scope of P1: got %v, %v, want %v", scope, err, want)
+	}
+
+	jan := User{Login: "jan", IdPBR: "P1", Role: UserNormal, IdGR: scope}
+	handler := app.MiddleAccessIdGR(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	cases := []struct {
+		year, idGR string
+		allowed    bool
+	}{
+		{"2025", "G1", true},
+		{"2025", "G2", false}, // another worker's farm
+		{"2025", "G3", false}, // own farm, but not surveyed this year
+		{"2024", "G3", true},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetPathValue("year", c.year)
+		req.SetPathValue("idgr", c.idGR)
+		w := httptest.NewRecorder()
+		sessionAs(app, jan, handler).ServeHTTP(w, req)
+		if allowed := w.Code == http.StatusOK; allowed != c.allowed {
+			t.Errorf("%s/%s: allowed %v, want %v (status %d)", c.year, c.idGR, allowed, c.allowed, w.Code)
+		}
+	}
+}
+
+// Counts cover the farms the user's list shows: all for Adm, the accounting
+// office for ZBR, the loaded scope for PBR and none for Met.
+func TestStatsGet(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = &DBManager{DirPath: t.TempDir() + "/", yearCacheMap: make(map[YearDB]*SqlCache)}
+	if err := app.DBManager.YearCreate(2030); err != nil {
+		t.Fatal(err)
+	}
+	defer app.DBManager.Disconnect()
+	app.DBManager.yearCache(2030).DB.MustExec(`
+		INSERT INTO b_statusy (idgr, idbr, idpbr, etap) VALUES
+			('G1', 'BR1', 'P1', 'PBR'), ('G2', 'BR1', 'P2', 'PBR'), ('G3', 'BR2', 'P1', 'ZBR'), ('G4', 'BR1', 'P2', 'ZBR');
+	`)
+
+	cases := map[string]struct {
+		user User
+		want map[string]int64
+	}{
+		"admin":              {User{Login: "admin", Role: UserAdmin}, map[string]int64{"PBR": 2, "ZBR": 2}},
+		"manager":            {User{Login: "zbr", IdBR: "BR1", Role: UserManager}, map[string]int64{"PBR": 2, "ZBR": 1}},
+		"worker":             {User{Login: "jan", IdPBR: "P1", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1", "G3"}}}, map[string]int64{"PBR": 1, "ZBR": 1}},
+		"worker, other year": {User{Login: "jan", IdPBR: "P1", Role: UserNormal, IdGR: map[YearDB][]string{2031: {"G2"}}}, map[string]int64{}},
+		"methodologist":      {User{Login: "met", Role: UserMethodolgist}, map[string]int64{}},
+	}
+	for name, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetPathValue("year", "2030")
+		w := httptest.NewRecorder()
+		sessionAs(app, c.user, app.StatsGet).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", name, w.Code)
+			continue
+		}
+		var counts map[string]int64
+		if err := json.Unmarshal(w.Body.Bytes(), &counts); err != nil || !maps.Equal(counts, c.want) {
+			t.Errorf("%s: got %v, %v, want %v", name, counts, err, c.want)
+		}
+	}
+}
+
+func TestDBManager_NotLoaded(t *testing.T) {
+	m := &DBManager{yearCacheMap: map[YearDB]*SqlCache{}}
+
+	master := map[string]error{}
+	_, master["MQueryx"] = m.MQueryx("uzytkownicy_count_all")
+	master["MQueryRowx"] = m.MQueryRowx("uzytkownicy_count_all").Scan(new(int))
+	_, master["MExec"] = m.MExec("uzytkownicy_count_all")
+	for name, err := range master {
+		if !errors.Is(err, ErrMasterNotLoaded) {
+			t.Errorf("%s: got %v, want ErrMasterNotLoaded", name, err)
+		}
+	}
+
+	year := map[string]error{}
+	_, year["YQueryx"] = m.YQueryx(2030, "b_statusy_list")
+	year["YQueryRowx"] = m.YQueryRowx(2030, "b_statusy_select_etap_where_idgr", "G1").StructScan(&Statusy{})
+	_, year["YExec"] = m.YExec(2030, "b_statusy_list")
+	_, year["YExecFromString"] = m.YExecFromString(2030, "SELECT 1")
+	year["YTx"] = m.YTx(2030, func(tx *SqlTx) error { return nil })
+	_, year["YearBackup"] = m.YearBackup(2030, t.TempDir())
+	for name, err := range year {
+		if !errors.Is(err, ErrYearNotLoaded) || !strings.Contains(err.Error(), "2030") {
+			t.Errorf("%s: got %v, want ErrYearNotLoaded for 2030", name, err)
+		}
+	}
+}
+
+// Run under -race: requests held by MiddleYear race RemoveYear.
+func TestDBManager_RemoveYear(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+
+	started, unblock := make(chan struct{}), make(chan struct{})
+	handler := app.MiddleYear(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		rows, err := app.DBManager.YQueryx(2030, "b_tabele_select_all")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rows.Close()
+	})
+	serve := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetPathValue("year", "2030")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	const running = 8
+	codes := make(chan int, running)
+	for range running {
+		go func() { codes <- serve() }()
+	}
+	for range running {
+		<-started
+	}
+
+	removed := make(chan error, 1)
+	go func() { removed <- app.DBManager.RemoveYear(2030) }()
+	for app.DBManager.HasYear(2030) {
+		time.Sleep(time.Millisecond)
+	}
+	if code := serve(); code != http.StatusNotFound {
+		t.Errorf("request after RemoveYear started: expected 404, got %d", code)
+	}
+	if years := app.DBManager.Years(); len(years) != 0 {
+		t.Errorf("years while removing: %v", years)
+	}
+	select {
+	case err := <-removed:
+		t.Fatalf("RemoveYear returned with requests running: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	for range running {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("running request: expected 200, got %d", code)
+		}
+	}
+	if err := <-removed; err != nil {
+		t.Fatalf("RemoveYear: %v", err)
+	}
+	if _, err := app.DBManager.YQueryx(2030, "b_tabele_select_all"); !errors.Is(err, ErrYearNotLoaded) {
+		t.Errorf("query after removal: got %v, want ErrYearNotLoaded", err)
+	}
+	if err := app.DBManager.RemoveYear(2030); !errors.Is(err, ErrYearNotLoaded) {
+		t.Errorf("second RemoveYear: got %v, want ErrYearNotLoaded", err)
+	}
+}
+
+func TestDBManager_RemoveYearTimeout(t *testing.T) {
+	m := NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer m.Disconnect()
+	m.DrainTimeout = 20 * time.Millisecond
+
+	release, ok := m.YearAcquire(2030)
+	if !ok {
+		t.Fatal("YearAcquire: year not loaded")
+	}
+	defer release()
+
+	done := make(chan error, 1)
+	go func() { done <- m.RemoveYear(2030) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("RemoveYear: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RemoveYear ignored DrainTimeout")
+	}
+	if m.HasYear(2030) {
+		t.Error("year still loaded")
+	}
+}
+
+// The schema template must satisfy every query in sql_year, otherwise AddYear fails
+// to prepare them.
+func TestDBManager_YearCreate(t *testing.T) {
+	dir := t.TempDir() + "/"
+	m := &DBManager{DirPath: dir, yearCacheMap: make(map[YearDB]*SqlCache)}
+
+	if err := m.YearCreate(2030); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer m.yearCache(2030).DB.Close()
+
+	if !m.HasYear(2030) {
+		t.Fatal("year not registered")
+	}
+	if _, err := m.YExec(2030, "b_bdgrobmsp_dane_replace", "1", "A", "[]"); err != nil {
+		t.Errorf("write to new year: %v", err)
+	}
+	if err := m.YearCreate(2030); !errors.Is(err, ErrYearExists) {
+		t.Errorf("expected ErrYearExists, got %v", err)
+	}
+	var recorded int
+	if err := m.yearCache(2030).DB.Get(&recorded, "SELECT COUNT(*) FROM migracje"); err != nil || recorded != len(MIGRATIONS_YEAR) {
+		t.Errorf("new year should record all %d migrations, got %d, %v", len(MIGRATIONS_YEAR), recorded, err)
+	}
+}
+
+func TestMigrationsApply(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0001_nic.sql":    {Data: []byte("-- nothing to change")},
+		"m/0002_tabela.sql": {Data: []byte("CREATE TABLE t (a TEXT); INSERT INTO t VALUES ('x');")},
+		"m/0003_blad.sql":   {Data: []byte("CREATE TABLE u (a TEXT); INSERT INTO brak VALUES (1);")},
+	}
+	migrations, err := MigrationsLoad(fsys, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := memoryDBOpen("")
+	defer db.Close()
+
+	applied, err := MigrationsApply(db, migrations[:1])
+	if err != nil || len(applied) != 1 || applied[0].Name != "nic" {
+		t.Fatalf("no-op migration: %v, %v", applied, err)
+	}
+	if applied, err := MigrationsApply(db, migrations[:1]); err != nil || len(applied) != 0 {
+		t.Fatalf("second run should apply nothing: %v, %v", applied, err)
+	}
+
+	applied, err = MigrationsApply(db, migrations)
+	if err == nil || !strings.Contains(err.Error(), "0003_blad") {
+		t.Fatalf("expected the failing migration named, got %v", err)
+	}
+	if len(applied) != 1 || applied[0].Version != 2 {
+		t.Errorf("applied before the failure: %v", applied)
+	}
+	var versions []int
+	if err := db.Select(&versions, "SELECT wersja FROM migracje ORDER BY wersja"); err != nil || !slices.Equal(versions, []int{1, 2}) {
+		t.Errorf("recorded versions %v, %v", versions, err)
+	}
+	var tables int
+	if err := db.Get(&tables, "SELECT COUNT(*) FROM sqlite_master WHERE name = 'u'"); err != nil || tables != 0 {
+		t.Errorf("failed migration left its table behind: %d, %v", tables, err)
+	}
+
+	for name, file := range map[string]string{
+		"bez_numeru": "m/bez_numeru.sql",
+		"duplikat":   "m/0002_znowu.sql",
+	} {
+		broken := maps.Clone(fsys)
+		broken[file] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+		if _, err := MigrationsLoad(broken, "m"); err == nil {
+			t.Errorf("%s: expected a load error", name)
+		}
+	}
+}
+
+// TEST_YEAR_SCHEMA_BASELINE is a year database as created before the year
+// migrations: sql_schema/year.sql without what they add.
+var TEST_YEAR_SCHEMA_BASELINE = sql_year_schema + `
+	DROP TABLE b_zalaczniki;
+	DROP TABLE b_audyt;
+	DROP TABLE b_edycje;
+	DROP TABLE b_nie_dotyczy;
+	ALTER TABLE b_kolumny DROP COLUMN formula;
+	ALTER TABLE b_kolumny DROP COLUMN walidacja;
+	ALTER TABLE b_kolumny DROP COLUMN wymagana_gdy;
+	ALTER TABLE b_kolumny DROP COLUMN zachowaj_biale_znaki;
+	ALTER TABLE b_kolumny DROP COLUMN role_edycji;
+`
+
+// Databases in production shape are brought up to date by Connect before their
+// queries are prepared; without migrations preparing them fails.
+func TestDBManager_ConnectMigrate(t *testing.T) {
+	for _, migrate := range []bool{false, true} {
+		dir := t.TempDir() + "/"
+		for name, schema := range map[string]string{
+			"master.db": TEST_MASTER_SCHEMA,
+			"2030.db":   TEST_YEAR_SCHEMA_BASELINE + "INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm) VALUES ('A_Kod', 'A', 'Kod', 1, 'txt');",
+		} {
+			db := sqlx.MustOpen(SQLITE_DRIVER, dir+name)
+			db.MustExec(schema)
+			db.Close()
+		}
+
+		m := &DBManager{Logger: slog.New(slog.DiscardHandler), yearCacheMap: make(map[YearDB]*SqlCache), Migrate: migrate}
+		err := m.Connect(dir)
+		if !migrate {
+			m.Disconnect()
+			if err == nil {
+				t.Errorf("connect without migrations should fail to prepare the queries")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("connect with migrations: %v", err)
+		}
+
+		var column struct {
+			Keep  int            `db:"zachowaj_biale_znaki"`
+			Roles sql.NullString `db:"role_edycji"`
+		}
+		if err := m.yearCache(2030).DB.Get(&column, "SELECT zachowaj_biale_znaki, role_edycji FROM b_kolumny WHERE kolumna = 'A_Kod'"); err != nil {
+			t.Errorf("migrated b_kolumny: %v", err)
+		} else if column.Keep != 0 || column.Roles.Valid {
+			t.Errorf("existing row got %+v, want the column defaults", column)
+		}
+		for cache, migrations := range map[*SqlCache][]Migration{m.MasterCache: MIGRATIONS_MASTER, m.yearCache(2030): MIGRATIONS_YEAR} {
+			var count int
+			if err := cache.DB.Get(&count, "SELECT COUNT(*) FROM migracje"); err != nil || count != len(migrations) {
+				t.Errorf("recorded %d of %d migrations: %v", count, len(migrations), err)
+			}
+		}
+		m.Disconnect()
+	}
+}
+
+func TestTmplsLoad_Error(t *testing.T) {
+	sets := TMPL_SETS
+	defer func() {
+		TMPL_SETS = sets
+		if err := TmplsLoad(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	var broken *html.Template
+	TMPL_SETS = append(slices.Clone(sets), struct {
+		Tmpl  **html.Template
+		Names []string
+	}{&broken, []string{"base", "brak"}})
+	err := TmplsLoad()
+	if err == nil || !strings.Contains(err.Error(), "template set base, brak") || !strings.Contains(err.Error(), "brak.html") {
+		t.Fatalf("expected an error naming the set and file, got %v", err)
+	}
+	if broken != nil || TMPL_LOGIN == nil {
+		t.Errorf("the other sets should still load, the broken one stay nil")
+	}
+}
+
+func TestServerError_Stdout(t *testing.T) {
+	capture := func(app *Application) string {
+		t.Helper()
+		read, write, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout := os.Stdout
+		os.Stdout = write
+		defer func() { os.Stdout = stdout }()
+
+		w := httptest.NewRecorder()
+		app.ServerError(w, httptest.NewRequest(http.MethodGet, "/", nil), errors.New("boom"))
+		write.Close()
+		out, _ := io.ReadAll(read)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("expected 500, got %d", w.Code)
+		}
+		return string(out)
+	}
+
+	app := corsTestApplication()
+	app.Debug = true
+	if out := capture(app); out != "" {
+		t.Errorf("stdout without -stack-stdout: %q", out)
+	}
+
+	app.StackStdout = true
+	if out := capture(app); !strings.Contains(out, "STACK TRACE") || !strings.Contains(out, "boom") {
+		t.Errorf("stdout with -stack-stdout: %q", out)
+	}
+}
+
+func TestMiddleHSTS(t *testing.T) {
+	app := &Application{HSTSMaxAge: 24 * time.Hour}
+	handler := app.MiddleHSTS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("HSTS over plain HTTP: %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=86400; includeSubDomains" {
+		t.Errorf("unexpected HSTS over TLS: %q", got)
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	app := &Application{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	w := httptest.NewRecorder()
+	app.RenderJSON(w, http.StatusCreated, map[string]any{"success": true})
+	if w.Code != http.StatusCreated {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := strings.TrimSpace(w.Body.String()); got != `{"success":true}` {
+		t.Errorf("body = %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	app.RenderJSON(w, http.StatusOK, make(chan int))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("unencodable value: status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if strings.Contains(w.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("unencodable value answered as JSON")
+	}
+}
+
+func TestRender_TemplateError(t *testing.T) {
+	app := corsTestApplication()
+	broken := html.Must(html.New("broken").Funcs(tmplFuncsLocale(LOCALE_DEFAULT)).Parse(
+		`{{define "base"}}<p>partial page</p>{{.Missing}}{{end}}`,
+	))
+
+	handler := app.Session.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="raport.html"`)
+		w.Header().Set("ETag", `"abc"`)
+		app.Render(w, r, http.StatusOK, broken, struct{}{})
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/app/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "partial page") {
+		t.Errorf("partial page leaked into the error response: %q", w.Body.String())
+	}
+	if got := strings.TrimSpace(w.Body.String()); got != http.StatusText(http.StatusInternalServerError) {
+		t.Errorf("unexpected body: %q", got)
+	}
+	for _, header := range []string{"Content-Disposition", "ETag"} {
+		if got := w.Header().Get(header); got != "" {
+			t.Errorf("%s survived the error: %q", header, got)
+		}
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	app := corsTestApplication()
+	req := httptest.NewRequest(http.MethodGet, "/app/profile", nil)
+	ctx, err := app.Session.Load(req.Context(), "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	req = req.WithContext(ctx)
+	data := TmplBaseData{PageTitle: "Profil", Profile: &UserProfile{Login: "nowak"}}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		app.Render(httptest.NewRecorder(), req, http.StatusOK, TMPL_PROFILE, data)
+	}
+}
+
+func TestMiddleLongWrite(t *testing.T) {
+	app := corsTestApplication()
+	app.LongWriteTimeout = 2 * time.Second
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	}
+
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		ok      bool
+	}{
+		{"server deadline", slow, false},
+		{"extended deadline", app.MiddleLongWrite(slow), true},
+	} {
+		server := httptest.NewUnstartedServer(tc.handler)
+		server.Config.WriteTimeout = 50 * time.Millisecond
+		server.Start()
+
+		resp, err := http.Get(server.URL)
+		var body []byte
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		server.Close()
+
+		if ok := err == nil && string(body) == "done"; ok != tc.ok {
+			t.Errorf("%s: got body %q err %v", tc.name, body, err)
+		}
+	}
+
+	// Recorders cannot move deadlines; the handler must still run.
+	w := httptest.NewRecorder()
+	app.MiddleLongWrite(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("recorder: expected 418, got %d", w.Code)
+	}
+}
+
+func TestMiddleInFlight(t *testing.T) {
+	app := corsTestApplication()
+	app.InFlight = make(chan struct{}, 2)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := app.MiddleInFlight(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var wg sync.WaitGroup
+	for range cap(app.InFlight) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+		}()
+		<-entered
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("saturated: expected 503 with Retry-After, got %d", w.Code)
+	}
+
+	close(release)
+	wg.Wait()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("released: expected 200, got %d", w.Code)
+	}
+}
+
+func TestRoutes_InFlightBypass(t *testing.T) {
+	app := testApplication(t)
+	app.InFlight = make(chan struct{}, 1)
+	app.InFlight <- struct{}{}
+	router := app.Routes()
+
+	for path, want := range map[string]int{
+		"/":                    http.StatusServiceUnavailable,
+		"/app/session/status":  http.StatusOK,
+		"/frontend/output.css": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("%s: expected %d, got %d", path, want, w.Code)
+		}
+	}
+}
+
+// An open events stream gives its slot back, so tabs left open on farm pages
+// don't lock everyone out.
+func TestRoutes_InFlightEvents(t *testing.T) {
+	app := testApplication(t)
+	app.InFlight = make(chan struct{}, 1)
+	srv := httptest.NewServer(app.Routes())
+	defer srv.Close()
+	cookie := sessionCookie(t, app, User{Login: "admin", Role: UserAdmin})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/app/2030/bdgr/lista-ankiet/G1/events", nil)
+	req.AddCookie(cookie)
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	if stream.StatusCode != http.StatusOK {
+		t.Fatalf("events: expected 200, got %d", stream.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/app/2030/bdgr/lista-ankiet/G1/progress.json", nil)
+	req.AddCookie(cookie)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("request next to an open stream: expected 200, got %d", resp.StatusCode)
+	}
+}
+
+// An open events stream doesn't hold its year, so removing it doesn't wait for
+// the pages to close.
+func TestRoutes_EventsYearRemove(t *testing.T) {
+	app := testApplication(t)
+	app.DBManager.DrainTimeout = time.Minute
+	srv := httptest.NewServer(app.Routes())
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/app/2030/bdgr/lista-ankiet/G1/events", nil)
+	req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+
+	removed := make(chan error, 1)
+	go func() { removed <- app.DBManager.RemoveYear(2030) }()
+	select {
+	case err := <-removed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("RemoveYear waited for the open stream")
+	}
+}
+
+func TestRedactHandler(t *testing.T) {
+	var out strings.Builder
+	logger := slog.New(RedactHandlerNew(slog.NewTextHandler(&out, nil)))
+	const secret = "Tajne-Haslo-981"
+
+	logger.Info("login failed for form login=jan&password="+secret+"&x=1",
+		slog.String("password", secret),
+		slog.Group("form", slog.String("haslo", secret), slog.String("login", "jan")),
+		slog.Any("error", fmt.Errorf(`decode {"login":"jan","password":"%s"}`, secret)),
+		slog.String("uri", "/api/2030?token="+secret),
+	)
+	logger.With("salt", secret).WithGroup("req").Info("ok", "body", `{"Password": "`+secret+`"}`)
+
+	if strings.Contains(out.String(), secret) {
+		t.Errorf("secret leaked into log:\n%s", out.String())
+	}
+	for _, kept := range []string{"login=jan", "x=1", LOG_REDACTED} {
+		if !strings.Contains(out.String(), kept) {
+			t.Errorf("expected %q to survive redaction:\n%s", kept, out.String())
+		}
+	}
+}
+
+func TestAnkietSubtablePost_LogRequestBodies(t *testing.T) {
+	// A blob version from the future is rejected before any database access.
+	const body = `{"_v":99,"data":[{"powierzchnia":"12,5"}]}`
+
+	for _, tc := range []struct {
+		debug, logBodies, logged bool
+	}{
+		{debug: true, logBodies: false, logged: false},
+		{debug: false, logBodies: true, logged: false},
+		{debug: true, logBodies: true, logged: true},
+	} {
+		var out strings.Builder
+		app := &Application{
+			Logger:           slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})),
+			Debug:            tc.debug,
+			LogRequestBodies: tc.logBodies,
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("subtable", "A")
+		w := httptest.NewRecorder()
+		app.AnkietSubtablePost(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d", w.Code)
+		}
+		if logged := strings.Contains(out.String(), "powierzchnia"); logged != tc.logged {
+			t.Errorf("debug=%v log-request-bodies=%v: body logged=%v\n%s", tc.debug, tc.logBodies, logged, out.String())
+		}
+	}
+}
+
+// A year master refuses to register leaves neither a file nor a loaded year
+// behind, so the admin can simply try again.
+func TestYearsPost_RegisterFails(t *testing.T) {
+	app := testApplication(t)
+	master := app.DBManager.MasterCache.DB
+	master.MustExec(`CREATE TRIGGER lata_odmowa BEFORE INSERT ON lata BEGIN SELECT RAISE(ABORT, 'odmowa'); END;`)
+	router := app.Routes()
+	cookie := sessionCookie(t, app, User{Login: "admin", Role: UserAdmin})
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/app/years", strings.NewReader("rok=2031"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post(); code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", code)
+	}
+	if app.DBManager.HasYear(2031) {
+		t.Error("unregistered year still loaded")
+	}
+	if _, err := os.Stat(filepath.Join(app.DBManager.DirPath, "2031.db")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("unregistered year left its file: %v", err)
+	}
+
+	master.MustExec(`DROP TRIGGER lata_odmowa`)
+	if code := post(); code != http.StatusCreated {
+		t.Errorf("retry: expected 201, got %d", code)
+	}
+}
+
+func TestSetupApplication_MissingMaster(t *testing.T) {
+	dir := t.TempDir() + "/"
+	m := &DBManager{DirPath: dir, yearCacheMap: make(map[YearDB]*SqlCache)}
+	if err := m.YearCreate(2025); err != nil {
+		t.Fatal(err)
+	}
+	m.Disconnect()
+
+	_, err := setupApplication(Config{DBDir: dir})
+	if err == nil {
+		t.Fatal("expected error without master.db")
+	}
+	if !strings.Contains(err.Error(), dir+"master.db") {
+		t.Errorf("error does not name the expected path: %v", err)
+	}
+}
+
+func TestValidateSubtableData(t *testing.T) {
+	min, max := int64(0), int64(100)
+	columns := []TableColumn{
+		{Name: "T_Kod", DataType: "str"},
+		{Name: "T_Ilosc", DataType: "int", Required: 1, Min: &min, Max: &max},
+		{Name: "T_Rodzaj", DataType: "P", Enum: []TableEnum{{Value: "A"}, {Value: "B"}}},
+		{Name: "T_Nip", DataType: "str", Regex: `\d{10}`},
+	}
+	blocks := []BBlokady{{Column: "T_Nip", Code: "2"}}
+
+	data := `[
+		{"T_Kod":"1","T_Ilosc":"1 000,5","T_Rodzaj":"C","T_Nip":"123"},
+		{"T_Kod":"2","T_Ilosc":"","T_Rodzaj":"A","T_Nip":"1234567890"},
+		{"T_Kod":"1","T_Ilosc":"abc","T_Rodzaj":"B","T_Nip":"1234567890"},
+		{"T_Kod":"3","T_Ilosc":"-1","T_Rodzaj":"","T_Nip":""}
+	]`
+
+	errs, err := ValidateSubtableData(HORIZONTAL_DYNAMIC_UNIQUE, columns, blocks, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]bool)
+	for _, e := range errs {
+		got[fmt.Sprintf("%d/%s/%s", e.Index, e.Column, e.Message)] = true
+	}
+	want := []string{
+		"0/T_Ilosc/Wartość musi być co najwyżej 100",
+		"0/T_Rodzaj/Wartość spoza listy",
+		"0/T_Nip/Nieprawidłowy format",
+		"1/T_Ilosc/Pole wymagane",
+		"1/T_Nip/Pole zablokowane",
+		"2/T_Kod/Zduplikowany kod",
+		"2/T_Ilosc/Nieprawidłowy format liczby",
+		"3/T_Ilosc/Wartość musi być co najmniej 0",
+	}
+	for _, w := range want {
+		if !got[w] {
+			t.Errorf("missing error %q", w)
+		}
+	}
+	if len(errs) != len(want) {
+		t.Errorf("expected %d errors, got %d: %+v", len(want), len(errs), errs)
+	}
+
+	errs, err = ValidateSubtableData(HORIZONTAL_DYNAMIC_DUPLICABLE, columns, nil, `[{"T_Kod":"1","T_Ilosc":"1"},{"T_Kod":"1","T_Ilosc":"2"}]`)
+	if err != nil || len(errs) != 0 {
+		t.Errorf("duplicable table: unexpected errors %+v, %v", errs, err)
+	}
+
+	// Only the _Kod suffix marks the key; a required column that merely contains it is validated.
+	keyLike := []TableColumn{{Name: "T_Kod", DataType: "str"}, {Name: "T_Koduwagi", DataType: "str", Required: 1}}
+	errs, err = ValidateSubtableData(HORIZONTAL_DYNAMIC_UNIQUE, keyLike, nil, `[{"T_Kod":"1","T_Koduwagi":""}]`)
+	if err != nil || len(errs) != 1 || errs[0].Column != "T_Koduwagi" {
+		t.Errorf("key-like column: expected one error on T_Koduwagi, got %+v, %v", errs, err)
+	}
+}
+
+func TestColumnsBuildFromKolumny_Tooltip(t *testing.T) {
+	kolumny := []BKolumny{
+		{Name: "A", Opis: sql.NullString{String: "Opis A", Valid: true}, Uwagi: sql.NullString{String: "Uwagi A", Valid: true}},
+		{Name: "B", Uwagi: sql.NullString{String: "Uwagi B", Valid: true}},
+		{Name: "C", Opis: sql.NullString{String: "  ", Valid: true}, Uwagi: sql.NullString{String: "Uwagi C", Valid: true}},
+		{Name: "D"},
+	}
+
+	want := []string{"Opis A", "Uwagi B", "Uwagi C", ""}
+	for i, column := range ColumnsBuildFromKolumny(kolumny) {
+		if column.Tooltip != want[i] {
+			t.Errorf("%s: tooltip %q, want %q", column.Name, column.Tooltip, want[i])
+		}
+	}
+
+	for _, name := range []string{"Tabela", "Tytuł", "Lp", "Symbol", "Opis", "Uwagi"} {
+		if SYSTEM_COLUMN_TOOLTIPS[name] == "" {
+			t.Errorf("system column %s has no tooltip", name)
+		}
+	}
+}
+
+func TestMaxRows_Boundary(t *testing.T) {
+	maxRows, err := MaxRowsParse("B_2=2, C_1=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := corsTestApplication()
+	app.MaxRows = maxRows
+
+	if _, exceeded := app.MaxRowsExceeded("B_2", 2); exceeded {
+		t.Error("2 rows should fit a limit of 2")
+	}
+	if _, exceeded := app.MaxRowsExceeded("B_2", 3); !exceeded {
+		t.Error("3 rows should exceed a limit of 2")
+	}
+	if _, exceeded := app.MaxRowsExceeded("D_1", 1000); exceeded {
+		t.Error("subtables without a limit are unlimited")
+	}
+
+	// A new row is counted against the rows stored, whatever the client says it shows.
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2025: ""})
+	defer app.DBManager.Disconnect()
+	app.DBManager.yearCache(2025).DB.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'B_2', '[{"B_2_Kod":"1"},{"B_2_Kod":"2"}]')`)
+	req := httptest.NewRequest(http.MethodGet, "/?count=0", nil)
+	req.SetPathValue("year", "2025")
+	req.SetPathValue("idgr", "G1")
+	req.SetPathValue("subtable", "B_2")
+	req.SetPathValue("index", "7")
+	w := httptest.NewRecorder()
+	app.AnkietRowGet(w, req)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("row beyond limit: expected 422, got %d", w.Code)
+	}
+	app.DBManager.yearCache(2025).DB.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G2', 'B_2', '[{"B_2_Kod":"1"}]')`)
+	req = httptest.NewRequest(http.MethodGet, "/?count=5", nil)
+	req.SetPathValue("year", "2025")
+	req.SetPathValue("idgr", "G2")
+	req.SetPathValue("subtable", "B_2")
+	req.SetPathValue("index", "1")
+	w = httptest.NewRecorder()
+	sessionAs(app, User{Login: "jan", Role: UserNormal}, app.AnkietRowGet).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("row within limit: expected 200, got %d", w.Code)
+	}
+	// A stored object, not a list, counts as one row instead of failing the request.
+	app.DBManager.yearCache(2025).DB.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G3', 'B_2', '{"_v":1,"data":{"B_2_Kod":"1"}}')`)
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetPathValue("year", "2025")
+	req.SetPathValue("idgr", "G3")
+	req.SetPathValue("subtable", "B_2")
+	req.SetPathValue("index", "1")
+	w = httptest.NewRecorder()
+	sessionAs(app, User{Login: "jan", Role: UserNormal}, app.AnkietRowGet).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("object blob: expected 200, got %d", w.Code)
+	}
+
+	// The save refuses before any database access.
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[{"B_2_Kod":"1"},{"B_2_Kod":"2"},{"B_2_Kod":"3"}]`))
+	req.SetPathValue("year", "2025")
+	req.SetPathValue("subtable", "B_2")
+	w = httptest.NewRecorder()
+	app.AnkietSubtablePost(w, req)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("save beyond limit: expected 422, got %d", w.Code)
+	}
+
+	for _, bad := range []string{"B_2", "B_2=0", "B_2=x"} {
+		if _, err := MaxRowsParse(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestEvalFormula(t *testing.T) {
+	values := map[string]any{"A": 10.0, "B": "2,5", "C": "", "D": "1 000"}
+	cases := map[string]float64{
+		"SUM(A, B, C)":     12.5,
+		"A - B * 2":        5,
+		"(A - B) * 2":      15,
+		"-A + D":           990,
+		"sum(A, SUM(B,B))": 15,
+		"Missing + 1":      1,
+		"A / 4":            2.5,
+	}
+	for formula, want := range cases {
+		got, err := EvalFormula(formula, values)
+		if err != nil || got != want {
+			t.Errorf("%s = %v, %v; want %v", formula, got, err, want)
+		}
+	}
+
+	for _, bad := range []string{"A /", "SUM(A", "A / C", "A $ B", "A B"} {
+		if _, err := EvalFormula(bad, values); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+
+	columns := []TableColumn{{Name: "A"}, {Name: "B"}, {Name: "T", Formula: "SUM(A, B)"}, {Name: "T2", Formula: "T * 2"}}
+	computed, err := VerticalFormulasApply(columns, `{"A":1,"B":"2","T":999}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if computed != `{"A":1,"B":"2","T":3,"T2":6}` {
+		t.Errorf("unexpected computed payload %s", computed)
+	}
+}
+
+func TestParseLocalizedNumber(t *testing.T) {
+	valid := map[string]float64{
+		"1 234,56":            1234.56,
+		"1\u00a0234,56":       1234.56,
+		"1\u202f234\u202f567": 1234567,
+		" 12,5 ":              12.5,
+		"12.5":                12.5,
+		"-0,75":               -0.75,
+		"1000":                1000,
+	}
+	for input, want := range valid {
+		got, err := ParseLocalizedNumber(input)
+		if err != nil || got != want {
+			t.Errorf("%q = %v, %v; want %v", input, got, err, want)
+		}
+	}
+
+	for _, input := range []string{"", "abc", "1,234.56", "1,2,3", "NaN", "Inf", "0x10", "12 zł"} {
+		if _, err := ParseLocalizedNumber(input); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+func TestSubtableDataNormalize(t *testing.T) {
+	columns := []TableColumn{{Name: "A", DataType: "int"}, {Name: "B", DataType: "float"}, {Name: "C", DataType: "str"}}
+
+	got, err := SubtableDataNormalize(columns, `[{"A":"1 000","B":"2,5","C":"3,5"},{"A":"x","B":""}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"A":1000,"B":2.5,"C":"3,5"},{"A":"x","B":""}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	got, err = SubtableDataNormalize(columns, `{"B":"1 234,56"}`)
+	if err != nil || got != `{"B":1234.56}` {
+		t.Errorf("vertical: got %s, %v", got, err)
+	}
+}
+
+func TestTextNormalize(t *testing.T) {
+	cases := []struct{ dataType, in, want string }{
+		{"str", "  Jan   Kowalski \t", "Jan Kowalski"},
+		{"str", "linia 1  \r\nlinia\t\t2\rlinia 3", "linia 1\nlinia 2\nlinia 3"},
+		{"P", " 0 1 ", "01"},
+		{"W0", " 1 , 2,3 ", "1,2,3"},
+		{"", "  a  b  ", "a  b"},
+	}
+	for _, c := range cases {
+		if got := TextNormalize(c.dataType, c.in); got != c.want {
+			t.Errorf("TextNormalize(%q, %q) = %q, want %q", c.dataType, c.in, got, c.want)
+		}
+	}
+
+	columns := []TableColumn{{Name: "A", DataType: "str"}, {Name: "B", DataType: "str", KeepWhitespace: true}}
+	got, err := SubtableDataNormalize(columns, `[{"A":" x  y ","B":" x  y ","C":" z "}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"A":"x y","B":" x  y ","C":" z "}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestKomentarz_RoleEnforcement(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+
+	if _, err := app.DBManager.yearCache(2030).DB.Exec("INSERT INTO b_statusy (idgr) VALUES ('G1')"); err != nil {
+		t.Fatal(err)
+	}
+
+	Year := ChainFuncNew(app.MiddleLoged).Append(app.MiddleYear)
+	zbr := Year.Append(app.MiddleAccessIdGR, app.MiddleRequireRole(UserManager)).Then(app.KomentarzZBRPost)
+	inst := Year.Append(app.MiddleRequireRole(AccessAdminMethodologist)).Then(app.KomentarzInstPost)
+
+	post := func(handler http.HandlerFunc, user User, komentarz string) *httptest.ResponseRecorder {
+		form := url.Values{"komentarz": {komentarz}}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("idgr", "G1")
+		w := httptest.NewRecorder()
+		sessionAs(app, user, handler).ServeHTTP(w, req)
+		return w
+	}
+
+	normal := User{Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}}
+	admin := User{Role: UserAdmin}
+
+	if w := post(inst, normal, "x"); w.Code != http.StatusForbidden {
+		t.Errorf("normal user on inst comment: expected 403, got %d", w.Code)
+	}
+	if w := post(zbr, normal, "x"); w.Code != http.StatusForbidden {
+		t.Errorf("normal user on zbr comment: expected 403, got %d", w.Code)
+	}
+	if w := post(zbr, admin, "x"); w.Code != http.StatusForbidden {
+		t.Errorf("admin on zbr comment: expected 403, got %d", w.Code)
+	}
+
+	var komentarz sql.NullString
+	selectKomentarz := func() {
+		row := app.DBManager.yearCache(2030).DB.QueryRow("SELECT komentarz_inst FROM b_statusy WHERE idgr = 'G1'")
+		if err := row.Scan(&komentarz); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if w := post(inst, admin, "  do poprawy  "); w.Code != http.StatusSeeOther {
+		t.Fatalf("admin on inst comment: expected 303, got %d", w.Code)
+	}
+	selectKomentarz()
+	if !komentarz.Valid || komentarz.String != "do poprawy" {
+		t.Errorf("unexpected comment %+v", komentarz)
+	}
+
+	w := post(inst, admin, strings.Repeat("ż", KOMENTARZ_MAX_LENGTH+1))
+	if loc := w.Header().Get("Location"); !strings.Contains(loc, "komentarz_error=1") {
+		t.Errorf("too long comment not rejected, location %q", loc)
+	}
+
+	post(inst, admin, "   ")
+	selectKomentarz()
+	if komentarz.Valid {
+		t.Errorf("empty comment should clear to NULL, got %q", komentarz.String)
+	}
+}
+
+func TestAnkietSubtableRawGet(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+
+	if _, err := app.DBManager.YExec(2030, "b_bdgrobmsp_dane_replace", "G1", "A", `{"_v":1,"data":[]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := ChainFuncNew(app.MiddleLoged, app.MiddleYear, app.MiddleAccessIdGR, app.MiddleRequireRole(AccessAdminOnly)).Then(app.AnkietSubtableRawGet)
+	get := func(user User, subtable string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("idgr", "G1")
+		req.SetPathValue("subtable", subtable)
+		w := httptest.NewRecorder()
+		sessionAs(app, user, handler).ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get(User{Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}}, "A"); w.Code != http.StatusForbidden {
+		t.Errorf("normal user: expected 403, got %d", w.Code)
+	}
+	if w := get(User{Role: UserAdmin}, "B"); w.Code != http.StatusNotFound {
+		t.Errorf("missing row: expected 404, got %d", w.Code)
+	}
+
+	w := get(User{Role: UserAdmin}, "A")
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin: expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"dane":{"_v":1,"data":[]}`) || !strings.Contains(body, `"data_modyfikacji":"`) {
+		t.Errorf("unexpected body %s", body)
+	}
+}
+
+func TestExportFormatNegotiate(t *testing.T) {
+	tests := []struct {
+		target string
+		accept string
+		want   string
+		err    bool
+	}{
+		{"/export", "", EXPORT_CSV, false},
+		{"/export", "*/*", EXPORT_CSV, false},
+		{"/export", "text/html,application/xhtml+xml,*/*;q=0.8", EXPORT_CSV, false},
+		{"/export", "application/json", EXPORT_JSON, false},
+		{"/export", "text/csv;q=0.5, application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", EXPORT_XLSX, false},
+		{"/export", "application/json;q=0, text/csv", EXPORT_CSV, false},
+		{"/export?format=xlsx", "application/json", EXPORT_XLSX, false},
+		{"/export.json", "", EXPORT_JSON, false},
+		{"/export", "image/png", "", true},
+		{"/export?format=pdf", "", "", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		got, err := ExportFormatNegotiate(req)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("%s Accept %q: got %q, %v", tt.target, tt.accept, got, err)
+		}
+	}
+}
+
+func TestLocaleFormat(t *testing.T) {
+	for locale := range I18N_CATALOG {
+		if _, ok := LOCALE_FORMATS[locale]; !ok {
+			t.Errorf("no LOCALE_FORMATS entry for %s", locale)
+		}
+	}
+
+	tests := []struct {
+		locale                      string
+		fraction, integer, negative string
+		date, dateTime, unparseable string
+	}{
+		{"pl", "1234,5", "1234", "-0,25", "05.03.2030", "05.03.2030 14:07", "wkrótce"},
+		{"en", "1234.5", "1234", "-0.25", "2030-03-05", "2030-03-05 14:07", "wkrótce"},
+		{"de", "1234,5", "1234", "-0,25", "05.03.2030", "05.03.2030 14:07", "wkrótce"},
+	}
+	for _, tt := range tests {
+		format := LocaleFormatGet(tt.locale)
+		got := []string{
+			format.Value(1234.5), format.Value(float64(1234)), format.Value(-0.25),
+			format.FormatDate("2030-03-05"), format.FormatDate("2030-03-05 14:07:09"), format.FormatDate("wkrótce"),
+		}
+		want := []string{tt.fraction, tt.integer, tt.negative, tt.date, tt.dateTime, tt.unparseable}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", tt.locale, got, want)
+		}
+		if format.Value("1.5") != "1.5" {
+			t.Errorf("%s: text answers must not be rewritten", tt.locale)
+		}
+	}
+}
+
+func TestAnkietExportGet_Formats(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+	app.DBManager.yearCache(2030).DB.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES
+		('G1', 'A', '{"_v":1,"data":[{"A_Opis":"pierwszy; \"wiersz\"","A_Kod":"1","A_Ilosc":2.5},{"A_Kod":"2"}]}')`)
+
+	get := func(target, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/app/2030/bdgr/lista-ankiet/G1/export", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != EXPORT_CONTENT_TYPES[EXPORT_CSV] {
+		t.Fatalf("default export: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	want := "\uFEFFpodtabela;wiersz;kolumna;wartosc\n" +
+		"A;1;A_Kod;1\n" +
+		"A;1;A_Opis;\"pierwszy; \"\"wiersz\"\"\"\n" +
+		"A;1;A_Ilosc;2,5\n" +
+		"A;2;A_Kod;2\n" +
+		"A;2;A_Opis;\n" +
+		"A;2;A_Ilosc;\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("csv export:\n%s\nwant:\n%s", got, want)
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), "ankieta_G1_2030.csv") {
+		t.Errorf("csv disposition %q", w.Header().Get("Content-Disposition"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/app/2030/bdgr/lista-ankiet/G1/export", nil)
+	req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
+	req.Header.Set("Accept-Language", "en-GB,en;q=0.9")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if got := w.Body.String(); !strings.Contains(got, "A,1,A_Ilosc,2.5\n") || !strings.Contains(got, "A,1,A_Opis,\"pierwszy; \"\"wiersz\"\"\"\n") {
+		t.Errorf("english csv export:\n%s", got)
+	}
+
+	w = get("/app/2030/bdgr/lista-ankiet/G1/export", "application/json")
+	if w.Header().Get("Content-Type") != "application/json" || !strings.Contains(w.Body.String(), `"A_Ilosc":2.5`) {
+		t.Errorf("json export: %q %s", w.Header().Get("Content-Type"), w.Body.String())
+	}
+	if w := get("/app/2030/bdgr/lista-ankiet/G1/export.json", ""); w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("export.json answered with %q", w.Header().Get("Content-Type"))
+	}
+	if w := get("/app/2030/bdgr/lista-ankiet/G1/export", "image/png"); w.Code != http.StatusNotAcceptable {
+		t.Errorf("unsupported Accept: status %d, want 406", w.Code)
+	}
+	if w := get("/app/2030/bdgr/lista-ankiet/G1/export?format=pdf", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: status %d, want 400", w.Code)
+	}
+
+	w = get("/app/2030/bdgr/lista-ankiet/G1/export?format=xlsx", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != EXPORT_CONTENT_TYPES[EXPORT_XLSX] {
+		t.Fatalf("xlsx export: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make(map[string]string)
+	for _, file := range archive.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		parts[file.Name] = string(content)
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels"} {
+		if _, ok := parts[name]; !ok {
+			t.Errorf("xlsx lacks %s", name)
+		}
+	}
+	if !strings.Contains(parts["xl/workbook.xml"], `<sheet name="A" sheetId="1" r:id="rId1"/>`) {
+		t.Errorf("workbook %s", parts["xl/workbook.xml"])
+	}
+	sheet := parts["xl/worksheets/sheet1.xml"]
+	for _, cell := range []string{
+		`<c r="A1" t="inlineStr"><is><t xml:space="preserve">A_Kod</t></is></c>`,
+		`<c r="B2" t="inlineStr"><is><t xml:space="preserve">pierwszy; &#34;wiersz&#34;</t></is></c>`,
+		`<c r="C2"><v>2.5</v></c>`,
+		`<row r="3"><c r="A3" t="inlineStr">`,
+	} {
+		if !strings.Contains(sheet, cell) {
+			t.Errorf("sheet lacks %s:\n%s", cell, sheet)
+		}
+	}
+}
+
+func TestXlsxSheetName(t *testing.T) {
+	used := make(map[string]bool)
+	long := strings.Repeat("x", 40)
+	for _, tt := range []struct{ name, want string }{
+		{"A/B", "A_B"},
+		{"a_b", "a_b~2"},
+		{long, long[:31]},
+		{long, long[:29] + "~2"},
+		{"", "_"},
+	} {
+		if got := xlsxSheetName(tt.name, used); got != tt.want {
+			t.Errorf("xlsxSheetName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := xlsxColumn(0) + xlsxColumn(25) + xlsxColumn(26) + xlsxColumn(701); got != "AZAAZZ" {
+		t.Errorf("xlsxColumn: %q", got)
+	}
+}
+
+func TestAuditExportGet(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+
+	serve := func(method, target, body string, user User) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(sessionCookie(t, app, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	jan := User{Login: "jan", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}}
+	admin := User{Login: "admin", Role: UserAdmin}
+
+	if w := serve(http.MethodPost, "/app/2030/bdgr/lista-ankiet/G1/T/A/", `[{"A_Kod":"1","A_Opis":"x"}]`, jan); w.Code != http.StatusOK {
+		t.Fatalf("save: %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(http.MethodDelete, "/app/2030/bdgr/lista-ankiet/G1/T/A", "", jan); w.Code != http.StatusOK {
+		t.Fatalf("clear: %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(http.MethodDelete, "/app/2030/bdgr/lista-ankiet/G1/T/A", "", jan); w.Code != http.StatusOK {
+		t.Fatalf("clear of empty subtable: %d %s", w.Code, w.Body.String())
+	}
+	if stored, err := app.DaneSelectByIdGRAndSubtable(2030, "G1", "A"); err != nil || stored != "" {
+		t.Fatalf("subtable should be cleared, got %q, %v", stored, err)
+	}
+
+	var export struct {
+		Wpisy []map[string]any `json:"wpisy"`
+	}
+	w := serve(http.MethodGet, "/app/2030/audyt?format=json", "", admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("json export: %d %s", w.Code, w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &export); err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Wpisy) != 2 {
+		t.Fatalf("expected a save and a clear, got %v", export.Wpisy)
+	}
+	save, clear := export.Wpisy[0], export.Wpisy[1]
+	if save["akcja"] != AUDIT_SAVE || save["login"] != "jan" || save["idgr"] != "G1" || save["podtabela"] != "A" {
+		t.Errorf("save entry %v", save)
+	}
+	if _, ok := save["dane"]; ok {
+		t.Errorf("payload exported without ?dane=1: %v", save)
+	}
+	if clear["akcja"] != AUDIT_DELETE || clear["skrot"] != AuditHash("") {
+		t.Errorf("clear entry %v", clear)
+	}
+
+	w = serve(http.MethodGet, "/app/2030/audyt?format=json&dane=1&login=jan&od=2000-01-01", "", admin)
+	if err := json.Unmarshal(w.Body.Bytes(), &export); err != nil {
+		t.Fatal(err)
+	}
+	dane, _ := export.Wpisy[0]["dane"].(string)
+	if dane == "" || export.Wpisy[0]["skrot"] != AuditHash(dane) {
+		t.Errorf("payload %q does not match its hash %v", dane, export.Wpisy[0]["skrot"])
+	}
+	for _, filter := range []string{"idgr=G2", "podtabela=B", "login=admin", "do=2000-01-01"} {
+		w := serve(http.MethodGet, "/app/2030/audyt?format=json&"+filter, "", admin)
+		if !strings.Contains(w.Body.String(), `"wpisy":[]`) {
+			t.Errorf("%s: expected no entries, got %s", filter, w.Body.String())
+		}
+	}
+	if w := serve(http.MethodGet, "/app/2030/audyt?od=wczoraj", "", admin); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid date: status %d, want 400", w.Code)
+	}
+
+	w = serve(http.MethodGet, "/app/2030/audyt", "", admin)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != EXPORT_CONTENT_TYPES[EXPORT_CSV] {
+		t.Fatalf("csv export: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 3 || lines[0] != "\uFEFFid;czas;idgr;podtabela;login;akcja;skrot" || !strings.HasSuffix(lines[2], ";G1;A;jan;usuniecie;"+AuditHash("")) {
+		t.Errorf("csv export:\n%s", w.Body.String())
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), "audyt_2030.csv") {
+		t.Errorf("csv disposition %q", w.Header().Get("Content-Disposition"))
+	}
+
+	if w := serve(http.MethodGet, "/app/2030/audyt", "", jan); w.Code != http.StatusForbidden {
+		t.Errorf("non-admin: status %d, want 403", w.Code)
+	}
+}
+
+func TestAnkietExportGet_IfModifiedSince(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+
+	db := app.DBManager.yearCache(2030).DB
+	db.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane, data_modyfikacji) VALUES
+		('G1', 'A', '{"_v":1,"data":[1],"notes":"uwaga"}', '2030-03-01 10:00:00'),
+		('G1', 'B', '{"_v":1,"data":[2]}', '2030-03-05 12:30:00'),
+		('G2', 'A', '{"_v":1,"data":[3]}', '2030-04-01 00:00:00')`)
+
+	user := User{Role: UserAdmin}
+	handler := ChainFuncNew(app.MiddleLoged, app.MiddleYear, app.MiddleAccessIdGR).Then(app.AnkietExportGet)
+	get := func(idGR, since string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("idgr", idGR)
+		req.Header.Set("Accept", "application/json")
+		if since != "" {
+			req.Header.Set("If-Modified-Since", since)
+		}
+		w := httptest.NewRecorder()
+		sessionAs(app, user, handler).ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("G1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	// The newest subtable of G1 wins; G2 must not leak into the aggregate.
+	lastModified := "Tue, 05 Mar 2030 12:30:00 GMT"
+	if got := w.Header().Get("Last-Modified"); got != lastModified {
+		t.Errorf("Last-Modified = %q, want %q", got, lastModified)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"dane":[1]`) || !strings.Contains(body, `"dane":[2]`) || !strings.Contains(body, `"uwagi":"uwaga"`) {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	if w := get("G1", lastModified); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("unchanged: expected empty 304, got %d %q", w.Code, w.Body.String())
+	}
+	if w := get("G1", "Tue, 05 Mar 2030 12:29:59 GMT"); w.Code != http.StatusOK {
+		t.Errorf("stale copy: expected 200, got %d", w.Code)
+	}
+	if w := get("G1", "not a date"); w.Code != http.StatusOK {
+		t.Errorf("bad header: expected 200, got %d", w.Code)
+	}
+
+	// Clearing a subtable removes its row; the audit entry still moves the stamp on.
+	db.MustExec(`DELETE FROM b_bdgrobmsp WHERE idgr = 'G1' AND podtabela = 'B'`)
+	db.MustExec(`INSERT INTO b_audyt (idgr, podtabela, login, akcja, skrot, dane, czas) VALUES ('G1', 'B', 'jan', ?, '', '', '2030-03-06 09:00:00')`, AUDIT_DELETE)
+	if w := get("G1", lastModified); w.Code != http.StatusOK || w.Header().Get("Last-Modified") != "Wed, 06 Mar 2030 09:00:00 GMT" {
+		t.Errorf("after clearing: expected 200 at the clearing time, got %d %q", w.Code, w.Header().Get("Last-Modified"))
+	}
+
+	w = get("G3", "Tue, 05 Mar 2030 12:30:00 GMT")
+	if w.Code != http.StatusOK || w.Header().Get("Last-Modified") != "" {
+		t.Errorf("no data: expected 200 without Last-Modified, got %d %q", w.Code, w.Header().Get("Last-Modified"))
+	}
+}
+
+func TestZalaczniki(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+	db := app.DBManager.yearCache(2030).DB
+	db.MustExec(`
+		INSERT INTO b_tabele (tabela, tytul, lp, symbol) VALUES ('T', 'T', 1, 'T');
+		INSERT INTO b_podtabele (podtabela, tabela, schemat_tabeli, tytul, lp) VALUES ('A', 'T', 'HORIZONTAL_DYNAMIC_UNIQUE', 'A', 1);
+	`)
+
+	user := User{Login: "jan", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}}
+	AccessIdGR := ChainFuncNew(app.MiddleLoged, app.MiddleYear, app.MiddleAccessIdGR)
+	serve := func(as User, handler http.HandlerFunc, req *http.Request, idGR, id string) *httptest.ResponseRecorder {
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("idgr", idGR)
+		req.SetPathValue("table", "T")
+		req.SetPathValue("subtable", "A")
+		req.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		sessionAs(app, as, AccessIdGR.Then(handler)).ServeHTTP(w, req)
+		return w
+	}
+	upload := func(name, contentType string, content []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="plik"; filename="%s"`, name))
+		header.Set("Content-Type", contentType)
+		part, _ := mw.CreatePart(header)
+		part.Write(content)
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return serve(user, app.ZalacznikiPost, req, "G1", "")
+	}
+
+	pdf := []byte("%PDF-1.4\nfaktura")
+	if w := upload(`C:\Users\jan\faktura.pdf`, "application/pdf", pdf); w.Code != http.StatusCreated {
+		t.Fatalf("pdf upload: expected 201, got %d %s", w.Code, w.Body.String())
+	}
+	if w := upload("faktura.pdf", "application/pdf", []byte("MZ\x90\x00binary")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("disguised binary: expected 415, got %d", w.Code)
+	}
+	if w := upload("skrypt.sh", "application/x-sh", []byte("#!/bin/sh")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("disallowed type: expected 415, got %d", w.Code)
+	}
+	if w := upload("duzy.txt", "text/plain", bytes.Repeat([]byte("a"), ATTACHMENT_MAX_SIZE+1)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized: expected 413, got %d", w.Code)
+	}
+
+	app.DBManager.MasterCache.DB.MustExec("INSERT INTO lata (rok, zablokowany, odlaczony) VALUES (2030, 1, 0)")
+	if w := upload("faktura.pdf", "application/pdf", pdf); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "zablokowany") {
+		t.Errorf("locked year: expected 403 JSON, got %d %s", w.Code, w.Body.String())
+	}
+	app.DBManager.MasterCache.DB.MustExec("DELETE FROM lata WHERE rok = 2030")
+
+	w := serve(user, app.ZalacznikiGet, httptest.NewRequest(http.MethodGet, "/", nil), "G1", "")
+	var list struct{ Zalaczniki []BZalaczniki }
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Zalaczniki) != 1 {
+		t.Fatalf("list: %v %s", err, w.Body.String())
+	}
+	got := list.Zalaczniki[0]
+	if got.NazwaPliku != "faktura.pdf" || got.Rozmiar != int64(len(pdf)) || got.Typ != "application/pdf" || got.Login != "jan" {
+		t.Errorf("unexpected metadata %+v", got)
+	}
+	if strings.Contains(w.Body.String(), "zawartosc") {
+		t.Errorf("list leaks file content: %s", w.Body.String())
+	}
+
+	id := fmt.Sprint(got.Id)
+	w = serve(user, app.ZalacznikGet, httptest.NewRequest(http.MethodGet, "/", nil), "G1", id)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), pdf) {
+		t.Fatalf("download: %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename=faktura.pdf` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	// An admin can open G2, but the id belongs to G1.
+	if w := serve(User{Role: UserAdmin}, app.ZalacznikGet, httptest.NewRequest(http.MethodGet, "/", nil), "G2", id); w.Code != http.StatusNotFound {
+		t.Errorf("other farm: expected 404, got %d", w.Code)
+	}
+	if w := serve(User{Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G2"}}}, app.ZalacznikGet, httptest.NewRequest(http.MethodGet, "/", nil), "G1", id); w.Code == http.StatusOK {
+		t.Errorf("no access: download allowed")
+	}
+}
+
+func TestEditLock(t *testing.T) {
+	app := corsTestApplication()
+	app.EditLockTimeout = 5 * time.Minute
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+	db := app.DBManager.yearCache(2030).DB
+
+	jan := User{Login: "jan", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}}
+	ewa := User{Login: "ewa", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}}
+	post := func(as User, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("idgr", "G1")
+		req.SetPathValue("subtable", "A")
+		w := httptest.NewRecorder()
+		sessionAs(app, as, handler).ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post(jan, app.EditLockPost); w.Code != http.StatusOK {
+		t.Fatalf("jan acquire: expected 200, got %d", w.Code)
+	}
+	if w := post(jan, app.EditLockPost); w.Code != http.StatusOK {
+		t.Errorf("jan refresh: expected 200, got %d", w.Code)
+	}
+	w := post(ewa, app.EditLockPost)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"login":"jan"`) {
+		t.Errorf("ewa while jan edits: expected 409 naming jan, got %d %s", w.Code, w.Body.String())
+	}
+	if lock, err := app.EditLockHolder(2030, "G1", "A", "ewa"); err != nil || lock == nil || lock.Login != "jan" {
+		t.Errorf("holder for ewa: %+v %v", lock, err)
+	}
+	if lock, _ := app.EditLockHolder(2030, "G1", "A", "jan"); lock != nil {
+		t.Errorf("jan sees his own lock as foreign: %+v", lock)
+	}
+
+	// Releasing someone else's lock is a no-op.
+	post(ewa, app.EditLockReleasePost)
+	if w := post(ewa, app.EditLockPost); w.Code != http.StatusConflict {
+		t.Errorf("after foreign release: expected 409, got %d", w.Code)
+	}
+
+	db.MustExec(`UPDATE b_edycje SET data_odswiezenia = datetime('now', '-10 minutes')`)
+	if lock, _ := app.EditLockHolder(2030, "G1", "A", "ewa"); lock != nil {
+		t.Errorf("expired lock still reported: %+v", lock)
+	}
+	if w := post(ewa, app.EditLockPost); w.Code != http.StatusOK {
+		t.Errorf("ewa takes over expired lock: expected 200, got %d", w.Code)
+	}
+
+	post(ewa, app.EditLockReleasePost)
+	if w := post(jan, app.EditLockPost); w.Code != http.StatusOK {
+		t.Errorf("jan after release: expected 200, got %d", w.Code)
+	}
+}
+
+func TestDBManager_YearBackup(t *testing.T) {
+	dir := t.TempDir() + "/"
+	m := &DBManager{DirPath: dir, yearCacheMap: make(map[YearDB]*SqlCache)}
+	if err := m.YearCreate(2030); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer m.yearCache(2030).DB.Close()
+
+	if _, err := m.YExec(2030, "b_bdgrobmsp_dane_replace", "G1", "A", "[]"); err != nil {
+		t.Fatal(err)
+	}
+
+	backupDir := t.TempDir()
+	name, err := m.YearBackup(2030, backupDir)
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(backupDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM b_bdgrobmsp").Scan(&count); err != nil || count != 1 {
+		t.Errorf("backup content: count %d, err %v", count, err)
+	}
+
+	if _, err := m.YearBackup(2031, backupDir); err == nil {
+		t.Error("expected error for a year that is not loaded")
+	}
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+	db := app.DBManager.yearCache(2030).DB
+
+	db.MustExec(`
+		INSERT INTO b_tabele (tabela, tytul, lp, symbol) VALUES ('T', 'T', 1, 'T');
+		INSERT INTO b_podtabele (podtabela, tabela, schemat_tabeli, tytul, lp) VALUES ('A', 'T', 'HORIZONTAL_DYNAMIC_UNIQUE', 'A', 1);
+		INSERT INTO b_jm (jm, typ_jm) VALUES ('txt', 'string');
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm, wymagana) VALUES ('A_Kod', 'A', 'Kod', 1, 'txt', 0);
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm, wymagana) VALUES ('A_Opis', 'A', 'Opis', 2, 'txt', 1);
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '{"_v":1,"data":[{"A_Kod":"1","A_Opis":"x"}]}');
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G2', 'A', '{"_v":1,"data":[{"A_Kod":"1","A_Stara":"y"}]}');
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G3', 'Usunieta', '[]');
+	`)
+
+	reports, err := app.IntegrityCheck(2030)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 reports, got %+v", reports)
+	}
+
+	drift := reports[0]
+	if drift.IdGR != "G2" || !slices.Equal(drift.UnknownColumns, []string{"A_Stara"}) {
+		t.Errorf("unexpected unknown columns %+v", drift)
+	}
+	if len(drift.MissingRequired) != 1 || drift.MissingRequired[0].Column != "A_Opis" {
+		t.Errorf("unexpected missing required %+v", drift.MissingRequired)
+	}
+	if reports[1].IdGR != "G3" || reports[1].Error == "" {
+		t.Errorf("unknown subtable not reported: %+v", reports[1])
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	values := map[string]any{"A": 10.0, "B": "2,5", "C": "", "K": "T"}
+	cases := map[string]bool{
+		"A > 5":                    true,
+		"A >= 10 AND B < 2":        false,
+		"A = 1 OR B <> 0":          true,
+		"NOT A = 10":               false,
+		"K = 'T'":                  true,
+		"K != 'T'":                 false,
+		"C = ''":                   true,
+		"(A - B) * 2 = 15":         true,
+		"(A = 1 OR K = 'T') and C": false,
+		"A":                        true,
+	}
+	for condition, want := range cases {
+		got, err := EvalCondition(condition, values)
+		if err != nil || got != want {
+			t.Errorf("%s = %v, %v; want %v", condition, got, err, want)
+		}
+	}
+
+	for _, bad := range []string{"K < 'T'", "K = 'T", "A ! B", "A = ", "'T' = K"} {
+		if _, err := EvalCondition(bad, values); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestValidateSubtableData_RequiredWhen(t *testing.T) {
+	columns := []TableColumn{
+		{Name: "R_Kod"},
+		{Name: "R_Dzierzawa"},
+		{Name: "R_Powierzchnia", Required: 1, RequiredWhen: "R_Dzierzawa = 'T'"},
+		{Name: "R_Uwagi", RequiredWhen: "R_Dzierzawa ="},
+	}
+
+	cases := map[string]int{
+		`[{"R_Kod":"1","R_Dzierzawa":"T"}]`:                      1,
+		`[{"R_Kod":"1","R_Dzierzawa":"T","R_Powierzchnia":"2"}]`: 0,
+		`[{"R_Kod":"1","R_Dzierzawa":"N"}]`:                      0,
+		`[{"R_Kod":"1"},{"R_Kod":"2","R_Dzierzawa":"T"}]`:        1,
+	}
+	for payload, want := range cases {
+		errs, err := ValidateSubtableData(HORIZONTAL_DYNAMIC_UNIQUE, columns, nil, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(errs) != want {
+			t.Errorf("%s: expected %d errors, got %+v", payload, want, errs)
+		}
+	}
+}
+
+// The form evaluates wymagana_gdy itself (condition_eval in script.ts), so the
+// inputs have to carry it next to data-required.
+func TestTableInputs_RequiredWhen(t *testing.T) {
+	column := TableColumn{Name: "R_Powierzchnia", Required: 1, RequiredWhen: "R_Dzierzawa = 'T'"}
+	for _, name := range []string{"input_string", "input_number", "input_enum", "input_multi_exclusive"} {
+		var buf strings.Builder
+		cell := TableCell{Name: column.Name, Column: &column, Required: column.Required, Editable: 1}
+		if err := TmplLocalize(TMPL_DYNAMIC_ROW, LOCALE_DEFAULT).ExecuteTemplate(&buf, name, cell); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), `data-required-when="R_Dzierzawa = &#39;T&#39;"`) {
+			t.Errorf("%s does not carry the condition:\n%s", name, buf.String())
+		}
+	}
+}
+
+func TestI18n(t *testing.T) {
+	cases := map[string]string{
+		"":                        "pl",
+		"en-GB,en;q=0.9":          "en",
+		"de-DE,pl;q=0.5,en;q=0.8": "en",
+		"fr":                      "pl",
+	}
+	for header, want := range cases {
+		if got := LocaleFromAcceptLanguage(header); got != want {
+			t.Errorf("%q: expected %s, got %s", header, want, got)
+		}
+	}
+
+	if got := I18nTranslate("xx", "role.manager"); got != "Kierownik" {
+		t.Errorf("unknown locale should fall back to default, got %q", got)
+	}
+	if got := I18nTranslate("en", "no.such.key"); got != "no.such.key" {
+		t.Errorf("missing key should render as the key, got %q", got)
+	}
+
+	// Every key of the default catalog has to be translated, otherwise the English
+	// UI silently mixes in Polish.
+	for locale, messages := range I18N_CATALOG {
+		for key := range I18N_CATALOG[LOCALE_DEFAULT] {
+			if _, ok := messages[key]; !ok {
+				t.Errorf("locale %s is missing %q", locale, key)
+			}
+		}
+	}
+
+	var buf strings.Builder
+	if err := TmplLocalize(TMPL_LOGIN, "en").ExecuteTemplate(&buf, "base", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<html lang="en">`) || !strings.Contains(buf.String(), "Password") {
+		t.Errorf("login page not rendered in English")
+	}
+}
+
+func TestProfileGet(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(nil)
+	defer app.DBManager.Disconnect()
+	app.DBManager.MasterCache.DB.MustExec(`INSERT INTO uzytkownicy (idpbr, login, password, salt, imie, nazwisko, email, rola, idbr) VALUES ('P1', 'jan', 'haslo-tajne-123', 'sol-xyz-789', 'Jan', 'Kowalski', 'jan@example.com', 'PBR', 'BR1')`)
+
+	req := httptest.NewRequest(http.MethodGet, "/app/profile", nil)
+	w := httptest.NewRecorder()
+	sessionAs(app, User{Login: "jan", Role: UserNormal, IdBR: "BR1", IdPBR: "P1", LastLogin: "2030-01-15 08:00:00"}, app.ProfileGet).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"Jan Kowalski", "jan@example.com", "BR1", "Pracownik", "2030-01-15 08:00:00"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("profile is missing %q", want)
+		}
+	}
+	for _, secret := range []string{"haslo-tajne-123", "sol-xyz-789"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("profile leaks %q", secret)
+		}
+	}
+}
+
+func TestLocalePost(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+	cookie := sessionCookie(t, app, User{Login: "jan", Role: UserNormal})
+
+	post := func(locale string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/app/profile/locale", strings.NewReader(url.Values{"locale": {locale}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	if w := post("xx"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown locale: status %d, want 400", w.Code)
+	}
+	if w := post("en"); w.Code != http.StatusSeeOther {
+		t.Fatalf("set locale: status %d", w.Code)
+	}
+
+	// The session choice beats the browser's Accept-Language.
+	req := httptest.NewRequest(http.MethodGet, "/app/profile", nil)
+	req.Header.Set("Accept-Language", "pl")
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "My profile") || !strings.Contains(body, `<option value="en" selected>`) {
+		t.Errorf("profile not rendered in the chosen locale: %d", w.Code)
+	}
+}
+
+func TestPasswordVerify(t *testing.T) {
+	hash, err := PasswordHash("Password2", "salt", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !PasswordVerify(hash, "salt", "Password2") {
+		t.Error("hash should verify")
+	}
+	if PasswordVerify(hash, "other", "Password2") || PasswordVerify(hash, "salt", "password2") {
+		t.Error("wrong salt or password verified")
+	}
+	if !PasswordVerify("legacy", "", "legacy") || PasswordVerify("legacy", "", "Legacy") {
+		t.Error("plain-text fallback broken")
+	}
+	if PasswordVerify(PASSWORD_HASH_PREFIX+"x$00", "salt", "") {
+		t.Error("malformed hash verified")
+	}
+}
+
+func TestUsers_CreateAndDeactivate(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(nil)
+	defer app.DBManager.Disconnect()
+	app.FormDecoder = form.NewDecoder()
+	admin := User{Login: "admin", Role: UserAdmin}
+
+	create := func(values url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/app/users", strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		sessionAs(app, admin, app.UsersPost).ServeHTTP(w, req)
+		return w
+	}
+	login := func(password string) string {
+		form := url.Values{"login": {"nowak"}, "password": {password}}
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		app.Session.LoadAndSave(http.HandlerFunc(app.LoginPost)).ServeHTTP(w, req)
+		return w.Header().Get("Location")
+	}
+
+	user := url.Values{
+		"idpbr": {"P2"}, "login": {"nowak"}, "password": {"dlugiehaslo"}, "imie": {"Anna"},
+		"nazwisko": {"Nowak"}, "email": {"anna@example.com"}, "rola": {"ZBR"}, "idbr": {"BR1"},
+	}
+	if w := create(user); w.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d %s", w.Code, w.Body)
+	}
+	if w := create(user); w.Code != http.StatusConflict {
+		t.Errorf("duplicate login: expected 409, got %d", w.Code)
+	}
+
+	for field, value := range map[string]string{"email": "anna", "rola": "XXX", "password": "short"} {
+		bad := url.Values{}
+		for k, v := range user {
+			bad[k] = v
+		}
+		bad.Set("login", "inny")
+		bad.Set(field, value)
+		if w := create(bad); w.Code != http.StatusBadRequest {
+			t.Errorf("invalid %s: expected 400, got %d", field, w.Code)
+		}
+	}
+
+	var stored string
+	app.DBManager.MasterCache.DB.QueryRow("SELECT password FROM uzytkownicy WHERE idpbr = 'P2'").Scan(&stored)
+	if !strings.HasPrefix(stored, PASSWORD_HASH_PREFIX) {
+		t.Errorf("password stored unhashed: %q", stored)
+	}
+
+	if loc := login("dlugiehaslo"); loc != "/app/" {
+		t.Fatalf("login with new account: redirected to %q", loc)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.SetPathValue("idpbr", "P2")
+	w := httptest.NewRecorder()
+	sessionAs(app, admin, app.UserAktywnyPost).ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `"aktywny":0`) {
+		t.Errorf("unexpected toggle response %s", w.Body)
+	}
+	if loc := login("dlugiehaslo"); loc != "/?login_error="+LOGIN_ERROR_INACTIVE {
+		t.Errorf("inactive account logged in, redirected to %q", loc)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/app/users.json?page=1", nil)
+	w = httptest.NewRecorder()
+	sessionAs(app, admin, app.UsersGet).ServeHTTP(w, req)
+	if body := w.Body.String(); !strings.Contains(body, `"total":1`) || strings.Contains(body, "password") {
+		t.Errorf("unexpected list %s", body)
+	}
+}
+
+// sessionCookie logs user in through the session manager and returns the cookie,
+// for tests that go through app.Routes() and its own LoadAndSave.
+func sessionCookie(t *testing.T, app *Application, user User) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	sessionAs(app, user, func(w http.ResponseWriter, r *http.Request) {}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("no session cookie")
+	}
+	return cookies[0]
+}
+
+func TestRoutes_Templates(t *testing.T) {
+	app := testApplication(t)
+
+	router := app.Routes()
+	get := func(user User, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.AddCookie(sessionCookie(t, app, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	admin := User{Login: "admin", Role: UserAdmin}
+	cases := []struct {
+		path, marker, absent string
+	}{
+		{"/app/2030/", "Wybierz moduł", "data-table-statusy"},
+		{"/app/2030/bdgr/lista-ankiet/", "data-table-statusy", "data-tab-rows"},
+		{"/app/2030/bdgr/lista-ankiet/G1", "data-tab-rows", "data-table-statusy"},
+	}
+	for _, c := range cases {
+		w := get(admin, c.path)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", c.path, w.Code)
+			continue
+		}
+		if body := w.Body.String(); !strings.Contains(body, c.marker) || strings.Contains(body, c.absent) {
+			t.Errorf("%s: wrong template rendered", c.path)
+		}
+	}
+
+	if w := get(admin, "/app/2030"); w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/app/2030/" {
+		t.Errorf("bare year path: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// A methodologist used to get the list rendered twice into one response.
+	w := get(User{Login: "met", Role: UserMethodolgist}, "/app/2030/bdgr/lista-ankiet/")
+	if n := strings.Count(w.Body.String(), "<!DOCTYPE html>"); n != 1 {
+		t.Errorf("methodologist list rendered %d times", n)
+	}
+}
+
+// Every route in its canonical form and with the trailing slash toggled: GETs
+// are redirected to the canonical form, other methods reach the same handler.
+func TestRoutes_TrailingSlash(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+	admin := User{Login: "admin", Role: UserAdmin}
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		req.AddCookie(sessionCookie(t, app, admin))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	toggle := func(path string) string {
+		if strings.HasSuffix(path, "/") {
+			return strings.TrimSuffix(path, "/")
+		}
+		return path + "/"
+	}
+	unrouted := func(w *httptest.ResponseRecorder) bool {
+		return w.Code == http.StatusMethodNotAllowed || w.Body.String() == "404 page not found\n"
+	}
+
+	const ankieta = "/app/2030/bdgr/lista-ankiet/G1"
+	gets := []string{
+		"/app/",
+		"/app/years.json",
+		"/app/config.json",
+		"/app/profile",
+		"/app/users.json",
+		"/app/2030/",
+		"/app/2030/modules.json",
+		"/app/2030/integrity.json",
+		"/app/2030/audyt",
+		"/app/2030/bdgr/lista-ankiet/",
+		"/app/2030/bdgr/stats.json",
+		ankieta,
+		ankieta + "/progress.json",
+		ankieta + "/timeline.json",
+		ankieta + "/export",
+		ankieta + "/export.json",
+		ankieta + "/T/",
+		ankieta + "/T/A/",
+		ankieta + "/T/A/zalaczniki.json",
+		ankieta + "/T/A/zalaczniki/1",
+		ankieta + "/T/A/raw.json",
+		ankieta + "/T/A/K1/0",
+		"/app/2030/bdgr/metodyka/preview/T/A",
+		"/app/2030/slowniki/pkd",
+		"/app/2030/bdgr/metodyka/diff/b_tabele",
+		"/app/2030/bdgr/metodyka/schema/A",
+		"/api/2030/bdgr/lista-ankiet/G1/progress.json",
+		"/api/2030/bdgr/lista-ankiet/G1/timeline.json",
+	}
+	for _, path := range gets {
+		if w := serve(http.MethodGet, path); w.Code == http.StatusTemporaryRedirect || unrouted(w) {
+			t.Errorf("GET %s: canonical form got %d %q", path, w.Code, w.Header().Get("Location"))
+		}
+		if w := serve(http.MethodGet, toggle(path)); w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != path {
+			t.Errorf("GET %s: got %d to %q, want a redirect to %s", toggle(path), w.Code, w.Header().Get("Location"), path)
+		}
+	}
+	// The event stream never ends, so only its other form is requested.
+	if w := serve(http.MethodGet, ankieta+"/events/"); w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != ankieta+"/events" {
+		t.Errorf("GET events/: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	if w := serve(http.MethodGet, "/app/2030?a=1"); w.Header().Get("Location") != "/app/2030/?a=1" {
+		t.Errorf("query lost in redirect: %q", w.Header().Get("Location"))
+	}
+
+	posts := []struct{ method, path string }{
+		{http.MethodPost, "/app/session/keepalive"},
+		{http.MethodPost, "/app/users"},
+		{http.MethodPost, "/app/users/P9/aktywny"},
+		{http.MethodPost, "/app/users/P9/zablokowany"},
+		{http.MethodPost, "/app/farms/G9/archiwizuj"},
+		{http.MethodPost, "/app/farms/G9/przywroc"},
+		{http.MethodPost, "/app/years"},
+		{http.MethodPost, "/app/2030/backup"},
+		{http.MethodPost, ankieta + "/komentarz-zbr"},
+		{http.MethodPost, ankieta + "/komentarz-inst"},
+		{http.MethodPost, ankieta + "/etap/zatwierdz"},
+		{http.MethodPost, "/app/2030/bdgr/lista-ankiet/batch-transition"},
+		{http.MethodPost, ankieta + "/kopiuj"},
+		{http.MethodPost, ankieta + "/T/A/"},
+		{http.MethodDelete, ankieta + "/T/A"},
+		{http.MethodPost, ankieta + "/T/A/validate"},
+		{http.MethodPost, ankieta + "/T/A/blokada"},
+		{http.MethodPost, ankieta + "/T/A/blokada/zwolnij"},
+		{http.MethodPost, ankieta + "/T/A/zalaczniki"},
+		{http.MethodPost, ankieta + "/T/A/nie-dotyczy"},
+		{http.MethodPost, ankieta + "/T/A/K1/0"},
+		{http.MethodPost, "/app/2030/bdgr/metodyka/import/b_tabele"},
+		{http.MethodPost, "/app/2030/bdgr/metodyka/kopiuj"},
+	}
+	for _, p := range posts {
+		for _, path := range []string{p.path, toggle(p.path)} {
+			if w := serve(p.method, path); w.Code == http.StatusTemporaryRedirect || unrouted(w) {
+				t.Errorf("%s %s: got %d, want the route's handler", p.method, path, w.Code)
+			}
+		}
+	}
+
+	// Subtree and catch-all routes take both forms as they are.
+	for _, path := range []string{"/app/2030/bdgr/metodyka/formularze", "/app/2030/bdgr/metodyka/formularze/", "/app/2030/bdgr/brak"} {
+		if w := serve(http.MethodGet, path); w.Code != http.StatusOK {
+			t.Errorf("GET %s: expected 200, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestRoutes_BasePath(t *testing.T) {
+	// After testApplication, whose Config has no base path.
+	app := testApplication(t)
+	BASE_PATH = BasePathClean("/ankiety/")
+	t.Cleanup(func() { BASE_PATH = "" })
+
+	router := app.Routes()
+	get := func(path string, user *User) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if user != nil {
+			req.AddCookie(sessionCookie(t, app, *user))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/ankiety/", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login page: expected 200, got %d", w.Code)
+	}
+	for _, want := range []string{`href="/ankiety/frontend/output.css"`, `action="/ankiety/login"`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("login page lacks %s", want)
+		}
+	}
+	if w := get("/ankiety/frontend/output.css", nil); w.Code != http.StatusOK {
+		t.Errorf("static: expected 200, got %d", w.Code)
+	}
+	if w := get("/app/", nil); w.Code != http.StatusNotFound {
+		t.Errorf("outside the prefix: expected 404, got %d", w.Code)
+	}
+
+	redirects := []struct {
+		path     string
+		user     *User
+		location string
+	}{
+		{"/ankiety", nil, "/ankiety/"},
+		{"/ankiety/app/", nil, "/ankiety/"},
+		{"/ankiety/app/2030", &User{Login: "admin", Role: UserAdmin}, "/ankiety/app/2030/"},
+	}
+	for _, c := range redirects {
+		w := get(c.path, c.user)
+		if w.Code < 300 || w.Code >= 400 || w.Header().Get("Location") != c.location {
+			t.Errorf("%s: got %d to %q, want %q", c.path, w.Code, w.Header().Get("Location"), c.location)
+		}
+	}
+
+	w = get("/ankiety/app/2030/bdgr/lista-ankiet/G1", &User{Login: "admin", Role: UserAdmin})
+	if w.Code != http.StatusOK {
+		t.Fatalf("farm page: expected 200, got %d", w.Code)
+	}
+	for _, want := range []string{`href="/ankiety/app/2030/bdgr/lista-ankiet/"`, `href="/ankiety/app/profile"`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("farm page lacks %s", want)
+		}
+	}
+}
+
+func TestAppURL(t *testing.T) {
+	cases := []struct {
+		base     string
+		segments []any
+		want     string
+	}{
+		{"", []any{"app", ""}, "/app/"},
+		{"", []any{"app", YearDB(2030), "bdgr", "lista-ankiet", "G1"}, "/app/2030/bdgr/lista-ankiet/G1"},
+		{"", []any{"app", 2030, "bdgr", "lista-ankiet", "G 1/x", "T", "A", ""}, "/app/2030/bdgr/lista-ankiet/G%201%2Fx/T/A/"},
+		{"/ankiety", []any{"frontend", "output.css"}, "/ankiety/frontend/output.css"},
+		{"/ankiety", nil, "/ankiety"},
+	}
+	for _, c := range cases {
+		BASE_PATH = c.base
+		if got := AppURL(c.segments...); got != c.want {
+			t.Errorf("AppURL(%v) under %q = %q, want %q", c.segments, c.base, got, c.want)
+		}
+	}
+	BASE_PATH = ""
+}
+
+func TestStaticDirOverride(t *testing.T) {
+	app := corsTestApplication()
+	app.StaticDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(app.StaticDir, "output.css"), []byte("/* marka */"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(app.StaticDir, "favicon.ico"), []byte("ikona"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	router := app.Routes()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	for _, path := range []string{"/frontend/output.css", "/favicon.ico"} {
+		w := get(path)
+		if w.Code != http.StatusOK || !strings.Contains("/* marka */ikona", w.Body.String()) {
+			t.Errorf("%s: expected the file from -static-dir, got %d %q", path, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-cache" {
+			t.Errorf("%s: Cache-Control = %q", path, got)
+		}
+		if w.Header().Get("Last-Modified") == "" {
+			t.Errorf("%s: no Last-Modified to revalidate against", path)
+		}
+	}
+
+	w := get("/frontend/script.js")
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("fallback to embedded: got %d", w.Code)
+	}
+	if got := w.Header().Get("Cache-Control"); !strings.Contains(got, "immutable") {
+		t.Errorf("embedded file: Cache-Control = %q", got)
+	}
+}
+
+func TestCellEditable(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+	app.DBManager.MasterCache.DB.MustExec(`INSERT INTO lata VALUES (2030, 0, 0), (2031, 1, 0)`)
+
+	jan := User{Login: "jan", Role: UserNormal}
+	admin := User{Login: "admin", Role: UserAdmin}
+	blocks := []BBlokady{{Column: "A_Ilosc", Code: "K1"}}
+
+	tests := []struct {
+		name   string
+		column TableColumn
+		code   string
+		year   YearDB
+		user   User
+		want   bool
+	}{
+		{"plain", TableColumn{Name: "A_Ilosc"}, "K2", 2030, jan, true},
+		{"key column", TableColumn{Name: "A_Kod"}, "K2", 2030, jan, false},
+		{"key-like column", TableColumn{Name: "Rok_Koduwagi"}, "K2", 2030, jan, true},
+		{"formula", TableColumn{Name: "A_Suma", Formula: "A_Ilosc * 2"}, "K2", 2030, jan, false},
+		{"blocked", TableColumn{Name: "A_Ilosc"}, "K1", 2030, jan, false},
+		{"blocked other column", TableColumn{Name: "A_Opis"}, "K1", 2030, jan, true},
+		{"locked year", TableColumn{Name: "A_Ilosc"}, "K2", 2031, jan, false},
+		{"locked year admin", TableColumn{Name: "A_Ilosc"}, "K2", 2031, admin, true},
+		{"year not in lata", TableColumn{Name: "A_Ilosc"}, "K2", 2032, jan, true},
+	}
+	for _, tt := range tests {
+		if got := app.CellEditable(&tt.column, tt.code, blocks, tt.year, tt.user); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestColumnIsKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         bool
+		description bool
+	}{
+		{"A_Kod", true, false},
+		{"A_1_Kod", true, false},
+		{"Rok_Koduwagi", false, false},
+		{"A_KodPocztowy", false, false},
+		{"A_Kod_Opis", false, false},
+		{"Kod", false, false},
+		{"A_Wyszczegolnienie", false, true},
+		{"A_Wyszczegolnienie_Uwagi", false, false},
+		{"A_WyszczegolnienieDodatkowe", false, false},
+	}
+	for _, tt := range tests {
+		if got := ColumnIsKey(tt.name); got != tt.key {
+			t.Errorf("ColumnIsKey(%q): expected %v, got %v", tt.name, tt.key, got)
+		}
+		if got := ColumnIsDescription(tt.name); got != tt.description {
+			t.Errorf("ColumnIsDescription(%q): expected %v, got %v", tt.name, tt.description, got)
+		}
+	}
+}
+
+func TestSystemImportPost(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+	db := app.DBManager.yearCache(2030).DB
+	db.MustExec(`INSERT INTO b_slowniki (slownik, wartosc, typ_slownika, opis) VALUES ('TAK_NIE', 'T', 'lista', 'stary opis')`)
+
+	upload := func(table, name, content string) (*httptest.ResponseRecorder, []SystemImportRow) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("plik", name)
+		part.Write([]byte(content))
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("table", table)
+		w := httptest.NewRecorder()
+		app.SystemImportPost(w, req)
+
+		var resp struct {
+			Rows []SystemImportRow `json:"rows"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp.Rows
+	}
+	count := func(table string) (n int) {
+		db.Get(&n, "SELECT COUNT(*) FROM "+table)
+		return n
+	}
+
+	csvFile := "\ufeffslownik;wartosc;typ_slownika;opis\nTAK_NIE;T;N;lista;\nPLEC;K;M;lista;Płeć\n"
+	if w, _ := upload("b_slowniki", "slowniki.csv", csvFile); w.Code != http.StatusBadRequest {
+		t.Errorf("ragged csv: expected 400, got %d", w.Code)
+	}
+	csvFile = "\ufeffslownik;wartosc;typ_slownika;opis\nTAK_NIE;\"T,N\";lista;\nPLEC;\"K,M\";lista;Płeć\n"
+	w, rows := upload("b_slowniki", "slowniki.csv", csvFile)
+	if w.Code != http.StatusOK || len(rows) != 2 || rows[1].Key != "PLEC" {
+		t.Fatalf("csv: expected 200 with 2 rows, got %d %s", w.Code, w.Body.String())
+	}
+	var opis sql.NullString
+	var wartosc string
+	db.QueryRow("SELECT wartosc, opis FROM b_slowniki WHERE slownik = 'TAK_NIE'").Scan(&wartosc, &opis)
+	if wartosc != "T,N" || opis.Valid {
+		t.Errorf("upsert: expected wartosc T,N and NULL opis, got %q %+v", wartosc, opis)
+	}
+
+	if w, _ := upload("b_slowniki", "slowniki.csv", "slownik,kolor\nX,czerwony\n"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown column: expected 400, got %d", w.Code)
+	}
+	if w, _ := upload("b_kody", "kody.csv", "kod\nX\n"); w.Code != http.StatusNotFound {
+		t.Errorf("table without import: expected 404, got %d", w.Code)
+	}
+
+	file := `[
+		{"stawka_vat_zo": "23", "wartosc_stawki_vat_zo": 0.23, "tytul": "Podstawowa"},
+		{"stawka_vat_zo": "8", "wartosc_stawki_vat_zo": "0,08", "tytul": "Obniżona"},
+		{"stawka_vat_zo": "5", "wartosc_stawki_vat_zo": "pięć", "tytul": "Obniżona"},
+		{"stawka_vat_zo": "0", "tytul": ""}
+	]`
+	w, rows = upload("b_stawki_vat_zo", "stawki.json", file)
+	if w.Code != http.StatusUnprocessableEntity || len(rows) != 4 {
+		t.Fatalf("invalid rows: expected 422 with 4 rows, got %d %s", w.Code, w.Body.String())
+	}
+	if rows[0].Error != "" || rows[2].Error == "" || rows[3].Error == "" {
+		t.Errorf("per-row errors: %+v", rows)
+	}
+	if n := count("b_stawki_vat_zo"); n != 0 {
+		t.Errorf("rejected file wrote %d rows", n)
+	}
+
+	file = `[{"stawka_vat_rr": "7", "wartosc_stawki_vat_rr": "0,07", "tytul": "Ryczałt"}]`
+	if w, _ := upload("b_stawki_vat_rr", "stawki.json", file); w.Code != http.StatusOK {
+		t.Fatalf("json: expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	var rate float64
+	db.Get(&rate, "SELECT wartosc_stawki_vat_rr FROM b_stawki_vat_rr WHERE stawka_vat_rr = '7'")
+	if rate != 0.07 {
+		t.Errorf("localized number: expected 0.07, got %v", rate)
+	}
+}
+
+func TestSystemDiffGet(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: "", 2031: ""})
+	defer app.DBManager.Disconnect()
+	for year, kolumny := range map[YearDB]string{
+		2030: `('A_Kod', 'Kod', 1, NULL), ('A_Opis', 'Opis', 2, NULL), ('A_Stare', 'Stare', 3, NULL)`,
+		2031: `('A_Kod', 'Kod', 1, NULL), ('A_Opis', 'Opis gospodarstwa', 2, 'nie puste'), ('A_Nowe', 'Nowe', 3, NULL)`,
+	} {
+		app.DBManager.yearCache(year).DB.MustExec(`
+			INSERT INTO b_tabele (tabela, tytul, lp, symbol) VALUES ('T', 'T', 1, 'T');
+			INSERT INTO b_podtabele (podtabela, tabela, schemat_tabeli, tytul, lp) VALUES ('A', 'T', 'HORIZONTAL_DYNAMIC_UNIQUE', 'A', 1);
+			INSERT INTO b_jm (jm, typ_jm) VALUES ('txt', 'string');
+			INSERT INTO b_kolumny (kolumna, tytul, lp, walidacja, podtabela, jm, wymagana) SELECT column1, column2, column3, column4, 'A', 'txt', 0 FROM (VALUES ` + kolumny + `);
+		`)
+	}
+
+	get := func(query string) (*httptest.ResponseRecorder, SystemDiff) {
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		req.SetPathValue("year", "2031")
+		req.SetPathValue("table", "b_kolumny")
+		w := httptest.NewRecorder()
+		app.SystemDiffGet(w, req)
+		var diff SystemDiff
+		json.Unmarshal(w.Body.Bytes(), &diff)
+		return w, diff
+	}
+
+	w, diff := get("od=2030&podtabela=A")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if !slices.Equal(diff.Added, []string{"A_Nowe"}) || !slices.Equal(diff.Removed, []string{"A_Stare"}) {
+		t.Errorf("added/removed: %+v %+v", diff.Added, diff.Removed)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].Key != "A_Opis" {
+		t.Fatalf("changed: %+v", diff.Changed)
+	}
+	fields := diff.Changed[0].Fields
+	if len(fields) != 2 || fields["tytul"].From != "Opis" || fields["tytul"].To != "Opis gospodarstwa" ||
+		fields["walidacja"].From != nil || fields["walidacja"].To != "nie puste" {
+		t.Errorf("fields: %+v", fields)
+	}
+
+	if w, _ := get("od=2029&podtabela=A"); w.Code != http.StatusNotFound {
+		t.Errorf("unloaded year: expected 404, got %d", w.Code)
+	}
+	if w, _ := get("od=2030"); w.Code != http.StatusBadRequest {
+		t.Errorf("missing podtabela: expected 400, got %d", w.Code)
+	}
+}
+
+func TestAnkietRowPost(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+	db := app.DBManager.yearCache(2030).DB
+	db.MustExec(`
+		INSERT INTO b_tabele (tabela, tytul, lp, symbol) VALUES ('T', 'T', 1, 'T');
+		INSERT INTO b_podtabele (podtabela, tabela, schemat_tabeli, tytul, lp) VALUES ('A', 'T', 'HORIZONTAL_DYNAMIC_UNIQUE', 'A', 1);
+		INSERT INTO b_jm (jm, typ_jm) VALUES ('txt', 'str'), ('szt', 'int');
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm, wymagana) VALUES ('A_Kod', 'A', 'Kod', 1, 'txt', 0);
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm, wymagana) VALUES ('A_Ilosc', 'A', 'Ilość', 2, 'szt', 1);
+	`)
+	blob, _ := BlobWrap([]byte(`[{"A_Kod":"K1","A_Ilosc":1}]`), "uwagi do tabeli")
+	db.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', ?)`, blob)
+
+	post := func(code, index, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("idgr", "G1")
+		req.SetPathValue("subtable", "A")
+		req.SetPathValue("code", code)
+		req.SetPathValue("index", index)
+		w := httptest.NewRecorder()
+		sessionAs(app, User{Login: "jan", Role: UserNormal}, app.AnkietRowPost).ServeHTTP(w, req)
+		return w
+	}
+	stored := func() string {
+		data, notes, err := app.DaneNotesSelectByIdGRAndSubtable(2030, "G1", "A")
+		if err != nil || notes != "uwagi do tabeli" {
+			t.Fatalf("stored blob: notes %q, %v", notes, err)
+		}
+		return data
+	}
+
+	// The client's row counter runs ahead of the array, so a high index appends.
+	if w := post("K2", "7", `{"A_Ilosc":"2","A_Kod":"ignored"}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"index":1`) {
+		t.Fatalf("append: expected 200 at index 1, got %d %s", w.Code, w.Body.String())
+	}
+	if w := post("K1", "0", `{"A_Ilosc":"5"}`); w.Code != http.StatusOK {
+		t.Fatalf("update: expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if got := stored(); got != `[{"A_Ilosc":5,"A_Kod":"K1"},{"A_Ilosc":2,"A_Kod":"K2"}]` {
+		t.Errorf("merged data: %s", got)
+	}
+
+	if w := post("K3", "0", `{"A_Ilosc":"1"}`); w.Code != http.StatusConflict {
+		t.Errorf("stale index: expected 409, got %d", w.Code)
+	}
+	w := post("K1", "9", `{"A_Ilosc":"3"}`)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "Zduplikowany kod") {
+		t.Errorf("duplicate code: expected 422, got %d %s", w.Code, w.Body.String())
+	}
+	if w := post("K3", "9", `{"A_Ilosc":""}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("missing required: expected 422, got %d", w.Code)
+	}
+	if got := stored(); strings.Count(got, "A_Kod") != 2 {
+		t.Errorf("rejected rows were written: %s", got)
+	}
+}
+
+func TestAnkietRowPost_RoleRestricted(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+	db := app.DBManager.yearCache(2030).DB
+	db.MustExec(`
+		INSERT INTO b_tabele (tabela, tytul, lp, symbol) VALUES ('T', 'T', 1, 'T');
+		INSERT INTO b_podtabele (podtabela, tabela, schemat_tabeli, tytul, lp) VALUES ('A', 'T', 'HORIZONTAL_DYNAMIC_UNIQUE', 'A', 1);
+		INSERT INTO b_jm (jm, typ_jm) VALUES ('txt', 'str'), ('szt', 'int');
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm, wymagana) VALUES ('A_Kod', 'A', 'Kod', 1, 'txt', 0);
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm, wymagana) VALUES ('A_Ilosc', 'A', 'Ilość', 2, 'szt', 1);
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm, wymagana, role_edycji) VALUES ('A_Korekta', 'A', 'Korekta', 3, 'szt', 1, 'ZBR');
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '[{"A_Kod":"K1","A_Ilosc":1,"A_Korekta":7}]');
+	`)
+
+	post := func(user User, code, index, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("idgr", "G1")
+		req.SetPathValue("subtable", "A")
+		req.SetPathValue("code", code)
+		req.SetPathValue("index", index)
+		w := httptest.NewRecorder()
+		sessionAs(app, user, app.AnkietRowPost).ServeHTTP(w, req)
+		return w
+	}
+	stored := func() string {
+		data, err := app.DaneSelectByIdGRAndSubtable(2030, "G1", "A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	jan, zbr := User{Login: "jan", Role: UserNormal}, User{Login: "zbr", Role: UserManager}
+
+	// Without the role the stored value stays, and the required column missing
+	// from a new row is not the user's to fill in.
+	if w := post(jan, "K1", "0", `{"A_Ilosc":"2","A_Korekta":"99"}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"A_Korekta":7`) {
+		t.Fatalf("normal user: expected 200 keeping A_Korekta, got %d %s", w.Code, w.Body.String())
+	}
+	if w := post(jan, "K2", "1", `{"A_Ilosc":"3","A_Korekta":"5"}`); w.Code != http.StatusOK {
+		t.Fatalf("normal user, new row: expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if got := stored(); got != `[{"A_Ilosc":2,"A_Kod":"K1","A_Korekta":7},{"A_Ilosc":3,"A_Kod":"K2"}]` {
+		t.Errorf("after normal user: %s", got)
+	}
+
+	if w := post(zbr, "K2", "1", `{"A_Ilosc":"3","A_Korekta":"4"}`); w.Code != http.StatusOK {
+		t.Fatalf("manager: expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if got := stored(); !strings.Contains(got, `{"A_Ilosc":3,"A_Kod":"K2","A_Korekta":4}`) {
+		t.Errorf("after manager: %s", got)
+	}
+}
+
+func TestRestrictedColumnsKeep(t *testing.T) {
+	tests := []struct {
+		name, tableType, stored, payload, want string
+	}{
+		{"horizontal", HORIZONTAL_DYNAMIC_DUPLICABLE,
+			`[{"A_Kod":"K1","A_X":1},{"A_Kod":"K1","A_X":2}]`,
+			`[{"A_Kod":"K1","A_X":9,"A_Y":1},{"A_Kod":"K1","A_Y":2},{"A_Kod":"K2","A_X":3}]`,
+			`[{"A_Kod":"K1","A_X":1,"A_Y":1},{"A_Kod":"K1","A_X":2,"A_Y":2},{"A_Kod":"K2"}]`},
+		{"horizontal, nothing stored", HORIZONTAL_STATIC_UNIQUE, ``, `[{"A_Kod":"K1","A_X":9}]`, `[{"A_Kod":"K1"}]`},
+		{"vertical", VERTICAL_STATIC_UNIQUE, `{"A_X":1,"A_Y":2}`, `{"A_Y":3}`, `{"A_X":1,"A_Y":3}`},
+		{"matrix", MATRIX_DYNAMIC_UNIQUE, `{"r":{"c":1}}`, `{"r":{"c":2}}`, `{"r":{"c":1}}`},
+	}
+	for _, tt := range tests {
+		got, err := RestrictedColumnsKeep(tt.tableType, tt.stored, tt.payload, []string{"A_X"})
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %s, %v; want %s", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestColumnRoleEditable(t *testing.T) {
+	app := testApplication(t)
+	tests := []struct {
+		roles string
+		role  UserType
+		want  bool
+	}{
+		{"", UserNormal, true},
+		{"ZBR", UserNormal, false},
+		{"ZBR", UserManager, true},
+		{"ZBR, PBR", UserNormal, true},
+		{"ZBR", UserAdmin, true},
+		{"Szef", UserManager, false},
+	}
+	for _, tt := range tests {
+		column := TableColumn{Name: "A_Opis", EditRoles: RolesMaskParse(tt.roles)}
+		if got := app.CellEditable(&column, "", nil, 2030, User{Role: tt.role}); got != tt.want {
+			t.Errorf("role_edycji %q, role %d: editable %v, want %v", tt.roles, tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestAnkietEventsGet(t *testing.T) {
+	app := corsTestApplication()
+	app.Events = EventHubNew()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+	app.DBManager.yearCache(2030).DB.MustExec(`
+		INSERT INTO b_tabele (tabela, tytul, lp, symbol) VALUES ('T', 'T', 1, 'T');
+		INSERT INTO b_podtabele (podtabela, tabela, schemat_tabeli, tytul, lp) VALUES ('A', 'T', 'HORIZONTAL_DYNAMIC_UNIQUE', 'A', 1);
+	`)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /app/{year}/bdgr/lista-ankiet/{idgr}/events", app.AnkietEventsGet)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/app/2030/bdgr/lista-ankiet/G1/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+	key := EventKey{Year: 2030, IdGR: "G1"}
+	if n := app.Events.Subscribers(key); n != 1 {
+		t.Fatalf("expected 1 subscriber, got %d", n)
+	}
+
+	save := func(idGR, login string) {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[]`))
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("idgr", idGR)
+		req.SetPathValue("subtable", "A")
+		w := httptest.NewRecorder()
+		sessionAs(app, User{Login: login, Role: UserNormal}, app.AnkietSubtablePost).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("save %s: expected 200, got %d %s", idGR, w.Code, w.Body.String())
+		}
+	}
+	// Another farm's save must not reach this stream.
+	save("G2", "ewa")
+	save("G1", "jan")
+
+	lines := bufio.NewScanner(resp.Body)
+	var event SaveEvent
+	for lines.Scan() {
+		if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			json.Unmarshal([]byte(data), &event)
+			break
+		}
+	}
+	if event.Login != "jan" || event.Podtabela != "A" {
+		t.Errorf("expected jan's save of A, got %+v", event)
+	}
+
+	cancel()
+	deadline := time.Now().Add(2 * time.Second)
+	for app.Events.Subscribers(key) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := app.Events.Subscribers(key); n != 0 {
+		t.Errorf("disconnected client still subscribed: %d", n)
+	}
+
+	// A stream that isn't read doesn't hold up saves.
+	_, unsubscribe := app.Events.Subscribe(key)
+	defer unsubscribe()
+	for i := 0; i < EVENT_BUFFER+5; i++ {
+		save("G1", "jan")
+	}
+}
+
+func TestConfigJSONGet(t *testing.T) {
+	app := testApplication(t)
+	app.Session.IdleTimeout = 10 * time.Minute
+	app.SessionWarning = 2 * time.Minute
+	app.MaxRows = map[string]int{"A": 5}
+	app.Directory = &LDAPDirectory{URL: "ldaps://dc.example", BindDN: "secret-%s"}
+	router := app.Routes()
+
+	r := httptest.NewRequest(http.MethodGet, "/app/config.json", nil)
+	r.AddCookie(sessionCookie(t, app, User{Login: "jan", Role: UserNormal}))
+	r.Header.Set("Accept-Language", "en")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Cache-Control"); got != "private, max-age=60" {
+		t.Errorf("Cache-Control %q", got)
+	}
+
+	var body struct {
+		Locale      string          `json:"locale"`
+		IdleTimeout int             `json:"idle_timeout_seconds"`
+		Absolute    int             `json:"absolute_timeout_seconds"`
+		Warning     int             `json:"warning_seconds"`
+		MaxRows     map[string]int  `json:"max_rows"`
+		Features    map[string]bool `json:"features"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Locale != "en" || body.IdleTimeout != 600 || body.Absolute != int(app.Session.Lifetime.Seconds()) || body.Warning != 120 || body.MaxRows["A"] != 5 {
+		t.Errorf("config %s", w.Body.String())
+	}
+	if !body.Features["directory_login"] || body.Features["edit_locks"] {
+		t.Errorf("features %v", body.Features)
+	}
+	if strings.Contains(w.Body.String(), "dc.example") || strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("config leaks directory settings: %s", w.Body.String())
+	}
+
+	anonymous := httptest.NewRecorder()
+	router.ServeHTTP(anonymous, httptest.NewRequest(http.MethodGet, "/app/config.json", nil))
+	if anonymous.Code == http.StatusOK {
+		t.Errorf("anonymous request got the config")
+	}
+}
+
+func TestSessionStatus(t *testing.T) {
+	app := testApplication(t)
+	app.Session.IdleTimeout = 10 * time.Minute
+	router := app.Routes()
+	cookie := sessionCookie(t, app, User{Login: "admin", Role: UserAdmin})
+
+	status := func(method, path string) map[string]any {
+		t.Helper()
+		r := httptest.NewRequest(method, path, nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: status %d", method, path, w.Code)
+		}
+		var body map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	if got := status(http.MethodPost, "/app/session/keepalive")["remaining_seconds"].(float64); got < 590 {
+		t.Fatalf("keepalive remaining = %v, want ~600", got)
+	}
+
+	// Pretend the last request was five minutes ago.
+	ctx, err := app.Session.Load(context.Background(), cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Session.Put(ctx, SESSION_SEEN_KEY, time.Now().Add(-5*time.Minute).Unix())
+	if _, _, err := app.Session.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		body := status(http.MethodGet, "/app/session/status")
+		if got := body["remaining_seconds"].(float64); got < 290 || got > 300 {
+			t.Fatalf("status remaining = %v, want ~300", got)
+		}
+		if body["active"] != true {
+			t.Fatalf("active = %v", body["active"])
+		}
+	}
+
+	if got := status(http.MethodPost, "/app/session/keepalive")["remaining_seconds"].(float64); got < 590 {
+		t.Fatalf("keepalive did not extend: %v", got)
+	}
+
+	anonymous := httptest.NewRecorder()
+	router.ServeHTTP(anonymous, httptest.NewRequest(http.MethodGet, "/app/session/status", nil))
+	if !strings.Contains(anonymous.Body.String(), `"active":false`) {
+		t.Fatalf("anonymous status = %s", anonymous.Body.String())
+	}
+}
+
+func TestBodyDecode(t *testing.T) {
+	polish := "Zażółć gęślą jaźń"
+	if got, err := BodyDecode([]byte(polish), "application/json", ""); err != nil || string(got) != polish {
+		t.Errorf("utf-8: got %q, %v", got, err)
+	}
+
+	invalid := []byte("{\"A\":\"Kowalski \xe6\"}")
+	if _, err := BodyDecode(invalid, "application/json", "utf-8"); !errors.Is(err, ErrInvalidUTF8) {
+		t.Errorf("invalid utf-8: got %v", err)
+	}
+
+	// "Łódź" as saved by a Windows tool.
+	cp1250 := []byte{0xA3, 0xF3, 0x64, 0x9F}
+	if got, err := BodyDecode(cp1250, "application/json; charset=windows-1250", "utf-8"); err != nil || string(got) != "Łódź" {
+		t.Errorf("windows-1250 header: got %q, %v", got, err)
+	}
+	if got, err := BodyDecode(cp1250, "application/json", "cp1250"); err != nil || string(got) != "Łódź" {
+		t.Errorf("windows-1250 fallback: got %q, %v", got, err)
+	}
+	if _, err := BodyDecode([]byte{0x81}, "text/plain; charset=cp1250", ""); !errors.Is(err, ErrInvalidUTF8) {
+		t.Errorf("undefined windows-1250 byte: got %v", err)
+	}
+	if _, err := BodyDecode(cp1250, "application/json; charset=iso-8859-2", ""); !errors.Is(err, ErrCharsetUnsupported) {
+		t.Errorf("unsupported charset: got %v", err)
+	}
+}
+
+func TestAnkietSubtablePost_Charset(t *testing.T) {
+	app := testApplication(t)
+
+	save := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.SetPathValue("year", "2030")
+		req.SetPathValue("idgr", "G1")
+		req.SetPathValue("subtable", "A")
+		w := httptest.NewRecorder()
+		sessionAs(app, User{Login: "jan", Role: UserNormal}, app.AnkietSubtablePost).ServeHTTP(w, req)
+		return w
+	}
+
+	if w := save("application/json", []byte("[{\"A_Kod\":\"1\",\"A_Opis\":\"\xa3\xf3d\x9f\"}]")); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid utf-8: expected 422, got %d %s", w.Code, w.Body.String())
+	}
+	if w := save("application/json; charset=koi8-r", []byte(`[]`)); w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("unknown charset: expected 415, got %d", w.Code)
+	}
+
+	if w := save("application/json; charset=windows-1250", []byte("[{\"A_Kod\":\"1\",\"A_Opis\":\"\xa3\xf3d\x9f\"}]")); w.Code != http.StatusOK {
+		t.Fatalf("windows-1250: expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	var dane string
+	if err := app.DBManager.yearCache(2030).DB.Get(&dane, "SELECT dane FROM b_bdgrobmsp WHERE idgr = 'G1' AND podtabela = 'A'"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dane, "Łódź") {
+		t.Errorf("stored %s, want Łódź", dane)
+	}
+}
+
+func TestAnkietSubtablePost_DeniedJSON(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+
+	save := func(user *User, year string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/app/"+year+"/bdgr/lista-ankiet/G1/T/A/", strings.NewReader(`[{"A_Kod":"1","A_Opis":"x"}]`))
+		req.Header.Set("Content-Type", "application/json")
+		if user != nil {
+			req.AddCookie(sessionCookie(t, app, *user))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	jan := User{Login: "jan", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}}
+	other := User{Login: "jan", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G2"}}}
+	admin := User{Login: "admin", Role: UserAdmin}
+
+	cases := []struct {
+		name string
+		user *User
+		year string
+		want int
+	}{
+		{"no session", nil, "2030", http.StatusUnauthorized},
+		{"unknown year", &jan, "2031", http.StatusNotFound},
+		{"other farm", &other, "2030", http.StatusForbidden},
+		{"allowed", &jan, "2030", http.StatusOK},
+	}
+	for _, c := range cases {
+		w := save(c.user, c.year)
+		if w.Code != c.want {
+			t.Errorf("%s: expected %d, got %d %s", c.name, c.want, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s: Content-Type %q, want JSON", c.name, ct)
+		}
+	}
+
+	app.DBManager.MasterCache.DB.MustExec("UPDATE lata SET zablokowany = 1 WHERE rok = 2030")
+	if w := save(&jan, "2030"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "zablokowany") {
+		t.Errorf("locked year: expected 403 JSON, got %d %s", w.Code, w.Body.String())
+	}
+	if w := save(&admin, "2030"); w.Code != http.StatusOK {
+		t.Errorf("locked year as admin: expected 200, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+// The single-row save is refused like the full save: JSON errors instead of
+// redirects, UTF-8 checked, and read-only on a locked year.
+func TestAnkietRowPost_DeniedJSON(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+
+	save := func(user *User, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/app/2030/bdgr/lista-ankiet/G1/T/A/01/0", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if user != nil {
+			req.AddCookie(sessionCookie(t, app, *user))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	jan := User{Login: "jan", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}}
+	other := User{Login: "jan", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G2"}}}
+	admin := User{Login: "admin", Role: UserAdmin}
+	row := []byte(`{"A_Opis":"x"}`)
+
+	cases := []struct {
+		name string
+		user *User
+		body []byte
+		want int
+	}{
+		{"no session", nil, row, http.StatusUnauthorized},
+		{"other farm", &other, row, http.StatusForbidden},
+		{"invalid utf-8", &jan, []byte("{\"A_Opis\":\"\xa3\xf3d\x9f\"}"), http.StatusUnprocessableEntity},
+		{"allowed", &jan, row, http.StatusOK},
+	}
+	for _, c := range cases {
+		w := save(c.user, c.body)
+		if w.Code != c.want {
+			t.Errorf("%s: expected %d, got %d %s", c.name, c.want, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s: Content-Type %q, want JSON", c.name, ct)
+		}
+	}
+
+	app.DBManager.MasterCache.DB.MustExec("UPDATE lata SET zablokowany = 1 WHERE rok = 2030")
+	if w := save(&jan, row); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "zablokowany") {
+		t.Errorf("locked year: expected 403 JSON, got %d %s", w.Code, w.Body.String())
+	}
+	if w := save(&admin, row); w.Code != http.StatusOK {
+		t.Errorf("locked year as admin: expected 200, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAnkietSubtableDelete(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+	yearDB := app.DBManager.yearCache(2030).DB
+
+	jan := User{Login: "jan", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}}
+	admin := User{Login: "admin", Role: UserAdmin}
+
+	clear := func(user User) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/app/2030/bdgr/lista-ankiet/G1/T/A", nil)
+		req.AddCookie(sessionCookie(t, app, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	stored := func() int {
+		var n int
+		if err := yearDB.Get(&n, "SELECT COUNT(*) FROM b_bdgrobmsp WHERE idgr = 'G1' AND podtabela = 'A'"); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	yearDB.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '[{"A_Kod":"1","A_Opis":"x"}]')`)
+	w := clear(jan)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"usunieto":true`) {
+		t.Fatalf("clear: expected 200 with usunieto, got %d %s", w.Code, w.Body.String())
+	}
+	if n := stored(); n != 0 {
+		t.Fatalf("clear left %d rows", n)
+	}
+	if dane, err := app.DaneSelectByIdGRAndSubtable(2030, "G1", "A"); err != nil || dane != "" {
+		t.Errorf("cleared subtable should read empty, got %q, %v", dane, err)
+	}
+
+	if w := clear(jan); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"usunieto":false`) {
+		t.Errorf("clear of empty subtable: got %d %s", w.Code, w.Body.String())
+	}
+
+	yearDB.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '[{"A_Kod":"1","A_Opis":"x"}]')`)
+	app.DBManager.MasterCache.DB.MustExec("UPDATE lata SET zablokowany = 1 WHERE rok = 2030")
+	if w := clear(jan); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "zablokowany") {
+		t.Errorf("locked year: expected 403 JSON, got %d %s", w.Code, w.Body.String())
+	}
+	if n := stored(); n != 1 {
+		t.Errorf("locked year: data should stay, got %d rows", n)
+	}
+	if w := clear(admin); w.Code != http.StatusOK {
+		t.Errorf("locked year as admin: expected 200, got %d %s", w.Code, w.Body.String())
+	}
+
+	// A column only managers fill in keeps a normal user from clearing it.
+	app.DBManager.MasterCache.DB.MustExec("UPDATE lata SET zablokowany = 0 WHERE rok = 2030")
+	yearDB.MustExec(`UPDATE b_kolumny SET role_edycji = 'ZBR' WHERE kolumna = 'A_Opis'`)
+	yearDB.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '[{"A_Kod":"1","A_Opis":"x"}]')`)
+	if w := clear(jan); w.Code != http.StatusForbidden {
+		t.Errorf("restricted column: expected 403, got %d %s", w.Code, w.Body.String())
+	}
+	if n := stored(); n != 1 {
+		t.Errorf("restricted column: data should stay, got %d rows", n)
+	}
+}
+
+func TestNullCountString(t *testing.T) {
+	for _, tt := range []struct {
+		value NullCount
+		want  string
+	}{
+		{NullCount{}, ""},
+		{NullCount{sql.NullInt64{Int64: 0, Valid: true}}, "0"},
+		{NullCount{sql.NullInt64{Int64: 12, Valid: true}}, "12"},
+	} {
+		if got := tt.value.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestListGRGet_Counts(t *testing.T) {
+	app := testApplication(t)
+	app.DBManager.yearCache(2030).DB.MustExec("UPDATE b_statusy SET o = 0, b = 7 WHERE idgr = 'G1'")
+
+	req := httptest.NewRequest(http.MethodGet, "/app/2030/bdgr/lista-ankiet/", nil)
+	req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
+	w := httptest.NewRecorder()
+	app.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	var cells []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, `<td class="px-4 py-3 text-sm text-slate-600 text-center">`) {
+			cells = append(cells, strings.TrimSuffix(strings.TrimPrefix(line, `<td class="px-4 py-3 text-sm text-slate-600 text-center">`), "</td>"))
+		}
+	}
+	// o, ow, oo, b, bw, bnw, bo, k, z, rok_auweitr
+	want := []string{"0", "", "", "7", "", "", "", "", "", ""}
+	if !slices.Equal(cells, want) {
+		t.Errorf("count cells = %q, want %q", cells, want)
+	}
+}
+
+func TestStatusyTimeline(t *testing.T) {
+	date := func(value string) sql.NullString { return sql.NullString{String: value, Valid: true} }
+	status := Statusy{
+		DataPrzepisaniaNaSP: "",
+		DataTestowania:      date("2030-03-01"),
+		DataPrzekazaniaZBR:  date("2030-02-10 08:30:00"),
+		DataZwrotuPBR:       date("nie wiem"),
+		DataAkceptacji:      date("2030-03-01"),
+		DataZamkniecia:      date("2030-04-02T10:00:00+02:00"),
+	}
+
+	var got []string
+	for _, event := range status.Timeline() {
+		got = append(got, event.Etap+" "+event.Data.UTC().Format(time.DateTime))
+	}
+	want := []string{
+		"przekazania_zbr 2030-02-10 08:30:00",
+		"testowania 2030-03-01 00:00:00",
+		"akceptacji 2030-03-01 00:00:00",
+		"zamkniecia 2030-04-02 08:00:00",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("timeline:\n got %v\nwant %v", got, want)
+	}
+
+	if events := (Statusy{}).Timeline(); events == nil || len(events) != 0 {
+		t.Errorf("no dates: %#v, want an empty slice for JSON []", events)
+	}
+}
+
+func TestAnkietTimelineGet(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+	app.DBManager.yearCache(2030).DB.MustExec(`UPDATE b_statusy SET data_testowania = '2030-05-01', data_przekazania_zbr = '2030-04-20 12:00:00' WHERE idgr = 'G1'`)
+
+	get := func(idGR string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/app/2030/bdgr/lista-ankiet/"+idGR+"/timeline.json", nil)
+		req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("G1")
+	var events []StatusEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &events); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("G1: %d %s", w.Code, w.Body.String())
+	}
+	if len(events) != 2 || events[0].Etap != "przekazania_zbr" || events[1].Etap != "testowania" {
+		t.Errorf("G1 timeline: %+v", events)
+	}
+
+	if w := get("G9"); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("farm without status: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMatrixTable(t *testing.T) {
+	limit := int64(100)
+	columns := []TableColumn{
+		{Name: "M_Kod"},
+		{Name: "M_Wyszczegolnienie"},
+		{Name: "M_Ha", DataType: "float", Required: 1, Max: &limit},
+	}
+	if value := ColumnFirstValue(columns); value == nil || value.Name != "M_Ha" {
+		t.Fatalf("value column = %+v", value)
+	}
+
+	normalized, err := SubtableDataNormalize(columns, `{"01":{"02":"1 234,5","03":" x "}}`)
+	if err != nil || normalized != `{"01":{"02":1234.5,"03":"x"}}` {
+		t.Fatalf("normalize: %s, %v", normalized, err)
+	}
+
+	blocks := []BBlokady{{Column: "M_Ha", Code: "09"}}
+	errs, err := ValidateSubtableData(MATRIX_DYNAMIC_UNIQUE, columns, blocks, `{"01":{"02":50,"03":"x","04":""},"05":{"01":150},"09":{"01":1}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ValidationError{
+		{Code: "01", Index: 0, Column: "03", Message: "Nieprawidłowy format liczby"},
+		{Code: "01", Index: 0, Column: "04", Message: MSG_REQUIRED},
+		{Code: "05", Index: 1, Column: "01", Message: "Wartość musi być co najwyżej 100"},
+		{Code: "09", Index: 2, Column: "01", Message: "Pole zablokowane"},
+	}
+	if !slices.Equal(errs, want) {
+		t.Errorf("got %+v\nwant %+v", errs, want)
+	}
+
+	rows := []TableRow{{Code: "01", Cells: []TableCell{{Name: "02"}, {Name: "03"}}}}
+	if err := PopulateCellsFromMatrix(rows, `{"_v":1,"data":{"01":{"02":2.5}}}`, LocaleFormatGet(LOCALE_DEFAULT)); err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].Cells[0].Value != "2,5" || rows[0].Cells[1].Value != "" {
+		t.Errorf("populated %+v", rows[0].Cells)
+	}
+}
+
+func TestAnkietSubtableGet_Matrix(t *testing.T) {
+	app := testApplication(t)
+	app.DBManager.yearCache(2030).DB.MustExec(`
+		INSERT INTO b_podtabele (podtabela, tabela, schemat_tabeli, tytul, lp) VALUES ('M', 'T', 'MATRIX_DYNAMIC_UNIQUE', 'M', 2);
+		INSERT INTO b_jm (jm, typ_jm) VALUES ('ha', 'float');
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm) VALUES ('M_Kod', 'M', 'Kod', 1, 'txt');
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm) VALUES ('M_Ha', 'M', 'Powierzchnia', 2, 'ha');
+		INSERT INTO b_kody (kod, tytul) VALUES ('01', 'Pszenica'), ('02', 'Rzepak'), ('03', 'Kukurydza');
+		INSERT INTO b_kody__podtabele (kod, podtabela, lp) VALUES ('01', 'M', 1), ('02', 'M', 2), ('03', 'M', 3);
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'M', '{"02":{"01":7.5}}');
+	`)
+
+	req := httptest.NewRequest(http.MethodGet, "/app/2030/bdgr/lista-ankiet/G1/T/M/", nil)
+	req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
+	w := httptest.NewRecorder()
+	app.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{`data-table-type="MATRIX_DYNAMIC_UNIQUE"`, `data-matrix-row="02"`, `data-matrix-column="01"`, `value="7,5"`, `<option value="03" data-label="Kukurydza">`, `data-matrix-cell`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if strings.Contains(body, `data-matrix-row="01"`) {
+		t.Error("row 01 has no data and must not be rendered")
+	}
+}
+
+func TestAnkietSubtableGet_DynamicCodes(t *testing.T) {
+	app := testApplication(t)
+	app.DBManager.yearCache(2030).DB.MustExec(`
+		INSERT INTO b_kody (kod, tytul) VALUES ('01', 'Pszenica'), ('02', 'Rzepak');
+		INSERT INTO b_kody__podtabele (kod, podtabela, lp) VALUES ('02', 'A', 1), ('01', 'A', 2);
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '{"_v":1,"data":[{"A_Kod":"01","A_Opis":"x"}]}');
+	`)
+
+	req := httptest.NewRequest(http.MethodGet, "/app/2030/bdgr/lista-ankiet/G1/T/A/", nil)
+	req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
+	w := httptest.NewRecorder()
+	app.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	first, second := strings.Index(body, `data-row-code="02"`), strings.Index(body, `data-row-code="01"`)
+	if first < 0 || second < 0 || first > second {
+		t.Errorf("row selector lacks the codes in lp order")
+	}
+	if !strings.Contains(body, `data-row-index="0" data-row-code="01"`) {
+		t.Errorf("stored row not rendered")
+	}
+}
+
+func TestValidateRowCodes(t *testing.T) {
+	allowed := map[string]bool{"01": true, "02": true}
+	data := `[{"A_Kod":"01","A_Opis":"x"},{"A_Kod":"07","A_Opis":"y"},{"A_Opis":"z"}]`
+
+	errs, err := ValidateRowCodes(HORIZONTAL_DYNAMIC_UNIQUE, allowed, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 2 || errs[0].Index != 1 || errs[0].Code != "07" || errs[1].Index != 2 || errs[0].Message != MSG_CODE_UNKNOWN {
+		t.Errorf("errors = %+v", errs)
+	}
+
+	if errs, _ := ValidateRowCodes(HORIZONTAL_DYNAMIC_UNIQUE, nil, data); errs != nil {
+		t.Errorf("no code list: %+v", errs)
+	}
+	if errs, _ := ValidateRowCodes(VERTICAL_STATIC_UNIQUE, allowed, `{"A_Kod":"07"}`); errs != nil {
+		t.Errorf("vertical table: %+v", errs)
+	}
+}
+
+func TestAnkietSubtablePost_UnknownCode(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+	db := app.DBManager.yearCache(2030).DB
+	db.MustExec(`
+		INSERT INTO b_kody (kod, tytul) VALUES ('01', 'Pszenica'), ('02', 'Rzepak');
+		INSERT INTO b_kody__podtabele (kod, podtabela, lp) VALUES ('01', 'A', 1), ('02', 'A', 2);
+	`)
+	cookie := sessionCookie(t, app, User{Login: "jan", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}})
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	stored := func() string {
+		dane, err := app.DaneSelectByIdGRAndSubtable(2030, "G1", "A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dane
+	}
+
+	if w := post("/app/2030/bdgr/lista-ankiet/G1/T/A/", `[{"A_Kod":"01","A_Opis":"x"}]`); w.Code != http.StatusOK {
+		t.Fatalf("valid code: %d %s", w.Code, w.Body.String())
+	}
+
+	w := post("/app/2030/bdgr/lista-ankiet/G1/T/A/", `[{"A_Kod":"01","A_Opis":"x"},{"A_Kod":"99","A_Opis":"y"}]`)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"code":"99"`) || !strings.Contains(w.Body.String(), MSG_CODE_UNKNOWN) {
+		t.Errorf("unknown code: %d %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(stored(), "99") {
+		t.Error("row with an unknown code was saved")
+	}
+
+	if w := post("/app/2030/bdgr/lista-ankiet/G1/T/A/99/0", `{"A_Opis":"y"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("row save with unknown code: %d %s", w.Code, w.Body.String())
+	}
+	if w := post("/app/2030/bdgr/lista-ankiet/G1/T/A/02/1", `{"A_Opis":"y"}`); w.Code != http.StatusOK {
+		t.Errorf("row save with valid code: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSubtableSchemaBuild(t *testing.T) {
+	app := testApplication(t)
+	db := app.DBManager.yearCache(2030).DB
+	db.MustExec(`
+		INSERT INTO b_kody (kod, tytul) VALUES ('01', 'Pszenica'), ('02', 'Rzepak');
+		INSERT INTO b_kody__podtabele (kod, podtabela, lp) VALUES ('01', 'A', 1), ('02', 'A', 2);
+		INSERT INTO b_blokady (podtabela, kolumna, kod) VALUES ('A', 'A_Opis', '02');
+	`)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx, err := app.Session.Load(req.Context(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(ctx)
+	user := User{Login: "jan", Role: UserNormal}
+
+	// summary writes a row as code:cells, # for a blocked cell, * after an editable one.
+	summary := func(rows []TableRow) []string {
+		var out []string
+		for _, row := range rows {
+			var cells []string
+			for _, cell := range row.Cells {
+				value := cell.Value
+				if cell.Blocked {
+					value = "#"
+				}
+				if cell.Editable == 1 {
+					value += "*"
+				}
+				cells = append(cells, value)
+			}
+			out = append(out, row.Code+":"+strings.Join(cells, "|"))
+		}
+		return out
+	}
+
+	tests := []struct {
+		tableType, dane string
+		rows            []string
+		codes           int
+	}{
+		{HORIZONTAL_DYNAMIC_UNIQUE, `[{"A_Kod":"02"},{"A_Kod":"01","A_Opis":"ozima"}]`, []string{"02:02|#", "01:01|ozima*"}, 2},
+		{HORIZONTAL_DYNAMIC_DUPLICABLE, `[{"A_Kod":"01","A_Opis":"a"},{"A_Kod":"01","A_Opis":"b"}]`, []string{"01:01|a*", "01:01|b*"}, 2},
+		{HORIZONTAL_STATIC_UNIQUE, `[{"A_Kod":"01","A_Opis":"ozima"}]`, []string{"01:01|ozima*", "02:02|#"}, 0},
+		{PKD_STATIC_UNIQUE, `[{"A_Kod":"01","A_Opis":"01.11"}]`, []string{"01:01|01.11*", "02:02|#"}, 0},
+		{VERTICAL_STATIC_UNIQUE, `{"A_Opis":"ozima"}`, []string{":", ":ozima*"}, 0},
+		{MATRIX_DYNAMIC_UNIQUE, `{"01":{"02":1.5}}`, []string{"01:1,5*"}, 2},
+	}
+	for _, tt := range tests {
+		db.MustExec("UPDATE b_podtabele SET schemat_tabeli = ? WHERE podtabela = 'A'", tt.tableType)
+		db.MustExec("DELETE FROM b_bdgrobmsp WHERE idgr = 'G1' AND podtabela = 'A'")
+		db.MustExec("INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', ?)", `{"_v":1,"data":`+tt.dane+`}`)
+
+		schema, err := app.SubtableSchemaBuild(req, 2030, "G1", "T", "A", 0, user)
+		if err != nil {
+			t.Errorf("%s: %v", tt.tableType, err)
+			continue
+		}
+		if schema.Type != tt.tableType || schema.IdGR != "G1" || schema.Year != "2030" || len(schema.Columns) != 2 {
+			t.Errorf("%s: schema %+v", tt.tableType, schema)
+		}
+		if got := summary(schema.Rows); !slices.Equal(got, tt.rows) {
+			t.Errorf("%s: rows %q, want %q", tt.tableType, got, tt.rows)
+		}
+		if len(schema.Codes) != tt.codes {
+			t.Errorf("%s: %d codes, want %d", tt.tableType, len(schema.Codes), tt.codes)
+		}
+
+		// Without a farm every type builds its empty grid.
+		empty, err := app.SubtableSchemaBuild(req, 2030, "", "T", "A", 0, user)
+		if err != nil {
+			t.Errorf("%s without a farm: %v", tt.tableType, err)
+		}
+		for _, row := range empty.Rows {
+			for _, cell := range row.Cells {
+				if cell.Value != "" && cell.Value != row.Code {
+					t.Errorf("%s without a farm shows %q", tt.tableType, cell.Value)
+				}
+			}
+		}
+	}
+
+	db.MustExec("UPDATE b_podtabele SET schemat_tabeli = 'PKD_STATIC_UNIQUE' WHERE podtabela = 'A'")
+	schema, _ := app.SubtableSchemaBuild(req, 2030, "G1", "T", "A", 0, user)
+	if lookup := schema.Rows[0].Cells[1].Lookup; lookup != AppURL("app", 2030, "slowniki", "pkd") {
+		t.Errorf("pkd lookup %q", lookup)
+	}
+
+	db.MustExec("UPDATE b_podtabele SET schemat_tabeli = 'NOWY_TYP' WHERE podtabela = 'A'")
+	schema, err = app.SubtableSchemaBuild(req, 2030, "G1", "T", "A", 0, user)
+	if !errors.Is(err, ErrTableTypeUnknown) || len(schema.Columns) != 2 {
+		t.Errorf("unknown type: %v with %d columns", err, len(schema.Columns))
+	}
+	if _, err := app.SubtableSchemaBuild(req, 2030, "G1", "T", "ZZ", 0, user); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("unknown subtable: %v", err)
+	}
+}
+
+func TestDefinitionsCopyPost(t *testing.T) {
+	app := testApplication(t)
+	app.DBManager.yearCache(2030).DB.MustExec(`
+		UPDATE b_kolumny SET przepisac_na = 'A_Opis2' WHERE kolumna = 'A_Opis';
+		INSERT INTO b_kody (kod, tytul) VALUES ('01', 'Pszenica');
+		INSERT INTO b_kody__podtabele (kod, podtabela, lp) VALUES ('01', 'A', 1);
+		INSERT INTO b_blokady (podtabela, kolumna, kod) VALUES ('A', 'A_Opis', '01');
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '[]');
+	`)
+	if err := app.DBManager.YearCreate(2031); err != nil {
+		t.Fatal(err)
+	}
+	target := app.DBManager.yearCache(2031).DB
+	router := app.Routes()
+
+	post := func(user User, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/app/2031/bdgr/metodyka/kopiuj", strings.NewReader(body))
+		req.AddCookie(sessionCookie(t, app, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	admin := User{Login: "admin", Role: UserAdmin}
+
+	w := post(admin, `{"zrodlo":2030,"przepisz":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("copy: %d %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Tabele []DefinitionsCopyResult `json:"tabele"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	copied := make(map[string]int)
+	for _, result := range body.Tabele {
+		copied[result.Tabela] = result.Wiersze
+	}
+	if copied["b_tabele"] != 1 || copied["b_kolumny"] != 2 || copied["b_kody__podtabele"] != 1 || copied["b_blokady"] != 1 {
+		t.Errorf("summary %v", body.Tabele)
+	}
+
+	var kolumny []string
+	if err := target.Select(&kolumny, "SELECT kolumna FROM b_kolumny WHERE przepisac_na = '' ORDER BY lp"); err != nil || !slices.Equal(kolumny, []string{"A_Kod", "A_Opis2"}) {
+		t.Errorf("renamed columns %v, %v", kolumny, err)
+	}
+	var blokada, typ string
+	if err := target.Get(&blokada, "SELECT kolumna FROM b_blokady"); err != nil || blokada != "A_Opis2" {
+		t.Errorf("block should follow the rename, got %q, %v", blokada, err)
+	}
+	if err := target.Get(&typ, "SELECT typeof(tytul) FROM b_tabele"); err != nil || typ != "text" {
+		t.Errorf("text copied as %q, %v", typ, err)
+	}
+	var answers int
+	if err := target.Get(&answers, "SELECT COUNT(*) FROM b_bdgrobmsp"); err != nil || answers != 0 {
+		t.Errorf("answers should stay in their year, got %d, %v", answers, err)
+	}
+
+	w = post(admin, `{"zrodlo":2030}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"b_kolumny"`) {
+		t.Errorf("copy over definitions: expected 409 listing them, got %d %s", w.Code, w.Body.String())
+	}
+	if w := post(admin, `{"zrodlo":2030,"wymus":true}`); w.Code != http.StatusOK {
+		t.Errorf("forced copy: %d %s", w.Code, w.Body.String())
+	}
+	var count int
+	if err := target.Get(&count, "SELECT COUNT(*) FROM b_kolumny"); err != nil || count != 3 {
+		t.Errorf("forced copy without renames should add A_Opis next to A_Opis2, got %d, %v", count, err)
+	}
+
+	// A successor that is already a column would be overwritten by the upsert.
+	app.DBManager.yearCache(2030).DB.MustExec(`UPDATE b_kolumny SET przepisac_na = 'A_Kod' WHERE kolumna = 'A_Opis'`)
+	if w := post(admin, `{"zrodlo":2030,"przepisz":true,"wymus":true}`); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "A_Opis") {
+		t.Errorf("rename onto an existing column: expected 409, got %d %s", w.Code, w.Body.String())
+	}
+	if w := post(admin, `{"zrodlo":2029}`); w.Code != http.StatusNotFound {
+		t.Errorf("unknown source: %d", w.Code)
+	}
+	if w := post(admin, `{"zrodlo":2031}`); w.Code != http.StatusBadRequest {
+		t.Errorf("same year: %d", w.Code)
+	}
+	if w := post(User{Login: "jan", Role: UserNormal}, `{"zrodlo":2030}`); w.Code != http.StatusForbidden {
+		t.Errorf("non-admin: %d", w.Code)
+	}
+}
+
+func TestPrzepisacNaApply(t *testing.T) {
+	kolumny := func(rows ...[2]string) map[string][]map[string]any {
+		tables := map[string][]map[string]any{}
+		for _, row := range rows {
+			tables["b_kolumny"] = append(tables["b_kolumny"], map[string]any{"kolumna": row[0], "przepisac_na": row[1]})
+		}
+		return tables
+	}
+
+	// A chain is fine: B is free once it moves on to C.
+	tables := kolumny([2]string{"A", "B"}, [2]string{"B", "C"})
+	if err := PrzepisacNaApply(tables); err != nil || tables["b_kolumny"][0]["kolumna"] != "B" || tables["b_kolumny"][1]["kolumna"] != "C" {
+		t.Errorf("chain: %v %v", tables, err)
+	}
+
+	for name, tables := range map[string]map[string][]map[string]any{
+		"existing": kolumny([2]string{"A", "B"}, [2]string{"B", ""}),
+		"twice":    kolumny([2]string{"A", "C"}, [2]string{"B", "C"}),
+	} {
+		if err := PrzepisacNaApply(tables); !errors.Is(err, ErrPrzepisacNaConflict) {
+			t.Errorf("%s: expected a conflict, got %v", name, err)
+		}
+		if tables["b_kolumny"][0]["kolumna"] != "A" {
+			t.Errorf("%s: renamed despite the conflict", name)
+		}
+	}
+}
+
+func TestMetodykaSchemaGet(t *testing.T) {
+	app := testApplication(t)
+	app.DBManager.yearCache(2030).DB.MustExec(`
+		INSERT INTO b_kody (kod, tytul) VALUES ('01', 'Pszenica'), ('02', 'Rzepak');
+		INSERT INTO b_kody__podtabele (kod, podtabela, lp) VALUES ('02', 'A', 1), ('01', 'A', 2);
+		INSERT INTO b_blokady (podtabela, kolumna, kod, opis) VALUES ('A', 'A_Opis', '02', 'bez opisu');
+	`)
+	router := app.Routes()
+
+	get := func(user User, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.AddCookie(sessionCookie(t, app, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(User{Login: "admin", Role: UserAdmin}, "/app/2030/bdgr/metodyka/schema/A")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	var got SubtableIntrospection
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Table != "T" || got.Type != HORIZONTAL_DYNAMIC_UNIQUE || !got.Supported || !got.Compactable {
+		t.Errorf("subtable: %+v", got)
+	}
+	if len(got.Columns) != 2 || got.Columns[0].Name != "A_Kod" || got.Columns[1].Name != "A_Opis" {
+		t.Errorf("columns: %+v", got.Columns)
+	}
+	if len(got.Codes) != 2 || got.Codes[0].Code != "02" || got.Codes[0].Lp == nil || *got.Codes[0].Lp != 1 {
+		t.Errorf("codes, want lp order: %+v", got.Codes)
+	}
+	if len(got.Blocks) != 1 || got.Blocks[0] != (SubtableIntrospectionBlock{Column: "A_Opis", Code: "02", Opis: "bez opisu"}) {
+		t.Errorf("blocks: %+v", got.Blocks)
+	}
+
+	if w := get(User{Login: "admin", Role: UserAdmin}, "/app/2030/bdgr/metodyka/schema/ZZ"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown subtable: expected 404, got %d", w.Code)
+	}
+	if w := get(User{Login: "zbr", Role: UserMethodolgist}, "/app/2030/bdgr/metodyka/schema/A"); w.Code != http.StatusForbidden {
+		t.Errorf("methodologist: expected 403, got %d", w.Code)
+	}
+}
+
+func TestMetodykaPreviewGet(t *testing.T) {
+	app := testApplication(t)
+	app.DBManager.yearCache(2030).DB.MustExec(`
+		UPDATE b_podtabele SET schemat_tabeli = 'HORIZONTAL_STATIC_UNIQUE' WHERE podtabela = 'A';
+		UPDATE b_jm SET typ_jm = 'str' WHERE jm = 'txt';
+		INSERT INTO b_kody (kod, tytul) VALUES ('01', 'Pszenica'), ('02', 'Rzepak');
+		INSERT INTO b_kody__podtabele (kod, podtabela, lp) VALUES ('01', 'A', 1), ('02', 'A', 2);
+		INSERT INTO b_blokady (podtabela, kolumna, kod) VALUES ('A', 'A_Opis', '02');
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '{"_v":1,"data":[{"A_Kod":"01","A_Opis":"ozima"}]}');
+	`)
+	router := app.Routes()
+
+	get := func(user User, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.AddCookie(sessionCookie(t, app, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(User{Login: "admin", Role: UserAdmin}, "/app/2030/bdgr/metodyka/preview/T/A")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{`data-table-type="HORIZONTAL_STATIC_UNIQUE"`, "Pszenica", "Rzepak", `value="02"`, `name="A_Opis"`, "data-preview"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("preview lacks %s", want)
+		}
+	}
+	if strings.Contains(body, "ozima") {
+		t.Error("preview shows a farm's answers")
+	}
+	if strings.Contains(body, "data-endpoint") {
+		t.Error("preview has a save endpoint")
+	}
+	if strings.Count(body, `name="A_Opis"`) != 1 {
+		t.Error("blocked cell of row 02 rendered as an input")
+	}
+
+	if w := get(User{Login: "admin", Role: UserAdmin}, "/app/2030/bdgr/metodyka/preview/T/ZZ"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown subtable: expected 404, got %d", w.Code)
+	}
+	if w := get(User{Login: "jan", Role: UserNormal}, "/app/2030/bdgr/metodyka/preview/T/A"); w.Code != http.StatusForbidden {
+		t.Errorf("normal user: expected 403, got %d", w.Code)
+	}
+}
+
+func TestAnkietSubtableGet_DynamicRows(t *testing.T) {
+	app := testApplication(t)
+	app.DBManager.yearCache(2030).DB.MustExec(`
+		UPDATE b_podtabele SET schemat_tabeli = 'HORIZONTAL_DYNAMIC_DUPLICABLE' WHERE podtabela = 'A';
+		UPDATE b_jm SET typ_jm = 'str' WHERE jm = 'txt';
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm) VALUES ('A_Wyszczegolnienie', 'A', 'Nazwa', 3, 'txt');
+		INSERT INTO b_kody (kod, tytul) VALUES ('01', 'Pszenica'), ('02', 'Rzepak');
+		INSERT INTO b_kody__podtabele (kod, podtabela, lp) VALUES ('01', 'A', 1), ('02', 'A', 2);
+		INSERT INTO b_blokady (podtabela, kolumna, kod) VALUES ('A', 'A_Opis', '02');
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '{"_v":1,"data":[
+			{"A_Kod":"01","A_Opis":"ozima"},
+			{"A_Opis":"bez kodu"},
+			{"A_Kod":"02","A_Opis":"zablokowany"},
+			{"A_Kod":"01","A_Opis":"jara","A_Wyszczegolnienie":"Pszenica jara"}
+		]}');
+	`)
+
+	req := httptest.NewRequest(http.MethodGet, "/app/2030/bdgr/lista-ankiet/G1/T/A/", nil)
+	req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
+	w := httptest.NewRecorder()
+	app.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+
+	// Indexes follow the stored array, so the entry without a code leaves a gap.
+	for _, want := range []string{
+		`data-row-index="0" data-row-code="01"`,
+		`data-row-index="2" data-row-code="02"`,
+		`data-row-index="3" data-row-code="01"`,
+		`value="ozima"`,
+		`value="jara"`,
+		`value="Pszenica"`,
+		`value="Pszenica jara"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("dynamic grid lacks %s", want)
+		}
+	}
+	if strings.Contains(body, `data-row-index="1"`) || strings.Contains(body, "bez kodu") {
+		t.Error("entry without a code was rendered")
+	}
+	if strings.Contains(body, `value="zablokowany"`) {
+		t.Error("blocked cell rendered as an input")
+	}
+
+	// A row added afterwards is still built by AnkietRowGet, empty.
+	req = httptest.NewRequest(http.MethodGet, "/app/2030/bdgr/lista-ankiet/G1/T/A/02/4", nil)
+	req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
+	w = httptest.NewRecorder()
+	app.Routes().ServeHTTP(w, req)
+	row := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(row, `data-row-index="4" data-row-code="02"`) || !strings.Contains(row, `value="Rzepak"`) {
+		t.Errorf("added row: %d %s", w.Code, row)
+	}
+	if strings.Contains(row, `name="A_Opis"`) {
+		t.Error("blocked cell of an added row rendered as an input")
+	}
+}
+
+func TestAnkietSubtableGet_UnhandledType(t *testing.T) {
+	app := testApplication(t)
+	app.DBManager.yearCache(2030).DB.MustExec(`
+		INSERT INTO b_podtabele (podtabela, tabela, schemat_tabeli, tytul, lp) VALUES ('X', 'T', 'NO_SUCH_SCHEMA', 'X', 2);
+	`)
+
+	req := httptest.NewRequest(http.MethodGet, "/app/2030/bdgr/lista-ankiet/G1/T/X/", nil)
+	req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
+	w := httptest.NewRecorder()
+	app.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("expected 501, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Nieznany typ tabeli") {
+		t.Error("page lacks the unknown table type notice")
+	}
+}
+
+func TestAnkietSubtableGet_PKD(t *testing.T) {
+	app := testApplication(t)
+	app.DBManager.yearCache(2030).DB.MustExec(`
+		INSERT INTO b_podtabele (podtabela, tabela, schemat_tabeli, tytul, lp) VALUES ('P', 'T', 'PKD_STATIC_UNIQUE', 'P', 2);
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm) VALUES ('P_Kod', 'P', 'Kod', 1, 'txt');
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm) VALUES ('P_Pkd', 'P', 'PKD', 2, 'txt');
+		INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm) VALUES ('P_Uwagi', 'P', 'Uwagi', 3, 'txt');
+		INSERT INTO b_kody (kod, tytul) VALUES ('01', 'Działalność główna');
+		INSERT INTO b_kody__podtabele (kod, podtabela, lp) VALUES ('01', 'P', 1);
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'P', '[{"P_Kod":"01","P_Pkd":"01.11.Z"}]');
+		INSERT INTO pkd_pkd (kod, opis) VALUES ('01.11.Z', 'Uprawa zbóż'), ('01.13.Z', 'Uprawa warzyw'), ('10.11.Z', 'Przetwarzanie mięsa');
+		INSERT INTO teryt_teryt (nrwpgr, wojewodztwo, powiat, gmina, rodzaj_gminy) VALUES ('1465011', 'mazowieckie', 'Warszawa', 'Warszawa', '1');
+		INSERT INTO teryt_simc (simc, miejscowosc, nrwpgr) VALUES ('0918123', 'Warszawa', '1465011');
+	`)
+	router := app.Routes()
+	cookie := sessionCookie(t, app, User{Login: "admin", Role: UserAdmin})
+
+	req := httptest.NewRequest(http.MethodGet, "/app/2030/bdgr/lista-ankiet/G1/T/P/", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{`data-table-type="PKD_STATIC_UNIQUE"`, `data-lookup-url="/app/2030/slowniki/pkd"`, `value="01.11.Z"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if strings.Count(body, "data-lookup-url") != 1 {
+		t.Error("only the first value column autocompletes")
+	}
+
+	lookup := func(path string) []LookupOption {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, w.Code)
+		}
+		var options []LookupOption
+		if err := json.Unmarshal(w.Body.Bytes(), &options); err != nil {
+			t.Fatal(err)
+		}
+		return options
+	}
+	if got := lookup("/app/2030/slowniki/pkd?q=01.1"); len(got) != 2 || got[0].Value != "01.11.Z" {
+		t.Errorf("pkd by code: %+v", got)
+	}
+	if got := lookup("/app/2030/slowniki/pkd?q=mięs"); len(got) != 1 || got[0].Value != "10.11.Z" {
+		t.Errorf("pkd by description: %+v", got)
+	}
+	if got := lookup("/app/2030/slowniki/simc?q=Warsz"); len(got) != 1 || got[0].Label != "Warszawa (gm. Warszawa, pow. Warszawa)" {
+		t.Errorf("simc: %+v", got)
+	}
+	if got := lookup("/app/2030/slowniki/simc?q="); len(got) != 0 {
+		t.Errorf("empty query: %+v", got)
+	}
+}
+
+func TestSqlCheckDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, schema := range map[string]string{
+		"master.db": TEST_MASTER_SCHEMA,
+		"2030.db":   sql_year_schema,
+		"2031.db":   sql_year_schema + "DROP TABLE b_zalaczniki;",
+	} {
+		db := sqlx.MustOpen(SQLITE_DRIVER, filepath.Join(dir, name))
+		db.MustExec(schema)
+		if name == "master.db" {
+			if _, err := MigrationsApply(db, MIGRATIONS_MASTER); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+	}
+
+	var out bytes.Buffer
+	failed, err := SqlCheckDir(dir, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed == 0 {
+		t.Fatalf("expected failures for the year without b_zalaczniki, got none")
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if !strings.Contains(line, "2031.db: sql_year/b_zalaczniki_") {
+			t.Errorf("unexpected failure line %q", line)
+		}
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != failed {
+		t.Errorf("printed %d lines for %d failures", lines, failed)
+	}
+}
+
+func TestSqlTiming(t *testing.T) {
+	app := testApplication(t)
+	var out bytes.Buffer
+	timing := &SqlTiming{Logger: slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	cache := app.DBManager.yearCache(2030)
+	cache.Timing = timing
+
+	query := func() {
+		var etap string
+		if err := app.DBManager.YQueryRowx(2030, "b_statusy_select_etap_where_idgr", "G1").Scan(&etap); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query()
+	if out.Len() != 0 {
+		t.Errorf("logged with no threshold: %s", out.String())
+	}
+
+	timing.Threshold = time.Nanosecond
+	query()
+	if log := out.String(); !strings.Contains(log, "slow query") || !strings.Contains(log, "query=b_statusy_select_etap_where_idgr") {
+		t.Errorf("slow query not logged: %s", log)
+	}
+
+	out.Reset()
+	timing.Threshold = time.Hour
+	query()
+	if out.Len() != 0 {
+		t.Errorf("logged a query under the threshold: %s", out.String())
+	}
+}
+
+func TestSqlRetry_Locked(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "2030.db") + "?_busy_timeout=0&_journal_mode=WAL"
+	db := sqlx.MustOpen("sqlite3", dsn)
+	db.MustExec(sql_year_schema + "INSERT INTO b_statusy (idgr) VALUES ('G1');")
+	m := &DBManager{yearCacheMap: make(map[YearDB]*SqlCache)}
+	if err := m.AddYear(2030, db); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Disconnect()
+
+	locker := sqlx.MustOpen("sqlite3", dsn)
+	defer locker.Close()
+	lock, err := locker.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Rollback()
+	lock.MustExec("INSERT INTO b_statusy (idgr) VALUES ('G2')")
+
+	runs := 0
+	save := func() error {
+		return m.YTx(2030, func(tx *SqlTx) error {
+			runs++
+			_, err := tx.Exec("b_bdgrobmsp_dane_replace", "G1", "A", `{"_v":1,"data":[]}`)
+			return err
+		})
+	}
+
+	if err := save(); !SqlBusy(err) || runs != 1 {
+		t.Fatalf("without retries: got %v after %d runs, want one busy error", err, runs)
+	}
+
+	runs = 0
+	m.Retry = SqlRetry{Attempts: 8, Backoff: 10 * time.Millisecond}
+	time.AfterFunc(50*time.Millisecond, func() { lock.Commit() })
+	if err := save(); err != nil {
+		t.Fatalf("with retries: %v", err)
+	}
+	if runs < 2 {
+		t.Errorf("saved in %d runs, the lock was never hit", runs)
+	}
+
+	runs = 0
+	other := errors.New("constraint")
+	if err := m.Retry.Do(func() error { runs++; return other }); err != other || runs != 1 {
+		t.Errorf("other errors are not retried: got %v after %d runs", err, runs)
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	app := testApplication(t)
+	var out bytes.Buffer
+	app.Logger = slog.New(slog.NewTextHandler(&out, nil))
+	router := app.Routes()
+
+	req := httptest.NewRequest("GET", "/app/", nil)
+	req.Header.Set("X-Request-Id", "proxy-42")
+	req.AddCookie(sessionCookie(t, app, User{Login: "admin", Role: UserAdmin}))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if got := w.Header().Get("X-Request-Id"); got != "proxy-42" {
+		t.Errorf("X-Request-Id = %q, want the proxy's", got)
+	}
+	if !strings.Contains(out.String(), "request_id=proxy-42 user=admin") {
+		t.Errorf("request log lacks request id and user:\n%s", out.String())
+	}
+
+	// A header that could forge log fields is replaced, and without a session
+	// there's no user to add.
+	out.Reset()
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "x user=admin")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	id := w.Header().Get("X-Request-Id")
+	if id == "" || strings.Contains(id, " ") {
+		t.Errorf("X-Request-Id = %q, want a generated one", id)
+	}
+	if !strings.Contains(out.String(), "request_id="+id) || strings.Contains(out.String(), "user=") {
+		t.Errorf("anonymous request log:\n%s", out.String())
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	allowed := []string{"ankiety.example.pl", "localhost", "::1"}
+	for host, want := range map[string]bool{
+		"ankiety.example.pl":      true,
+		"ANKIETY.example.pl:8082": true,
+		"ankiety.example.pl.":     true,
+		"localhost:8082":          true,
+		"[::1]:8082":              true,
+		"evil.example.com":        false,
+		"ankiety.example.pl.evil": false,
+		"":                        false,
+	} {
+		if got := HostAllowed(host, allowed); got != want {
+			t.Errorf("HostAllowed(%q) = %v, want %v", host, got, want)
+		}
+	}
+	if !HostAllowed("anything", []string{"*"}) {
+		t.Errorf("* should allow any host")
+	}
+}
+
+func TestMiddleAllowedHosts(t *testing.T) {
+	app := testApplication(t)
+	app.AllowedHosts = []string{"ankiety.example.pl"}
+	router := app.Routes()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "ankiety.example.pl:8082"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("allowed host: status %d, want 200", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Host = "evil.example.com"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("disallowed host: status %d, want 400", w.Code)
+	}
+}
+
+func TestFlagStrings(t *testing.T) {
+	var hosts FlagStrings
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Var(&hosts, "allowed-host", "")
+	if err := flags.Parse([]string{"-allowed-host", "a.pl", "-allowed-host", "b.pl, c.pl"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.pl", "b.pl", "c.pl"}; !slices.Equal(hosts, want) {
+		t.Errorf("hosts = %v, want %v", hosts, want)
+	}
+}
+
+func TestConfigParse(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+	cfg, err := ConfigParse(flag.NewFlagSet("test", flag.ContinueOnError), nil, noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":8082" || cfg.SessionIdleTimeout != 30*time.Minute || !slices.Equal(cfg.AllowedHosts, ALLOWED_HOSTS_DEV) {
+		t.Errorf("defaults: %+v", cfg)
+	}
+
+	cfg, err = ConfigParse(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-addr", ":9000", "-db", "dane/", "-allowed-host", "a.pl", "-busy-retries", "5",
+		"-session-idle-timeout", "1h", "-debug=false", "-log-level", "warn",
+	}, noEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":9000" || cfg.DBDir != "dane/" || cfg.BusyRetries != 5 || cfg.SessionIdleTimeout != time.Hour || cfg.Debug || cfg.LogLevel != slog.LevelWarn {
+		t.Errorf("parsed: %+v", cfg)
+	}
+	if !slices.Equal(cfg.AllowedHosts, []string{"a.pl"}) {
+		t.Errorf("allowed hosts = %v", cfg.AllowedHosts)
+	}
+	if cfg.ReadTimeout != 5*time.Second {
+		t.Errorf("unset flag lost its default: read timeout %v", cfg.ReadTimeout)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if _, err := ConfigParse(fs, []string{"-no-such-flag"}, noEnv); err == nil {
+		t.Error("unknown flag: expected error")
+	}
+}
+
+func TestConfigParse_Env(t *testing.T) {
+	env := map[string]string{
+		"ANKIETY_ADDR":          ":7000",
+		"ANKIETY_DB":            "env-db/",
+		"ANKIETY_LOG_LEVEL":     "error",
+		"ANKIETY_ALLOWED_HOST":  "env.pl, www.env.pl",
+		"ANKIETY_MAX_IN_FLIGHT": "8",
+	}
+	lookup := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+
+	// defaults < env < flags
+	cfg, err := ConfigParse(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-addr", ":9000", "-allowed-host", "flag.pl"}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":9000" {
+		t.Errorf("flag should beat env: addr %q", cfg.Addr)
+	}
+	if cfg.DBDir != "env-db/" || cfg.LogLevel != slog.LevelError || cfg.MaxInFlight != 8 {
+		t.Errorf("env should beat defaults: %+v", cfg)
+	}
+	if !slices.Equal(cfg.AllowedHosts, []string{"flag.pl"}) {
+		t.Errorf("allowed hosts = %v, want only the flag's", cfg.AllowedHosts)
+	}
+	if cfg.ReadTimeout != 5*time.Second {
+		t.Errorf("read timeout %v, want the default", cfg.ReadTimeout)
+	}
+
+	cfg, err = ConfigParse(flag.NewFlagSet("test", flag.ContinueOnError), nil, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cfg.AllowedHosts, []string{"env.pl", "www.env.pl"}) {
+		t.Errorf("allowed hosts = %v, want the env's", cfg.AllowedHosts)
+	}
+
+	env["ANKIETY_BUSY_RETRIES"] = "trzy"
+	if _, err := ConfigParse(flag.NewFlagSet("test", flag.ContinueOnError), nil, lookup); err == nil || !strings.Contains(err.Error(), "ANKIETY_BUSY_RETRIES") {
+		t.Errorf("bad env value: error %v, want it to name the variable", err)
+	}
+}
+
+func TestConfigAttrs_Redacted(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg := ConfigDefault()
+	ConfigFlags(fs, &cfg)
+	fs.String("smtp-password", "tajne", "")
+
+	var out bytes.Buffer
+	logger := slog.New(RedactHandlerNew(slog.NewTextHandler(&out, nil)))
+	logger.Info("config", slog.Group("flags", ConfigAttrs(fs)...))
+	if !strings.Contains(out.String(), "flags.addr=:8082") {
+		t.Errorf("effective value missing: %s", out.String())
+	}
+	if strings.Contains(out.String(), "tajne") {
+		t.Errorf("secret logged: %s", out.String())
+	}
+}
+
+func TestSetupApplication_ConfigInvalid(t *testing.T) {
+	dir := t.TempDir() + "/"
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"charset", Config{DBDir: dir, BodyCharset: "latin-1"}, "-body-charset"},
+		{"max rows", Config{DBDir: dir, MaxRows: "A=x"}, "A"},
+		{"static dir", Config{DBDir: dir, StaticDir: dir + "brak"}, "-static-dir"},
+		{"backup dir", Config{DBDir: dir, BackupDir: dir}, "-backup-dir"},
+		{"cors wildcard credentials", Config{DBDir: dir, CORSOrigins: "https://a.example, *", CORSCredentials: true}, "-cors-credentials"},
+		{"tls cert only", Config{DBDir: dir, TLSCert: dir + "cert.pem"}, "-tls-key"},
+		{"tls key only", Config{DBDir: dir, TLSKey: dir + "key.pem"}, "-tls-key"},
+		{"ldap no groups", Config{DBDir: dir, LDAPURL: "ldap://x", LDAPBindDN: "uid=%s,dc=x"}, "-ldap-groups"},
+		{"ldap bad group", Config{DBDir: dir, LDAPURL: "ldap://x", LDAPBindDN: "uid=%s,dc=x", LDAPGroups: "ankiety=Boss"}, "-ldap-groups"},
+		{"ldap bind dn", Config{DBDir: dir, LDAPURL: "ldap://x", LDAPBindDN: "uid=jan,dc=x", LDAPGroups: "ankiety=PBR"}, "-ldap-bind-dn"},
+		{"features", Config{DBDir: dir, Features: "raporty=false"}, "-features"},
+		// With ldap off its settings aren't checked; setup gets as far as the databases.
+		{"ldap off", Config{DBDir: dir, LDAPURL: "ldap://x", Features: "ldap=false"}, "master database"},
+	}
+	for _, tt := range tests {
+		_, err := setupApplication(tt.cfg)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want it to mention %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestFeaturesParse(t *testing.T) {
+	features, err := FeaturesParse(" api=false, exports=true ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features[FEATURE_API] || !features[FEATURE_EXPORTS] || !features[FEATURE_LDAP] {
+		t.Errorf("features %v", features)
+	}
+	for _, value := range []string{"api", "api=nie", "raporty=false"} {
+		if _, err := FeaturesParse(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestRoutes_FeatureDisabled(t *testing.T) {
+	app := testApplication(t)
+	admin := User{Login: "admin", Role: UserAdmin}
+	paths := []string{
+		"/app/2030/bdgr/lista-ankiet/G1/export",
+		"/app/2030/bdgr/lista-ankiet/G1/export.json",
+		"/app/2030/audyt",
+		"/api/2030/bdgr/lista-ankiet/G1/progress.json",
+	}
+
+	for _, disabled := range []bool{false, true} {
+		if disabled {
+			app.Features = map[string]bool{FEATURE_API: false, FEATURE_EXPORTS: false}
+		}
+		router := app.Routes()
+		for _, path := range paths {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.AddCookie(sessionCookie(t, app, admin))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if disabled && w.Code != http.StatusNotFound {
+				t.Errorf("%s with the feature off: got %d, want 404", path, w.Code)
+			}
+			if !disabled && w.Code != http.StatusOK {
+				t.Errorf("%s: got %d, want 200", path, w.Code)
+			}
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/app/config.json", nil)
+	req.AddCookie(sessionCookie(t, app, admin))
+	w := httptest.NewRecorder()
+	app.Routes().ServeHTTP(w, req)
+	if body := w.Body.String(); !strings.Contains(body, `"exports":false`) || !strings.Contains(body, `"ldap":true`) {
+		t.Errorf("config.json features: %s", body)
+	}
+}
+
+func TestChooserJSONGet(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+
+	get := func(path string, user User) ChooserJSON {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(sessionCookie(t, app, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, w.Code)
+		}
+		var chooser ChooserJSON
+		if err := json.Unmarshal(w.Body.Bytes(), &chooser); err != nil {
+			t.Fatal(err)
+		}
+		return chooser
+	}
+
+	admin := User{Login: "admin", Role: UserAdmin}
+	years := get("/app/years.json", admin)
+	if len(years.Years) != 1 || years.Years[0].Year != "2030" || years.Modules != nil {
+		t.Errorf("years.json = %+v", years)
+	}
+
+	year := get("/app/2030/modules.json", admin)
+	if year.Year != "2030" || len(year.Modules) != 2 || year.Modules[1].URL != "/app/2030/bdgr/metodyka/" {
+		t.Errorf("admin modules.json = %+v", year)
+	}
+
+	// The worker doesn't get Metodyka, same as in the HTML chooser.
+	worker := User{Login: "jan", Role: UserNormal}
+	year = get("/app/2030/modules.json", worker)
+	if len(year.Modules) != 1 || year.Modules[0].Code != "lista-ankiet" {
+		t.Errorf("worker modules.json = %+v", year.Modules)
+	}
+
+	req := httptest.NewRequest("GET", "/app/2030/", nil)
+	req.AddCookie(sessionCookie(t, app, worker))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if body := w.Body.String(); !strings.Contains(body, `href="/app/2030/bdgr/lista-ankiet/"`) || strings.Contains(body, "· Metodyka") {
+		t.Errorf("HTML chooser modules differ from JSON")
+	}
+}
+
+func TestNotApplicable(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+	cookie := sessionCookie(t, app, User{Login: "admin", Role: UserAdmin})
+	app.DBManager.yearCache(2030).DB.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '{"_v":1,"data":[{"A_Kod":"1","A_Opis":""}]}')`)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	progress := func() SubtableProgress {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/app/2030/bdgr/lista-ankiet/G1/progress.json", nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var items []SubtableProgress
+		if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil || len(items) != 1 {
+			t.Fatalf("progress: %s", w.Body.String())
+		}
+		return items[0]
+	}
+	const url = "/app/2030/bdgr/lista-ankiet/G1/T/A/nie-dotyczy"
+	const missing = `[{"A_Kod":"1","A_Opis":""}]`
+
+	if item := progress(); item.Complete || item.NotApplicable {
+		t.Fatalf("before marking: %+v", item)
+	}
+	if w := post(url, `{"nie_dotyczy":true,"powod":"  "}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("mark without reason: status %d", w.Code)
+	}
+
+	if w := post(url, `{"nie_dotyczy":true,"powod":"Brak  działalności"}`); w.Code != http.StatusOK {
+		t.Fatalf("mark: status %d %s", w.Code, w.Body.String())
+	}
+	var mark BNieDotyczy
+	app.DBManager.yearCache(2030).DB.Get(&mark, `SELECT * FROM b_nie_dotyczy`)
+	if mark.Powod != "Brak działalności" || mark.Login != "admin" {
+		t.Errorf("stored mark %+v", mark)
+	}
+	if item := progress(); !item.Complete || !item.NotApplicable || !item.HasData {
+		t.Errorf("marked: %+v", item)
+	}
+	if w := post("/app/2030/bdgr/lista-ankiet/G1/T/A/validate", missing); w.Code != http.StatusOK {
+		t.Errorf("validate while marked: status %d %s", w.Code, w.Body.String())
+	}
+	reports, err := app.IntegrityCheck(2030)
+	if err != nil || len(reports) != 0 {
+		t.Errorf("integrity while marked: %+v %v", reports, err)
+	}
+
+	req := httptest.NewRequest("GET", "/app/2030/bdgr/lista-ankiet/G1/T/A/", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "data-not-applicable-check checked") || !strings.Contains(body, `value="Brak działalności"`) {
+		t.Errorf("grid does not show the mark")
+	}
+
+	if w := post(url, `{"nie_dotyczy":false}`); w.Code != http.StatusOK {
+		t.Fatalf("unmark: status %d", w.Code)
+	}
+	if item := progress(); item.Complete || item.NotApplicable {
+		t.Errorf("unmarked: %+v", item)
+	}
+	if w := post("/app/2030/bdgr/lista-ankiet/G1/T/A/validate", missing); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("validate after unmarking: status %d", w.Code)
+	}
+
+	// On a locked year only an admin may still change the mark.
+	app.DBManager.MasterCache.DB.MustExec("UPDATE lata SET zablokowany = 1 WHERE rok = 2030")
+	req = httptest.NewRequest("POST", url, strings.NewReader(`{"nie_dotyczy":true,"powod":"x"}`))
+	req.AddCookie(sessionCookie(t, app, User{Login: "jan", Role: UserNormal, IdGR: map[YearDB][]string{2030: {"G1"}}}))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "zablokowany") {
+		t.Errorf("locked year: expected 403 JSON, got %d %s", w.Code, w.Body.String())
+	}
+	if w := post(url, `{"nie_dotyczy":true,"powod":"x"}`); w.Code != http.StatusOK {
+		t.Errorf("locked year as admin: status %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPodtabeleWithDataSelect(t *testing.T) {
+	app := corsTestApplication()
+	app.DBManager = NewDBManagerForTest(map[YearDB]string{2030: ""})
+	defer app.DBManager.Disconnect()
+	app.DBManager.yearCache(2030).DB.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES
+		('G1', 'A', '{"_v":1,"data":[{"A_Kod":"1"}]}'),
+		('G1', 'B', '{"_v":1,"data":[]}'),
+		('G1', 'C', '{"_v":1,"data":{},"notes":"brak"}'),
+		('G1', 'D', '[]'),
+		('G2', 'E', '[{"E_Kod":"1"}]')`)
+
+	got, err := app.PodtabeleWithDataSelect(2030, "G1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"A": true, "B": false, "C": true, "D": false}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestColumnsCompact(t *testing.T) {
+	columns := []TableColumn{
+		{Name: "A_Kod", Lp: 9},
+		{Name: "A_Opis", Lp: 1, Width: 300},
+		{Name: "A_Ilosc", Lp: 2},
+		{Name: "A_Uwagi", Lp: 3, Width: 500},
+	}
+	if got := ColumnsWidth(columns); got != 140+300+140+500 {
+		t.Errorf("ColumnsWidth = %d", got)
+	}
+
+	kept, hidden := ColumnsCompact(columns, 2)
+	var names []string
+	for _, column := range kept {
+		names = append(names, column.Name)
+	}
+	if !slices.Equal(names, []string{"A_Kod", "A_Opis", "A_Ilosc"}) || !slices.Equal(hidden, []string{"A_Uwagi"}) {
+		t.Errorf("kept %v, hidden %v", names, hidden)
+	}
+
+	stored := `[{"A_Kod":"1","A_Uwagi":"a"},{"A_Kod":"1","A_Uwagi":"b"},{"A_Kod":"2","A_Uwagi":"c"}]`
+	payload := `[{"A_Kod":"2","A_Ilosc":5},{"A_Kod":"1","A_Ilosc":6},{"A_Kod":"1","A_Ilosc":7},{"A_Kod":"3"}]`
+	merged, err := HiddenColumnsRestore(stored, payload, hidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"A_Ilosc":5,"A_Kod":"2","A_Uwagi":"c"},{"A_Ilosc":6,"A_Kod":"1","A_Uwagi":"a"},{"A_Ilosc":7,"A_Kod":"1","A_Uwagi":"b"},{"A_Kod":"3"}]`
+	if merged != want {
+		t.Errorf("merged\n%s\nwant\n%s", merged, want)
+	}
+}
+
+func TestAnkietSubtable_Compact(t *testing.T) {
+	app := testApplication(t)
+	app.WideTableWidth = 200
+	app.CompactColumns = 1
+	router := app.Routes()
+	cookie := sessionCookie(t, app, User{Login: "admin", Role: UserAdmin})
+	db := app.DBManager.yearCache(2030).DB
+	db.MustExec(`INSERT INTO b_kolumny (kolumna, podtabela, tytul, lp, jm, wymagana) VALUES ('A_Uwagi', 'A', 'Uwagi', 3, 'txt', 0)`)
+	db.MustExec(`INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '{"_v":1,"data":[{"A_Kod":"1","A_Opis":"x","A_Uwagi":"zostaje"}]}')`)
+
+	get := func(path string) string {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	if body := get("/app/2030/bdgr/lista-ankiet/G1/T/A/"); !strings.Contains(body, `href="?compact=1"`) {
+		t.Errorf("wide table notice missing")
+	}
+	body := get("/app/2030/bdgr/lista-ankiet/G1/T/A/?compact=2")
+	if !strings.Contains(body, `data-compact="2"`) || strings.Contains(body, "grid-template-columns: 80px 140px 140px 140px") {
+		t.Errorf("compact view still renders the hidden column")
+	}
+
+	req := httptest.NewRequest("POST", "/app/2030/bdgr/lista-ankiet/G1/T/A/?compact=2", strings.NewReader(`[{"A_Kod":"1","A_Opis":"y"}]`))
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("compact save: status %d %s", w.Code, w.Body.String())
+	}
+	data, err := app.DaneSelectByIdGRAndSubtable(2030, "G1", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(data, `"A_Uwagi":"zostaje"`) || !strings.Contains(data, `"A_Opis":"y"`) {
+		t.Errorf("compact save lost the hidden column: %s", data)
+	}
+}
+
+func TestColumnsBuildFromKolumny_Order(t *testing.T) {
+	kolumny := []BKolumny{
+		{Name: "A_C", Lp: 3},
+		{Name: "A_B", Lp: 1},
+		{Name: "A_A", Lp: 1},
+		{Name: "A_D", Lp: 2},
+	}
+	want := []string{"A_A", "A_B", "A_D", "A_C"}
+	for range 3 {
+		var names []string
+		for _, column := range ColumnsBuildFromKolumny(kolumny) {
+			names = append(names, column.Name)
+		}
+		if !slices.Equal(names, want) {
+			t.Fatalf("order %v, want %v for input %v", names, want, kolumny)
+		}
+		slices.Reverse(kolumny)
+		kolumny[0], kolumny[2] = kolumny[2], kolumny[0]
+	}
+
+	kody := []BKodyPodtabele{
+		{Code: "9"},
+		{Code: "2", Lp: sql.NullInt64{Int64: 2, Valid: true}},
+		{Code: "1", Lp: sql.NullInt64{Int64: 2, Valid: true}},
+		{Code: "5", Lp: sql.NullInt64{Int64: 1, Valid: true}},
+		{Code: "3"},
+	}
+	KodyPodtabeleSort(kody)
+	var codes []string
+	for _, kod := range kody {
+		codes = append(codes, kod.Code)
+	}
+	if !slices.Equal(codes, []string{"5", "1", "2", "3", "9"}) {
+		t.Errorf("row order %v", codes)
+	}
+}
+
+func TestEtapTransitionPost(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+	db := app.DBManager.yearCache(2030).DB
+
+	post := func(user User, action string) int {
+		req := httptest.NewRequest("POST", "/app/2030/bdgr/lista-ankiet/G1/etap/"+action, nil)
+		req.AddCookie(sessionCookie(t, app, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	admin := User{Login: "admin", Role: UserAdmin}
+
+	if code := post(admin, "eksport"); code != http.StatusConflict {
+		t.Errorf("export before reaching the institute: status %d, want 409", code)
+	}
+	db.MustExec(`UPDATE b_statusy SET etap = ? WHERE idgr = 'G1'`, ETAP_INST)
+
+	if code := post(User{Login: "zbr", Role: UserManager, IdBR: "BR1"}, "eksport"); code != http.StatusForbidden {
+		t.Errorf("export by a manager: status %d, want 403", code)
+	}
+	if code := post(admin, "import"); code != http.StatusConflict {
+		t.Errorf("import before export: status %d, want 409", code)
+	}
+	if code := post(admin, "nieznana"); code != http.StatusNotFound {
+		t.Errorf("unknown action: status %d, want 404", code)
+	}
+
+	if code := post(User{Login: "met", Role: UserMethodolgist}, "eksport"); code != http.StatusOK {
+		t.Fatalf("export: status %d", code)
+	}
+	if code := post(admin, "import"); code != http.StatusOK {
+		t.Fatalf("import: status %d", code)
+	}
+
+	var status Statusy
+	if err := db.Get(&status, `SELECT * FROM b_statusy WHERE idgr = 'G1'`); err != nil {
+		t.Fatal(err)
+	}
+	if status.Etap != ETAP_IMPORT || !status.DataEksportu.Valid || !status.DataImportu.Valid {
+		t.Errorf("status after export and import: etap %q, eksport %v, import %v", status.Etap, status.DataEksportu, status.DataImportu)
+	}
+	if code := post(admin, "import"); code != http.StatusConflict {
+		t.Errorf("second import: status %d, want 409", code)
+	}
+}
+
+func TestBatchTransitionPost(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+	db := app.DBManager.yearCache(2030).DB
+	db.MustExec(`
+		UPDATE b_statusy SET idbr = 'BR1', etap = 'ZBR' WHERE idgr = 'G1';
+		INSERT INTO b_statusy (idgr, idbr, etap) VALUES ('G2', 'BR1', 'PBR');
+		INSERT INTO b_statusy (idgr, idbr, etap) VALUES ('G3', 'BR2', 'ZBR');
+		INSERT INTO b_statusy (idgr, idbr, etap) VALUES ('G4', 'BR1', 'ZBR');
+	`)
+	app.DBManager.MasterCache.DB.MustExec(`INSERT INTO gospodarstwa (idgr, idbr, zarchiwizowane) VALUES ('G4', 'BR1', 1)`)
+
+	post := func(user User, action string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/app/2030/bdgr/lista-ankiet/batch-transition", strings.NewReader(`{"akcja":"`+action+`"}`))
+		req.AddCookie(sessionCookie(t, app, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	manager := User{Login: "zbr", Role: UserManager, IdBR: "BR1"}
+
+	if w := post(manager, "eksport"); w.Code != http.StatusForbidden {
+		t.Errorf("export by a manager: status %d, want 403", w.Code)
+	}
+
+	w := post(manager, "zwrot-pbr")
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch: status %d %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Wyniki []BatchTransitionResult `json:"wyniki"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	results := make(map[string]BatchTransitionResult)
+	for _, result := range body.Wyniki {
+		results[result.IdGR] = result
+	}
+	if len(results) != 2 || !results["G1"].Success || results["G1"].Etap != ETAP_PBR {
+		t.Errorf("G1 not handed back: %+v", body.Wyniki)
+	}
+	if g2 := results["G2"]; g2.Success || g2.Message == "" || g2.Etap != ETAP_PBR {
+		t.Errorf("G2 should be reported as not eligible: %+v", g2)
+	}
+
+	etapy := make(map[string]string)
+	var statusy []Statusy
+	db.Select(&statusy, `SELECT * FROM b_statusy`)
+	for _, status := range statusy {
+		etapy[status.IDGR] = status.Etap
+		if status.IDGR == "G1" && !status.DataZwrotuPBR.Valid {
+			t.Errorf("G1 data_zwrotu_pbr not stamped")
+		}
+	}
+	if etapy["G1"] != ETAP_PBR || etapy["G2"] != ETAP_PBR || etapy["G3"] != ETAP_ZBR || etapy["G4"] != ETAP_ZBR {
+		t.Errorf("etapy after batch: %v", etapy)
+	}
+}
+
+func TestFarmCopyPost(t *testing.T) {
+	app := testApplication(t)
+	router := app.Routes()
+	db := app.DBManager.yearCache(2030).DB
+	db.MustExec(`
+		INSERT INTO b_statusy (idgr) VALUES ('G2');
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G1', 'A', '{"_v":1,"data":[{"A_Kod":"1"},{"A_Kod":"2"}],"notes":"uwaga"}');
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G2', 'A', '{"_v":1,"data":[]}');
+		INSERT INTO b_bdgrobmsp (idgr, podtabela, dane) VALUES ('G2', 'B', '{"_v":1,"data":[{"B_Kod":"x"}]}');
+	`)
+
+	post := func(user User, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/app/2030/bdgr/lista-ankiet/G1/kopiuj", strings.NewReader(body))
+		req.AddCookie(sessionCookie(t, app, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	admin := User{Login: "admin", Role: UserAdmin}
+
+	if w := post(User{Login: "zbr", Role: UserManager, IdBR: "BR1"}, `{"cel":"G2"}`); w.Code != http.StatusForbidden {
+		t.Errorf("copy by a manager: status %d, want 403", w.Code)
+	}
+	if w := post(admin, `{"cel":"G9"}`); w.Code != http.StatusNotFound {
+		t.Errorf("unknown target: status %d, want 404", w.Code)
+	}
+	if w := post(admin, `{"cel":"G1"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("copy onto itself: status %d, want 400", w.Code)
+	}
+
+	w := post(admin, `{"cel":"G2"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("copy onto an empty subtable: status %d %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Podtabele []FarmCopyResult `json:"podtabele"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if want := []FarmCopyResult{{Podtabela: "A", Wiersze: 2}}; !slices.Equal(body.Podtabele, want) {
+		t.Errorf("summary %+v, want %+v", body.Podtabele, want)
+	}
+
+	var copied string
+	db.Get(&copied, `SELECT dane FROM b_bdgrobmsp WHERE idgr = 'G2' AND podtabela = 'A'`)
+	if _, notes, _ := BlobUnwrapNotes(copied); BlobRowCount(copied) != 2 || notes != "uwaga" {
+		t.Errorf("copied blob %s", copied)
+	}
+	var kept string
+	db.Get(&kept, `SELECT dane FROM b_bdgrobmsp WHERE idgr = 'G2' AND podtabela = 'B'`)
+	if BlobRowCount(kept) != 1 {
+		t.Errorf("subtable missing from the source was touched: %s", kept)
+	}
+
+	db.MustExec(`UPDATE b_bdgrobmsp SET dane = '{"_v":1,"data":[{"A_Kod":"9"}]}' WHERE idgr = 'G1'`)
+	if w := post(admin, `{"cel":"G2"}`); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"niepuste":["A"]`) {
+		t.Errorf("overwrite without force: status %d %s", w.Code, w.Body.String())
+	}
+	db.Get(&copied, `SELECT dane FROM b_bdgrobmsp WHERE idgr = 'G2' AND podtabela = 'A'`)
+	if BlobRowCount(copied) != 2 {
+		t.Errorf("refused copy changed the target: %s", copied)
+	}
+
+	w = post(admin, `{"cel":"G2","wymus":true}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"nadpisano":true`) {
+		t.Errorf("forced copy: status %d %s", w.Code, w.Body.String())
+	}
+	db.Get(&copied, `SELECT dane FROM b_bdgrobmsp WHERE idgr = 'G2' AND podtabela = 'A'`)
+	if BlobRowCount(copied) != 1 {
+		t.Errorf("forced copy did not overwrite: %s", copied)
+	}
+}
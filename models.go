@@ -67,7 +67,7 @@ type TypyJM struct {
 type Slowniki struct {
 	Slownik     string         `db:"slownik"`
 	Opis        sql.NullString `db:"opis"`
-	Uwagi       sql.NullString `db:"opis"`
+	Uwagi       sql.NullString `db:"uwagi"`
 	Wartosc     string         `db:"wartosc"`
 	TypSlownika string         `db:"typ_slownika"`
 }
@@ -75,7 +75,7 @@ type Slowniki struct {
 type TypySlownikow struct {
 	TypSlownika string         `db:"typ_slownika"`
 	Opis        sql.NullString `db:"opis"`
-	Uwagi       sql.NullString `db:"opis"`
+	Uwagi       sql.NullString `db:"uwagi"`
 }
 
 // BiuraRachunkowe represents an accounting office (user group)
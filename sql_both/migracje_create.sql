@@ -0,0 +1,6 @@
+-- Versions from sql_migrations/ applied to this database, see MigrationsApply
+CREATE TABLE IF NOT EXISTS migracje (
+    wersja INTEGER PRIMARY KEY,
+    nazwa TEXT NOT NULL,
+    data_zastosowania TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
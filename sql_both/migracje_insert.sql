@@ -0,0 +1 @@
+INSERT INTO migracje (wersja, nazwa) VALUES (?, ?);
\ No newline at end of file
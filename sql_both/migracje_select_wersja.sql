@@ -0,0 +1 @@
+SELECT wersja FROM migracje;
\ No newline at end of file
@@ -0,0 +1,5 @@
+SELECT gl.rok, gl.idgr
+FROM gospodarstwa__lata gl
+JOIN gospodarstwa g ON g.idgr = gl.idgr
+WHERE g.idpbr = ?
+ORDER BY gl.rok, gl.idgr;
@@ -0,0 +1 @@
+SELECT idgr FROM gospodarstwa WHERE zarchiwizowane = 1;
\ No newline at end of file
@@ -0,0 +1,4 @@
+UPDATE gospodarstwa
+SET zarchiwizowane = ?
+WHERE idgr = ?
+RETURNING zarchiwizowane;
\ No newline at end of file
@@ -0,0 +1 @@
+SELECT EXISTS(SELECT 1 FROM gospodarstwa WHERE idgr = ? AND zarchiwizowane = 1) AS result;
\ No newline at end of file
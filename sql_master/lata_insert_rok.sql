@@ -0,0 +1,2 @@
+INSERT OR IGNORE INTO lata (rok, zablokowany, odlaczony)
+VALUES (?, 0, 0);
\ No newline at end of file
@@ -0,0 +1 @@
+SELECT zablokowany FROM lata WHERE rok = ?;
\ No newline at end of file
@@ -1 +1 @@
-SELECT login, password FROM uzytkownicy WHERE login = ?;
\ No newline at end of file
+SELECT login, password, salt, aktywny, zablokowany FROM uzytkownicy WHERE login_fold(login) = login_fold(?);
\ No newline at end of file
@@ -1 +1 @@
-SELECT login, rola, idbr, idpbr FROM uzytkownicy WHERE login = ?;
\ No newline at end of file
+SELECT login, rola, idbr, idpbr, ostatnie_logowanie FROM uzytkownicy WHERE login = ?;
\ No newline at end of file
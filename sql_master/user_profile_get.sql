@@ -0,0 +1 @@
+SELECT login, imie, nazwisko, email FROM uzytkownicy WHERE login = ?;
\ No newline at end of file
@@ -0,0 +1 @@
+SELECT EXISTS(SELECT 1 FROM uzytkownicy WHERE login_fold(login) = login_fold(?)) AS result;
\ No newline at end of file
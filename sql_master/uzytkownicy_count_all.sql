@@ -0,0 +1 @@
+SELECT COUNT(*) FROM uzytkownicy;
\ No newline at end of file
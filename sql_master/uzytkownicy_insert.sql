@@ -0,0 +1,2 @@
+INSERT INTO uzytkownicy (idpbr, login, password, salt, imie, nazwisko, email, rola, aktywny, zablokowany, data_wylosowania, idbr)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1, 0, date('now'), ?);
\ No newline at end of file
@@ -0,0 +1 @@
+SELECT login FROM uzytkownicy WHERE login_fold(login) = login_fold(?);
\ No newline at end of file
@@ -0,0 +1,4 @@
+SELECT idpbr, login, imie, nazwisko, email, rola, aktywny, zablokowany, idbr
+FROM uzytkownicy
+ORDER BY login
+LIMIT ? OFFSET ?;
\ No newline at end of file
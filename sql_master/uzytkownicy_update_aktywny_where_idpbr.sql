@@ -0,0 +1,4 @@
+UPDATE uzytkownicy
+SET aktywny = 1 - aktywny
+WHERE idpbr = ?
+RETURNING aktywny;
\ No newline at end of file
@@ -0,0 +1,6 @@
+UPDATE uzytkownicy
+SET rola = ?,
+    imie = COALESCE(NULLIF(?, ''), imie),
+    nazwisko = COALESCE(NULLIF(?, ''), nazwisko),
+    email = COALESCE(NULLIF(?, ''), email)
+WHERE login = ?;
\ No newline at end of file
@@ -0,0 +1 @@
+UPDATE uzytkownicy SET ostatnie_logowanie = datetime('now', 'localtime') WHERE login = ?;
\ No newline at end of file
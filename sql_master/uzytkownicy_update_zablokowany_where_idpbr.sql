@@ -0,0 +1,4 @@
+UPDATE uzytkownicy
+SET zablokowany = 1 - zablokowany
+WHERE idpbr = ?
+RETURNING zablokowany;
\ No newline at end of file
@@ -0,0 +1,2 @@
+-- Starting point of the master migrations, the schema as it stood when they
+-- were introduced. Nothing to change.
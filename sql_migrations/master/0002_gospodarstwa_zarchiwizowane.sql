@@ -0,0 +1,3 @@
+-- Archived farms stay in the year databases but drop out of the lists for
+-- everyone but Adm.
+ALTER TABLE gospodarstwa ADD COLUMN zarchiwizowane INTEGER NOT NULL DEFAULT 0;
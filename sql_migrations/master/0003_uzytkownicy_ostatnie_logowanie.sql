@@ -0,0 +1,2 @@
+-- Time of the user's last successful login, shown in the nav and on the profile.
+ALTER TABLE uzytkownicy ADD COLUMN ostatnie_logowanie TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+-- Computed values and validation expressions of a column. Year databases made
+-- from sql_schema/year.sql already have them.
+ALTER TABLE b_kolumny ADD COLUMN formula TEXT;
+ALTER TABLE b_kolumny ADD COLUMN walidacja TEXT;
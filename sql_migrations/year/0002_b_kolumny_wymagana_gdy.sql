@@ -0,0 +1,2 @@
+-- Condition under which a column is required, see EvalCondition.
+ALTER TABLE b_kolumny ADD COLUMN wymagana_gdy TEXT;
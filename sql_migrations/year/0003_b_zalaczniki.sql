@@ -0,0 +1,15 @@
+-- Supporting documents for a subtable submission, kept in the year database so
+-- backups and year archives carry them along.
+CREATE TABLE IF NOT EXISTS b_zalaczniki (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    idgr TEXT NOT NULL,
+    podtabela TEXT NOT NULL,
+    nazwa_pliku TEXT NOT NULL,
+    rozmiar INTEGER NOT NULL,
+    typ TEXT NOT NULL,
+    zawartosc BLOB NOT NULL,
+    login TEXT NOT NULL,
+    data_dodania TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS b_zalaczniki_idgr_podtabela ON b_zalaczniki (idgr, podtabela);
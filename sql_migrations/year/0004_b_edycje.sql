@@ -0,0 +1,9 @@
+-- Advisory edit locks: who has a subtable open. Rows older than the lock
+-- timeout are expired and simply taken over by the next editor.
+CREATE TABLE IF NOT EXISTS b_edycje (
+    idgr TEXT NOT NULL,
+    podtabela TEXT NOT NULL,
+    login TEXT NOT NULL,
+    data_odswiezenia TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (idgr, podtabela)
+);
@@ -0,0 +1,2 @@
+-- Text answers of a column with 1 are saved without trimming, see TextNormalize.
+ALTER TABLE b_kolumny ADD COLUMN zachowaj_biale_znaki INTEGER NOT NULL DEFAULT 0;
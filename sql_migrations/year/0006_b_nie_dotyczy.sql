@@ -0,0 +1,10 @@
+-- Subtables marked as not applicable to a farm, with the reason. They count as
+-- complete and skip required field checks, whatever data they hold.
+CREATE TABLE IF NOT EXISTS b_nie_dotyczy (
+    idgr TEXT NOT NULL,
+    podtabela TEXT NOT NULL,
+    powod TEXT NOT NULL,
+    login TEXT NOT NULL,
+    data_oznaczenia TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (idgr, podtabela)
+);
@@ -0,0 +1,2 @@
+-- Roles that may fill a column in, comma separated; empty leaves it to everyone.
+ALTER TABLE b_kolumny ADD COLUMN role_edycji TEXT;
@@ -0,0 +1,14 @@
+-- Audit trail of saves, clears and copies of farm answers. skrot is the SHA-256
+-- hex of dane, the subtable blob as stored after the change.
+CREATE TABLE IF NOT EXISTS b_audyt (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    idgr TEXT NOT NULL,
+    podtabela TEXT NOT NULL,
+    login TEXT NOT NULL,
+    akcja TEXT NOT NULL,
+    skrot TEXT NOT NULL,
+    dane TEXT NOT NULL,
+    czas TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS b_audyt_idgr_podtabela ON b_audyt (idgr, podtabela);
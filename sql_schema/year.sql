@@ -0,0 +1,271 @@
+-- Schema of a year database ({year}.db). Used when a new survey year is created
+-- in-app; keep it in sync with the queries in sql_year/.
+
+CREATE TABLE IF NOT EXISTS b_kody_w_tabeli (
+    kody_w_tabli TEXT PRIMARY KEY,
+    kody_w_tabli4schemat TEXT NOT NULL,
+    opis TEXT,
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_typy_tabel (
+    typ_tabeli TEXT PRIMARY KEY,
+    typ_tabeli4schemat TEXT NOT NULL,
+    opis TEXT,
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_rodzaje_tabel (
+    rodzaj_tabeli TEXT PRIMARY KEY,
+    rodzaj_tabeli4schemat TEXT NOT NULL,
+    opis TEXT,
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_tabele (
+    tabela TEXT PRIMARY KEY,
+    tytul TEXT NOT NULL,
+    lp INTEGER NOT NULL,
+    symbol TEXT NOT NULL,
+    opis TEXT,
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_podtabele (
+    podtabela TEXT PRIMARY KEY,
+    tabela TEXT NOT NULL REFERENCES b_tabele (tabela),
+    rodzaj_tabeli TEXT NOT NULL DEFAULT '',
+    typ_tabeli TEXT NOT NULL DEFAULT '',
+    kody_w_tabeli TEXT NOT NULL DEFAULT '',
+    schemat_tabeli TEXT NOT NULL,
+    tytul TEXT NOT NULL,
+    lp INTEGER NOT NULL,
+    symbol TEXT NOT NULL DEFAULT '',
+    czy_przepisac INTEGER NOT NULL DEFAULT 0,
+    opis TEXT,
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_typy_jm (
+    typ_jm TEXT PRIMARY KEY,
+    opis TEXT,
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_jm (
+    jm TEXT PRIMARY KEY,
+    opis TEXT,
+    typ_jm TEXT NOT NULL,
+    format TEXT NOT NULL DEFAULT '',
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_typy_slownikow (
+    typ_slownika TEXT PRIMARY KEY,
+    opis TEXT,
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_slowniki (
+    slownik TEXT PRIMARY KEY,
+    opis TEXT,
+    uwagi TEXT,
+    wartosc TEXT NOT NULL,
+    typ_slownika TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS b_kolumny (
+    kolumna TEXT PRIMARY KEY,
+    podtabela TEXT NOT NULL REFERENCES b_podtabele (podtabela),
+    symbol TEXT NOT NULL DEFAULT '',
+    tytul TEXT NOT NULL,
+    lp INTEGER NOT NULL,
+    jm TEXT NOT NULL,
+    wymagana INTEGER NOT NULL DEFAULT 0,
+    widoczna INTEGER NOT NULL DEFAULT 1,
+    szerokosc INTEGER NOT NULL DEFAULT 0,
+    formula TEXT,
+    walidacja TEXT,
+    wymagana_gdy TEXT,
+    zachowaj_biale_znaki INTEGER NOT NULL DEFAULT 0,
+    role_edycji TEXT,
+    min INTEGER,
+    max INTEGER,
+    slownik TEXT,
+    przepisac_na TEXT NOT NULL DEFAULT '',
+    opis TEXT,
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_stawki_vat_zo (
+    stawka_vat_zo TEXT PRIMARY KEY,
+    wartosc_stawki_vat_zo REAL,
+    tytul TEXT NOT NULL,
+    opis TEXT,
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_stawki_vat_rr (
+    stawka_vat_rr TEXT PRIMARY KEY,
+    wartosc_stawki_vat_rr REAL,
+    tytul TEXT NOT NULL,
+    opis TEXT,
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_kody (
+    kod TEXT PRIMARY KEY,
+    kod_soc TEXT NOT NULL DEFAULT '',
+    tytul TEXT NOT NULL,
+    opis TEXT,
+    uwagi TEXT,
+    stawka_vat_zo TEXT,
+    stawka_vat_rr TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_kody__podtabele (
+    kod TEXT NOT NULL,
+    podtabela TEXT NOT NULL REFERENCES b_podtabele (podtabela),
+    fr_tabela_kod TEXT NOT NULL DEFAULT '',
+    tytul TEXT NOT NULL DEFAULT '',
+    lp INTEGER,
+    opis TEXT,
+    uwagi TEXT,
+    UNIQUE (kod, podtabela)
+);
+
+CREATE TABLE IF NOT EXISTS b_blokady (
+    podtabela TEXT NOT NULL,
+    kolumna TEXT NOT NULL,
+    kod TEXT NOT NULL,
+    opis TEXT,
+    uwagi TEXT,
+    UNIQUE (podtabela, kolumna, kod)
+);
+
+CREATE TABLE IF NOT EXISTS b_bdgrobmsp (
+    idgr TEXT NOT NULL,
+    podtabela TEXT NOT NULL,
+    dane TEXT NOT NULL,
+    data_modyfikacji TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (idgr, podtabela)
+);
+
+-- Supporting documents for a subtable submission, kept in the year database so
+-- backups and year archives carry them along.
+CREATE TABLE IF NOT EXISTS b_zalaczniki (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    idgr TEXT NOT NULL,
+    podtabela TEXT NOT NULL,
+    nazwa_pliku TEXT NOT NULL,
+    rozmiar INTEGER NOT NULL,
+    typ TEXT NOT NULL,
+    zawartosc BLOB NOT NULL,
+    login TEXT NOT NULL,
+    data_dodania TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS b_zalaczniki_idgr_podtabela ON b_zalaczniki (idgr, podtabela);
+
+-- Audit trail of saves, clears and copies of farm answers. skrot is the SHA-256
+-- hex of dane, the subtable blob as stored after the change.
+CREATE TABLE IF NOT EXISTS b_audyt (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    idgr TEXT NOT NULL,
+    podtabela TEXT NOT NULL,
+    login TEXT NOT NULL,
+    akcja TEXT NOT NULL,
+    skrot TEXT NOT NULL,
+    dane TEXT NOT NULL,
+    czas TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS b_audyt_idgr_podtabela ON b_audyt (idgr, podtabela);
+
+-- Advisory edit locks: who has a subtable open. Rows older than the lock
+-- timeout are expired and simply taken over by the next editor.
+CREATE TABLE IF NOT EXISTS b_edycje (
+    idgr TEXT NOT NULL,
+    podtabela TEXT NOT NULL,
+    login TEXT NOT NULL,
+    data_odswiezenia TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (idgr, podtabela)
+);
+
+-- Subtables marked as not applicable to a farm, with the reason. They count as
+-- complete and skip required field checks, whatever data they hold.
+CREATE TABLE IF NOT EXISTS b_nie_dotyczy (
+    idgr TEXT NOT NULL,
+    podtabela TEXT NOT NULL,
+    powod TEXT NOT NULL,
+    login TEXT NOT NULL,
+    data_oznaczenia TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (idgr, podtabela)
+);
+
+CREATE TABLE IF NOT EXISTS b_etapy (
+    etap TEXT PRIMARY KEY,
+    opis TEXT,
+    uwagi TEXT
+);
+
+CREATE TABLE IF NOT EXISTS b_statusy (
+    idgr TEXT PRIMARY KEY,
+    idbr TEXT NOT NULL DEFAULT '',
+    idpbr TEXT NOT NULL DEFAULT '',
+    etap TEXT NOT NULL DEFAULT '',
+    o INTEGER,
+    ow INTEGER,
+    oo INTEGER,
+    b INTEGER,
+    bw INTEGER,
+    bnw INTEGER,
+    bo INTEGER,
+    k INTEGER,
+    z INTEGER,
+    komentarz_zbr TEXT,
+    komentarz_inst TEXT,
+    data_przepisania_na_sp TEXT NOT NULL DEFAULT '',
+    rok_auweitr INTEGER,
+    data_testowania TEXT,
+    data_przekazania_zbr TEXT,
+    data_zwrotu_pbr TEXT,
+    data_przekazania_inst TEXT,
+    data_zwrotu_zbr TEXT,
+    data_eksportu TEXT,
+    data_importu TEXT,
+    data_akceptacji TEXT,
+    data_zamkniecia TEXT,
+    data_przepisania_z_sk TEXT
+);
+
+CREATE TABLE IF NOT EXISTS fr_kody (
+    tabela_kod TEXT PRIMARY KEY,
+    nazwa TEXT NOT NULL,
+    tabela TEXT NOT NULL,
+    kod TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS pkd_pkd (
+    kod TEXT PRIMARY KEY,
+    opis TEXT
+);
+
+CREATE TABLE IF NOT EXISTS teryt_teryt (
+    nrwpgr TEXT PRIMARY KEY,
+    wojewodztwo TEXT NOT NULL,
+    powiat TEXT NOT NULL,
+    gmina TEXT NOT NULL,
+    rodzaj_gminy TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS teryt_simc (
+    simc TEXT PRIMARY KEY,
+    miejscowosc TEXT NOT NULL,
+    nrwpgr TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS utgr_wspolczynniki_so (
+    kod_soc TEXT PRIMARY KEY,
+    opis_soc TEXT NOT NULL
+);
@@ -0,0 +1,2 @@
+INSERT INTO b_audyt (idgr, podtabela, login, akcja, skrot, dane)
+VALUES (?, ?, ?, ?, ?, ?);
\ No newline at end of file
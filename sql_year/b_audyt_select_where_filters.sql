@@ -0,0 +1,8 @@
+SELECT id, idgr, podtabela, login, akcja, skrot, CASE WHEN ? THEN dane ELSE '' END AS dane, czas
+FROM b_audyt
+WHERE (? = '' OR idgr = ?)
+  AND (? = '' OR podtabela = ?)
+  AND (? = '' OR login = ?)
+  AND (? = '' OR czas >= ?)
+  AND (? = '' OR czas < date(?, '+1 day'))
+ORDER BY id;
\ No newline at end of file
@@ -0,0 +1,2 @@
+DELETE FROM b_bdgrobmsp
+WHERE idgr = ? AND podtabela = ?;
\ No newline at end of file
@@ -1,3 +1,3 @@
-SELECT idgr, podtabela, dane
+SELECT idgr, podtabela, dane, data_modyfikacji
 FROM b_bdgrobmsp
 WHERE idgr = ? AND podtabela = ?;
\ No newline at end of file
@@ -0,0 +1,5 @@
+SELECT MAX(czas) FROM (
+    SELECT MAX(data_modyfikacji) AS czas FROM b_bdgrobmsp WHERE idgr = ?
+    UNION ALL
+    SELECT MAX(czas) FROM b_audyt WHERE idgr = ? AND akcja = ?
+);
@@ -0,0 +1,4 @@
+SELECT idgr, podtabela, dane, data_modyfikacji
+FROM b_bdgrobmsp
+WHERE idgr = ?
+ORDER BY podtabela;
@@ -0,0 +1,3 @@
+UPDATE b_bdgrobmsp
+SET dane = ?
+WHERE idgr = ? AND podtabela = ?;
\ No newline at end of file
@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_blokady;
\ No newline at end of file
@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_blokady (podtabela, kolumna, kod, opis, uwagi)
+VALUES (:podtabela, :kolumna, :kod, :opis, :uwagi);
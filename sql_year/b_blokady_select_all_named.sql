@@ -0,0 +1,2 @@
+SELECT podtabela, kolumna, kod, opis, uwagi
+FROM b_blokady;
@@ -1 +1 @@
-SELECT kolumna, kod FROM b_blokady WHERE podtabela = ?;
\ No newline at end of file
+SELECT podtabela, kolumna, kod, opis FROM b_blokady WHERE podtabela = ?;
\ No newline at end of file
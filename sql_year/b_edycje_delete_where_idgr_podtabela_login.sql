@@ -0,0 +1,2 @@
+DELETE FROM b_edycje
+WHERE idgr = ? AND podtabela = ? AND login = ?;
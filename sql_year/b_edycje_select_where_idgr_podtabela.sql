@@ -0,0 +1,3 @@
+SELECT idgr, podtabela, login, data_odswiezenia
+FROM b_edycje
+WHERE idgr = ? AND podtabela = ?;
@@ -0,0 +1,5 @@
+INSERT INTO b_edycje (idgr, podtabela, login, data_odswiezenia)
+VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+ON CONFLICT (idgr, podtabela) DO UPDATE
+SET login = excluded.login, data_odswiezenia = excluded.data_odswiezenia
+WHERE b_edycje.login = excluded.login OR b_edycje.data_odswiezenia < ?;
@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_etapy;
\ No newline at end of file
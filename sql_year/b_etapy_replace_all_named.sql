@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_etapy (etap, opis, uwagi)
+VALUES (:etap, :opis, :uwagi);
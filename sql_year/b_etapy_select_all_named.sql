@@ -0,0 +1,2 @@
+SELECT etap, opis, uwagi
+FROM b_etapy;
@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_jm (jm, opis, typ_jm, format, uwagi)
+VALUES (:jm, :opis, :typ_jm, :format, :uwagi);
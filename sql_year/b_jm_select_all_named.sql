@@ -0,0 +1,2 @@
+SELECT jm, opis, typ_jm, format, uwagi
+FROM b_jm;
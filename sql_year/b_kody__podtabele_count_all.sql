@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_kody__podtabele;
\ No newline at end of file
@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_kody__podtabele (kod, podtabela, fr_tabela_kod, tytul, lp, opis, uwagi)
+VALUES (:kod, :podtabela, :fr_tabela_kod, :tytul, :lp, :opis, :uwagi);
@@ -0,0 +1,2 @@
+SELECT kod, podtabela, fr_tabela_kod, tytul, lp, opis, uwagi
+FROM b_kody__podtabele;
@@ -1,4 +1,4 @@
-SELECT kody__podtabele.kod, kody.tytul
+SELECT kody__podtabele.kod, kody.tytul, kody__podtabele.lp
 FROM b_kody__podtabele kody__podtabele
 LEFT JOIN b_kody kody
 ON kody__podtabele.kod = kody.kod 
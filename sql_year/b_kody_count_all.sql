@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_kody;
\ No newline at end of file
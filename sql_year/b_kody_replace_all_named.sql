@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_kody (kod, kod_soc, tytul, opis, uwagi, stawka_vat_zo, stawka_vat_rr)
+VALUES (:kod, :kod_soc, :tytul, :opis, :uwagi, :stawka_vat_zo, :stawka_vat_rr);
@@ -0,0 +1,2 @@
+SELECT kod, kod_soc, tytul, opis, uwagi, stawka_vat_zo, stawka_vat_rr
+FROM b_kody;
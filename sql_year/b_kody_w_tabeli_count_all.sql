@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_kody_w_tabeli;
\ No newline at end of file
@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_kody_w_tabeli (kody_w_tabli, kody_w_tabli4schemat, opis, uwagi)
+VALUES (:kody_w_tabli, :kody_w_tabli4schemat, :opis, :uwagi);
@@ -0,0 +1,2 @@
+SELECT kody_w_tabli, kody_w_tabli4schemat, opis, uwagi
+FROM b_kody_w_tabeli;
@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_kolumny;
\ No newline at end of file
@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_kolumny (kolumna, podtabela, symbol, tytul, lp, jm, wymagana, widoczna, szerokosc, formula, walidacja, wymagana_gdy, zachowaj_biale_znaki, role_edycji, min, max, slownik, przepisac_na, opis, uwagi)
+VALUES (:kolumna, :podtabela, :symbol, :tytul, :lp, :jm, :wymagana, :widoczna, :szerokosc, :formula, :walidacja, :wymagana_gdy, :zachowaj_biale_znaki, :role_edycji, :min, :max, :slownik, :przepisac_na, :opis, :uwagi);
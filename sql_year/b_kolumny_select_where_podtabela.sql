@@ -9,6 +9,13 @@ SELECT
     b_kolumny.szerokosc,
     b_kolumny.min,
     b_kolumny.max,
+    b_kolumny.formula,
+    b_kolumny.walidacja,
+    b_kolumny.wymagana_gdy,
+    b_kolumny.zachowaj_biale_znaki,
+    b_kolumny.role_edycji,
+    b_kolumny.opis,
+    b_kolumny.uwagi,
     b_kolumny.slownik,
     b_jm.typ_jm,
     b_jm.format,
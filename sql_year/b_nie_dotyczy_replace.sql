@@ -0,0 +1,2 @@
+REPLACE INTO b_nie_dotyczy (idgr, podtabela, powod, login)
+VALUES (?, ?, ?, ?);
\ No newline at end of file
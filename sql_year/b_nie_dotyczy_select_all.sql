@@ -0,0 +1,2 @@
+SELECT idgr, podtabela, powod, login, data_oznaczenia
+FROM b_nie_dotyczy;
\ No newline at end of file
@@ -0,0 +1,3 @@
+SELECT idgr, podtabela, powod, login, data_oznaczenia
+FROM b_nie_dotyczy
+WHERE idgr = ?;
\ No newline at end of file
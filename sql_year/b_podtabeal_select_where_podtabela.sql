@@ -1 +1 @@
-SELECT schemat_tabeli, tytul, symbol FROM b_podtabele WHERE podtabela = ?;
\ No newline at end of file
+SELECT podtabela, tabela, schemat_tabeli, tytul, symbol FROM b_podtabele WHERE podtabela = ?;
\ No newline at end of file
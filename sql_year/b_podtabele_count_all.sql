@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_podtabele;
\ No newline at end of file
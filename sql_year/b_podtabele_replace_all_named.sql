@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_podtabele (podtabela, tabela, rodzaj_tabeli, typ_tabeli, kody_w_tabeli, schemat_tabeli, tytul, lp, symbol, czy_przepisac, opis, uwagi)
+VALUES (:podtabela, :tabela, :rodzaj_tabeli, :typ_tabeli, :kody_w_tabeli, :schemat_tabeli, :tytul, :lp, :symbol, :czy_przepisac, :opis, :uwagi);
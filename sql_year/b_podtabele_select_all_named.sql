@@ -0,0 +1,2 @@
+SELECT podtabela, tabela, rodzaj_tabeli, typ_tabeli, kody_w_tabeli, schemat_tabeli, tytul, lp, symbol, czy_przepisac, opis, uwagi
+FROM b_podtabele;
@@ -0,0 +1,5 @@
+SELECT b_podtabele.tabela, b_podtabele.podtabela, b_podtabele.schemat_tabeli
+FROM b_podtabele
+LEFT JOIN b_tabele
+    ON b_podtabele.tabela = b_tabele.tabela
+ORDER BY b_tabele.lp ASC, b_podtabele.lp ASC;
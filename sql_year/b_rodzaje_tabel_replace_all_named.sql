@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_rodzaje_tabel (rodzaj_tabeli, rodzaj_tabeli4schemat, opis, uwagi)
+VALUES (:rodzaj_tabeli, :rodzaj_tabeli4schemat, :opis, :uwagi);
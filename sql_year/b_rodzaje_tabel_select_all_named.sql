@@ -0,0 +1,2 @@
+SELECT rodzaj_tabeli, rodzaj_tabeli4schemat, opis, uwagi
+FROM b_rodzaje_tabel;
@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_slowniki;
\ No newline at end of file
@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_slowniki (slownik, opis, uwagi, wartosc, typ_slownika)
+VALUES (:slownik, :opis, :uwagi, :wartosc, :typ_slownika);
@@ -0,0 +1,2 @@
+SELECT slownik, opis, uwagi, wartosc, typ_slownika
+FROM b_slowniki;
@@ -0,0 +1,4 @@
+INSERT INTO b_slowniki (slownik, wartosc, typ_slownika, opis, uwagi)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (slownik) DO UPDATE
+SET wartosc = excluded.wartosc, typ_slownika = excluded.typ_slownika, opis = excluded.opis, uwagi = excluded.uwagi;
@@ -0,0 +1,3 @@
+SELECT etap, COUNT(*)
+FROM b_statusy
+GROUP BY etap;
\ No newline at end of file
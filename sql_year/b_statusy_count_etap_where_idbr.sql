@@ -0,0 +1,4 @@
+SELECT etap, COUNT(*)
+FROM b_statusy
+WHERE idbr = ?
+GROUP BY etap;
\ No newline at end of file
@@ -0,0 +1,4 @@
+SELECT etap, COUNT(*)
+FROM b_statusy
+WHERE idgr IN (SELECT value FROM json_each(?))
+GROUP BY etap;
\ No newline at end of file
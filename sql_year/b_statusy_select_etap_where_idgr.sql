@@ -0,0 +1,3 @@
+SELECT etap
+FROM b_statusy
+WHERE idgr = ?;
\ No newline at end of file
@@ -0,0 +1,3 @@
+UPDATE b_statusy
+SET komentarz_inst = ?
+WHERE idgr = ?;
\ No newline at end of file
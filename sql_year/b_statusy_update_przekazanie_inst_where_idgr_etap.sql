@@ -0,0 +1,3 @@
+UPDATE b_statusy
+SET etap = ?, data_przekazania_inst = CURRENT_TIMESTAMP
+WHERE idgr = ? AND etap = ?;
\ No newline at end of file
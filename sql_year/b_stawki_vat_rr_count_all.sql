@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_stawki_vat_rr;
\ No newline at end of file
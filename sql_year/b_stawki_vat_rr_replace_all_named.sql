@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_stawki_vat_rr (stawka_vat_rr, wartosc_stawki_vat_rr, tytul, opis, uwagi)
+VALUES (:stawka_vat_rr, :wartosc_stawki_vat_rr, :tytul, :opis, :uwagi);
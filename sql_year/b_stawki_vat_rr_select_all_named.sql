@@ -0,0 +1,2 @@
+SELECT stawka_vat_rr, wartosc_stawki_vat_rr, tytul, opis, uwagi
+FROM b_stawki_vat_rr;
@@ -0,0 +1,4 @@
+INSERT INTO b_stawki_vat_rr (stawka_vat_rr, wartosc_stawki_vat_rr, tytul, opis, uwagi)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (stawka_vat_rr) DO UPDATE
+SET wartosc_stawki_vat_rr = excluded.wartosc_stawki_vat_rr, tytul = excluded.tytul, opis = excluded.opis, uwagi = excluded.uwagi;
@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_stawki_vat_zo;
\ No newline at end of file
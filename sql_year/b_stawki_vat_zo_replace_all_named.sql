@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_stawki_vat_zo (stawka_vat_zo, wartosc_stawki_vat_zo, tytul, opis, uwagi)
+VALUES (:stawka_vat_zo, :wartosc_stawki_vat_zo, :tytul, :opis, :uwagi);
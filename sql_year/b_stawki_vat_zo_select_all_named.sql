@@ -0,0 +1,2 @@
+SELECT stawka_vat_zo, wartosc_stawki_vat_zo, tytul, opis, uwagi
+FROM b_stawki_vat_zo;
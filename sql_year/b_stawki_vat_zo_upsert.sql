@@ -0,0 +1,4 @@
+INSERT INTO b_stawki_vat_zo (stawka_vat_zo, wartosc_stawki_vat_zo, tytul, opis, uwagi)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (stawka_vat_zo) DO UPDATE
+SET wartosc_stawki_vat_zo = excluded.wartosc_stawki_vat_zo, tytul = excluded.tytul, opis = excluded.opis, uwagi = excluded.uwagi;
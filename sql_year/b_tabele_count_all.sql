@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_tabele;
\ No newline at end of file
@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_tabele (tabela, tytul, lp, symbol, opis, uwagi)
+VALUES (:tabela, :tytul, :lp, :symbol, :opis, :uwagi);
@@ -1 +1,2 @@
-select * from b_tabele;
\ No newline at end of file
+SELECT tabela AS "Tabela", tytul AS "Tytuł", lp AS "Lp", symbol AS "Symbol", opis AS "Opis", uwagi AS "Uwagi"
+FROM b_tabele;
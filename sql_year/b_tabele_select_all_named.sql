@@ -0,0 +1,2 @@
+SELECT tabela, tytul, lp, symbol, opis, uwagi
+FROM b_tabele;
@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_typy_jm;
\ No newline at end of file
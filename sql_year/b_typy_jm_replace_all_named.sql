@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_typy_jm (typ_jm, opis, uwagi)
+VALUES (:typ_jm, :opis, :uwagi);
@@ -0,0 +1,2 @@
+SELECT typ_jm, opis, uwagi
+FROM b_typy_jm;
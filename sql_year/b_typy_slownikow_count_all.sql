@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_typy_slownikow;
\ No newline at end of file
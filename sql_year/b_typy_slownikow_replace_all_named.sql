@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_typy_slownikow (typ_slownika, opis, uwagi)
+VALUES (:typ_slownika, :opis, :uwagi);
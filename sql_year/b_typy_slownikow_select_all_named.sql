@@ -0,0 +1,2 @@
+SELECT typ_slownika, opis, uwagi
+FROM b_typy_slownikow;
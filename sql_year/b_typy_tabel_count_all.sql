@@ -0,0 +1 @@
+SELECT COUNT(*) FROM b_typy_tabel;
\ No newline at end of file
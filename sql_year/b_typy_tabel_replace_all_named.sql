@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO b_typy_tabel (typ_tabeli, typ_tabeli4schemat, opis, uwagi)
+VALUES (:typ_tabeli, :typ_tabeli4schemat, :opis, :uwagi);
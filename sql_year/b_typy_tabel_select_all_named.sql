@@ -0,0 +1,2 @@
+SELECT typ_tabeli, typ_tabeli4schemat, opis, uwagi
+FROM b_typy_tabel;
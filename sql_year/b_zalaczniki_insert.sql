@@ -0,0 +1,2 @@
+INSERT INTO b_zalaczniki (idgr, podtabela, nazwa_pliku, rozmiar, typ, zawartosc, login)
+VALUES (?, ?, ?, ?, ?, ?, ?);
@@ -0,0 +1,3 @@
+SELECT id, idgr, podtabela, nazwa_pliku, rozmiar, typ, zawartosc, login, data_dodania
+FROM b_zalaczniki
+WHERE id = ? AND idgr = ? AND podtabela = ?;
@@ -0,0 +1,4 @@
+SELECT id, idgr, podtabela, nazwa_pliku, rozmiar, typ, login, data_dodania
+FROM b_zalaczniki
+WHERE idgr = ? AND podtabela = ?
+ORDER BY id;
@@ -0,0 +1 @@
+SELECT COUNT(*) FROM fr_kody;
\ No newline at end of file
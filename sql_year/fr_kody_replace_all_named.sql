@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO fr_kody (tabela_kod, nazwa, tabela, kod)
+VALUES (:tabela_kod, :nazwa, :tabela, :kod);
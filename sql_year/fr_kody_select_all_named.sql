@@ -0,0 +1,2 @@
+SELECT tabela_kod, nazwa, tabela, kod
+FROM fr_kody;
@@ -0,0 +1 @@
+SELECT COUNT(*) FROM pkd_pkd;
\ No newline at end of file
@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO pkd_pkd (kod, opis)
+VALUES (:kod, :opis);
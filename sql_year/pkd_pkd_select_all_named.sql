@@ -0,0 +1,2 @@
+SELECT kod, opis
+FROM pkd_pkd;
@@ -0,0 +1,5 @@
+SELECT kod, opis
+FROM pkd_pkd
+WHERE kod LIKE ? || '%' OR opis LIKE '%' || ? || '%'
+ORDER BY kod
+LIMIT ?;
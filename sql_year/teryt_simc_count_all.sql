@@ -0,0 +1 @@
+SELECT COUNT(*) FROM teryt_simc;
\ No newline at end of file
@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO teryt_simc (simc, miejscowosc, nrwpgr)
+VALUES (:simc, :miejscowosc, :nrwpgr);
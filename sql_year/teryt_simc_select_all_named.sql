@@ -0,0 +1,2 @@
+SELECT simc, miejscowosc, nrwpgr
+FROM teryt_simc;
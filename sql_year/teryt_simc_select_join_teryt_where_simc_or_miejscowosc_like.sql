@@ -0,0 +1,11 @@
+SELECT
+    teryt_simc.simc,
+    teryt_simc.miejscowosc,
+    teryt_teryt.gmina,
+    teryt_teryt.powiat
+FROM teryt_simc
+LEFT JOIN teryt_teryt
+    ON teryt_simc.nrwpgr = teryt_teryt.nrwpgr
+WHERE teryt_simc.simc LIKE ? || '%' OR teryt_simc.miejscowosc LIKE ? || '%'
+ORDER BY teryt_simc.miejscowosc, teryt_simc.simc
+LIMIT ?;
@@ -0,0 +1 @@
+SELECT COUNT(*) FROM teryt_teryt;
\ No newline at end of file
@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO teryt_teryt (nrwpgr, wojewodztwo, powiat, gmina, rodzaj_gminy)
+VALUES (:nrwpgr, :wojewodztwo, :powiat, :gmina, :rodzaj_gminy);
@@ -0,0 +1,2 @@
+SELECT nrwpgr, wojewodztwo, powiat, gmina, rodzaj_gminy
+FROM teryt_teryt;
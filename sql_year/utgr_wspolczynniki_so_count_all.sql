@@ -0,0 +1 @@
+SELECT COUNT(*) FROM utgr_wspolczynniki_so;
\ No newline at end of file
@@ -0,0 +1,2 @@
+INSERT OR REPLACE INTO utgr_wspolczynniki_so (kod_soc, opis_soc)
+VALUES (:kod_soc, :opis_soc);
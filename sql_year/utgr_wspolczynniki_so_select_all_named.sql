@@ -0,0 +1,2 @@
+SELECT kod_soc, opis_soc
+FROM utgr_wspolczynniki_so;
@@ -1,13 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
 	"net/http"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/jmoiron/sqlx"
 )
 
 
@@ -81,14 +94,28 @@ var (
 		Key:       "slownik_fomularzy",
 		Label:     "Słowniki formularzy",
 		Access:    AccessAllUsers,
-		TableName: "SlownikiSlownikFomularzy",
+		TableName: "b_typy_slownikow",
 	}
 	tabSlownikiWartosciSlownikow = &TabNode{
 		Lp:        20,
 		Key:       "wartosci_slownikow",
 		Label:     "Wartości słowników formularzy",
 		Access:    AccessAllUsers,
-		TableName: "SlownikiWartosciSlownikow",
+		TableName: "b_slowniki",
+	}
+	tabSlownikiStawkiVATZO = &TabNode{
+		Lp:        30,
+		Key:       "stawki_vat_zo",
+		Label:     "Stawki VAT ZO",
+		Access:    AccessAllUsers,
+		TableName: "b_stawki_vat_zo",
+	}
+	tabSlownikiStawkiVATRR = &TabNode{
+		Lp:        40,
+		Key:       "stawki_vat_rr",
+		Label:     "Stawki VAT RR",
+		Access:    AccessAllUsers,
+		TableName: "b_stawki_vat_rr",
 	}
 	tabSlowniki = &TabNode{
 		Lp:     20,
@@ -98,6 +125,8 @@ var (
 		Children: map[string]*TabNode{
 			"slownik_fomularzy":  tabSlownikiSlownikFomularzy,
 			"wartosci_slownikow": tabSlownikiWartosciSlownikow,
+			"stawki_vat_zo":      tabSlownikiStawkiVATZO,
+			"stawki_vat_rr":      tabSlownikiStawkiVATRR,
 		},
 	}
 )
@@ -183,7 +212,7 @@ type StawkiVATZO struct {
 	WartoscStawkiVATZO float64        `db:"wartosc_stawki_vat_zo"`
 	Tytul              string         `db:"tytul"`
 	Opis               sql.NullString `db:"opis"`
-	Uwagi              sql.NullString `db:"opis"`
+	Uwagi              sql.NullString `db:"uwagi"`
 }
 
 type StawkiVATRR struct {
@@ -191,7 +220,7 @@ type StawkiVATRR struct {
 	WartoscStawkiVATRR float64        `db:"wartosc_stawki_vat_rr"`
 	Tytul              string         `db:"tytul"`
 	Opis               sql.NullString `db:"opis"`
-	Uwagi              sql.NullString `db:"opis"`
+	Uwagi              sql.NullString `db:"uwagi"`
 }
 
 type UTGRWspolczynnikiSO struct {
@@ -207,13 +236,58 @@ type FRKody struct {
 }
 
 
+// Column help for the metodyka system tables, keyed by column name. These tables
+// describe the survey itself, so there is no b_kolumny row to take the text from.
+var SYSTEM_COLUMN_TOOLTIPS = map[string]string{
+	"Tabela": "Kod tabeli, używany w adresach i w b_podtabele",
+	"Tytuł":  "Nazwa tabeli wyświetlana w zakładkach",
+	"Lp":     "Kolejność tabeli w zakładkach",
+	"Symbol": "Symbol tabeli z formularza papierowego",
+	"Opis":   "Opis tabeli dla ankietera",
+	"Uwagi":  "Uwagi metodyczne, niewidoczne dla ankietera",
+
+	"Typ słownika":   "Rodzaj słownika, wspólny dla słowników o tej samej budowie",
+	"Słownik":        "Kod słownika, wskazywany w b_kolumny.slownik",
+	"Wartości":       "Dopuszczalne wartości słownika",
+	"Stawka VAT":     "Kod stawki, wskazywany w b_kody",
+	"Wartość stawki": "Stawka jako ułamek, np. 0.23",
+}
+
+// SystemTableBuild lays out a read-only SYSTEM_DEFINITION grid; values holds one
+// slice of cell texts per row, in column order. Reference data is edited through
+// import, never cell by cell, so every cell has Editable 0.
+func SystemTableBuild(year, tableName string, columns []TableColumn, values [][]string) TableSchema {
+	tableSchema := TableSchema{
+		Type:      SYSTEM_DEFINITON,
+		TableName: tableName,
+		Year:      year,
+		Columns:   columns,
+	}
+
+	for _, rowValues := range values {
+		var tableRow TableRow
+		for i, value := range rowValues {
+			column := &tableSchema.Columns[i]
+			tableRow.Cells = append(tableRow.Cells, TableCell{Column: column, Name: column.Name, Value: value})
+		}
+		tableSchema.Rows = append(tableSchema.Rows, tableRow)
+	}
+
+	return tableSchema
+}
+
+// systemTableColumn is the column shape shared by the read-only system tables.
+func systemTableColumn(name string, width int64, dataType string) TableColumn {
+	return TableColumn{Name: name, Tooltip: SYSTEM_COLUMN_TOOLTIPS[name], Width: width, DataType: dataType}
+}
+
 func (app *Application) TableSysBTabeleGet(year, endpoint string, yearDB YearDB) TableSchema {
-	columnTabela := TableColumn{Name: "Tabela", Tooltip: "Darek wymysli", Width: 30, IsPK: true, DataType: "string"}
-	columnTytul := TableColumn{Name: "Tytuł", Tooltip: "Darek wymysli", Width: 90, IsPK: false, DataType: "string"}
-	columnLp := TableColumn{Name: "Lp", Tooltip: "Darek wymysli", Width: 30, IsPK: false, DataType: "int"}
-	columnSymbol := TableColumn{Name: "Symbol", Tooltip: "Darek wymysli", Width: 80, IsPK: false, DataType: "string"}
-	columnOpis := TableColumn{Name: "Opis", Tooltip: "Darek wymysli", Width: 80, IsPK: false, DataType: "string"}
-	columnUwagi := TableColumn{Name: "Uwagi", Tooltip: "Darek wymysli", Width: 80, IsPK: false, DataType: "string"}
+	columnTabela := TableColumn{Name: "Tabela", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Tabela"], Width: 30, IsPK: true, DataType: "string"}
+	columnTytul := TableColumn{Name: "Tytuł", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Tytuł"], Width: 90, IsPK: false, DataType: "string"}
+	columnLp := TableColumn{Name: "Lp", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Lp"], Width: 30, IsPK: false, DataType: "int"}
+	columnSymbol := TableColumn{Name: "Symbol", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Symbol"], Width: 80, IsPK: false, DataType: "string"}
+	columnOpis := TableColumn{Name: "Opis", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Opis"], Width: 80, IsPK: false, DataType: "string"}
+	columnUwagi := TableColumn{Name: "Uwagi", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Uwagi"], Width: 80, IsPK: false, DataType: "string"}
 
 	tableSchema := TableSchema{
 		Type:      SYSTEM_DEFINITON,
@@ -229,34 +303,532 @@ func (app *Application) TableSysBTabeleGet(year, endpoint string, yearDB YearDB)
 	}
 	defer rows.Close()
 
-	var tableRows []TableRow
-	for rows.Next() {
-		var b BTabele
-		if err := rows.Scan(&b); err != nil {
-			app.Logger.Error("scan failed", "error", err)
-			return TableSchema{}
-		}
-		tableRows = append(tableRows, TableRow{
-			Cells: []TableCell{
-				{Column: &columnTabela, Value: b.Tabela, Name: "tabela", Editable: 1},
-				{Column: &columnTytul, Value: b.Tytul, Name: "tytul", Editable: 1},
-				{Column: &columnLp, Value: strconv.FormatInt(b.LP, 10), Name: "lp", Editable: 1},
-				{Column: &columnSymbol, Value: b.Symbol, Name: "symbol", Editable: 1},
-				{Column: &columnOpis, Value: b.Opis.String, Name: "opis", Editable: 1},
-				{Column: &columnUwagi, Value: b.Uwagi.String, Name: "uwagi", Editable: 1},
-			},
+	tableSchema.Rows, err = ScanRowsToTableRows(rows, tableSchema.Columns)
+	if err != nil {
+		app.Logger.Error("scan failed", "error", err)
+		return tableSchema
+	}
+	for i := range tableSchema.Rows {
+		for j := range tableSchema.Rows[i].Cells {
+			tableSchema.Rows[i].Cells[j].Editable = 1
+		}
+	}
+
+	return tableSchema
+}
+
+func (app *Application) TableSysBTypySlownikowGet(year string, yearDB YearDB) TableSchema {
+	columns := []TableColumn{
+		{Name: "Typ słownika", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Typ słownika"], Width: 60, IsPK: true, DataType: "str"},
+		{Name: "Opis", Width: 120, DataType: "str"},
+		{Name: "Uwagi", Width: 120, DataType: "str"},
+	}
+
+	rows, err := app.DBManager.YQueryx(yearDB, "b_typy_slownikow_select_all")
+	if err != nil {
+		app.Logger.Error(err.Error())
+		return SystemTableBuild(year, "b_typy_slownikow", columns, nil)
+	}
+	defer rows.Close()
+
+	var typy []TypySlownikow
+	if err := sqlx.StructScan(rows, &typy); err != nil {
+		app.Logger.Error(err.Error())
+		return SystemTableBuild(year, "b_typy_slownikow", columns, nil)
+	}
+
+	values := make([][]string, 0, len(typy))
+	for _, t := range typy {
+		values = append(values, []string{t.TypSlownika, t.Opis.String, t.Uwagi.String})
+	}
+
+	return SystemTableBuild(year, "b_typy_slownikow", columns, values)
+}
+
+func (app *Application) TableSysBSlownikiGet(year string, yearDB YearDB) TableSchema {
+	columns := []TableColumn{
+		{Name: "Słownik", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Słownik"], Width: 60, IsPK: true, DataType: "str"},
+		{Name: "Typ słownika", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Typ słownika"], Width: 60, DataType: "str"},
+		{Name: "Wartości", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Wartości"], Width: 160, DataType: "str"},
+		{Name: "Opis", Width: 120, DataType: "str"},
+		{Name: "Uwagi", Width: 120, DataType: "str"},
+	}
+
+	rows, err := app.DBManager.YQueryx(yearDB, "b_slowniki_select_all")
+	if err != nil {
+		app.Logger.Error(err.Error())
+		return SystemTableBuild(year, "b_slowniki", columns, nil)
+	}
+	defer rows.Close()
+
+	var slowniki []Slowniki
+	if err := sqlx.StructScan(rows, &slowniki); err != nil {
+		app.Logger.Error(err.Error())
+		return SystemTableBuild(year, "b_slowniki", columns, nil)
+	}
+
+	values := make([][]string, 0, len(slowniki))
+	for _, s := range slowniki {
+		values = append(values, []string{s.Slownik, s.TypSlownika, s.Wartosc, s.Opis.String, s.Uwagi.String})
+	}
+
+	return SystemTableBuild(year, "b_slowniki", columns, values)
+}
+
+func stawkiVATColumns() []TableColumn {
+	return []TableColumn{
+		{Name: "Stawka VAT", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Stawka VAT"], Width: 50, IsPK: true, DataType: "str"},
+		{Name: "Wartość stawki", Tooltip: SYSTEM_COLUMN_TOOLTIPS["Wartość stawki"], Width: 50, DataType: "float"},
+		{Name: "Tytuł", Width: 90, DataType: "str"},
+		{Name: "Opis", Width: 120, DataType: "str"},
+		{Name: "Uwagi", Width: 120, DataType: "str"},
+	}
+}
+
+func (app *Application) TableSysBStawkiVATZOGet(year string, yearDB YearDB) TableSchema {
+	columns := stawkiVATColumns()
+
+	rows, err := app.DBManager.YQueryx(yearDB, "b_stawki_vat_zo_select_all")
+	if err != nil {
+		app.Logger.Error(err.Error())
+		return SystemTableBuild(year, "b_stawki_vat_zo", columns, nil)
+	}
+	defer rows.Close()
+
+	var stawki []StawkiVATZO
+	if err := sqlx.StructScan(rows, &stawki); err != nil {
+		app.Logger.Error(err.Error())
+		return SystemTableBuild(year, "b_stawki_vat_zo", columns, nil)
+	}
+
+	values := make([][]string, 0, len(stawki))
+	for _, s := range stawki {
+		rate := strconv.FormatFloat(s.WartoscStawkiVATZO, 'f', -1, 64)
+		values = append(values, []string{s.StawkaVATZO, rate, s.Tytul, s.Opis.String, s.Uwagi.String})
+	}
+
+	return SystemTableBuild(year, "b_stawki_vat_zo", columns, values)
+}
+
+func (app *Application) TableSysBStawkiVATRRGet(year string, yearDB YearDB) TableSchema {
+	columns := stawkiVATColumns()
+
+	rows, err := app.DBManager.YQueryx(yearDB, "b_stawki_vat_rr_select_all")
+	if err != nil {
+		app.Logger.Error(err.Error())
+		return SystemTableBuild(year, "b_stawki_vat_rr", columns, nil)
+	}
+	defer rows.Close()
+
+	var stawki []StawkiVATRR
+	if err := sqlx.StructScan(rows, &stawki); err != nil {
+		app.Logger.Error(err.Error())
+		return SystemTableBuild(year, "b_stawki_vat_rr", columns, nil)
+	}
+
+	values := make([][]string, 0, len(stawki))
+	for _, s := range stawki {
+		rate := strconv.FormatFloat(s.WartoscStawkiVATRR, 'f', -1, 64)
+		values = append(values, []string{s.StawkaVATRR, rate, s.Tytul, s.Opis.String, s.Uwagi.String})
+	}
+
+	return SystemTableBuild(year, "b_stawki_vat_rr", columns, values)
+}
+
+// SystemImportColumn is one column an import file may carry; Number columns are
+// stored as REAL and accept the Polish "0,23" as well as "0.23".
+type SystemImportColumn struct {
+	Name     string
+	Required bool
+	Number   bool
+}
+
+// SystemImport describes a reference table that admins load from a file. The first
+// column is the primary key and Query takes the columns in this order.
+type SystemImport struct {
+	Columns []SystemImportColumn
+	Query   string
+}
+
+var SYSTEM_IMPORTS = map[string]SystemImport{
+	"b_slowniki": {
+		Columns: []SystemImportColumn{
+			{Name: "slownik", Required: true},
+			{Name: "wartosc", Required: true},
+			{Name: "typ_slownika", Required: true},
+			{Name: "opis"},
+			{Name: "uwagi"},
+		},
+		Query: "b_slowniki_upsert",
+	},
+	"b_stawki_vat_zo": {
+		Columns: []SystemImportColumn{
+			{Name: "stawka_vat_zo", Required: true},
+			{Name: "wartosc_stawki_vat_zo", Number: true},
+			{Name: "tytul", Required: true},
+			{Name: "opis"},
+			{Name: "uwagi"},
+		},
+		Query: "b_stawki_vat_zo_upsert",
+	},
+	"b_stawki_vat_rr": {
+		Columns: []SystemImportColumn{
+			{Name: "stawka_vat_rr", Required: true},
+			{Name: "wartosc_stawki_vat_rr", Number: true},
+			{Name: "tytul", Required: true},
+			{Name: "opis"},
+			{Name: "uwagi"},
+		},
+		Query: "b_stawki_vat_rr_upsert",
+	},
+}
+
+const SYSTEM_IMPORT_MAX_SIZE = 10 << 20
+
+// SystemImportRow is the outcome for one data row; Row counts from 1 and skips the
+// CSV header, so row 1 is the second line of the file.
+type SystemImportRow struct {
+	Row   int    `json:"row"`
+	Key   string `json:"key"`
+	Error string `json:"error,omitempty"`
+}
+
+// SystemImportRecords reads a .csv or .json import file into one map per row. CSV
+// needs a header row; Excel in a Polish locale saves with ';', so the header
+// decides between ';' and ','.
+func SystemImportRecords(name string, content []byte) ([]map[string]string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		var items []map[string]any
+		if err := json.Unmarshal(content, &items); err != nil {
+			return nil, err
+		}
+		records := make([]map[string]string, 0, len(items))
+		for _, item := range items {
+			record := make(map[string]string, len(item))
+			for k, v := range item {
+				record[k] = formatValue(v)
+			}
+			records = append(records, record)
+		}
+		return records, nil
+
+	case ".csv":
+		content = bytes.TrimPrefix(content, []byte("\ufeff"))
+		header, _, _ := bytes.Cut(content, []byte("\n"))
+		reader := csv.NewReader(bytes.NewReader(content))
+		if bytes.Contains(header, []byte(";")) {
+			reader.Comma = ';'
+		}
+		lines, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(lines) == 0 {
+			return nil, errors.New("missing header row")
+		}
+		records := make([]map[string]string, 0, len(lines)-1)
+		for _, line := range lines[1:] {
+			record := make(map[string]string, len(line))
+			for i, value := range line {
+				record[strings.TrimSpace(lines[0][i])] = value
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	}
+
+	return nil, fmt.Errorf("unsupported file type %q, expected .csv or .json", filepath.Ext(name))
+}
+
+// Check rejects files whose columns don't belong to the table or lack a required
+// one; those are a wrong file rather than bad rows.
+func (imp SystemImport) Check(records []map[string]string) error {
+	known := make(map[string]bool, len(imp.Columns))
+	for _, column := range imp.Columns {
+		known[column.Name] = true
+	}
+	for _, record := range records {
+		for name := range record {
+			if !known[name] {
+				return fmt.Errorf("unknown column %q", name)
+			}
+		}
+		for _, column := range imp.Columns {
+			if _, ok := record[column.Name]; column.Required && !ok {
+				return fmt.Errorf("missing column %q", column.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Args validates one record and returns the upsert arguments. Empty optional
+// values are stored as NULL, not as empty strings.
+func (imp SystemImport) Args(record map[string]string) ([]any, error) {
+	args := make([]any, 0, len(imp.Columns))
+	for _, column := range imp.Columns {
+		value := strings.TrimSpace(record[column.Name])
+		switch {
+		case value == "" && column.Required:
+			return nil, fmt.Errorf("%s: Pole wymagane", column.Name)
+		case value == "":
+			args = append(args, nil)
+		case column.Number:
+			number, err := ParseLocalizedNumber(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: Nieprawidłowy format liczby", column.Name)
+			}
+			args = append(args, number)
+		default:
+			args = append(args, value)
+		}
+	}
+	return args, nil
+}
+
+// SystemImportPost upserts an uploaded file ("plik") into a reference table. Every
+// row is validated first and all are written in one transaction, so a file with
+// any bad row changes nothing; the response lists the result of each row.
+func (app *Application) SystemImportPost(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	imp, ok := SYSTEM_IMPORTS[r.PathValue("table")]
+	if !ok {
+		app.jsonError(w, "Unknown table", http.StatusNotFound)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, SYSTEM_IMPORT_MAX_SIZE+64<<10)
+	if err := r.ParseMultipartForm(SYSTEM_IMPORT_MAX_SIZE); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			app.jsonError(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		app.jsonError(w, "Invalid upload", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("plik")
+	if err != nil {
+		app.jsonError(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	records, err := SystemImportRecords(header.Filename, content)
+	if err != nil {
+		app.jsonError(w, "Invalid file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := imp.Check(records); err != nil {
+		app.jsonError(w, "Invalid file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]SystemImportRow, len(records))
+	args := make([][]any, len(records))
+	valid := true
+	for i, record := range records {
+		results[i] = SystemImportRow{Row: i + 1, Key: record[imp.Columns[0].Name]}
+		if args[i], err = imp.Args(record); err != nil {
+			results[i].Error = err.Error()
+			valid = false
+		}
+	}
+
+	if valid {
+		err = app.DBManager.YTx(yearDB, func(tx *SqlTx) error {
+			for i := range args {
+				if _, err := tx.Exec(imp.Query, args[i]...); err != nil {
+					results[i].Error = err.Error()
+					return err
+				}
+			}
+			return nil
 		})
+		valid = err == nil
 	}
 
-	if err := rows.Err(); err != nil {
-		app.Logger.Error(fmt.Sprintln("rows iteration failed:", err.Error()))
-		return tableSchema
+	if !valid {
+		app.RenderJSON(w, http.StatusUnprocessableEntity, map[string]any{"success": false, "rows": results})
+		return
 	}
+	app.RenderJSON(w, http.StatusOK, map[string]any{"success": true, "rows": results})
+}
 
-	tableSchema.Rows = tableRows
+// DiffField is one column that differs between the two years.
+type DiffField struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
 
-	return tableSchema
-}	
+type DiffRow struct {
+	Key    string               `json:"key"`
+	Fields map[string]DiffField `json:"fields"`
+}
+
+// SystemDiff compares a reference table between two years; rows are matched by
+// primary key and keys are sorted, so the same change always reads the same.
+type SystemDiff struct {
+	Table   string    `json:"table"`
+	From    YearDB    `json:"from"`
+	To      YearDB    `json:"to"`
+	Added   []string  `json:"added"`
+	Removed []string  `json:"removed"`
+	Changed []DiffRow `json:"changed"`
+}
+
+// StructDiff lists the db columns whose values differ between a and b, two values
+// of the same struct type. Nullable fields compare by their SQL value, so NULL and
+// "" count as a change.
+func StructDiff(a, b any) map[string]DiffField {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	fields := make(map[string]DiffField)
+	for i := 0; i < va.NumField(); i++ {
+		column := va.Type().Field(i).Tag.Get("db")
+		if column == "" {
+			continue
+		}
+		from, to := diffValue(va.Field(i)), diffValue(vb.Field(i))
+		if from != to {
+			fields[column] = DiffField{From: from, To: to}
+		}
+	}
+	return fields
+}
+
+func diffValue(v reflect.Value) any {
+	if valuer, ok := v.Interface().(driver.Valuer); ok {
+		value, _ := valuer.Value()
+		return value
+	}
+	return v.Interface()
+}
+
+// SystemDiffBuild diffs two row sets keyed by primary key.
+func SystemDiffBuild(from, to map[string]any) SystemDiff {
+	diff := SystemDiff{Added: []string{}, Removed: []string{}, Changed: []DiffRow{}}
+	for key, row := range to {
+		old, ok := from[key]
+		if !ok {
+			diff.Added = append(diff.Added, key)
+			continue
+		}
+		if fields := StructDiff(old, row); len(fields) > 0 {
+			diff.Changed = append(diff.Changed, DiffRow{Key: key, Fields: fields})
+		}
+	}
+	for key := range from {
+		if _, ok := to[key]; !ok {
+			diff.Removed = append(diff.Removed, key)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Key < diff.Changed[j].Key })
+	return diff
+}
+
+// SYSTEM_DIFFS load a reference table of one year keyed by primary key. b_kolumny
+// is too big to compare whole, so it takes ?podtabela=.
+var SYSTEM_DIFFS = map[string]func(app *Application, yearDB YearDB, r *http.Request) (map[string]any, error){
+	"b_kolumny": func(app *Application, yearDB YearDB, r *http.Request) (map[string]any, error) {
+		kolumny, err := app.KolumnySelectBySubtable(yearDB, r.URL.Query().Get("podtabela"))
+		rows := make(map[string]any, len(kolumny))
+		for _, k := range kolumny {
+			rows[k.Name] = k
+		}
+		return rows, err
+	},
+	"b_slowniki": func(app *Application, yearDB YearDB, r *http.Request) (map[string]any, error) {
+		var slowniki []Slowniki
+		err := systemDiffSelect(app, yearDB, "b_slowniki_select_all", &slowniki)
+		rows := make(map[string]any, len(slowniki))
+		for _, s := range slowniki {
+			rows[s.Slownik] = s
+		}
+		return rows, err
+	},
+	"b_stawki_vat_zo": func(app *Application, yearDB YearDB, r *http.Request) (map[string]any, error) {
+		var stawki []StawkiVATZO
+		err := systemDiffSelect(app, yearDB, "b_stawki_vat_zo_select_all", &stawki)
+		rows := make(map[string]any, len(stawki))
+		for _, s := range stawki {
+			rows[s.StawkaVATZO] = s
+		}
+		return rows, err
+	},
+	"b_stawki_vat_rr": func(app *Application, yearDB YearDB, r *http.Request) (map[string]any, error) {
+		var stawki []StawkiVATRR
+		err := systemDiffSelect(app, yearDB, "b_stawki_vat_rr_select_all", &stawki)
+		rows := make(map[string]any, len(stawki))
+		for _, s := range stawki {
+			rows[s.StawkaVATRR] = s
+		}
+		return rows, err
+	},
+}
+
+func systemDiffSelect(app *Application, yearDB YearDB, queryName string, dest any) error {
+	rows, err := app.DBManager.YQueryx(yearDB, queryName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return sqlx.StructScan(rows, dest)
+}
+
+// SystemDiffGet reports how a reference table changed from the year in ?od= to
+// the year in the path.
+func (app *Application) SystemDiffGet(w http.ResponseWriter, r *http.Request) {
+	toYear, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	fromInt, err := strconv.Atoi(r.URL.Query().Get("od"))
+	fromYear := YearDB(fromInt)
+	if err != nil || !app.DBManager.HasYear(fromYear) {
+		app.jsonError(w, "Unknown year in od", http.StatusNotFound)
+		return
+	}
+	table := r.PathValue("table")
+	load, ok := SYSTEM_DIFFS[table]
+	if !ok {
+		app.jsonError(w, "Unknown table", http.StatusNotFound)
+		return
+	}
+	if table == "b_kolumny" && r.URL.Query().Get("podtabela") == "" {
+		app.jsonError(w, "Missing podtabela", http.StatusBadRequest)
+		return
+	}
+
+	from, err := load(app, fromYear, r)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	to, err := load(app, toYear, r)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	diff := SystemDiffBuild(from, to)
+	diff.Table, diff.From, diff.To = table, fromYear, toYear
+	app.RenderJSON(w, http.StatusOK, diff)
+}
 
 func (app *Application) MetodykaGet(w http.ResponseWriter, r *http.Request) {
 	year := r.PathValue("year")
@@ -291,7 +863,7 @@ func (app *Application) MetodykaGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	baseUrl := fmt.Sprintf("/app/%s/bdgr/metodyka", year)
+	baseUrl := AppURL("app", year, "bdgr", "metodyka")
 	tmplBaseData.TabRows = TabsBDGRMetodyka.TabRowsBuild(baseUrl, segments, tmplBaseData.User.Role)
 	tableName := TabsBDGRMetodyka.TableNameGet(segments)
 
@@ -299,6 +871,367 @@ func (app *Application) MetodykaGet(w http.ResponseWriter, r *http.Request) {
 	app.Render(w, r, http.StatusOK, TMPL_GRID, tmplBaseData)
 }
 
+// MetodykaPreviewGet shows the grid of a subtable as a farm sees it before
+// answering, so methodologists can check columns, blocks and types without
+// opening a farm. Nothing on it is saved.
+func (app *Application) MetodykaPreviewGet(w http.ResponseWriter, r *http.Request) {
+	data, err := app.TmplBaseDataUserDate(r)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	data.Module = TmplModuleBDGR
+
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.Forbidden(w, r)
+		return
+	}
+	table, subtable := r.PathValue("table"), r.PathValue("subtable")
+
+	subtabItems, err := app.TabRowsSubtableBuild(yearDB, "", table, subtable)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	data.TabRows = []TmplTabsRow{{Items: subtabItems, BaseUrl: AppURL("app", yearDB, "bdgr", "metodyka", "preview")}}
+
+	compact, err := CompactParse(r)
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	data.Table, err = app.SubtableSchemaBuild(r, yearDB, "", table, subtable, compact, data.User)
+	switch {
+	case errors.Is(err, ErrTableTypeUnknown):
+		app.logger(r).Error(err.Error())
+		status = http.StatusNotImplemented
+	case errors.Is(err, sql.ErrNoRows):
+		http.NotFound(w, r)
+		return
+	case err != nil:
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.Render(w, r, status, TMPL_GRID, data)
+}
+
+// SubtableIntrospection is everything SubtableSchemaBuild reads about a
+// subtable, for checking a form definition without rendering it.
+type SubtableIntrospection struct {
+	Subtable string `json:"subtable"`
+	Table    string `json:"table"`
+	Title    string `json:"title"`
+	Type     string `json:"type"`
+	// Supported is false for types SubtableSchemaBuild can't build rows for.
+	Supported   bool `json:"supported"`
+	Compactable bool `json:"compactable"`
+
+	Columns []TableColumn                `json:"columns"`
+	Codes   []SubtableIntrospectionCode  `json:"codes"`
+	Blocks  []SubtableIntrospectionBlock `json:"blocks"`
+}
+
+type SubtableIntrospectionCode struct {
+	Code  string `json:"code"`
+	Title string `json:"title"`
+	Lp    *int64 `json:"lp"`
+}
+
+type SubtableIntrospectionBlock struct {
+	Column string `json:"column"`
+	Code   string `json:"code"`
+	Opis   string `json:"opis,omitempty"`
+}
+
+// SUBTABLE_TYPES_SUPPORTED are the types SubtableSchemaBuild renders.
+var SUBTABLE_TYPES_SUPPORTED = []string{
+	HORIZONTAL_DYNAMIC_DUPLICABLE, HORIZONTAL_DYNAMIC_UNIQUE, HORIZONTAL_STATIC_UNIQUE,
+	PKD_STATIC_UNIQUE, SIMC_STATIC_UNIQUE, VERTICAL_STATIC_UNIQUE, MATRIX_DYNAMIC_UNIQUE,
+}
+
+// MetodykaSchemaGet dumps the definition of a subtable as JSON: its type, the
+// columns with their rules, the codes and the blocks.
+func (app *Application) MetodykaSchemaGet(w http.ResponseWriter, r *http.Request) {
+	yearDB, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	subtable := r.PathValue("subtable")
+
+	definition, err := app.SubtableDefinitionSelect(yearDB, subtable)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.jsonError(w, "Unknown subtable", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	kody, err := app.KodySelectBySubtable(yearDB, subtable)
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+
+	podtabela := definition.Podtabela
+	introspection := SubtableIntrospection{
+		Subtable:    podtabela.Subtable,
+		Table:       podtabela.Table,
+		Title:       podtabela.Symbol + podtabela.Title,
+		Type:        podtabela.TableSchema,
+		Supported:   slices.Contains(SUBTABLE_TYPES_SUPPORTED, podtabela.TableSchema),
+		Compactable: TableCompactable(podtabela.TableSchema),
+		Columns:     definition.Columns,
+		Codes:       make([]SubtableIntrospectionCode, 0, len(kody)),
+		Blocks:      make([]SubtableIntrospectionBlock, 0, len(definition.Blocks)),
+	}
+	if introspection.Columns == nil {
+		introspection.Columns = []TableColumn{}
+	}
+	for _, kod := range kody {
+		code := SubtableIntrospectionCode{Code: kod.Code, Title: kod.Title}
+		if kod.Lp.Valid {
+			code.Lp = &kod.Lp.Int64
+		}
+		introspection.Codes = append(introspection.Codes, code)
+	}
+	for _, block := range definition.Blocks {
+		introspection.Blocks = append(introspection.Blocks, SubtableIntrospectionBlock{Column: block.Column, Code: block.Code, Opis: block.Opis.String})
+	}
+
+	app.RenderJSON(w, http.StatusOK, introspection)
+}
+
+// DEFINITION_TABLES are the metodyka and reference tables a new year takes
+// over from an earlier one, each after the tables it refers to. Answers,
+// statuses, attachments and the audit trail belong to their year and stay.
+var DEFINITION_TABLES = []string{
+	"b_kody_w_tabeli",
+	"b_typy_tabel",
+	"b_rodzaje_tabel",
+	"b_tabele",
+	"b_podtabele",
+	"b_typy_jm",
+	"b_jm",
+	"b_typy_slownikow",
+	"b_slowniki",
+	"b_kolumny",
+	"b_stawki_vat_zo",
+	"b_stawki_vat_rr",
+	"b_kody",
+	"b_kody__podtabele",
+	"b_blokady",
+	"b_etapy",
+	"fr_kody",
+	"pkd_pkd",
+	"teryt_teryt",
+	"teryt_simc",
+	"utgr_wspolczynniki_so",
+}
+
+type DefinitionsCopyResult struct {
+	Tabela    string `json:"tabela"`
+	Wiersze   int    `json:"wiersze"`
+	Nadpisano bool   `json:"nadpisano"`
+}
+
+// ErrDefinitionsTargetNotEmpty stops DefinitionsCopyPost from merging into a
+// year that already has definitions unless the admin confirms.
+var ErrDefinitionsTargetNotEmpty = errors.New("target year has definitions")
+
+// DefinitionsRead loads every DEFINITION_TABLES row of a year in one read
+// transaction, so the copy is consistent even while the year is edited. Each
+// table is read by its {table}_select_all_named query, with the columns year.sql has.
+func (m *DBManager) DefinitionsRead(year YearDB) (map[string][]map[string]any, error) {
+	var tables map[string][]map[string]any
+	err := m.YTx(year, func(tx *SqlTx) error {
+		tables = make(map[string][]map[string]any, len(DEFINITION_TABLES))
+		for _, table := range DEFINITION_TABLES {
+			rows, err := tx.Queryx(table + "_select_all_named")
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				row := make(map[string]any)
+				if err := rows.MapScan(row); err != nil {
+					rows.Close()
+					return err
+				}
+				// TEXT comes back as []byte, which would be written back as a BLOB.
+				for column, value := range row {
+					if b, ok := value.([]byte); ok {
+						row[column] = string(b)
+					}
+				}
+				tables[table] = append(tables[table], row)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return tables, err
+}
+
+// ErrPrzepisacNaConflict is a przepisac_na naming a column the new year
+// already gets, from the source as it is or from another rename.
+var ErrPrzepisacNaConflict = errors.New("przepisac_na names an existing column")
+
+// PrzepisacNaApply renames the b_kolumny rows that name their successor in
+// przepisac_na, and the b_blokady rows on those columns with them. The renamed
+// column starts the new year with no successor of its own. Nothing is renamed
+// when a successor would collide with another column.
+func PrzepisacNaApply(tables map[string][]map[string]any) error {
+	renames := make(map[string]string)
+	for _, row := range tables["b_kolumny"] {
+		kolumna, _ := row["kolumna"].(string)
+		if next, _ := row["przepisac_na"].(string); next != "" {
+			renames[kolumna] = next
+		}
+	}
+
+	taken := make(map[string]bool)
+	for _, row := range tables["b_kolumny"] {
+		kolumna, _ := row["kolumna"].(string)
+		if _, renamed := renames[kolumna]; !renamed {
+			taken[kolumna] = true
+		}
+	}
+	for _, kolumna := range slices.Sorted(maps.Keys(renames)) {
+		next := renames[kolumna]
+		if taken[next] {
+			return fmt.Errorf("%w: %s -> %s", ErrPrzepisacNaConflict, kolumna, next)
+		}
+		taken[next] = true
+	}
+
+	for _, row := range tables["b_kolumny"] {
+		kolumna, _ := row["kolumna"].(string)
+		if next, ok := renames[kolumna]; ok {
+			row["kolumna"], row["przepisac_na"] = next, ""
+		}
+	}
+	for _, row := range tables["b_blokady"] {
+		kolumna, _ := row["kolumna"].(string)
+		if next, ok := renames[kolumna]; ok {
+			row["kolumna"] = next
+		}
+	}
+	return nil
+}
+
+// DefinitionsWrite inserts the tables into year in one transaction, replacing
+// rows with the same key. A year that already has rows in any of them is only
+// written with force, the names of those tables are returned either way. Rows
+// go in through {table}_replace_all_named, bound by column name.
+func (m *DBManager) DefinitionsWrite(year YearDB, tables map[string][]map[string]any, force bool) ([]DefinitionsCopyResult, []string, error) {
+	var results []DefinitionsCopyResult
+	var notEmpty []string
+	err := m.YTx(year, func(tx *SqlTx) error {
+		results, notEmpty = nil, nil
+		for _, table := range DEFINITION_TABLES {
+			var count int
+			if err := tx.QueryRowx(table + "_count_all").Scan(&count); err != nil {
+				return err
+			}
+			if count > 0 {
+				notEmpty = append(notEmpty, table)
+			}
+			results = append(results, DefinitionsCopyResult{Tabela: table, Wiersze: len(tables[table]), Nadpisano: count > 0})
+		}
+		if len(notEmpty) > 0 && !force {
+			return ErrDefinitionsTargetNotEmpty
+		}
+
+		for _, table := range DEFINITION_TABLES {
+			for _, row := range tables[table] {
+				args := make([]any, 0, len(row))
+				for column, value := range row {
+					args = append(args, sql.Named(column, value))
+				}
+				if _, err := tx.Exec(table+"_replace_all_named", args...); err != nil {
+					return fmt.Errorf("%s: %w", table, err)
+				}
+			}
+		}
+		return nil
+	})
+	return results, notEmpty, err
+}
+
+// DefinitionsCopyPost copies the definitions of the year in "zrodlo" into the
+// year in the path, with the przepisac_na renames when "przepisz" is set.
+func (app *Application) DefinitionsCopyPost(w http.ResponseWriter, r *http.Request) {
+	target, err := app.PathValueYearParse(r)
+	if err != nil {
+		app.jsonError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+
+	var form struct {
+		Zrodlo   YearDB `json:"zrodlo"`
+		Przepisz bool   `json:"przepisz"`
+		Wymus    bool   `json:"wymus"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		app.jsonError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if form.Zrodlo == target {
+		app.jsonError(w, "Source year must differ from the target", http.StatusBadRequest)
+		return
+	}
+	release, ok := app.DBManager.YearAcquire(form.Zrodlo)
+	if !ok {
+		app.jsonError(w, "Unknown source year", http.StatusNotFound)
+		return
+	}
+	tables, err := app.DBManager.DefinitionsRead(form.Zrodlo)
+	release()
+	if err != nil {
+		app.ServerError(w, r, err)
+		return
+	}
+	if form.Przepisz {
+		if err := PrzepisacNaApply(tables); err != nil {
+			app.RenderJSON(w, http.StatusConflict, map[string]any{
+				"success": false,
+				"error":   "Przepisanie nazwy koliduje z inną kolumną (" + err.Error() + ")",
+			})
+			return
+		}
+	}
+
+	results, notEmpty, err := app.DBManager.DefinitionsWrite(target, tables, form.Wymus)
+	switch {
+	case errors.Is(err, ErrDefinitionsTargetNotEmpty):
+		app.RenderJSON(w, http.StatusConflict, map[string]any{
+			"success":  false,
+			"error":    "Rok docelowy ma już definicje, potwierdź nadpisanie",
+			"niepuste": notEmpty,
+		})
+		return
+	case err != nil:
+		app.ServerError(w, r, err)
+		return
+	}
+
+	app.logger(r).Info("year definitions copied", slog.Int64("year", int64(target)), slog.Int64("source", int64(form.Zrodlo)), slog.Bool("renamed", form.Przepisz), slog.Int("overwritten", len(notEmpty)))
+	app.RenderJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"zrodlo":  form.Zrodlo,
+		"cel":     target,
+		"tabele":  results,
+	})
+}
+
 func (app *Application) YearSystemTableCreate(tableName, yearString, url string, yearDB YearDB) TableSchema {
 	var tableSchema TableSchema
 	switch tableName {
@@ -317,14 +1250,18 @@ func (app *Application) YearSystemTableCreate(tableName, yearString, url string,
 	case "b_jm":
 
 	case "b_typy_slownikow":
+		tableSchema = app.TableSysBTypySlownikowGet(yearString, yearDB)
 
 	case "b_slowniki":
+		tableSchema = app.TableSysBSlownikiGet(yearString, yearDB)
 
 	case "b_kolumny":
 
 	case "b_stawki_vat_zo":
+		tableSchema = app.TableSysBStawkiVATZOGet(yearString, yearDB)
 
 	case "b_stawki_vat_rr":
+		tableSchema = app.TableSysBStawkiVATRRGet(yearString, yearDB)
 
 	case "utgr_wspolczynniki_so":
 